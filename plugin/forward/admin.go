@@ -0,0 +1,229 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+var (
+	registryMu sync.Mutex
+	// instances are the forward plugins that are running.
+	instances = map[*Forward]struct{}{}
+	// drained holds the addresses of the upstreams drained through the admin endpoint. It outlives the
+	// instances, so an upstream stays drained over a reload that keeps it.
+	drained = map[string]bool{}
+	// admins are the admin endpoints by address, each is shared by the instances that configured it.
+	admins = map[string]*admin{}
+)
+
+// register adds f to the running instances and starts its admin endpoint when it has one.
+func (f *Forward) register() error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	instances[f] = struct{}{}
+	if f.adminAddr == "" {
+		return nil
+	}
+	a, ok := admins[f.adminAddr]
+	if !ok {
+		a = &admin{addr: f.adminAddr}
+		if err := a.start(); err != nil {
+			return err
+		}
+		admins[f.adminAddr] = a
+	}
+	a.refs++
+	return nil
+}
+
+// unregister removes f from the running instances and stops its admin endpoint when no other instance uses it.
+// Upstreams that no instance uses anymore are forgotten as drained. On a reload the new instances are registered
+// before the old ones are unregistered, so the upstreams that are kept stay drained.
+func (f *Forward) unregister() error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	delete(instances, f)
+	for to := range drained {
+		if len(upstreamsAt(to)) == 0 {
+			delete(drained, to)
+		}
+	}
+	if f.adminAddr == "" {
+		return nil
+	}
+	a, ok := admins[f.adminAddr]
+	if !ok {
+		return nil
+	}
+	if a.refs--; a.refs > 0 {
+		return nil
+	}
+	delete(admins, f.adminAddr)
+	return a.stop()
+}
+
+// isDrained returns true if the upstream at to was drained through the admin endpoint.
+func isDrained(to string) bool {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return drained[to]
+}
+
+// setDrained drains the upstream at to, or undrains it, in all running instances. It returns false when no running
+// instance has an upstream at to. registryMu must be held.
+func setDrained(to string, b bool) bool {
+	ps := upstreamsAt(to)
+	if len(ps) == 0 {
+		return false
+	}
+	for _, p := range ps {
+		p.SetDrained(b)
+	}
+	if b {
+		drained[to] = true
+	} else {
+		delete(drained, to)
+	}
+	return true
+}
+
+// upstreamsAt returns the upstreams at to of all running instances. registryMu must be held.
+func upstreamsAt(to string) []*proxy.Proxy {
+	var ps []*proxy.Proxy
+	for f := range instances {
+		for _, p := range f.upstreams() {
+			if p.Addr() == to {
+				ps = append(ps, p)
+			}
+		}
+	}
+	return ps
+}
+
+// undrained returns the upstreams of list that aren't drained, in the order of list.
+func undrained(list []*proxy.Proxy) []*proxy.Proxy {
+	if !slices.ContainsFunc(list, (*proxy.Proxy).Drained) {
+		return list
+	}
+	return slices.DeleteFunc(slices.Clone(list), (*proxy.Proxy).Drained)
+}
+
+// upstreamState is an upstream as listed by the admin endpoint.
+type upstreamState struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Drained bool   `json:"drained"`
+	Down    bool   `json:"down"`
+	Fails   uint32 `json:"fails"`
+}
+
+// admin is an HTTP endpoint that lists the upstreams of the running instances and drains them.
+type admin struct {
+	addr string
+	refs int
+	ln   net.Listener
+	srv  *http.Server
+}
+
+const adminShutdownTimeout = 5 * time.Second
+
+func (a *admin) start() error {
+	// Reloading without changing the address starts the new endpoint before the old one is stopped, when the
+	// instances don't share it, so the port has to be reused.
+	ln, err := reuseport.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+	a.srv = &http.Server{
+		Handler:      a.handler(),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  5 * time.Second,
+	}
+
+	go func() { a.srv.Serve(a.ln) }()
+	return nil
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forward/upstreams", a.list)
+	mux.HandleFunc("/forward/drain", func(w http.ResponseWriter, r *http.Request) { a.drain(w, r, true) })
+	mux.HandleFunc("/forward/undrain", func(w http.ResponseWriter, r *http.Request) { a.drain(w, r, false) })
+	return mux
+}
+
+func (a *admin) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	return a.srv.Shutdown(ctx)
+}
+
+// list writes the upstreams of all running instances as JSON.
+func (a *admin) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	registryMu.Lock()
+	states := []upstreamState{}
+	for f := range instances {
+		for _, p := range f.upstreams() {
+			states = append(states, upstreamState{From: f.from, To: p.Addr(), Drained: p.Drained(), Down: p.Down(f.maxfails), Fails: p.Fails()})
+		}
+	}
+	registryMu.Unlock()
+
+	slices.SortFunc(states, func(a, b upstreamState) int {
+		if c := strings.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		return strings.Compare(a.To, b.To)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+// drain drains, or undrains, the upstream given with the to parameter.
+func (a *admin) drain(w http.ResponseWriter, r *http.Request, b bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "missing to parameter")
+		return
+	}
+
+	registryMu.Lock()
+	ok := setDrained(to, b)
+	registryMu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "no upstream "+to)
+		return
+	}
+	if b {
+		log.Infof("Drained upstream %s", to)
+	} else {
+		log.Infof("Undrained upstream %s", to)
+	}
+	io.WriteString(w, http.StatusText(http.StatusOK))
+}
@@ -0,0 +1,136 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+
+	"github.com/miekg/dns"
+)
+
+func TestAdminDrain(t *testing.T) {
+	var asked1, asked2 atomic.Int32
+	newServer := func(asked *atomic.Int32) *dnstest.Server {
+		return dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			asked.Add(1)
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		})
+	}
+	s1, s2 := newServer(&asked1), newServer(&asked2)
+	defer s1.Close()
+	defer s2.Close()
+
+	f := New()
+	f.p = &sequential{}
+	for _, s := range []*dnstest.Server{s1, s2} {
+		p := proxy.NewProxy("forward", s.Addr, "dns")
+		f.SetProxy(p)
+		defer p.Stop()
+	}
+	if err := f.register(); err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	defer f.unregister()
+
+	h := (&admin{}).handler()
+	do := func(method, target string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code
+	}
+	query := func() (int, error) {
+		asked1.Store(0)
+		asked2.Store(0)
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		return f.ServeDNS(context.Background(), &mockResponseWriter{}, req)
+	}
+
+	if code := do(http.MethodPost, "/forward/drain?to="+s1.Addr); code != http.StatusOK {
+		t.Fatalf("Expected 200 draining %s, got %d", s1.Addr, code)
+	}
+	if _, err := query(); err != nil {
+		t.Fatalf("Expected the query to go to the undrained upstream, got %s", err)
+	}
+	if asked1.Load() != 0 || asked2.Load() != 1 {
+		t.Errorf("Expected only %s to be asked, got %d and %d queries", s2.Addr, asked1.Load(), asked2.Load())
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/forward/upstreams", nil))
+	var states []upstreamState
+	if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+		t.Fatalf("Failed to decode the upstreams: %s", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("Expected 2 upstreams, got %d", len(states))
+	}
+	for _, st := range states {
+		if st.Drained != (st.To == s1.Addr) {
+			t.Errorf("Expected only %s to be drained, got %+v", s1.Addr, st)
+		}
+	}
+
+	// With every upstream drained the query fails.
+	do(http.MethodPost, "/forward/drain?to="+s2.Addr)
+	if rcode, err := query(); rcode != dns.RcodeServerFailure || !errors.Is(err, ErrAllDrained) {
+		t.Errorf("Expected SERVFAIL and ErrAllDrained, got %s and %v", dns.RcodeToString[rcode], err)
+	}
+
+	do(http.MethodPost, "/forward/undrain?to="+s1.Addr)
+	if _, err := query(); err != nil {
+		t.Fatalf("Expected the query to go to the undrained upstream, got %s", err)
+	}
+	if asked1.Load() != 1 || asked2.Load() != 0 {
+		t.Errorf("Expected only %s to be asked, got %d and %d queries", s1.Addr, asked1.Load(), asked2.Load())
+	}
+
+	if code := do(http.MethodPost, "/forward/drain?to=127.0.0.1:1"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown upstream, got %d", code)
+	}
+	if code := do(http.MethodGet, "/forward/drain?to="+s1.Addr); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", code)
+	}
+	if code := do(http.MethodPost, "/forward/drain"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without to, got %d", code)
+	}
+}
+
+func TestAdminDrainReload(t *testing.T) {
+	old := New()
+	for _, addr := range []string{"127.0.0.1:1053", "127.0.0.1:2053"} {
+		old.SetProxy(proxy.NewProxy("forward", addr, "dns"))
+	}
+	old.register()
+	registryMu.Lock()
+	setDrained("127.0.0.1:1053", true)
+	setDrained("127.0.0.1:2053", true)
+	registryMu.Unlock()
+
+	// The new instance is set up and started before the old one is shut down.
+	f := New()
+	for _, addr := range []string{"127.0.0.1:1053", "127.0.0.1:3053"} {
+		p := proxy.NewProxy("forward", addr, "dns")
+		p.SetDrained(isDrained(addr))
+		f.SetProxy(p)
+	}
+	f.register()
+	old.unregister()
+	defer f.unregister()
+
+	if !f.proxies[0].Drained() || f.proxies[1].Drained() {
+		t.Errorf("Expected only the kept upstream to be drained, got %t and %t", f.proxies[0].Drained(), f.proxies[1].Drained())
+	}
+	if isDrained("127.0.0.1:2053") {
+		t.Error("Expected the removed upstream to be forgotten")
+	}
+}
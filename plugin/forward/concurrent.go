@@ -0,0 +1,48 @@
+package forward
+
+import (
+	"fmt"
+	"sync"
+)
+
+// upstreamConcurrent returns the number of concurrent queries each upstream may have, 0 means no limit.
+// Unless it is set on its own, max_concurrent is divided between the upstreams, rounded up.
+func (f *Forward) upstreamConcurrent() int64 {
+	if f.maxConcurrentUpstream > 0 {
+		return f.maxConcurrentUpstream
+	}
+	n := int64(f.Len())
+	if f.maxConcurrent == 0 || n == 0 {
+		return f.maxConcurrent
+	}
+	return (f.maxConcurrent + n - 1) / n
+}
+
+// acquireConcurrent counts a concurrent query to the upstream to, release uncounts it. When the upstream
+// already has as many concurrent queries as it may have the query is not counted and an error wrapping
+// ErrLimitExceeded is returned. An upstream without queries is removed from f.concurrent, so the addresses
+// of upstreams that went away with reresolve don't pile up.
+func (f *Forward) acquireConcurrent(to string) (release func(), err error) {
+	limit := f.upstreamConcurrent()
+	if limit == 0 {
+		return func() {}, nil
+	}
+
+	f.concurrentMu.Lock()
+	defer f.concurrentMu.Unlock()
+	if f.concurrent[to] >= limit {
+		maxConcurrentRejectCount.WithLabelValues(to).Add(1)
+		return nil, fmt.Errorf("%w: %d to %s", f.ErrLimitExceeded, limit, to)
+	}
+	if f.concurrent == nil {
+		f.concurrent = make(map[string]int64)
+	}
+	f.concurrent[to]++
+	return sync.OnceFunc(func() {
+		f.concurrentMu.Lock()
+		defer f.concurrentMu.Unlock()
+		if f.concurrent[to]--; f.concurrent[to] <= 0 {
+			delete(f.concurrent, to)
+		}
+	}), nil
+}
@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxConcurrentPerUpstream(t *testing.T) {
+	unblock := make(chan struct{})
+	hung := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		<-unblock
+	})
+	defer hung.Close()
+	defer close(unblock)
+
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.p = &sequential{}
+	f.maxConcurrent = 2
+	f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum 2")
+	p1 := proxy.NewProxy("forward", hung.Addr, "dns")
+	p1.SetReadTimeout(5 * time.Second)
+	f.SetProxy(p1)
+	defer p1.Stop()
+	p2 := proxy.NewProxy("forward", s.Addr, "dns")
+	f.SetProxy(p2)
+	defer p2.Stop()
+
+	inFlight := func(to string) int64 {
+		f.concurrentMu.Lock()
+		defer f.concurrentMu.Unlock()
+		return f.concurrent[to]
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	// The first query hangs on the first upstream, which then has all of its share of max_concurrent.
+	go f.ServeDNS(context.Background(), &mockResponseWriter{}, req.Copy())
+	for range 100 {
+		if inFlight(hung.Addr) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if x := inFlight(hung.Addr); x != 1 {
+		t.Fatalf("Expected 1 query in flight to the hung upstream, got %d", x)
+	}
+
+	if _, err := f.ServeDNS(context.Background(), &mockResponseWriter{}, req.Copy()); err != nil {
+		t.Fatalf("Expected the query to go to the other upstream, got %s", err)
+	}
+	if x := testutil.ToFloat64(maxConcurrentRejectCount.WithLabelValues(hung.Addr)); x != 1 {
+		t.Errorf("Expected 1 reject for the hung upstream, got %v", x)
+	}
+	if x := inFlight(s.Addr); x != 0 {
+		t.Errorf("Expected no query in flight to the other upstream, got %d", x)
+	}
+
+	// With both upstreams at their limit the query is refused.
+	release, err := f.acquireConcurrent(s.Addr)
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %s", err)
+	}
+	defer release()
+	rcode, err := f.ServeDNS(context.Background(), &mockResponseWriter{}, req.Copy())
+	if rcode != dns.RcodeRefused || !errors.Is(err, f.ErrLimitExceeded) {
+		t.Fatalf("Expected REFUSED and the limit error, got %s and %v", dns.RcodeToString[rcode], err)
+	}
+	if !strings.Contains(err.Error(), s.Addr) {
+		t.Errorf("Expected the error to name the saturated upstream, got %s", err)
+	}
+}
+
+func TestConcurrentRelease(t *testing.T) {
+	f := New()
+	f.maxConcurrent = 2
+	f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum 2")
+
+	first, err := f.acquireConcurrent("10.0.0.1:53")
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %s", err)
+	}
+	second, err := f.acquireConcurrent("10.0.0.1:53")
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %s", err)
+	}
+	first()
+	first() // A second release doesn't give back the slot of another query.
+	if x := f.concurrent["10.0.0.1:53"]; x != 1 {
+		t.Errorf("Expected 1 query in flight, got %d", x)
+	}
+
+	// The entry of an upstream without queries is removed.
+	second()
+	if _, ok := f.concurrent["10.0.0.1:53"]; ok {
+		t.Error("Expected the upstream without queries to be removed")
+	}
+}
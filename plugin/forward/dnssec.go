@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"slices"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecReply fixes up ret, the reply of the upstream, for the client of state when set_do or strip_dnssec
+// is used. With set_do the upstream saw a DO bit the client may not have sent, so the OPT record of the
+// reply is taken back to what the client asked for. With strip_dnssec the RRSIG, NSEC and NSEC3 records are
+// removed for a client without DO. The AD bit is only kept when the client set DO or AD (RFC 6840,
+// section 5.7).
+func (f *Forward) dnssecReply(state request.Request, ret *dns.Msg) {
+	if !f.opts.SetDO && !f.stripDNSSEC {
+		return
+	}
+	do := state.Do()
+	if !do && !state.Req.AuthenticatedData {
+		ret.AuthenticatedData = false
+	}
+	if f.opts.SetDO && !do {
+		if state.Req.IsEdns0() == nil {
+			ret.Extra = withoutType(ret.Extra, dns.TypeOPT)
+		} else if opt := ret.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+	if f.stripDNSSEC && !do {
+		ret.Answer = withoutType(ret.Answer, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+		ret.Ns = withoutType(ret.Ns, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+		ret.Extra = withoutType(ret.Extra, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+	}
+}
+
+// withoutType returns rrs without the records of the types, reusing the backing array of rrs.
+func withoutType(rrs []dns.RR, types ...uint16) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if !slices.Contains(types, rr.Header().Rrtype) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
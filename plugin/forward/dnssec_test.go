@@ -0,0 +1,131 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestForwardDNSSEC(t *testing.T) {
+	// A validating upstream: the signatures and the denial of existence come with the DO bit only.
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.AuthenticatedData = true
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		if opt := r.IsEdns0(); opt != nil {
+			ret.SetEdns0(opt.UDPSize(), opt.Do())
+			if opt.Do() {
+				ret.Answer = append(ret.Answer, test.RRSIG("example.org. IN RRSIG A 8 2 3600 20300101000000 20200101000000 12345 example.org. AAAA"))
+				ret.Ns = append(ret.Ns,
+					test.NSEC("example.org. IN NSEC a.example.org. A RRSIG NSEC"),
+					test.RRSIG("example.org. IN RRSIG NSEC 8 2 3600 20300101000000 20200101000000 12345 example.org. AAAA"))
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	const (
+		noOPT = iota
+		opt
+		optDO
+	)
+	tests := []struct {
+		options   string
+		client    int  // the EDNS of the client
+		clientAD  bool // the client set AD
+		expectOPT bool
+		expectDO  bool
+		expectAD  bool
+		expectRRs int // records in the answer and authority sections
+	}{
+		{"", noOPT, false, false, false, true, 1},
+		{"set_do", noOPT, false, false, false, false, 4},
+		{"set_do", noOPT, true, false, false, true, 4},
+		{"set_do", opt, false, true, false, false, 4},
+		{"set_do", optDO, false, true, true, true, 4},
+		{"set_do\nstrip_dnssec", noOPT, false, false, false, false, 1},
+		{"set_do\nstrip_dnssec", noOPT, true, false, false, true, 1},
+		{"set_do\nstrip_dnssec", opt, false, true, false, false, 1},
+		{"set_do\nstrip_dnssec", optDO, false, true, true, true, 4},
+		{"strip_dnssec", noOPT, false, false, false, false, 1},
+		{"strip_dnssec", optDO, false, true, true, true, 4},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s {\n%s\n}\n", s.Addr, tc.options))
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		f := fs[0]
+		f.OnStartup()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.AuthenticatedData = tc.clientAD
+		if tc.client != noOPT {
+			m.SetEdns0(1232, tc.client == optDO)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but got: %s", i, err)
+		}
+		f.OnShutdown()
+
+		ret := rec.Msg
+		o := ret.IsEdns0()
+		if (o != nil) != tc.expectOPT {
+			t.Errorf("Test %d: expected OPT record %t, got %v", i, tc.expectOPT, o)
+		}
+		if o != nil && o.Do() != tc.expectDO {
+			t.Errorf("Test %d: expected DO %t, got %t", i, tc.expectDO, o.Do())
+		}
+		if ret.AuthenticatedData != tc.expectAD {
+			t.Errorf("Test %d: expected AD %t, got %t", i, tc.expectAD, ret.AuthenticatedData)
+		}
+		if x := len(ret.Answer) + len(ret.Ns); x != tc.expectRRs {
+			t.Errorf("Test %d: expected %d records, got %d", i, tc.expectRRs, x)
+		}
+	}
+}
+
+func TestSetupDNSSEC(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedDO  bool
+		expectStrip bool
+	}{
+		{"forward . 127.0.0.1\n", false, false, false},
+		{"forward . 127.0.0.1 {\nset_do\n}\n", false, true, false},
+		{"forward . 127.0.0.1 {\nstrip_dnssec\n}\n", false, false, true},
+		{"forward . 127.0.0.1 {\nset_do\nstrip_dnssec\n}\n", false, true, true},
+		{"forward . 127.0.0.1 {\nset_do yes\n}\n", true, false, false},
+		{"forward . 127.0.0.1 {\nstrip_dnssec yes\n}\n", true, false, false},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+		}
+		if fs[0].opts.SetDO != test.expectedDO || fs[0].stripDNSSEC != test.expectStrip {
+			t.Errorf("Test %d: expected set_do %t and strip_dnssec %t, got %t and %t", i, test.expectedDO, test.expectStrip, fs[0].opts.SetDO, fs[0].stripDNSSEC)
+		}
+	}
+}
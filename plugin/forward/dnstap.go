@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin/dnstap/msg"
@@ -16,7 +17,8 @@ import (
 
 // toDnstap will send the forward and received message to the dnstap plugin.
 func toDnstap(ctx context.Context, f *Forward, host string, state request.Request, opts proxy.Options, reply *dns.Msg, start time.Time) {
-	ap, _ := netip.ParseAddrPort(host) // this is preparsed and can't err here
+	host, _, _ = strings.Cut(host, "/") // DoH upstreams carry the URL path
+	ap, _ := netip.ParseAddrPort(host)  // this is preparsed and can't err here
 	ip := net.IP(ap.Addr().AsSlice())
 	port := int(ap.Port())
 
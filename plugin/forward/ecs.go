@@ -0,0 +1,204 @@
+package forward
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Modes of the ecs option.
+const (
+	ecsStrip    = "strip"
+	ecsForward  = "forward"
+	ecsOverride = "override"
+)
+
+// Default source prefix lengths of ecs forward, as recommended by RFC 7871 section 11.1.
+const (
+	defaultECSv4 = 24
+	defaultECSv6 = 56
+)
+
+// ecs is the EDNS Client Subnet (RFC 7871) handling of a forward block, see the ecs option.
+type ecs struct {
+	mode   string
+	v4, v6 uint8             // source prefix lengths of ecsForward
+	subnet *dns.EDNS0_SUBNET // the subnet sent with ecsOverride
+}
+
+// query rewrites the ECS option of the query in state for the upstreams. It returns reply, which takes the ECS
+// option of a reply back to what the client sent, and restore, which puts back the query of the client. restore
+// may be called more than once. A nil e leaves the query alone.
+//
+// The reply to a client that sent no ECS option carries none. A client that sent one gets it back, with the scope
+// prefix length of the upstream for ecsForward and 0 otherwise: a stripped or overridden subnet gives every client
+// the same answer, so caches downstream must not tell them apart.
+func (e *ecs) query(state request.Request) (reply func(*dns.Msg), restore func()) {
+	nop := func(*dns.Msg) {}
+	if e == nil {
+		return nop, func() {}
+	}
+
+	r := state.Req
+	opt := r.IsEdns0()
+	var client *dns.EDNS0_SUBNET
+	if opt != nil {
+		client = subnetOption(opt)
+	}
+
+	var sent *dns.EDNS0_SUBNET
+	switch e.mode {
+	case ecsForward:
+		if client != nil {
+			// A downstream forwarder already says who the client is, only the prefix is shortened.
+			sent = truncateSubnet(client, e.v4, e.v6)
+		} else if ip := net.ParseIP(state.IP()); ip != nil {
+			sent = truncateSubnet(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Address: ip}, e.v4, e.v6)
+		}
+	case ecsOverride:
+		s := *e.subnet
+		sent = &s
+	}
+	if client == nil && sent == nil {
+		return nop, func() {}
+	}
+
+	added := opt == nil
+	if added {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.MinMsgSize)
+		r.Extra = append(r.Extra, opt)
+	}
+	options := opt.Option
+	opt.Option = withoutSubnet(options)
+	if sent != nil {
+		opt.Option = append(opt.Option, sent)
+	}
+
+	restore = func() {
+		opt.Option = options
+		if added {
+			r.Extra = withoutType(r.Extra, dns.TypeOPT)
+		}
+	}
+	reply = func(ret *dns.Msg) {
+		ro := ret.IsEdns0()
+		if ro == nil {
+			return
+		}
+		if added {
+			ret.Extra = withoutType(ret.Extra, dns.TypeOPT)
+			return
+		}
+		upstream := subnetOption(ro)
+		ro.Option = withoutSubnet(ro.Option)
+		if client == nil {
+			return
+		}
+		echo := *client
+		echo.SourceScope = 0
+		if e.mode == ecsForward && upstream != nil {
+			echo.SourceScope = min(upstream.SourceScope, client.SourceNetmask)
+		}
+		ro.Option = append(ro.Option, &echo)
+	}
+	return reply, restore
+}
+
+// subnetOption returns the ECS option of opt, or nil when it has none.
+func subnetOption(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// withoutSubnet returns a copy of options without the ECS option.
+func withoutSubnet(options []dns.EDNS0) []dns.EDNS0 {
+	kept := make([]dns.EDNS0, 0, len(options)+1)
+	for _, o := range options {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// truncateSubnet returns a copy of s with the source prefix no longer than v4 or v6 bits, depending on the family
+// of its address. The address is masked to the prefix.
+func truncateSubnet(s *dns.EDNS0_SUBNET, v4, v6 uint8) *dns.EDNS0_SUBNET {
+	t := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := s.Address.To4(); ip4 != nil && s.Family != 2 {
+		t.Family, t.SourceNetmask = 1, v4
+		if s.Family == 1 {
+			t.SourceNetmask = min(s.SourceNetmask, v4)
+		}
+		t.Address = ip4.Mask(net.CIDRMask(int(t.SourceNetmask), 32))
+		return t
+	}
+	t.Family, t.SourceNetmask = 2, v6
+	if s.Family == 2 {
+		t.SourceNetmask = min(s.SourceNetmask, v6)
+	}
+	t.Address = s.Address.To16().Mask(net.CIDRMask(int(t.SourceNetmask), 128))
+	return t
+}
+
+// parseECS parses the arguments of the ecs option.
+func parseECS(c *caddy.Controller) (*ecs, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	e := &ecs{mode: args[0]}
+	switch e.mode {
+	case ecsStrip:
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+	case ecsForward:
+		if len(args) > 3 {
+			return nil, c.ArgErr()
+		}
+		e.v4, e.v6 = defaultECSv4, defaultECSv6
+		for i, bits := range []int{32, 128} {
+			if len(args) <= i+1 {
+				break
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > bits {
+				return nil, c.Errf("ecs forward: prefix length must be between 0 and %d: %d", bits, n)
+			}
+			if i == 0 {
+				e.v4 = uint8(n) // #nosec G115 -- checked above
+			} else {
+				e.v6 = uint8(n) // #nosec G115 -- checked above
+			}
+		}
+	case ecsOverride:
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		_, subnet, err := net.ParseCIDR(args[1])
+		if err != nil {
+			return nil, c.Errf("ecs override: %s", err)
+		}
+		ones, _ := subnet.Mask.Size()
+		e.subnet = &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: uint8(ones), Address: subnet.IP} // #nosec G115 -- at most 128
+		if ip4 := subnet.IP.To4(); ip4 != nil {
+			e.subnet.Family, e.subnet.Address = 1, ip4
+		}
+	default:
+		return nil, c.Errf("unknown ecs mode '%s', expected strip, forward or override", e.mode)
+	}
+	return e, nil
+}
@@ -0,0 +1,198 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// ecsString returns the ECS option of m as address/source/scope, or "" when it has none.
+func ecsString(m *dns.Msg) string {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	if e := subnetOption(opt); e != nil {
+		return fmt.Sprintf("%s/%d/%d", e.Address, e.SourceNetmask, e.SourceScope)
+	}
+	return ""
+}
+
+func TestForwardECS(t *testing.T) {
+	// The upstream echoes the ECS option it got, with a scope of the source prefix length.
+	var (
+		mu   sync.Mutex
+		seen string
+	)
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		seen = ecsString(r)
+		mu.Unlock()
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		if opt := r.IsEdns0(); opt != nil {
+			ro := new(dns.OPT)
+			ro.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}
+			ro.SetUDPSize(opt.UDPSize())
+			if e := subnetOption(opt); e != nil {
+				echo := *e
+				echo.SourceScope = e.SourceNetmask
+				ro.Option = append(ro.Option, &echo)
+			}
+			ret.Extra = append(ret.Extra, ro)
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	const (
+		noOPT = "no OPT"
+		noECS = "no ECS"
+	)
+	// The client is 10.240.0.1, clients with an ECS option are behind a downstream forwarder.
+	tests := []struct {
+		option      string
+		client      string // the ECS option of the client as a prefix, or noOPT or noECS
+		expectSent  string // the ECS option the upstream got
+		expectReply string // the ECS option of the reply to the client
+		expectOPT   bool
+	}{
+		{"", noOPT, "", "", false},
+		{"", "192.0.2.1/32", "192.0.2.1/32/0", "192.0.2.1/32/32", true},
+
+		{"ecs strip", noOPT, "", "", false},
+		{"ecs strip", noECS, "", "", true},
+		{"ecs strip", "192.0.2.1/32", "", "192.0.2.1/32/0", true},
+
+		{"ecs forward", noOPT, "10.240.0.0/24/0", "", false},
+		{"ecs forward", noECS, "10.240.0.0/24/0", "", true},
+		{"ecs forward 16 48", noECS, "10.240.0.0/16/0", "", true},
+		{"ecs forward", "192.0.2.1/32", "192.0.2.0/24/0", "192.0.2.1/32/24", true},
+		{"ecs forward", "192.0.0.0/16", "192.0.0.0/16/0", "192.0.0.0/16/16", true},
+		{"ecs forward", "2001:db8:1:2::1/128", "2001:db8:1::/56/0", "2001:db8:1:2::1/128/56", true},
+		{"ecs forward", "192.0.2.1/0", "0.0.0.0/0/0", "192.0.2.1/0/0", true},
+		{"ecs forward 0 0", noECS, "0.0.0.0/0/0", "", true},
+
+		{"ecs override 198.51.100.0/24", noOPT, "198.51.100.0/24/0", "", false},
+		{"ecs override 198.51.100.0/24", noECS, "198.51.100.0/24/0", "", true},
+		{"ecs override 198.51.100.0/24", "192.0.2.1/32", "198.51.100.0/24/0", "192.0.2.1/32/0", true},
+		{"ecs override 2001:db8::/48", "192.0.2.1/32", "2001:db8::/48/0", "192.0.2.1/32/0", true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s {\n%s\n}\n", s.Addr, tc.option))
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		f := fs[0]
+		f.OnStartup()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		switch tc.client {
+		case noOPT:
+		case noECS:
+			m.SetEdns0(1232, false)
+		default:
+			m.SetEdns0(1232, false)
+			ip, subnet, _ := net.ParseCIDR(tc.client)
+			ones, _ := subnet.Mask.Size()
+			e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: uint8(ones), Address: ip}
+			if strings.Contains(tc.client, ".") {
+				e.Family, e.Address = 1, ip.To4()
+			}
+			m.IsEdns0().Option = append(m.IsEdns0().Option, e)
+		}
+		before := m.String()
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected to receive reply, but got: %s", i, err)
+		}
+		f.OnShutdown()
+
+		mu.Lock()
+		sent := seen
+		mu.Unlock()
+		if sent != tc.expectSent {
+			t.Errorf("Test %d: %s with %s: expected the upstream to get ECS %q, got %q", i, tc.option, tc.client, tc.expectSent, sent)
+		}
+		if x := ecsString(rec.Msg); x != tc.expectReply {
+			t.Errorf("Test %d: %s with %s: expected ECS %q in the reply, got %q", i, tc.option, tc.client, tc.expectReply, x)
+		}
+		if x := rec.Msg.IsEdns0() != nil; x != tc.expectOPT {
+			t.Errorf("Test %d: %s with %s: expected OPT record in the reply %t, got %t", i, tc.option, tc.client, tc.expectOPT, x)
+		}
+		if after := m.String(); after != before {
+			t.Errorf("Test %d: %s with %s: expected the query of the client to be put back, got\n%s", i, tc.option, tc.client, after)
+		}
+	}
+}
+
+func TestSetupECS(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expected    string // mode, v4 and v6 prefix lengths, and the override subnet
+		expectedErr string
+	}{
+		{"forward . 127.0.0.1\n", false, "", ""},
+		{"forward . 127.0.0.1 {\necs strip\n}\n", false, "strip 0 0 <nil>", ""},
+		{"forward . 127.0.0.1 {\necs forward\n}\n", false, "forward 24 56 <nil>", ""},
+		{"forward . 127.0.0.1 {\necs forward 20\n}\n", false, "forward 20 56 <nil>", ""},
+		{"forward . 127.0.0.1 {\necs forward 20 48\n}\n", false, "forward 20 48 <nil>", ""},
+		{"forward . 127.0.0.1 {\necs override 192.0.2.0/24\n}\n", false, "override 0 0 192.0.2.0/24/0", ""},
+		{"forward . 127.0.0.1 {\necs override 192.0.2.1/24\n}\n", false, "override 0 0 192.0.2.0/24/0", ""},
+		{"forward . 127.0.0.1 {\necs override 2001:db8::/32\n}\n", false, "override 0 0 2001:db8::/32/0", ""},
+		{"forward . 127.0.0.1 {\necs\n}\n", true, "", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\necs strip 24\n}\n", true, "", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\necs forward 33\n}\n", true, "", "between 0 and 32"},
+		{"forward . 127.0.0.1 {\necs forward 24 129\n}\n", true, "", "between 0 and 128"},
+		{"forward . 127.0.0.1 {\necs forward 24 56 8\n}\n", true, "", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\necs forward many\n}\n", true, "", "invalid syntax"},
+		{"forward . 127.0.0.1 {\necs override\n}\n", true, "", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\necs override 192.0.2.1\n}\n", true, "", "invalid CIDR"},
+		{"forward . 127.0.0.1 {\necs rewrite\n}\n", true, "", "unknown ecs mode 'rewrite'"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		got := ""
+		if e := fs[0].ecs; e != nil {
+			subnet := "<nil>"
+			if e.subnet != nil {
+				subnet = fmt.Sprintf("%s/%d/%d", e.subnet.Address, e.subnet.SourceNetmask, e.subnet.SourceScope)
+			}
+			got = fmt.Sprintf("%s %d %d %s", e.mode, e.v4, e.v6, subnet)
+		}
+		if got != test.expected {
+			t.Errorf("Test %d: expected ecs %q, got %q", i, test.expected, got)
+		}
+	}
+}
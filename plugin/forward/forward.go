@@ -8,7 +8,9 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"sync/atomic"
+	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -27,16 +29,23 @@ import (
 var log = clog.NewWithPlugin("forward")
 
 const (
-	defaultExpire = 10 * time.Second
-	hcInterval    = 500 * time.Millisecond
+	defaultExpire  = 10 * time.Second
+	hcInterval     = 500 * time.Millisecond
+	defaultPadding = 128 // block size recommended for queries by RFC 8467
+
+	defaultExpectInterval = 30 * time.Second // the stricter health check is sent at most this often
+
+	defaultHedgeMax = 100 // hedged queries in flight per block
 )
 
 // Forward represents a plugin instance that can proxy requests to another (DNS) server. It has a list
 // of proxies each representing one upstream proxy.
 type Forward struct {
-	concurrent int64 // atomic counters need to be first in struct for proper alignment
+	concurrent   map[string]int64 // per upstream address, the number of concurrent queries to it; 0 isn't stored
+	concurrentMu sync.Mutex
 
 	proxies    []*proxyPkg.Proxy
+	proxiesMu  sync.RWMutex // proxies is replaced when hostname upstreams are re-resolved
 	p          Policy
 	hcInterval time.Duration
 
@@ -47,24 +56,80 @@ type Forward struct {
 	nextOnNodata        bool
 
 	tlsConfig                  *tls.Config
+	tlsArgs                    []string                    // the files of the tls option, for tls_upstream
+	upstreamTLS                map[string]*upstreamTLS     // per upstream TLS configuration, keyed by address
+	upstreamTimeouts           map[string]*upstreamTimeout // per upstream timeouts, keyed by the TO as written
 	tlsServerName              string
+	tlsPins                    []string
 	maxfails                   uint32
 	expire                     time.Duration
+	expireUDP                  time.Duration // 0 means expire
+	expireTCP                  time.Duration // 0 means expire, also used for tcp-tls
 	maxAge                     time.Duration
 	maxIdleConns               int
+	maxQueries                 int
+	noCache                    bool
+	pipelining                 bool
+	pipelineDepth              int
+	origins                    map[string]*toEntry // TO entry of each normalized upstream address, see expand
+	scopes                     map[string]*scope   // per upstream address, see only_for and except_for
+	affinity                   bool
 	maxConcurrent              int64
+	maxConcurrentUpstream      int64 // 0 divides maxConcurrent between the upstreams
 	failfastUnhealthyUpstreams bool
-	failoverRcodes             []int
 	maxConnectAttempts         uint32
+	maxMismatched              int
+	stripDNSSEC                bool
+	ecs                        *ecs // nil leaves the ECS option of queries alone
+	maxTransferRecords         int  // 0 is unlimited, as is maxTransferBytes
+	maxTransferBytes           int
+	sourceAddr4                net.IP
+	sourceAddr6                net.IP
+	sourcePort                 int
+	sourceInterface            string
+	socksAddr                  string
+	socksUser                  string
+	socksPassword              string
+	fastOpen                   bool
+	earlyData                  bool
+	proxyProtocol              bool
+	tcpKeepAlive               time.Duration // 0 leaves the default, negative disables the probes
+	maxInFlight                int
+	inFlightWait               time.Duration
+	breakerFailures            int
+	breakerWindow              time.Duration
+	breakerCooldown            time.Duration
+	minDialTimeout             time.Duration
+	maxDialTimeout             time.Duration
+	avgWeight                  int64
+	timeoutJitter              float64
+	minReadTimeout             time.Duration
+	maxReadTimeout             time.Duration
+	writeTimeout               time.Duration // 0 keeps the default of the proxy
+	truncationHistory          int
+	hcRcodes                   []int                       // healthy rcodes for health checks, empty means any
+	hcBackoff                  time.Duration               // health check interval cap while an upstream fails them, 0 disables backoff
+	hcExpect                   *proxyPkg.HealthExpectation // the stricter health check, nil when there is none
+	activeHcInterval           time.Duration
+	activeHcFailures           int
+	hedgeDelay                 time.Duration
+	hedgeLimit                 *proxyPkg.HedgeLimit // shared by the queries of this block
+	adminAddr                  string               // address of the admin endpoint, see admin.go
 
 	// Hostname resolution fields
-	resolver  []string  // custom resolver IPs for hostname TO resolution
-	toEntries []toEntry // ordered TO entries preserving config order
+	resolver      []string  // custom resolver IPs for hostname TO resolution
+	toEntries     []toEntry // ordered TO entries preserving config order
+	happyEyeballs bool      // keep a hostname TO as one upstream racing its addresses
+
+	reresolve     time.Duration // re-resolve hostname TO entries this often, 0 disables
+	watchInterval time.Duration // check the files of TO entries for changes this often, 0 disables
+	reresolveStop chan struct{}
+	reresolveDone chan struct{}
 
 	opts proxyPkg.Options // also here for testing
 
-	// ErrLimitExceeded indicates that a query was rejected because the number of concurrent queries has exceeded
-	// the maximum allowed (maxConcurrent)
+	// ErrLimitExceeded indicates that a query was rejected because the number of concurrent queries to the
+	// upstreams it could be sent to has exceeded the maximum allowed (maxConcurrent)
 	ErrLimitExceeded error
 
 	tapPlugins []*dnstap.Dnstap // when dnstap plugins are loaded, we use to this to send messages out.
@@ -74,14 +139,19 @@ type Forward struct {
 
 // New returns a new Forward.
 func New() *Forward {
-	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcInterval, opts: proxyPkg.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
+	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, maxMismatched: proxyPkg.DefaultMaxMismatched, p: new(random), from: ".", hcInterval: hcInterval, watchInterval: defaultWatchInterval, opts: proxyPkg.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
 	return f
 }
 
 // SetProxy appends p to the proxy list and starts healthchecking.
 func (f *Forward) SetProxy(p *proxyPkg.Proxy) {
+	f.proxiesMu.Lock()
 	f.proxies = append(f.proxies, p)
-	p.Start(f.hcInterval)
+	f.proxiesMu.Unlock()
+	if p.HealthObserver() == nil {
+		p.SetHealthObserver(newUpstreamHealth(f.from, p.Addr(), f.maxfails))
+	}
+	f.startProxy(p)
 }
 
 // SetProxyOptions setup proxy options
@@ -98,7 +168,7 @@ func (f *Forward) SetTapPlugin(tapPlugin *dnstap.Dnstap) {
 }
 
 // Len returns the number of configured proxies.
-func (f *Forward) Len() int { return len(f.proxies) }
+func (f *Forward) Len() int { return len(f.upstreams()) }
 
 // Name implements plugin.Handler.
 func (f *Forward) Name() string { return "forward" }
@@ -110,24 +180,41 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 	}
 
-	if f.maxConcurrent > 0 {
-		count := atomic.AddInt64(&(f.concurrent), 1)
-		defer atomic.AddInt64(&(f.concurrent), -1)
-		if count > f.maxConcurrent {
-			maxConcurrentRejectCount.Add(1)
-			return dns.RcodeRefused, f.ErrLimitExceeded
-		}
-	}
-
 	fails := 0
 	var span, child ot.Span
 	var upstreamErr error
+	var best *dns.Msg // best reply with a failover rcode
 	span = ot.SpanFromContext(ctx)
 	i := 0
-	list := f.List()
+	list := f.list(state)
+	if len(f.scopes) > 0 {
+		if list = f.scoped(list, state.Name()); len(list) == 0 {
+			return dns.RcodeServerFailure, ErrNoScope
+		}
+	}
+	if list = undrained(list); len(list) == 0 {
+		return dns.RcodeServerFailure, ErrAllDrained
+	}
+	ecsReply, ecsRestore := f.ecs.query(state)
+	defer ecsRestore()
+
+	// answered is the upstream whose reply is returned, tried the last one the query was sent to. With fanout or
+	// hedging only the proxy package knows which upstream answered, it records that in the context of the query.
+	var answered, bestUpstream proxyPkg.Upstream
+	tried := ""
+	metadata.SetValueFunc(ctx, "forward/upstream", func() string {
+		if answered.Addr != "" {
+			return answered.Addr
+		}
+		return tried
+	})
+	metadata.SetValueFunc(ctx, "forward/proto", func() string {
+		return answered.Proto
+	})
 	deadline := time.Now().Add(defaultTimeout)
 	start := time.Now()
 	connectAttempts := uint32(0)
+	selected := false
 
 	for time.Now().Before(deadline) && ctx.Err() == nil && (f.maxConnectAttempts == 0 || connectAttempts < f.maxConnectAttempts) {
 		if i >= len(list) {
@@ -140,7 +227,7 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 		i++
 		if proxy.Down(f.maxfails) {
 			fails++
-			if fails < len(f.proxies) {
+			if fails < len(list) {
 				continue
 			}
 
@@ -152,8 +239,27 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			// assume healthcheck is completely broken and randomly
 			// select an upstream to connect to.
 			r := new(random)
-			proxy = r.List(f.proxies)[0]
+			proxy = r.List(list)[0]
+		}
+
+		// An upstream with too many concurrent queries is skipped, so it doesn't hold up the others.
+		release, limitErr := f.acquireConcurrent(proxy.Addr())
+		if limitErr != nil {
+			upstreamErr = limitErr
+			fails++
+			if fails < len(list) {
+				continue
+			}
+			break
+		}
+
+		// The first upstream of the list is the one the policy chose, any other is a failover.
+		choice := "next"
+		if !selected && proxy == list[0] {
+			choice = "first"
 		}
+		selected = true
+		upstreamSelectionsCount.WithLabelValues(f.p.String(), proxy.Addr(), choice).Add(1)
 
 		if span != nil {
 			child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
@@ -161,9 +267,7 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			ctx = ot.ContextWithSpan(ctx, child)
 		}
 
-		metadata.SetValueFunc(ctx, "forward/upstream", func() string {
-			return proxy.Addr()
-		})
+		tried = proxy.Addr()
 
 		var (
 			ret     *dns.Msg
@@ -172,10 +276,43 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 		)
 		opts := f.opts
 
+		// With fanout the query is sent to the next healthy upstreams in the list as well, when
+		// hedging to the next one after the hedge delay.
+		group := []*proxyPkg.Proxy{proxy}
+		releases := []func(){release}
+		size := opts.Fanout
+		if f.hedgeDelay > 0 {
+			size = 2
+		}
+		if size > 1 && state.QType() != dns.TypeAXFR && state.QType() != dns.TypeIXFR {
+			for ; i < len(list) && len(group) < size; i++ {
+				if list[i].Down(f.maxfails) {
+					continue
+				}
+				if release, err := f.acquireConcurrent(list[i].Addr()); err == nil {
+					group = append(group, list[i])
+					releases = append(releases, release)
+				}
+			}
+		}
+
+		qctx := proxyPkg.WithUpstream(ctx)
 		for {
-			ret, records, err = proxy.Connect(ctx, state, opts)
+			switch {
+			case len(group) > 1 && f.hedgeDelay > 0:
+				ret, proxy, err = proxyPkg.RaceConnect(qctx, group[0], group[1], state, opts, f.hedgeDelay, f.hedgeLimit)
+			case len(group) > 1:
+				ret, proxy, err = proxyPkg.ConnectFanout(qctx, group, state, opts)
+			default:
+				ret, records, err = proxy.Connect(qctx, state, opts)
+			}
 
-			if err == proxyPkg.ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
+			if errors.Is(err, proxyPkg.ErrCachedClosed) { // Remote side closed conn, can only happen with TCP.
+				continue
+			}
+			// An upstream without IXFR is asked for the whole zone, a full transfer is a valid reply to an IXFR.
+			if errors.Is(err, proxyPkg.ErrIXFRNotImplemented) {
+				state = request.Request{Req: asAXFR(state.Req), W: state.W}
 				continue
 			}
 			// Retry with TCP if truncated and prefer_udp configured.
@@ -185,6 +322,10 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			}
 			break
 		}
+		for _, release := range releases {
+			release()
+		}
+		up, _ := proxyPkg.UpstreamFromContext(qctx)
 
 		if child != nil {
 			child.Finish()
@@ -194,12 +335,35 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			toDnstap(ctx, f, proxy.Addr(), state, opts, ret, start)
 		}
 
+		// A failover rcode makes us try the next upstream in the list, counted as a connect attempt. Once
+		// every upstream was tried the best reply seen is returned.
+		if errors.Is(err, proxyPkg.ErrFailover) && ret != nil {
+			if best == nil || failoverRank(ret.Rcode) < failoverRank(best.Rcode) {
+				best, bestUpstream = ret, up
+			}
+			fails++
+			if f.maxConnectAttempts > 0 {
+				connectAttempts++
+			}
+			if fails < len(list) {
+				continue
+			}
+			ret, err, up = best, nil, bestUpstream
+		}
+
 		upstreamErr = err
 
 		if err != nil {
+			upstreamErrorsCount.WithLabelValues(proxy.Addr(), proxyPkg.ErrorKind(err)).Add(1)
+			observeHealth(proxy)
 			// Kick off health check to see if *our* upstream is broken.
-			if f.maxfails != 0 {
-				proxy.Healthcheck()
+			if f.maxfails != 0 && unreachable(err) {
+				for _, p := range group {
+					p.Healthcheck()
+				}
+			}
+			if nonRetryable(err) {
+				break
 			}
 
 			// If a per-request connect-attempt cap is configured, count this
@@ -211,11 +375,12 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 				}
 			}
 
-			if fails < len(f.proxies) {
+			if fails < len(list) {
 				continue
 			}
 			break
 		}
+		answered = up
 
 		if records != nil {
 			ch := make(chan *dns.Envelope)
@@ -237,7 +402,7 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			return 0, nil
 		}
 		// Check if the reply is correct; if not return FormErr.
-		if !state.Match(ret) {
+		if !f.opts.NoQuestionCheck && !state.Match(ret) {
 			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
 
 			formerr := new(dns.Msg)
@@ -246,42 +411,44 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			return 0, nil
 		}
 
-		// Check if we have a failover Rcode defined, check if we match on the code
-		tryNext := false
-		for _, failoverRcode := range f.failoverRcodes {
-			// if we match, we continue to the next upstream in the list
-			if failoverRcode == ret.Rcode {
-				if fails < len(f.proxies) {
-					tryNext = true
-				}
-			}
-		}
-		if tryNext {
-			fails++
-			continue
-		}
-
-		// Check if we have an alternate Rcode defined, check if we match on the code
-		for _, alternateRcode := range f.nextAlternateRcodes {
-			if alternateRcode == ret.Rcode && f.Next != nil { // In case we do not have a Next handler, just continue normally
-				if _, ok := f.Next.(*Forward); ok { // Only continue if the next forwarder is also a Forworder
-					return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
-				}
-			}
+		// An rcode of next hands the query to the next plugin, which answers it instead. Nothing was written
+		// to w yet, so plugins in front of us, like cache, only see the reply of the next plugin. In case we
+		// do not have a Next handler, just continue normally.
+		// The next plugin gets the query of the client, not the one with our ECS option.
+		if slices.Contains(f.nextAlternateRcodes, ret.Rcode) && f.Next != nil {
+			ecsRestore()
+			return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 		}
 
 		if f.nextOnNodata && f.Next != nil {
 			if ret.Rcode == dns.RcodeSuccess && isEmpty(ret) {
 				if _, ok := f.Next.(*Forward); ok {
+					ecsRestore()
 					return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 				}
 			}
 		}
 
+		ecsReply(ret)
+		f.dnssecReply(state, ret)
 		w.WriteMsg(ret)
 		return 0, nil
 	}
 
+	// An upstream replied with a failover rcode before we ran out of time or attempts.
+	if best != nil {
+		answered = bestUpstream
+		ecsReply(best)
+		f.dnssecReply(state, best)
+		w.WriteMsg(best)
+		return 0, nil
+	}
+
+	// Every upstream we could send the query to has too many concurrent queries.
+	if f.ErrLimitExceeded != nil && errors.Is(upstreamErr, f.ErrLimitExceeded) {
+		return dns.RcodeRefused, upstreamErr
+	}
+
 	if upstreamErr != nil {
 		return dns.RcodeServerFailure, upstreamErr
 	}
@@ -289,6 +456,19 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 	return dns.RcodeServerFailure, ErrNoHealthy
 }
 
+// failoverRank ranks the rcodes of the replies that made us fail over, the reply with the lowest rank is
+// returned when no upstream did better. A name error still answers the query, a server failure tells the
+// client the least.
+func failoverRank(rcode int) int {
+	switch rcode {
+	case dns.RcodeNameError:
+		return 0
+	case dns.RcodeServerFailure:
+		return 2
+	}
+	return 1
+}
+
 func (f *Forward) match(state request.Request) bool {
 	if !plugin.Name(f.from).Matches(state.Name()) || !f.isAllowedDomain(state.Name()) {
 		return false
@@ -323,6 +503,46 @@ func isEmpty(r *dns.Msg) bool {
 	return true
 }
 
+// unreachable returns true when err suggests the upstream can't be reached, which a health check confirms.
+// An upstream that is busy, sent a reply, or that the query wasn't sent to isn't checked.
+func unreachable(err error) bool {
+	switch {
+	case errors.Is(err, proxyPkg.ErrMaxInFlight),
+		errors.Is(err, proxyPkg.ErrCircuitOpen),
+		errors.Is(err, proxyPkg.ErrShuttingDown),
+		errors.Is(err, proxyPkg.ErrDrained),
+		errors.Is(err, proxyPkg.ErrLocalAddr),
+		errors.Is(err, proxyPkg.ErrMalformed),
+		errors.Is(err, proxyPkg.ErrQuestionMismatch),
+		errors.Is(err, proxyPkg.ErrUnsignedAD),
+		errors.Is(err, proxyPkg.ErrBadCookie),
+		errors.Is(err, proxyPkg.ErrIXFRNotImplemented),
+		errors.Is(err, proxyPkg.ErrTransferRcode),
+		errors.Is(err, proxyPkg.ErrTransferTooLarge),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// nonRetryable returns true when err would be the same with the next upstream, so the query isn't sent to it: a
+// zone transfer that was refused or is too large, part of which may already be written to the client, and a
+// source address that isn't local, which no upstream can be dialed from.
+func nonRetryable(err error) bool {
+	return errors.Is(err, proxyPkg.ErrTransferTooLarge) ||
+		errors.Is(err, proxyPkg.ErrTransferRcode) ||
+		errors.Is(err, proxyPkg.ErrLocalAddr)
+}
+
+// asAXFR returns a copy of the IXFR m that asks for an AXFR of the zone instead.
+func asAXFR(m *dns.Msg) *dns.Msg {
+	m = m.Copy()
+	m.Question[0].Qtype = dns.TypeAXFR
+	m.Ns = nil
+	return m
+}
+
 // ForceTCP returns if TCP is forced to be used even when the request comes in over UDP.
 func (f *Forward) ForceTCP() bool { return f.opts.ForceTCP }
 
@@ -330,7 +550,23 @@ func (f *Forward) ForceTCP() bool { return f.opts.ForceTCP }
 func (f *Forward) PreferUDP() bool { return f.opts.PreferUDP }
 
 // List returns a set of proxies to be used for this client depending on the policy in f.
-func (f *Forward) List() []*proxyPkg.Proxy { return f.p.List(f.proxies) }
+func (f *Forward) List() []*proxyPkg.Proxy { return f.p.List(f.upstreams()) }
+
+// list returns the proxies to be used for state, in the order of the policy for its client when the
+// policy orders by client.
+func (f *Forward) list(state request.Request) []*proxyPkg.Proxy {
+	if p, ok := f.p.(clientPolicy); ok {
+		return p.ListFor(state, f.upstreams())
+	}
+	return f.List()
+}
+
+// upstreams returns the current proxies, which change when hostname upstreams are re-resolved.
+func (f *Forward) upstreams() []*proxyPkg.Proxy {
+	f.proxiesMu.RLock()
+	defer f.proxiesMu.RUnlock()
+	return f.proxies
+}
 
 var (
 	// ErrNoHealthy means no healthy proxies left.
@@ -339,6 +575,10 @@ var (
 	ErrNoForward = errors.New("no forwarder defined")
 	// ErrCachedClosed means cached connection was closed by peer.
 	ErrCachedClosed = errors.New("cached connection was closed by peer")
+	// ErrNoScope means only_for and except_for leave no upstream for the name.
+	ErrNoScope = errors.New("no upstream is used for this name")
+	// ErrAllDrained means every upstream the query could be sent to is drained through the admin endpoint.
+	ErrAllDrained = errors.New("all upstreams are drained")
 )
 
 // Options holds various Options that can be set.
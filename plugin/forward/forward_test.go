@@ -2,17 +2,27 @@ package forward
 
 import (
 	"context"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/caddy/caddyfile"
 	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/doh"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/plugin/test"
@@ -20,6 +30,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestList(t *testing.T) {
@@ -141,7 +152,13 @@ func TestForward_Regression_NoBusyLoop(t *testing.T) {
 			rw := &mockResponseWriter{}
 
 			_, err := f.ServeDNS(ctx, rw, req)
-			spans := tracer.FinishedSpans()
+			// The proxy adds spans of its own inside each connect span.
+			var spans []*mocktracer.MockSpan
+			for _, s := range tracer.FinishedSpans() {
+				if s.OperationName == "connect" {
+					spans = append(spans, s)
+				}
+			}
 
 			if err == nil {
 				t.Errorf("Expected error from ServeDNS due to connection refused, got nil")
@@ -238,3 +255,413 @@ func TestForward_NextOnNodata(t *testing.T) {
 		})
 	}
 }
+
+func TestForwardNextPlugin(t *testing.T) {
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "refused.example.org." {
+			ret.Rcode = dns.RcodeRefused
+		} else {
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s {\nnext REFUSED NXDOMAIN\n}\n", s.Addr))
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	var nexts atomic.Int32
+	f.Next = plugin.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		nexts.Add(1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		w.WriteMsg(ret)
+		return dns.RcodeSuccess, nil
+	})
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	for i, tc := range []struct {
+		name  string
+		ip    string
+		nexts int32
+	}{
+		{"refused.example.org.", "10.0.0.1", 1},
+		{"example.org.", "127.0.0.1", 1},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		// A plugin in front of forward, like cache, sees every message written, which must only be the
+		// reply of the next plugin.
+		rec := &writesRecorder{Recorder: dnstest.NewRecorder(&test.ResponseWriter{})}
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected a reply, got %s", i, err)
+		}
+		if rec.writes != 1 {
+			t.Fatalf("Test %d: expected 1 message written, got %d", i, rec.writes)
+		}
+		if rec.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Test %d: expected a NOERROR reply with one answer, got %v", i, rec.Msg)
+		}
+		if x := rec.Msg.Answer[0].(*dns.A).A.String(); x != tc.ip {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.ip, x)
+		}
+		if x := nexts.Load(); x != tc.nexts {
+			t.Errorf("Test %d: expected the next plugin to be called %d times, got %d", i, tc.nexts, x)
+		}
+	}
+}
+
+// writesRecorder counts the messages written.
+type writesRecorder struct {
+	*dnstest.Recorder
+	writes int
+}
+
+func (w *writesRecorder) WriteMsg(m *dns.Msg) error {
+	w.writes++
+	return w.Recorder.WriteMsg(m)
+}
+
+func TestForwardDoH(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/custom" {
+			http.NotFound(w, r)
+			return
+		}
+		m, err := doh.RequestToMsg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		buf, _ := ret.Pack()
+		w.Header().Set("Content-Type", doh.MimeType)
+		w.Write(buf)
+	}))
+	defer s.Close()
+
+	// The CA of the test server, for the tls option.
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("Failed to write the CA: %s", err)
+	}
+
+	to := "https://" + s.Listener.Addr().String() + "/custom"
+	c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s {\ntls %s\ntls_servername example.com\n}\n", to, ca))
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(rec.Msg.Answer))
+	}
+
+	// The health check probes the DoH endpoint.
+	if err := f.proxies[0].GetHealthchecker().Check(f.proxies[0]); err != nil {
+		t.Errorf("Expected the health check of the DoH endpoint to pass, got %s", err)
+	}
+}
+
+// transferWriter is a ResponseWriter that keeps the records of the messages of a zone transfer.
+type transferWriter struct {
+	test.ResponseWriter
+	mu  sync.Mutex
+	rrs []dns.RR
+}
+
+func (w *transferWriter) WriteMsg(m *dns.Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rrs = append(w.rrs, m.Answer...)
+	return nil
+}
+
+func (w *transferWriter) records() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.rrs)
+}
+
+func TestForwardIXFRFallback(t *testing.T) {
+	var axfrs atomic.Int32
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeIXFR {
+			ret.Rcode = dns.RcodeNotImplemented
+		} else {
+			axfrs.Add(1)
+			soa := test.SOA("example.org. IN SOA ns.example.org. admin.example.org. 3 7200 3600 1209600 3600")
+			ret.Answer = []dns.RR{soa, test.A("a.example.org. IN A 127.0.0.1"), soa}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr+" {\nforce_tcp\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// The upstream doesn't implement IXFR, the zone is transferred in full instead.
+	m := new(dns.Msg)
+	m.SetIxfr("example.org.", 1, "ns.example.org.", "admin.example.org.")
+	w := &transferWriter{}
+	if _, err := f.ServeDNS(context.TODO(), w, m); err != nil {
+		t.Fatalf("Expected the transfer to succeed, got %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for w.records() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if x := w.records(); x != 3 {
+		t.Errorf("Expected the 3 records of the full transfer, got %d", x)
+	}
+	if x := axfrs.Load(); x != 1 {
+		t.Errorf("Expected 1 AXFR, got %d", x)
+	}
+	if m.Question[0].Qtype != dns.TypeIXFR || len(m.Ns) != 1 {
+		t.Error("Expected the query of the client to be left alone")
+	}
+}
+
+func TestForwardHedge(t *testing.T) {
+	slow := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Second)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer slow.Close()
+	fast := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer fast.Close()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s %s {\npolicy sequential\nhedge 50ms\n}\n", slow.Addr, fast.Addr))
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	begin := time.Now()
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if d := time.Since(begin); d < 50*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("Expected the reply of the hedged query after the delay, took %s", d)
+	}
+	if x := len(rec.Msg.Answer); x != 1 {
+		t.Errorf("Expected the answer of the fast upstream, got %d answers", x)
+	}
+}
+
+func TestForwardFanout(t *testing.T) {
+	slow := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Second)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer slow.Close()
+	fast := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer fast.Close()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf("forward . %s %s {\npolicy sequential\nfanout 2\n}\n", slow.Addr, fast.Addr))
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	begin := time.Now()
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("Expected the reply of the fast upstream, took %s", d)
+	}
+	if x := len(rec.Msg.Answer); x != 1 {
+		t.Errorf("Expected the answer of the fast upstream, got %d answers", x)
+	}
+}
+
+func TestForwardUpstreamErrors(t *testing.T) {
+	f := New()
+	f.opts.ForceTCP = true
+	f.maxConnectAttempts = 1
+
+	// Assume nothing is listening on this port, so the connection will be refused.
+	p := proxy.NewProxy("forward", "127.0.0.1:54322", "tcp")
+	f.SetProxy(p)
+	defer p.Stop()
+
+	refused := upstreamErrorsCount.WithLabelValues("127.0.0.1:54322", "refused")
+	before := testutil.ToFloat64(refused)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.ServeDNS(context.Background(), &mockResponseWriter{}, req); err == nil {
+		t.Fatal("Expected error from ServeDNS due to connection refused, got nil")
+	}
+
+	if x := testutil.ToFloat64(refused) - before; x != 1 {
+		t.Errorf("Expected 1 refused error, got %v", x)
+	}
+}
+
+func TestForwardUpstreamSelections(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.p = &sequential{}
+	f.opts.ForceTCP = true
+
+	// Assume nothing is listening on this port, so the query fails over to the next upstream.
+	refused := proxy.NewProxy("forward", "127.0.0.1:54323", "tcp")
+	f.SetProxy(refused)
+	defer refused.Stop()
+	p := proxy.NewProxy("forward", s.Addr, "tcp")
+	f.SetProxy(p)
+	defer p.Stop()
+
+	first := upstreamSelectionsCount.WithLabelValues("sequential", "127.0.0.1:54323", "first")
+	next := upstreamSelectionsCount.WithLabelValues("sequential", s.Addr, "next")
+	firstBefore, nextBefore := testutil.ToFloat64(first), testutil.ToFloat64(next)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.ServeDNS(context.Background(), &mockResponseWriter{}, req); err != nil {
+		t.Fatalf("Expected a reply from the second upstream, got %s", err)
+	}
+
+	if x := testutil.ToFloat64(first) - firstBefore; x != 1 {
+		t.Errorf("Expected the first upstream to be chosen once, got %v", x)
+	}
+	if x := testutil.ToFloat64(next) - nextBefore; x != 1 {
+		t.Errorf("Expected 1 failover to the second upstream, got %v", x)
+	}
+}
+
+func TestForwardTransferNotRetried(t *testing.T) {
+	var axfrs atomic.Int32
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		axfrs.Add(1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Rcode = dns.RcodeRefused
+		w.WriteMsg(ret)
+	}
+	s1 := dnstest.NewMultipleServer(handler)
+	defer s1.Close()
+	s2 := dnstest.NewMultipleServer(handler)
+	defer s2.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s1.Addr+" "+s2.Addr+" {\nforce_tcp\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// The other upstream would refuse the transfer as well, it isn't asked.
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	if _, err := f.ServeDNS(context.TODO(), &transferWriter{}, m); !errors.Is(err, proxy.ErrTransferRcode) {
+		t.Errorf("Expected %q, got %v", proxy.ErrTransferRcode, err)
+	}
+	if x := axfrs.Load(); x != 1 {
+		t.Errorf("Expected the transfer to be sent to 1 upstream, got %d", x)
+	}
+}
+
+func TestNonRetryable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{proxy.ErrTransferTooLarge, true},
+		{fmt.Errorf("%w: REFUSED", proxy.ErrTransferRcode), true},
+		{fmt.Errorf("%w: 192.0.2.1", proxy.ErrLocalAddr), true},
+		{proxy.ErrIXFRNotImplemented, false},
+		{fmt.Errorf("%w: i/o timeout", proxy.ErrTimeout), false},
+		{proxy.ErrCachedClosed, false},
+	}
+	for i, tc := range tests {
+		if x := nonRetryable(tc.err); x != tc.expected {
+			t.Errorf("Test %d: expected non-retryable %t for %v, got %t", i, tc.expected, tc.err, x)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{fmt.Errorf("%w: dial failed", proxy.ErrConnRefused), true},
+		{fmt.Errorf("%w: i/o timeout", proxy.ErrTimeout), true},
+		{proxy.ErrCachedClosed, true},
+		{errors.New("unknown"), true},
+		{fmt.Errorf("%w: short read", proxy.ErrMalformed), false},
+		{proxy.ErrMaxInFlight, false},
+		{proxy.ErrCircuitOpen, false},
+		{context.Canceled, false},
+	}
+	for i, tc := range tests {
+		if x := unreachable(tc.err); x != tc.expected {
+			t.Errorf("Test %d: expected unreachable %t for %v, got %t", i, tc.expected, tc.err, x)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"sync/atomic"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+)
+
+// upstreamHealth follows the health of an upstream for the upstream_healthy, upstream_fails and
+// upstream_down_total metrics. It is the proxy.HealthObserver of the upstream, and is updated from the
+// query path as well.
+type upstreamHealth struct {
+	from     string // the forward block, as preferred_upstream names it
+	to       string
+	maxfails uint32
+
+	fails     atomic.Uint32 // health checks in a row that failed
+	probeDown atomic.Bool   // the active health check marked the upstream down
+	down      atomic.Bool
+}
+
+// newUpstreamHealth returns the upstreamHealth of the upstream to in the forward block for from, which starts out
+// healthy. Its metrics are left alone until publish is called, the proxy it belongs to may never be started.
+func newUpstreamHealth(from, to string, maxfails uint32) *upstreamHealth {
+	return &upstreamHealth{from: from, to: to, maxfails: maxfails}
+}
+
+// publish sets the metrics from the state of the upstream, when its proxy is started.
+func (h *upstreamHealth) publish() {
+	healthy := 1.0
+	if h.down.Load() {
+		healthy = 0
+	}
+	upstreamHealthyGauge.WithLabelValues(h.from, h.to).Set(healthy)
+	upstreamFailsGauge.WithLabelValues(h.from, h.to).Set(float64(h.fails.Load()))
+}
+
+// forget removes the metrics of the upstream, when its proxy is dropped from the forward block.
+func (h *upstreamHealth) forget() {
+	upstreamHealthyGauge.DeleteLabelValues(h.from, h.to)
+	upstreamFailsGauge.DeleteLabelValues(h.from, h.to)
+	upstreamDownCount.DeleteLabelValues(h.from, h.to)
+}
+
+// Checked implements proxy.HealthObserver.
+func (h *upstreamHealth) Checked(fails uint32) {
+	h.fails.Store(fails)
+	h.update()
+}
+
+// Probed implements proxy.HealthObserver.
+func (h *upstreamHealth) Probed(down bool) {
+	h.probeDown.Store(down)
+	h.update()
+}
+
+// update sets the metrics from the state of the upstream, as proxy.Proxy.Down would see it.
+func (h *upstreamHealth) update() {
+	fails := h.fails.Load()
+	down := h.probeDown.Load() || (h.maxfails > 0 && fails > h.maxfails)
+
+	upstreamFailsGauge.WithLabelValues(h.from, h.to).Set(float64(fails))
+	if h.down.Swap(down) == down {
+		return
+	}
+	if down {
+		upstreamHealthyGauge.WithLabelValues(h.from, h.to).Set(0)
+		upstreamDownCount.WithLabelValues(h.from, h.to).Add(1)
+		log.Warningf("Upstream %s of %s is down", h.to, h.from)
+		return
+	}
+	upstreamHealthyGauge.WithLabelValues(h.from, h.to).Set(1)
+	log.Infof("Upstream %s of %s is up again", h.to, h.from)
+}
+
+// startProxy starts the health checks of p and publishes its health metrics.
+func (f *Forward) startProxy(p *proxy.Proxy) {
+	if h, ok := p.HealthObserver().(*upstreamHealth); ok {
+		h.publish()
+	}
+	p.Start(f.hcInterval)
+}
+
+// observeHealth updates the health metrics of p after a query to it failed.
+func observeHealth(p *proxy.Proxy) {
+	if h, ok := p.HealthObserver().(*upstreamHealth); ok {
+		h.probeDown.Store(p.Down(0)) // with 0 only the active health check counts
+		h.Checked(p.Fails())
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/coredns/coredns/plugin/test"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestHealth(t *testing.T) {
@@ -367,3 +368,67 @@ func TestAllUpstreamsDown(t *testing.T) {
 		t.Errorf("Expected queries to the upstream: 1, Got: %d", q1)
 	}
 }
+
+func TestHealthMetrics(t *testing.T) {
+	origTimeout := defaultTimeout
+	defaultTimeout = 10 * time.Millisecond
+	defer func() { defaultTimeout = origTimeout }()
+
+	var healthy atomic.Bool
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if !healthy.Load() {
+			return // timeout
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := proxy.NewProxy("TestHealthMetrics", s.Addr, transport.DNS)
+	p.SetReadTimeout(10 * time.Millisecond)
+	p.GetHealthchecker().SetReadTimeout(10 * time.Millisecond)
+	p.GetHealthchecker().SetWriteTimeout(10 * time.Millisecond)
+	f := New()
+	f.hcInterval = 10 * time.Millisecond
+	f.maxfails = 2
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	healthyGauge := func() float64 { return testutil.ToFloat64(upstreamHealthyGauge.WithLabelValues(f.from, s.Addr)) }
+	downs := testutil.ToFloat64(upstreamDownCount.WithLabelValues(f.from, s.Addr))
+	if x := healthyGauge(); x != 1 {
+		t.Errorf("Expected the upstream to start out healthy, got %v", x)
+	}
+	waitFor := func(expected float64) {
+		t.Helper()
+		for range 200 {
+			if healthyGauge() == expected {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Expected upstream_healthy %v, got %v", expected, healthyGauge())
+	}
+
+	// The failed query starts the health checks, which go on failing.
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	f.ServeDNS(context.TODO(), &test.ResponseWriter{}, req)
+	waitFor(0)
+	if x := testutil.ToFloat64(upstreamDownCount.WithLabelValues(f.from, s.Addr)); x != downs+1 {
+		t.Errorf("Expected 1 transition to down, got %v", x-downs)
+	}
+	if x := testutil.ToFloat64(upstreamFailsGauge.WithLabelValues(f.from, s.Addr)); x <= float64(f.maxfails) {
+		t.Errorf("Expected more than %d failed health checks, got %v", f.maxfails, x)
+	}
+
+	healthy.Store(true)
+	waitFor(1)
+	if x := testutil.ToFloat64(upstreamFailsGauge.WithLabelValues(f.from, s.Addr)); x != 0 {
+		t.Errorf("Expected no failed health checks after a passing one, got %v", x)
+	}
+	if x := testutil.ToFloat64(upstreamDownCount.WithLabelValues(f.from, s.Addr)); x != downs+1 {
+		t.Errorf("Expected still 1 transition to down, got %v", x-downs)
+	}
+}
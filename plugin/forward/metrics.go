@@ -16,10 +16,66 @@ var (
 		Help:      "Counter of the number of complete failures of the healthchecks.",
 	})
 
-	maxConcurrentRejectCount = promauto.NewCounter(prometheus.CounterOpts{
+	maxConcurrentRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
 		Name:      "max_concurrent_rejects_total",
-		Help:      "Counter of the number of queries rejected because the concurrent queries were at maximum.",
+		Help:      "Counter of the number of queries not sent to an upstream because its concurrent queries were at maximum.",
+	}, []string{"to"})
+
+	upstreamChangesCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_changes_total",
+		Help:      "Counter of the number of times re-resolving the hostname upstreams, or reading upstream files again, changed their addresses.",
 	})
+
+	upstreamErrorsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_errors_total",
+		Help:      "Counter of failed queries to an upstream, per kind of error.",
+	}, []string{"to", "kind"})
+
+	upstreamSelectionsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_selections_total",
+		Help:      "Counter of the upstreams queries were sent to, per policy and whether the policy chose it first or it was a failover.",
+	}, []string{"policy", "to", "choice"})
+
+	preferredUpstreamGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "preferred_upstream",
+		Help:      "Gauge that is 1 for the upstream the latency policy currently prefers per forward block, 0 for the others.",
+	}, []string{"from", "to"})
+
+	fileReloadsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "file_reloads_total",
+		Help:      "Counter of the number of times a resolv.conf like upstream file was read again after it changed.",
+	}, []string{"file"})
+
+	upstreamHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_healthy",
+		Help:      "Gauge that is 1 when the upstream is healthy, 0 when it is down, per forward block.",
+	}, []string{"from", "to"})
+
+	upstreamFailsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_fails",
+		Help:      "Gauge of the number of health checks of the upstream in a row that failed.",
+	}, []string{"from", "to"})
+
+	upstreamDownCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_down_total",
+		Help:      "Counter of the number of times the upstream went from healthy to down.",
+	}, []string{"from", "to"})
 )
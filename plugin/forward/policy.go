@@ -1,11 +1,18 @@
 package forward
 
 import (
+	"cmp"
+	"hash/fnv"
+	"net"
+	"slices"
 	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/rand"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
 )
 
 // Policy defines a policy we use for selecting upstreams.
@@ -67,4 +74,168 @@ func (r *sequential) List(p []*proxy.Proxy) []*proxy.Proxy {
 	return p
 }
 
+// latency is a policy that puts the upstream with the lowest smoothed round-trip time first, see
+// proxy.Proxy.SRTT, and orders the others by it as well. Upstreams without a round-trip time yet come
+// first so they get one. Another upstream only takes the lead when it's faster by more than
+// latencyTolerance, so two upstreams with about the same latency don't flap. One in latencyExplore
+// queries uses a random order instead, so the round-trip times of the other upstreams stay current.
+type latency struct {
+	from      string // the forward block, for the preferred upstream metric
+	preferred atomic.Pointer[proxy.Proxy]
+}
+
+const (
+	latencyTolerance = 5 * time.Millisecond
+	latencyExplore   = 50
+)
+
+func (l *latency) String() string { return "latency" }
+
+func (l *latency) List(p []*proxy.Proxy) []*proxy.Proxy {
+	if len(p) < 2 {
+		return p
+	}
+	if rn.Int()%latencyExplore == 0 {
+		return (&random{}).List(p)
+	}
+
+	// The round-trip times change while sorting, take them once.
+	type upstream struct {
+		p    *proxy.Proxy
+		srtt time.Duration
+	}
+	ups := make([]upstream, len(p))
+	for i := range p {
+		ups[i] = upstream{p[i], p[i].SRTT()}
+	}
+	slices.SortStableFunc(ups, func(a, b upstream) int { return cmp.Compare(a.srtt, b.srtt) })
+
+	cur := l.preferred.Load()
+	if i := slices.IndexFunc(ups, func(u upstream) bool { return u.p == cur }); i > 0 && ups[i].srtt-ups[0].srtt <= latencyTolerance {
+		first := ups[i]
+		copy(ups[1:i+1], ups[:i])
+		ups[0] = first
+	}
+
+	if best := ups[0].p; best != cur && l.preferred.CompareAndSwap(cur, best) {
+		if cur != nil {
+			preferredUpstreamGauge.WithLabelValues(l.from, cur.Addr()).Set(0)
+		}
+		preferredUpstreamGauge.WithLabelValues(l.from, best.Addr()).Set(1)
+	}
+
+	list := make([]*proxy.Proxy, len(ups))
+	for i := range ups {
+		list[i] = ups[i].p
+	}
+	return list
+}
+
+// weighted is a policy that orders the upstreams randomly in proportion to their weight, see
+// proxy.Proxy.SetWeight: each next upstream is drawn from the remaining ones by weight. As an upstream that
+// is down is skipped for the next one in the list, its share goes to the others in proportion to their
+// weights.
+type weighted struct{}
+
+func (w *weighted) String() string { return "weighted" }
+
+func (w *weighted) List(p []*proxy.Proxy) []*proxy.Proxy {
+	if len(p) < 2 {
+		return p
+	}
+	total := 0
+	for _, x := range p {
+		total += x.Weight()
+	}
+
+	list := make([]*proxy.Proxy, len(p))
+	copy(list, p)
+	for i := range len(list) - 1 {
+		r := rn.Int() % total
+		j := i
+		for ; j < len(list)-1; j++ {
+			if r -= list[j].Weight(); r < 0 {
+				break
+			}
+		}
+		list[i], list[j] = list[j], list[i]
+		total -= list[i].Weight()
+	}
+	return list
+}
+
+// clientPolicy is a Policy that orders the upstreams by the client of the query.
+type clientPolicy interface {
+	Policy
+	ListFor(state request.Request, p []*proxy.Proxy) []*proxy.Proxy
+}
+
+// clientHash is a policy that sends the queries of a client to the same upstream. It uses rendezvous
+// hashing: every upstream gets a score from the hash of its address and the client, and the upstreams are
+// ordered by it. Adding or removing an upstream only moves the clients that have it first, and when the
+// first upstream is down its clients are spread over the others by their next upstream. The client is
+// the prefix of the EDNS0 client subnet option when the query has one, its address otherwise. Without
+// either, as with a unix socket, the order is random.
+type clientHash struct{}
+
+func (c *clientHash) String() string { return "client_hash" }
+
+// List implements Policy, without a client the order is random.
+func (c *clientHash) List(p []*proxy.Proxy) []*proxy.Proxy { return (&random{}).List(p) }
+
+// ListFor implements clientPolicy.
+func (c *clientHash) ListFor(state request.Request, p []*proxy.Proxy) []*proxy.Proxy {
+	if len(p) < 2 {
+		return p
+	}
+	key := clientKey(state)
+	if key == nil {
+		return c.List(p)
+	}
+
+	type upstream struct {
+		p     *proxy.Proxy
+		score uint64
+	}
+	ups := make([]upstream, len(p))
+	for i := range p {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write([]byte(p[i].Addr()))
+		ups[i] = upstream{p[i], h.Sum64()}
+	}
+	slices.SortFunc(ups, func(a, b upstream) int { return cmp.Compare(b.score, a.score) })
+
+	list := make([]*proxy.Proxy, len(ups))
+	for i := range ups {
+		list[i] = ups[i].p
+	}
+	return list
+}
+
+// clientKey returns what identifies the client of state for clientHash: the prefix of its EDNS0 client
+// subnet option, or else its address. It returns nil when there is neither.
+func clientKey(state request.Request) []byte {
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok && e.Address != nil {
+				bits := 32
+				if e.Family == 2 {
+					bits = 128
+				}
+				ip := e.Address.Mask(net.CIDRMask(int(e.SourceNetmask), bits))
+				if ip == nil {
+					break
+				}
+				return append(ip, e.SourceNetmask)
+			}
+		}
+	}
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return nil
+	}
+	return ip
+}
+
 var rn = rand.New(time.Now().UnixNano())
@@ -0,0 +1,213 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLatencyPolicy(t *testing.T) {
+	newServer := func(delay time.Duration) *dnstest.Server {
+		return dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			time.Sleep(delay)
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		})
+	}
+	slow, fast, fast2 := newServer(30*time.Millisecond), newServer(0), newServer(0)
+	defer slow.Close()
+	defer fast.Close()
+	defer fast2.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	newProxy := func(addr string) *proxy.Proxy {
+		p := proxy.NewProxy("forward", addr, transport.DNS)
+		p.Start(time.Second)
+		t.Cleanup(p.Stop)
+		if _, _, err := p.Connect(context.Background(), req, proxy.Options{}); err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		return p
+	}
+	ps, pf, pf2 := newProxy(slow.Addr), newProxy(fast.Addr), newProxy(fast2.Addr)
+
+	// first counts how often p comes first in 100 lists.
+	first := func(l *latency, list []*proxy.Proxy, p *proxy.Proxy) int {
+		n := 0
+		for range 100 {
+			if l.List(list)[0] == p {
+				n++
+			}
+		}
+		return n
+	}
+
+	l := &latency{from: "TestLatencyPolicy."}
+	if n := first(l, []*proxy.Proxy{ps, pf}, pf); n < 90 {
+		t.Errorf("Expected the fastest upstream to come first in most lists, got %d of 100", n)
+	}
+	if x := testutil.ToFloat64(preferredUpstreamGauge.WithLabelValues("TestLatencyPolicy.", fast.Addr)); x != 1 {
+		t.Errorf("Expected the fastest upstream to be preferred, got %v", x)
+	}
+	if x := testutil.ToFloat64(preferredUpstreamGauge.WithLabelValues("TestLatencyPolicy.", slow.Addr)); x != 0 {
+		t.Errorf("Expected the slow upstream not to be preferred, got %v", x)
+	}
+
+	// Upstreams with about the same latency don't take the lead from each other.
+	l = &latency{from: "TestLatencyPolicy."}
+	l.preferred.Store(pf2)
+	if n := first(l, []*proxy.Proxy{pf, pf2}, pf2); n < 90 {
+		t.Errorf("Expected the preferred upstream to stay first in most lists, got %d of 100", n)
+	}
+	if l.preferred.Load() != pf2 {
+		t.Error("Expected the preferred upstream not to change")
+	}
+
+	// An upstream without a round-trip time is tried first.
+	cold := proxy.NewProxy("forward", "127.0.0.1:53", transport.DNS)
+	if n := first(&latency{}, []*proxy.Proxy{pf, cold}, cold); n < 90 {
+		t.Errorf("Expected the upstream without a round-trip time first in most lists, got %d of 100", n)
+	}
+}
+
+func TestWeightedPolicy(t *testing.T) {
+	newProxy := func(addr string, w int) *proxy.Proxy {
+		p := proxy.NewProxy("forward", addr, transport.DNS)
+		p.SetWeight(w)
+		return p
+	}
+	a, b, c := newProxy("10.0.0.1:53", 2), newProxy("10.0.0.2:53", 1), newProxy("10.0.0.3:53", 1)
+	list := []*proxy.Proxy{a, b, c}
+
+	const n = 10000
+	first := map[*proxy.Proxy]int{}
+	// The first upstream in the list after a, as if a is down.
+	next := map[*proxy.Proxy]int{}
+	w := &weighted{}
+	for range n {
+		l := w.List(list)
+		if len(l) != len(list) {
+			t.Fatalf("Expected %d upstreams, got %d", len(list), len(l))
+		}
+		first[l[0]]++
+		for _, p := range l {
+			if p != a {
+				next[p]++
+				break
+			}
+		}
+	}
+
+	// a gets half of the queries, b and c a quarter each.
+	if x := first[a]; x < 4500 || x > 5500 {
+		t.Errorf("Expected about %d queries first to the upstream with weight 2, got %d", n/2, x)
+	}
+	if x := first[b]; x < 2000 || x > 3000 {
+		t.Errorf("Expected about %d queries first to an upstream with weight 1, got %d", n/4, x)
+	}
+	// With a down its share is split evenly between b and c.
+	if x := next[b]; x < 4500 || x > 5500 {
+		t.Errorf("Expected about %d queries to go to b when a is down, got %d", n/2, x)
+	}
+}
+
+// unixWriter is a ResponseWriter of a client on a unix socket, which has no address.
+type unixWriter struct{ test.ResponseWriter }
+
+func (u *unixWriter) RemoteAddr() net.Addr { return &net.UnixAddr{Name: "@", Net: "unix"} }
+
+func TestClientHashPolicy(t *testing.T) {
+	var list []*proxy.Proxy
+	for i := 1; i <= 4; i++ {
+		list = append(list, proxy.NewProxy("forward", fmt.Sprintf("10.0.0.%d:53", i), transport.DNS))
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	client := func(ip string) request.Request {
+		return request.Request{Req: m, W: &test.ResponseWriter{RemoteIP: ip}}
+	}
+
+	c := &clientHash{}
+	first := map[*proxy.Proxy]int{}
+	for i := range 1000 {
+		state := client(fmt.Sprintf("192.0.%d.%d", i/256, i%256))
+		l := c.ListFor(state, list)
+		if len(l) != len(list) {
+			t.Fatalf("Expected %d upstreams, got %d", len(list), len(l))
+		}
+		if !slices.Equal(l, c.ListFor(state, list)) {
+			t.Errorf("Expected the same order for client %s", state.IP())
+		}
+		first[l[0]]++
+
+		// Without the first upstream the client moves to its next one, the others keep theirs.
+		var without []*proxy.Proxy
+		for _, p := range list {
+			if p != list[0] {
+				without = append(without, p)
+			}
+		}
+		next := l[0]
+		if next == list[0] {
+			next = l[1]
+		}
+		if x := c.ListFor(state, without)[0]; x != next {
+			t.Errorf("Expected client %s to stay with %s when an upstream is removed, got %s", state.IP(), next.Addr(), x.Addr())
+		}
+	}
+	for _, p := range list {
+		if x := first[p]; x < 150 || x > 350 {
+			t.Errorf("Expected about 250 clients on %s, got %d", p.Addr(), x)
+		}
+	}
+
+	// Clients in the same client subnet go to the same upstreams.
+	ecs := func(ip, subnet string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		o := m.SetEdns0(4096, false).IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+		return request.Request{Req: m, W: &test.ResponseWriter{RemoteIP: ip}}
+	}
+	for i := range 50 {
+		a := c.ListFor(ecs("10.1.1.1", fmt.Sprintf("198.51.%d.1", i)), list)
+		b := c.ListFor(ecs("10.2.2.2", fmt.Sprintf("198.51.%d.200", i)), list)
+		if !slices.Equal(a, b) {
+			t.Errorf("Expected the same order for the client subnet 198.51.%d.0/24", i)
+		}
+	}
+
+	// Without a client address all upstreams are still listed.
+	l := c.ListFor(request.Request{Req: m, W: &unixWriter{}}, list)
+	if len(l) != len(list) {
+		t.Errorf("Expected %d upstreams for a client on a unix socket, got %d", len(list), len(l))
+	}
+}
+
+func TestSetupWeights(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1*3 127.0.0.2 {\npolicy weighted\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	ps := fs[0].proxies
+	if ps[0].Weight() != 3 || ps[1].Weight() != 1 {
+		t.Errorf("Expected weights 3 and 1, got %d and %d", ps[0].Weight(), ps[1].Weight())
+	}
+}
@@ -0,0 +1,163 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+)
+
+// hasHostnames returns true when one of the TO entries is a hostname that is resolved.
+func (f *Forward) hasHostnames() bool {
+	for _, e := range f.toEntries {
+		if !e.static {
+			return true
+		}
+	}
+	return false
+}
+
+// startReresolve starts re-resolving the hostname TO entries every f.reresolve, and checking the files of
+// the TO entries for changes every f.watchInterval, until stopReresolve is called.
+func (f *Forward) startReresolve() {
+	if !f.reresolving() && !f.watching() {
+		return
+	}
+	f.reresolveStop = make(chan struct{})
+	f.reresolveDone = make(chan struct{})
+	go f.reresolveLoop(f.reresolveStop, f.reresolveDone)
+}
+
+// stopReresolve stops the re-resolution and waits until a re-resolution in progress is done, so the
+// proxies aren't replaced after that.
+func (f *Forward) stopReresolve() {
+	if f.reresolveStop == nil {
+		return
+	}
+	close(f.reresolveStop)
+	<-f.reresolveDone
+	f.reresolveStop = nil
+}
+
+// reresolving returns true when the hostname TO entries are re-resolved.
+func (f *Forward) reresolving() bool { return f.reresolve > 0 && f.hasHostnames() }
+
+// watching returns true when the files of the TO entries are checked for changes.
+func (f *Forward) watching() bool { return f.watchInterval > 0 && f.hasFiles() }
+
+// reresolveLoop does both the re-resolution and the watching of files, so refresh never runs concurrently.
+func (f *Forward) reresolveLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	var reresolve, watch <-chan time.Time // a nil channel never fires
+	if f.reresolving() {
+		ticker := time.NewTicker(f.reresolve)
+		defer ticker.Stop()
+		reresolve = ticker.C
+	}
+	if f.watching() {
+		ticker := time.NewTicker(f.watchInterval)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-reresolve:
+			if err := f.refresh(); err != nil {
+				log.Warningf("Failed to re-resolve upstreams of %s, keeping the current ones: %s", f.from, err)
+			}
+		case <-watch:
+			f.watch()
+		}
+	}
+}
+
+// refresh resolves the TO entries again and replaces the proxies when the upstream addresses changed.
+// Proxies of addresses that are still there are kept along with their connections and health state.
+// New proxies are started, and the proxies of removed addresses are shut down once the queries they
+// are handling are done.
+func (f *Forward) refresh() error {
+	toHosts, candidates, err := f.expand()
+	if err != nil {
+		return err
+	}
+	if len(toHosts) == 0 {
+		return fmt.Errorf("no valid upstream addresses found")
+	}
+
+	current := f.upstreams()
+	old := make(map[string]*proxy.Proxy, len(current))
+	for _, p := range current {
+		old[upstreamKey(p.Addr(), p.Candidates())] = p
+	}
+
+	var added []string
+	for _, host := range toHosts {
+		h := normalizeAddr(host)
+		if _, ok := old[upstreamKey(h, candidates[h])]; !ok {
+			added = append(added, host)
+		}
+	}
+	if len(added) == 0 && len(toHosts) == len(current) {
+		return nil
+	}
+
+	created, err := f.newProxies(added, candidates)
+	if err != nil {
+		return err
+	}
+
+	proxies := make([]*proxy.Proxy, 0, len(toHosts))
+	for _, host := range toHosts {
+		h := normalizeAddr(host)
+		key := upstreamKey(h, candidates[h])
+		if p, ok := old[key]; ok {
+			proxies = append(proxies, p)
+			delete(old, key)
+			continue
+		}
+		p := created[0]
+		created = created[1:]
+		f.startProxy(p)
+		proxies = append(proxies, p)
+	}
+
+	f.proxiesMu.Lock()
+	f.proxies = proxies
+	f.proxiesMu.Unlock()
+
+	removed := make([]string, 0, len(old))
+	for _, p := range old {
+		removed = append(removed, p.Addr())
+		if h, ok := p.HealthObserver().(*upstreamHealth); ok {
+			h.forget()
+		}
+	}
+	upstreamChangesCount.Add(1)
+	log.Infof("Upstreams of %s changed, added: %v, removed: %v", f.from, added, removed)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+		for _, p := range old {
+			p.Shutdown(ctx)
+		}
+	}()
+	return nil
+}
+
+// upstreamKey identifies an upstream by its address and, with happy_eyeballs, the addresses its hostname
+// resolved to.
+func upstreamKey(addr string, candidates []string) string {
+	if len(candidates) == 0 {
+		return addr
+	}
+	candidates = slices.Clone(candidates)
+	slices.Sort(candidates)
+	return addr + "=" + strings.Join(candidates, ",")
+}
@@ -0,0 +1,230 @@
+package forward
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// movingResolver is a DNS server that answers A queries for up.example.com with the addresses in ips.
+type movingResolver struct {
+	mu  sync.Mutex
+	ips []string
+}
+
+func (m *movingResolver) set(ips ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ips = ips
+}
+
+func (m *movingResolver) serve(w dns.ResponseWriter, r *dns.Msg) {
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "up.example.com." {
+		m.mu.Lock()
+		for _, ip := range m.ips {
+			ret.Answer = append(ret.Answer, test.A("up.example.com. IN A "+ip))
+		}
+		m.mu.Unlock()
+	}
+	w.WriteMsg(ret)
+}
+
+func upstreamAddrs(f *Forward) []string {
+	var addrs []string
+	for _, p := range f.upstreams() {
+		addrs = append(addrs, p.Addr())
+	}
+	return addrs
+}
+
+func TestSetupReresolve(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expected    time.Duration
+		expectedErr string
+	}{
+		{"forward . 127.0.0.1\n", false, 0, ""},
+		{"forward . 127.0.0.1 {\nreresolve 30s\n}\n", false, 30 * time.Second, ""},
+		{"forward . 127.0.0.1 {\nreresolve 0s\n}\n", true, 0, "must be positive"},
+		{"forward . 127.0.0.1 {\nreresolve often\n}\n", true, 0, "invalid duration"},
+		{"forward . 127.0.0.1 {\nreresolve\n}\n", true, 0, "Wrong argument count"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if fs[0].reresolve != test.expected {
+			t.Errorf("Test %d: expected reresolve %s, got %s", i, test.expected, fs[0].reresolve)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	m := &movingResolver{}
+	m.set("10.0.0.1", "10.0.0.2")
+	s := dnstest.NewMultipleServer(m.serve)
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . up.example.com 10.0.0.9 {\nresolver "+s.Addr+"\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	kept := f.upstreams()[1]
+	changes := testutil.ToFloat64(upstreamChangesCount)
+
+	// Unchanged addresses leave the proxies alone.
+	if err := f.refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+	if x := testutil.ToFloat64(upstreamChangesCount); x != changes {
+		t.Errorf("Expected no upstream change to be counted, got %v", x-changes)
+	}
+
+	m.set("10.0.0.2", "10.0.0.3")
+	if err := f.refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+	expected := []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.9:53"}
+	if addrs := upstreamAddrs(f); !slices.Equal(addrs, expected) {
+		t.Errorf("Expected upstreams %v, got %v", expected, addrs)
+	}
+	if f.upstreams()[0] != kept {
+		t.Error("Expected the proxy of an address that is still there to be kept")
+	}
+	if x := testutil.ToFloat64(upstreamChangesCount); x != changes+1 {
+		t.Errorf("Expected 1 upstream change to be counted, got %v", x-changes)
+	}
+	// The health metrics of the removed upstream are gone, those of the added one published.
+	if upstreamHealthyGauge.DeleteLabelValues(f.from, "10.0.0.1:53") {
+		t.Error("Expected the health metrics of the removed upstream to be deleted")
+	}
+	if x := testutil.ToFloat64(upstreamHealthyGauge.WithLabelValues(f.from, "10.0.0.3:53")); x != 1 {
+		t.Errorf("Expected the added upstream to be healthy, got %v", x)
+	}
+
+	// A failed resolution keeps the current upstreams.
+	m.set()
+	if err := f.refresh(); err == nil {
+		t.Error("Expected an error when the hostname doesn't resolve")
+	}
+	if addrs := upstreamAddrs(f); !slices.Equal(addrs, expected) {
+		t.Errorf("Expected upstreams %v after a failed resolution, got %v", expected, addrs)
+	}
+}
+
+func TestRefreshUpstreamTimeout(t *testing.T) {
+	m := &movingResolver{}
+	m.set("10.0.0.1")
+	s := dnstest.NewMultipleServer(m.serve)
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . up.example.com 10.0.0.9 {\nresolver "+s.Addr+"\nupstream_timeout up.example.com read 50ms\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// The override follows the hostname to the addresses it resolves to later, not the first address.
+	m.set("10.0.0.2")
+	if err := f.refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+	for _, p := range f.upstreams() {
+		overridden := p.ReadTimeout() == 50*time.Millisecond
+		if expected := p.Addr() == "10.0.0.2:53"; overridden != expected {
+			t.Errorf("Expected the read timeout of %s to be overridden: %t, got %s", p.Addr(), expected, p.ReadTimeout())
+		}
+	}
+}
+
+func TestRefreshCandidates(t *testing.T) {
+	m := &movingResolver{}
+	m.set("10.0.0.1")
+	s := dnstest.NewMultipleServer(m.serve)
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . up.example.com {\nresolver "+s.Addr+"\nhappy_eyeballs\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	old := f.upstreams()[0]
+	m.set("10.0.0.2")
+	if err := f.refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+
+	p := f.upstreams()[0]
+	if p == old {
+		t.Fatal("Expected a new proxy when the addresses of the hostname changed")
+	}
+	if p.Addr() != "up.example.com:53" {
+		t.Errorf("Expected upstream up.example.com:53, got %s", p.Addr())
+	}
+	if candidates := p.Candidates(); !slices.Equal(candidates, []string{"10.0.0.2:53"}) {
+		t.Errorf("Expected candidates [10.0.0.2:53], got %v", candidates)
+	}
+}
+
+func TestReresolveLoop(t *testing.T) {
+	m := &movingResolver{}
+	m.set("10.0.0.1")
+	s := dnstest.NewMultipleServer(m.serve)
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . up.example.com {\nresolver "+s.Addr+"\nreresolve 10ms\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m.set("10.0.0.2")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if addrs := upstreamAddrs(f); slices.Equal(addrs, []string{"10.0.0.2:53"}) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the upstream to move to 10.0.0.2:53, got %v", upstreamAddrs(f))
+}
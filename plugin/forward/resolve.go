@@ -3,6 +3,7 @@ package forward
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,7 +25,11 @@ type hostEntry struct {
 type toEntry struct {
 	static bool      // true for IP/file-based entries
 	addrs  []string  // for static: resolved by HostPortOrFile
+	file   string    // for static: the resolv.conf like file addrs were read from, see watch.go
+	stamp  fileStamp // for static: the file as it was when addrs were read
 	entry  hostEntry // for dynamic: hostname to resolve
+	weight int       // weight of the upstreams of this entry, 0 when none was given
+	key    string    // the address of the entry as written, see scopeKey; empty when it isn't a single upstream
 }
 
 // classifyToAddrs processes TO addresses in order, returning an ordered list of
@@ -32,10 +37,22 @@ type toEntry struct {
 func classifyToAddrs(toAddrs []string) ([]toEntry, error) {
 	var entries []toEntry
 	for _, h := range toAddrs {
+		h, weight, err := splitWeight(h)
+		if err != nil {
+			return nil, err
+		}
+		key, _ := scopeKey(h)
+
 		// Try HostPortOrFile first - this handles IPs and files
 		hosts, parseErr := parse.HostPortOrFile(h)
 		if parseErr == nil {
-			entries = append(entries, toEntry{static: true, addrs: hosts})
+			e := toEntry{static: true, addrs: hosts, weight: weight, key: key}
+			// A file is watched for changes, see watch.go.
+			_, host := parse.Transport(h)
+			if stamp, err := statFile(host); err == nil {
+				e.file, e.stamp = host, stamp
+			}
+			entries = append(entries, e)
 			continue
 		}
 
@@ -46,16 +63,68 @@ func classifyToAddrs(toAddrs []string) ([]toEntry, error) {
 			return nil, parseErr
 		}
 
+		// A DoH upstream keeps its hostname, see dohHostAddr.
+		if addr, ok := dohHostAddr(h); ok {
+			entries = append(entries, toEntry{static: true, addrs: []string{addr}, weight: weight, key: key})
+			continue
+		}
+
 		// Not an IP or file - check if it's a valid hostname
 		entry, ok := parseAsHostEntry(h)
 		if !ok {
 			return nil, fmt.Errorf("not an IP address, file, or valid domain: %q", h)
 		}
-		entries = append(entries, toEntry{static: false, entry: entry})
+		entries = append(entries, toEntry{static: false, entry: entry, weight: weight, key: key})
 	}
 	return entries, nil
 }
 
+// splitWeight splits the weight off a TO address written as ADDRESS*WEIGHT. The weight is 0 when there
+// is none.
+func splitWeight(h string) (string, int, error) {
+	i := strings.LastIndex(h, "*")
+	if i < 0 {
+		return h, 0, nil
+	}
+	w, err := strconv.Atoi(h[i+1:])
+	if err != nil || w < 1 {
+		return "", 0, fmt.Errorf("invalid weight in %q, it must be a positive integer", h)
+	}
+	return h[:i], w, nil
+}
+
+// hasWeights returns true when one of the TO entries has a weight.
+func hasWeights(entries []toEntry) bool {
+	for _, e := range entries {
+		if e.weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dohHostAddr returns the https:// TO address h whose host is a name, with the default port added when
+// it has none. It isn't resolved here: the HTTP client resolves the name when it connects, and uses it as
+// the TLS server name.
+func dohHostAddr(h string) (string, bool) {
+	trans, host := parse.Transport(h)
+	if trans != transport.HTTPS {
+		return "", false
+	}
+	var path string
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, path = host[:i], host[i:]
+	}
+	hostname, port := host, transport.HTTPSPort
+	if h2, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h2, p
+	}
+	if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" || net.ParseIP(hostname) != nil {
+		return "", false
+	}
+	return transport.HTTPS + "://" + net.JoinHostPort(hostname, port) + path, true
+}
+
 // parseAsHostEntry attempts to parse a TO address as a hostname-based entry.
 func parseAsHostEntry(h string) (hostEntry, bool) {
 	cleanH, zone := splitZone(h)
@@ -100,11 +169,13 @@ func parseAsHostEntry(h string) (hostEntry, bool) {
 
 // expandAndDedup resolves all toEntries in order, expands hostnames to IPs,
 // and deduplicates by first-seen address. Returns the deduplicated address list.
-func expandAndDedup(entries []toEntry, resolvers []string) ([]string, error) {
+// The entry each address came from is stored in origins, keyed by the normalized address, when it isn't nil.
+func expandAndDedup(entries []toEntry, resolvers []string, origins map[string]*toEntry) ([]string, error) {
 	seen := make(map[string]bool)
 	var result []string
 
-	for _, e := range entries {
+	for i := range entries {
+		e := &entries[i]
 		var addrs []string
 		if e.static {
 			addrs = e.addrs
@@ -122,12 +193,61 @@ func expandAndDedup(entries []toEntry, resolvers []string) ([]string, error) {
 			if !seen[key] {
 				seen[key] = true
 				result = append(result, addr)
+				setOrigin(origins, key, e)
 			}
 		}
 	}
 	return result, nil
 }
 
+// expandGrouped is expandAndDedup, but each hostname becomes a single address, hostname:port, instead of
+// one per resolved IP. The resolved IP:port addresses are returned as its candidates, keyed by the
+// normalized address. Static addresses are deduplicated as by expandAndDedup, and origins is filled in the
+// same way.
+func expandGrouped(entries []toEntry, resolvers []string, origins map[string]*toEntry) ([]string, map[string][]string, error) {
+	seen := make(map[string]bool)
+	candidates := make(map[string][]string)
+	var result []string
+
+	for i := range entries {
+		e := &entries[i]
+		if e.static {
+			for _, addr := range e.addrs {
+				if key := normalizeAddr(addr); !seen[key] {
+					seen[key] = true
+					result = append(result, addr)
+					setOrigin(origins, key, e)
+				}
+			}
+			continue
+		}
+
+		ips, err := lookupHost(e.entry.hostname, resolvers)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve %q: %v", e.entry.hostname, err)
+		}
+		addr := formatResolvedAddr(e.entry.hostname, e.entry.port, e.entry.transport, e.entry.zone)
+		key := normalizeAddr(addr)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, addr)
+		setOrigin(origins, key, e)
+		for _, ip := range ips {
+			candidates[key] = append(candidates[key], net.JoinHostPort(ip, e.entry.port))
+		}
+	}
+	return result, candidates, nil
+}
+
+// setOrigin stores e as the entry of the address key when origins isn't nil.
+func setOrigin(origins map[string]*toEntry, key string, e *toEntry) {
+	if origins != nil {
+		origins[key] = e
+	}
+}
+
 // normalizeAddr extracts the canonical IP:port from an address string
 // (stripping transport prefix and zone) for deduplication.
 func normalizeAddr(addr string) string {
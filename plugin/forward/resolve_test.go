@@ -3,6 +3,7 @@ package forward
 import (
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 
@@ -83,6 +84,18 @@ func TestClassifyToAddrs(t *testing.T) {
 			wantStatic:  2,
 			wantDynamic: 1,
 		},
+		{
+			name:        "weighted IP and hostname",
+			input:       []string{"127.0.0.1*3", "dns.example.com*2"},
+			wantStatic:  1,
+			wantDynamic: 1,
+		},
+		{
+			name:        "invalid weight",
+			input:       []string{"127.0.0.1*-1"},
+			wantErr:     true,
+			errContains: "invalid weight",
+		},
 		{
 			name:        "/dev/null returns file error",
 			input:       []string{"/dev/null"},
@@ -248,7 +261,7 @@ func TestExpandAndDedup(t *testing.T) {
 		{static: true, addrs: []string{"10.0.0.2:53"}},
 	}
 
-	result, err := expandAndDedup(entries, []string{s.Addr})
+	result, err := expandAndDedup(entries, []string{s.Addr}, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -285,7 +298,7 @@ func TestExpandAndDedupOrderPreserved(t *testing.T) {
 		{static: true, addrs: []string{"192.168.1.1:53"}},
 	}
 
-	result, err := expandAndDedup(entries, []string{s.Addr})
+	result, err := expandAndDedup(entries, []string{s.Addr}, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -430,7 +443,7 @@ func TestSetupWithHostnameTO(t *testing.T) {
 		{static: false, entry: entry},
 	}
 
-	resolvedAddrs, err := expandAndDedup(f.toEntries, f.resolver)
+	resolvedAddrs, err := expandAndDedup(f.toEntries, f.resolver, nil)
 	if err != nil {
 		t.Fatalf("resolution failed: %v", err)
 	}
@@ -471,7 +484,7 @@ func TestSetupMixedIPAndHostnameTO(t *testing.T) {
 		{static: true, addrs: []string{"127.0.0.1:53"}},
 	}
 
-	resolvedAddrs, err := expandAndDedup(f.toEntries, f.resolver)
+	resolvedAddrs, err := expandAndDedup(f.toEntries, f.resolver, nil)
 	if err != nil {
 		t.Fatalf("expand error: %v", err)
 	}
@@ -571,7 +584,7 @@ func TestExpandAndDedupTLS(t *testing.T) {
 		{static: true, addrs: []string{"tls://9.9.9.10:853"}},
 	}
 
-	result, err := expandAndDedup(entries, []string{s.Addr})
+	result, err := expandAndDedup(entries, []string{s.Addr}, nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -606,3 +619,106 @@ func TestResolverWithHCOptions(t *testing.T) {
 		t.Errorf("expected opts %v, got %v", expectedOpts, f.opts)
 	}
 }
+
+func TestExpandGrouped(t *testing.T) {
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "dual.example.com." {
+			switch r.Question[0].Qtype {
+			case dns.TypeA:
+				ret.Answer = append(ret.Answer, test.A("dual.example.com. IN A 10.0.0.1"))
+			case dns.TypeAAAA:
+				ret.Answer = append(ret.Answer, test.AAAA("dual.example.com. IN AAAA 2001:db8::1"))
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	entries := []toEntry{
+		{static: false, entry: hostEntry{hostname: "dual.example.com", port: "53", transport: "dns"}},
+		{static: true, addrs: []string{"10.0.0.1:53"}},
+		{static: false, entry: hostEntry{hostname: "dual.example.com", port: "53", transport: "dns"}},
+	}
+
+	result, candidates, err := expandGrouped(entries, []string{s.Addr}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The static address doesn't collide with the hostname, the repeated hostname is dropped.
+	expected := []string{"dual.example.com:53", "10.0.0.1:53"}
+	if len(result) != len(expected) {
+		t.Fatalf("expected %d addresses, got %d: %v", len(expected), len(result), result)
+	}
+	for i, addr := range result {
+		if addr != expected[i] {
+			t.Errorf("position %d: expected %s, got %s", i, expected[i], addr)
+		}
+	}
+
+	got := candidates["dual.example.com:53"]
+	if len(got) != 2 {
+		t.Fatalf("expected 2 candidates, got %v", got)
+	}
+	for _, want := range []string{"10.0.0.1:53", "[2001:db8::1]:53"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("expected candidate %s in %v", want, got)
+		}
+	}
+	if _, ok := candidates["10.0.0.1:53"]; ok {
+		t.Error("expected no candidates for a static address")
+	}
+}
+
+func TestSetupHappyEyeballs(t *testing.T) {
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA && r.Question[0].Name == "dual.example.com." {
+			ret.Answer = append(ret.Answer,
+				test.A("dual.example.com. IN A 10.0.0.1"),
+				test.A("dual.example.com. IN A 10.0.0.2"),
+			)
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expected    []string
+		expectedErr string
+	}{
+		{"forward . dual.example.com {\nresolver " + s.Addr + "\n}\n", false, []string{"10.0.0.1:53", "10.0.0.2:53"}, ""},
+		{"forward . dual.example.com {\nresolver " + s.Addr + "\nhappy_eyeballs\n}\n", false, []string{"dual.example.com:53"}, ""},
+		{"forward . dual.example.com {\nhappy_eyeballs yes\n}\n", true, nil, "Wrong argument count"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		var addrs []string
+		for _, p := range fs[0].proxies {
+			addrs = append(addrs, p.Addr())
+		}
+		if !slices.Equal(addrs, test.expected) {
+			t.Errorf("Test %d: expected proxies %v, got %v", i, test.expected, addrs)
+		}
+	}
+}
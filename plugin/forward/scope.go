@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+
+	"github.com/miekg/dns"
+)
+
+// scope limits the names an upstream is used for, see only_for and except_for.
+type scope struct {
+	only   []string // the upstream is only used for names under one of these, empty means all names
+	except []string // the upstream is not used for names under one of these
+}
+
+// match returns how closely name matches s: the number of labels of the longest only domain that name is
+// under, or 0 when s has no only domains. It returns -1 when the upstream is not to be used for name.
+func (s *scope) match(name string) int {
+	for _, e := range s.except {
+		if plugin.Name(e).Matches(name) {
+			return -1
+		}
+	}
+	if len(s.only) == 0 {
+		return 0
+	}
+	best := -1
+	for _, o := range s.only {
+		if n := dns.CountLabel(o); n > best && plugin.Name(o).Matches(name) {
+			best = n
+		}
+	}
+	return best
+}
+
+// scoped returns the upstreams of list with the scope that matches name most closely, see scope.match,
+// in the order of list. Upstreams without a scope match every name with 0.
+func (f *Forward) scoped(list []*proxy.Proxy, name string) []*proxy.Proxy {
+	best := -1
+	matches := make([]int, len(list))
+	for i, p := range list {
+		if s, ok := f.scopes[p.Addr()]; ok {
+			matches[i] = s.match(name)
+		}
+		if matches[i] > best {
+			best = matches[i]
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	scoped := make([]*proxy.Proxy, 0, len(list))
+	for i, p := range list {
+		if matches[i] == best {
+			scoped = append(scoped, p)
+		}
+	}
+	return scoped
+}
+
+// scopeKey returns the address of the upstream to, as written in only_for or except_for, as returned by
+// proxy.Proxy.Addr.
+func scopeKey(to string) (string, bool) {
+	if hosts, err := parse.HostPortOrFile(to); err == nil {
+		if len(hosts) != 1 {
+			return "", false
+		}
+		return normalizeAddr(hosts[0]), true
+	}
+	// A hostname upstream with happy_eyeballs keeps its name.
+	entry, ok := parseAsHostEntry(to)
+	if !ok {
+		return "", false
+	}
+	return net.JoinHostPort(entry.hostname, entry.port), true
+}
@@ -0,0 +1,134 @@
+package forward
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestScopeMatch(t *testing.T) {
+	s := &scope{only: []string{"corp.example.", "eng.corp.example."}, except: []string{"public.corp.example."}}
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"www.example.", -1},
+		{"corp.example.", 2},
+		{"www.corp.example.", 2},
+		{"www.eng.corp.example.", 3},
+		{"www.public.corp.example.", -1},
+	}
+	for i, tc := range tests {
+		if x := s.match(tc.name); x != tc.expected {
+			t.Errorf("Test %d: expected %d for %s, got %d", i, tc.expected, tc.name, x)
+		}
+	}
+
+	if x := (&scope{except: []string{"corp.example."}}).match("www.example."); x != 0 {
+		t.Errorf("Expected 0 for a scope without only domains, got %d", x)
+	}
+}
+
+func TestSetupScopes(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expected    map[string]scope
+		expectedErr string
+	}{
+		{"forward . 127.0.0.1 127.0.0.2\n", false, nil, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nonly_for 127.0.0.2 Corp.Example\nexcept_for 127.0.0.1:53 corp.example\n}\n", false,
+			map[string]scope{"127.0.0.2:53": {only: []string{"corp.example."}}, "127.0.0.1:53": {except: []string{"corp.example."}}}, ""},
+		{"forward . 127.0.0.1 {\nonly_for 127.0.0.1\n}\n", true, nil, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nonly_for 127.0.0.3 corp.example\n}\n", true, nil, "not one of the upstreams"},
+		{"forward . 127.0.0.1 {\nexcept_for tls:// corp.example\n}\n", true, nil, "not a single upstream address"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if len(fs[0].scopes) != len(test.expected) {
+			t.Fatalf("Test %d: expected %d scopes, got %d", i, len(test.expected), len(fs[0].scopes))
+		}
+		for addr, s := range test.expected {
+			got, ok := fs[0].scopes[addr]
+			if !ok {
+				t.Errorf("Test %d: expected a scope for %s", i, addr)
+				continue
+			}
+			if strings.Join(got.only, ",") != strings.Join(s.only, ",") || strings.Join(got.except, ",") != strings.Join(s.except, ",") {
+				t.Errorf("Test %d: expected scope %v for %s, got %v", i, s, addr, *got)
+			}
+		}
+	}
+}
+
+func TestForwardScoped(t *testing.T) {
+	newServer := func(ip string) *dnstest.Server {
+		return dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A "+ip))
+			w.WriteMsg(ret)
+		})
+	}
+	public, corp, eng := newServer("10.0.0.1"), newServer("10.0.0.2"), newServer("10.0.0.3")
+	defer public.Close()
+	defer corp.Close()
+	defer eng.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+public.Addr+" "+corp.Addr+" "+eng.Addr+` {
+		except_for `+public.Addr+` corp.example
+		only_for `+corp.Addr+` corp.example
+		only_for `+eng.Addr+` eng.corp.example
+	}`)
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"www.example.org.", "10.0.0.1"},
+		{"www.corp.example.", "10.0.0.2"},
+		{"www.eng.corp.example.", "10.0.0.3"},
+	}
+	for i, tc := range tests {
+		// Whatever the policy picks, only the upstream of the scope is used.
+		for range 5 {
+			m := new(dns.Msg)
+			m.SetQuestion(tc.name, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := f.ServeDNS(context.Background(), rec, m); err != nil {
+				t.Fatalf("Test %d: expected a reply, got %s", i, err)
+			}
+			if x := rec.Msg.Answer[0].(*dns.A).A.String(); x != tc.expected {
+				t.Errorf("Test %d: expected %s to be answered by the upstream with %s, got %s", i, tc.name, tc.expected, x)
+			}
+		}
+	}
+}
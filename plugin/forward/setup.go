@@ -1,11 +1,14 @@
 package forward
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -73,17 +76,22 @@ func setup(c *caddy.Controller) error {
 // OnStartup starts a goroutines for all proxies.
 func (f *Forward) OnStartup() (err error) {
 	for _, p := range f.proxies {
-		p.Start(f.hcInterval)
+		f.startProxy(p)
 	}
-	return nil
+	f.startReresolve()
+	return f.register()
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies, queries in flight get up to defaultTimeout to finish.
 func (f *Forward) OnShutdown() error {
-	for _, p := range f.proxies {
-		p.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	f.stopReresolve()
+	err := f.unregister()
+	for _, p := range f.upstreams() {
+		p.Shutdown(ctx)
 	}
-	return nil
+	return err
 }
 
 func parseForward(c *caddy.Controller) ([]*Forward, error) {
@@ -154,9 +162,20 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		}
 	}
 
+	if f.proxyProtocol && f.opts.PreferUDP {
+		return f, fmt.Errorf("proxy_protocol can't be combined with prefer_udp: the PROXY protocol header is only sent over TCP")
+	}
+
+	if f.hedgeDelay > 0 && f.opts.Fanout > 1 {
+		return f, fmt.Errorf("hedge can't be combined with fanout")
+	}
+
 	if f.maxAge > 0 && f.maxAge < f.expire {
 		return f, fmt.Errorf("max_age (%s) must not be less than expire (%s)", f.maxAge, f.expire)
 	}
+	if f.maxAge > 0 && f.maxAge < f.expireTCP {
+		return f, fmt.Errorf("max_age (%s) must not be less than expire_tcp (%s)", f.maxAge, f.expireTCP)
+	}
 
 	// Classify TO addresses in order, preserving config ordering.
 	entries, err := classifyToAddrs(to)
@@ -164,9 +183,13 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		return f, err
 	}
 	f.toEntries = entries
+	if hasWeights(entries) && f.p.String() != "weighted" {
+		return f, fmt.Errorf("upstream weights can only be used with policy weighted")
+	}
 
-	// Expand hostnames and deduplicate globally (first-seen order wins).
-	toHosts, err := expandAndDedup(f.toEntries, f.resolver)
+	// Expand hostnames and deduplicate globally (first-seen order wins). With happy eyeballs a hostname
+	// stays one upstream that races the addresses it resolved to.
+	toHosts, candidates, err := f.expand()
 	if err != nil {
 		return f, err
 	}
@@ -174,34 +197,91 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		return f, fmt.Errorf("no valid upstream addresses found")
 	}
 
+	if f.tlsServerName != "" {
+		f.tlsConfig.ServerName = f.tlsServerName
+	}
+	// Initialize ClientSessionCache in tls.Config. This may speed up a TLS handshake
+	// in upcoming connections to the same TLS server.
+	f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(toHosts))
+	if err := f.buildUpstreamTLS(); err != nil {
+		return f, err
+	}
+
+	f.proxies, err = f.newProxies(toHosts, candidates)
+	if err != nil {
+		return f, err
+	}
+
+	for key, u := range f.upstreamTLS {
+		if !slices.ContainsFunc(f.proxies, func(p *proxy.Proxy) bool { return p.Addr() == key }) {
+			return f, fmt.Errorf("tls_upstream: '%s' is not one of the upstreams", u.to)
+		}
+	}
+	for key, u := range f.upstreamTimeouts {
+		if !slices.ContainsFunc(f.proxies, func(p *proxy.Proxy) bool { return f.upstreamTimeoutKey(p.Addr()) == key }) {
+			return f, fmt.Errorf("upstream_timeout: '%s' is not one of the upstreams", u.to)
+		}
+	}
+	for key := range f.scopes {
+		if !slices.ContainsFunc(f.proxies, func(p *proxy.Proxy) bool { return p.Addr() == key }) {
+			return f, fmt.Errorf("only_for or except_for: '%s' is not one of the upstreams", key)
+		}
+	}
+
+	return f, nil
+}
+
+// expand expands the TO entries into upstream addresses, see expandAndDedup and expandGrouped. The entries
+// the addresses came from are kept in f.origins for newProxies.
+func (f *Forward) expand() ([]string, map[string][]string, error) {
+	origins := make(map[string]*toEntry)
+	defer func() { f.origins = origins }()
+	if f.happyEyeballs {
+		return expandGrouped(f.toEntries, f.resolver, origins)
+	}
+	toHosts, err := expandAndDedup(f.toEntries, f.resolver, origins)
+	return toHosts, nil, err
+}
+
+// newProxies creates and configures a proxy for each of toHosts. The candidates of an address are the
+// addresses its hostname resolved to, when happy_eyeballs is used.
+func (f *Forward) newProxies(toHosts []string, candidates map[string][]string) ([]*proxy.Proxy, error) {
+	var proxies []*proxy.Proxy
 	tlsServerNames := make([]string, len(toHosts))
 	perServerNameProxyCount := make(map[string]int)
 	transports := make([]string, len(toHosts))
-	allowedTrans := map[string]bool{"dns": true, "tls": true}
+	allowedTrans := map[string]bool{"dns": true, "tls": true, "unix": true, "https": true, "quic": true}
 	for i, hostWithZone := range toHosts {
 		host, serverName := splitZone(hostWithZone)
 		trans, h := parse.Transport(host)
 
 		if !allowedTrans[trans] {
-			return f, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
+			return nil, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
 		}
-		if trans == transport.TLS && serverName != "" {
+		if (trans == transport.TLS || trans == transport.QUIC) && serverName != "" {
 			if f.tlsServerName != "" {
-				return f, fmt.Errorf("both forward ('%s') and proxy level ('%s') TLS servernames are set for upstream proxy '%s'", f.tlsServerName, serverName, host)
+				return nil, fmt.Errorf("both forward ('%s') and proxy level ('%s') TLS servernames are set for upstream proxy '%s'", f.tlsServerName, serverName, host)
 			}
 
 			tlsServerNames[i] = serverName
 			perServerNameProxyCount[serverName]++
 		}
+		if f.socksAddr != "" && trans == transport.DNS && !f.opts.ForceTCP {
+			return nil, fmt.Errorf("socks5 can't be used for upstream '%s' over UDP, use force_tcp or tls://", host)
+		}
+		if f.socksAddr != "" && trans == transport.QUIC {
+			return nil, fmt.Errorf("socks5 can't be used for the DNS-over-QUIC upstream '%s'", host)
+		}
 		p := proxy.NewProxy("forward", h, trans)
-		f.proxies = append(f.proxies, p)
+		if addrs := candidates[h]; len(addrs) > 0 {
+			p.SetCandidates(addrs)
+		}
+		proxies = append(proxies, p)
 		transports[i] = trans
 	}
 
 	perServerNameTlsConfig := make(map[string]*tls.Config)
-	if f.tlsServerName != "" {
-		f.tlsConfig.ServerName = f.tlsServerName
-	} else {
+	if f.tlsServerName == "" {
 		for serverName, proxyCount := range perServerNameProxyCount {
 			tlsConfig := f.tlsConfig.Clone()
 			tlsConfig.ServerName = serverName
@@ -210,31 +290,101 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		}
 	}
 
-	// Initialize ClientSessionCache in tls.Config. This may speed up a TLS handshake
-	// in upcoming connections to the same TLS server.
-	f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(f.proxies))
-
-	for i := range f.proxies {
-		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			if tlsConfig, ok := perServerNameTlsConfig[tlsServerNames[i]]; ok {
-				f.proxies[i].SetTLSConfig(tlsConfig)
+	for i := range proxies {
+		// Only set this for proxies that need it. DoH upstreams share the TLS config of the block, the
+		// HTTP client takes the server name from the URL unless tls_servername is set.
+		switch transports[i] {
+		case transport.HTTPS:
+			proxies[i].SetTLSConfig(f.tlsConfig)
+			if err := proxies[i].SetPins(f.tlsPins); err != nil {
+				return nil, err
+			}
+		case transport.TLS, transport.QUIC:
+			if tlsConfig, ok, err := f.tlsConfigFor(proxies[i].Addr(), tlsServerNames[i]); err != nil {
+				return nil, err
+			} else if ok {
+				proxies[i].SetTLSConfig(tlsConfig)
+			} else if tlsConfig, ok := perServerNameTlsConfig[tlsServerNames[i]]; ok {
+				proxies[i].SetTLSConfig(tlsConfig)
 			} else {
-				f.proxies[i].SetTLSConfig(f.tlsConfig)
+				proxies[i].SetTLSConfig(f.tlsConfig)
+			}
+			if err := proxies[i].SetPins(f.tlsPins); err != nil {
+				return nil, err
 			}
 		}
-		f.proxies[i].SetExpire(f.expire)
-		f.proxies[i].SetMaxAge(f.maxAge)
-		f.proxies[i].SetMaxIdleConns(f.maxIdleConns)
-		f.proxies[i].GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
-		// when TLS is used, checks are set to tcp-tls
+		if _, ok := f.upstreamTLS[proxies[i].Addr()]; ok && transports[i] != transport.TLS {
+			return nil, fmt.Errorf("tls_upstream: '%s' is not a tls:// upstream", f.upstreamTLS[proxies[i].Addr()].to)
+		}
+		if e, ok := f.origins[normalizeAddr(toHosts[i])]; ok && e.weight > 0 {
+			proxies[i].SetWeight(e.weight)
+		}
+		proxies[i].SetExpire(f.expire)
+		proxies[i].SetProtoExpire("udp", f.expireUDP)
+		proxies[i].SetProtoExpire("tcp", f.expireTCP)
+		proxies[i].SetProtoExpire("tcp-tls", f.expireTCP)
+		proxies[i].SetMaxAge(f.maxAge)
+		proxies[i].SetMaxIdleConns(f.maxIdleConns)
+		proxies[i].SetMaxUses(f.maxQueries)
+		proxies[i].SetNoCache(f.noCache)
+		proxies[i].SetPipelining(f.pipelining)
+		proxies[i].SetPipelineDepth(f.pipelineDepth)
+		if f.affinity {
+			proxies[i].SetAffinity(proxy.FNVAffinity)
+		}
+		proxies[i].SetLocalAddr(f.sourceAddr4, f.sourceAddr6)
+		proxies[i].SetLocalPort(f.sourcePort)
+		proxies[i].SetBindDevice(f.sourceInterface)
+		if f.socksAddr != "" {
+			proxies[i].SetSOCKS5(f.socksAddr, f.socksUser, f.socksPassword)
+		}
+		proxies[i].SetFastOpen(f.fastOpen)
+		proxies[i].SetEarlyData(f.earlyData)
+		proxies[i].SetProxyProtocol(f.proxyProtocol)
+		if f.tcpKeepAlive != 0 {
+			proxies[i].SetKeepAlivePeriod(f.tcpKeepAlive)
+		}
+		proxies[i].SetMaxInFlight(f.maxInFlight, f.inFlightWait)
+		proxies[i].SetMaxMismatched(f.maxMismatched)
+		proxies[i].SetMaxTransferSize(f.maxTransferRecords, f.maxTransferBytes)
+		proxies[i].SetCircuitBreaker(f.breakerFailures, f.breakerWindow, f.breakerCooldown)
+		if f.maxDialTimeout > 0 {
+			proxies[i].SetDialTimeout(f.minDialTimeout, f.maxDialTimeout)
+		}
+		if f.avgWeight > 0 {
+			proxies[i].SetAverageWeight(f.avgWeight)
+		}
+		proxies[i].SetTimeoutJitter(f.timeoutJitter)
+		proxies[i].SetAdaptiveReadTimeout(f.minReadTimeout, f.maxReadTimeout)
+		if f.writeTimeout > 0 {
+			proxies[i].SetWriteTimeout(f.writeTimeout)
+		}
+		if u, ok := f.upstreamTimeouts[f.upstreamTimeoutKey(proxies[i].Addr())]; ok {
+			u.apply(proxies[i])
+		}
+		if f.opts.PreferTCPLarge {
+			proxies[i].SetTruncationHistory(f.truncationHistory)
+		}
+		proxies[i].GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
+		// when TLS is used, checks are set to tcp-tls, DoQ and DoH checks use their own protocol
 		if f.opts.ForceTCP && transports[i] != transport.TLS {
-			f.proxies[i].GetHealthchecker().SetTCPTransport()
+			proxies[i].GetHealthchecker().SetTCPTransport()
+		}
+		proxies[i].GetHealthchecker().SetDomain(f.opts.HCDomain)
+		if f.opts.HCQType != 0 {
+			proxies[i].GetHealthchecker().SetQType(f.opts.HCQType)
 		}
-		f.proxies[i].GetHealthchecker().SetDomain(f.opts.HCDomain)
+		proxies[i].GetHealthchecker().SetRcodes(f.hcRcodes)
+		proxies[i].GetHealthchecker().SetExpectation(f.hcExpect)
+		if f.hcBackoff > 0 {
+			proxies[i].SetHealthcheckBackoff(f.hcBackoff)
+		}
+		proxies[i].SetDrained(isDrained(proxies[i].Addr()))
+		proxies[i].SetActiveHealthCheck(f.activeHcInterval, f.opts.HCDomain, f.opts.HCQType, f.activeHcFailures)
+		proxies[i].SetHealthObserver(newUpstreamHealth(f.from, proxies[i].Addr(), f.maxfails))
 	}
 
-	return f, nil
+	return proxies, nil
 }
 
 func parseBlock(c *caddy.Controller, f *Forward) error {
@@ -248,6 +398,33 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		for i := range ignore {
 			f.ignored = append(f.ignored, plugin.Host(ignore[i]).NormalizeExact()...)
 		}
+	case "only_for", "except_for":
+		dir := c.Val()
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		key, ok := scopeKey(args[0])
+		if !ok {
+			return c.Errf("%s: '%s' is not a single upstream address", dir, args[0])
+		}
+		if f.scopes == nil {
+			f.scopes = make(map[string]*scope)
+		}
+		s, ok := f.scopes[key]
+		if !ok {
+			s = &scope{}
+			f.scopes[key] = s
+		}
+		var names []string
+		for _, name := range args[1:] {
+			names = append(names, plugin.Host(name).NormalizeExact()...)
+		}
+		if dir == "only_for" {
+			s.only = append(s.only, names...)
+		} else {
+			s.except = append(s.except, names...)
+		}
 	case "max_fails":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -266,6 +443,35 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return err
 		}
 		f.maxConnectAttempts = uint32(n)
+	case "max_mismatched":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_mismatched can't be negative: %d", n)
+		}
+		f.maxMismatched = n
+	case "max_transfer_size":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		var sizes [2]int
+		for i, a := range args {
+			n, err := strconv.Atoi(a)
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("max_transfer_size can't be negative: %d", n)
+			}
+			sizes[i] = n
+		}
+		f.maxTransferRecords, f.maxTransferBytes = sizes[0], sizes[1]
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -280,6 +486,11 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		f.hcInterval = dur
 		f.opts.HCDomain = "."
 
+		var (
+			expect         *proxy.HealthExpectation
+			answer         bool
+			expectInterval time.Duration
+		)
 		for c.NextArg() {
 			switch hcOpts := c.Val(); hcOpts {
 			case "no_rec":
@@ -293,11 +504,112 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 					return fmt.Errorf("health_check: invalid domain name %s", hcDomain)
 				}
 				f.opts.HCDomain = plugin.Name(hcDomain).Normalize()
+			case "type":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				qtype, ok := dns.StringToType[strings.ToUpper(c.Val())]
+				if !ok {
+					return fmt.Errorf("health_check: invalid type %s", c.Val())
+				}
+				f.opts.HCQType = qtype
+			case "rcodes":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				f.hcRcodes = nil
+				for rc := range strings.SplitSeq(c.Val(), ",") {
+					rcode, ok := dns.StringToRcode[strings.ToUpper(rc)]
+					if !ok {
+						return fmt.Errorf("health_check: invalid rcode %s", rc)
+					}
+					f.hcRcodes = append(f.hcRcodes, rcode)
+				}
+			case "backoff":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				limit, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return err
+				}
+				if limit < dur {
+					return fmt.Errorf("health_check: backoff %s is shorter than the interval %s", limit, dur)
+				}
+				f.hcBackoff = limit
+			case "expect":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				rcode, ok := dns.StringToRcode[strings.ToUpper(c.Val())]
+				if !ok {
+					return fmt.Errorf("health_check: invalid rcode %s", c.Val())
+				}
+				if expect == nil {
+					expect = &proxy.HealthExpectation{Interval: defaultExpectInterval}
+				}
+				expect.Rcode = rcode
+			case "answer":
+				answer = true
+			case "expect_interval":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return err
+				}
+				if interval < dur {
+					return fmt.Errorf("health_check: expect_interval %s is shorter than the interval %s", interval, dur)
+				}
+				expectInterval = interval
 			default:
 				return fmt.Errorf("health_check: unknown option %s", hcOpts)
 			}
 		}
 
+		if expect == nil {
+			if answer || expectInterval > 0 {
+				return fmt.Errorf("health_check: answer and expect_interval need expect")
+			}
+			f.hcExpect = nil
+			break
+		}
+		// The domain and type name the query of the stricter check, the cheap probe, and the probes of
+		// active_health_check, ask for the root NS instead. This is documented with expect in the README.
+		expect.Name, expect.QType, expect.Answer = f.opts.HCDomain, f.opts.HCQType, answer
+		if expect.QType == 0 {
+			expect.QType = dns.TypeNS
+		}
+		if expectInterval > 0 {
+			expect.Interval = expectInterval
+		}
+		f.hcExpect = expect
+		f.opts.HCDomain, f.opts.HCQType = ".", 0
+
+	case "active_health_check":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("active_health_check must be positive: %s", dur)
+		}
+		f.activeHcInterval = dur
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("active_health_check failures must be positive: %d", n)
+			}
+			f.activeHcFailures = n
+		}
 	case "force_tcp":
 		if c.NextArg() {
 			return c.ArgErr()
@@ -308,6 +620,58 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return c.ArgErr()
 		}
 		f.opts.PreferUDP = true
+	case "prefer_tcp_large":
+		f.opts.PreferTCPLarge = true
+		f.truncationHistory = proxy.DefaultTruncationHistory
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("prefer_tcp_large history can't be negative: %d", n)
+			}
+			f.truncationHistory = n
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "tcp_fallback":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.RetryTCPOnTruncated = true
+	case "cookies":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.EnableCookies = true
+	case "edns_tcp_keepalive":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.TCPKeepalive = true
+	case "ecs":
+		e, err := parseECS(c)
+		if err != nil {
+			return err
+		}
+		f.ecs = e
+	case "set_do":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.SetDO = true
+	case "strip_dnssec":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.stripDNSSEC = true
+	case "no_question_check":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.NoQuestionCheck = true
 	case "tls":
 		args := c.RemainingArgs()
 		if len(args) > 3 {
@@ -324,11 +688,21 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return err
 		}
 		f.tlsConfig = tlsConfig
+		f.tlsArgs = args
+	case "tls_upstream":
+		if err := parseUpstreamTLS(c, f, config.Root); err != nil {
+			return err
+		}
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		f.tlsServerName = c.Val()
+	case "tls_pin":
+		f.tlsPins = c.RemainingArgs()
+		if len(f.tlsPins) == 0 {
+			return c.ArgErr()
+		}
 	case "expire":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -341,6 +715,23 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return fmt.Errorf("expire can't be negative: %s", dur)
 		}
 		f.expire = dur
+	case "expire_udp", "expire_tcp":
+		dir := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("%s must be positive: %s", dir, dur)
+		}
+		if dir == "expire_udp" {
+			f.expireUDP = dur
+		} else {
+			f.expireTCP = dur
+		}
 	case "max_age":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -365,6 +756,241 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return fmt.Errorf("max_idle_conns can't be negative: %d", n)
 		}
 		f.maxIdleConns = n
+	case "max_queries":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_queries can't be negative: %d", n)
+		}
+		f.maxQueries = n
+	case "affinity":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.affinity = true
+	case "no_cache":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.noCache = true
+	case "pipeline":
+		f.pipelining = true
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return fmt.Errorf("pipeline depth must be a positive integer: %q", c.Val())
+			}
+			f.pipelineDepth = n
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "padding":
+		f.opts.Padding = defaultPadding
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return err
+			}
+			if n <= 0 || n > 512 {
+				return fmt.Errorf("padding block size must be between 1 and 512: %d", n)
+			}
+			f.opts.Padding = n
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "dial_timeout":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		minDur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		maxDur, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		if minDur <= 0 || maxDur < minDur {
+			return fmt.Errorf("dial_timeout needs 0 < MIN <= MAX: %s %s", minDur, maxDur)
+		}
+		f.minDialTimeout = minDur
+		f.maxDialTimeout = maxDur
+	case "timeout_weight":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseInt(c.Val(), 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("timeout_weight must be at least 1: %d", n)
+		}
+		f.avgWeight = n
+	case "timeout_jitter":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		x, err := strconv.ParseFloat(c.Val(), 64)
+		if err != nil {
+			return err
+		}
+		if x < 0 || x >= 1 {
+			return fmt.Errorf("timeout_jitter must be at least 0 and less than 1: %s", c.Val())
+		}
+		f.timeoutJitter = x
+	case "adaptive_read_timeout":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		minDur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		maxDur, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		if minDur <= 0 || maxDur < minDur {
+			return fmt.Errorf("adaptive_read_timeout needs 0 < MIN <= MAX: %s %s", minDur, maxDur)
+		}
+		f.minReadTimeout = minDur
+		f.maxReadTimeout = maxDur
+	case "upstream_timeout":
+		if err := parseUpstreamTimeout(c, f); err != nil {
+			return err
+		}
+	case "write_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("write_timeout must be positive: %s", d)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.writeTimeout = d
+	case "circuit_breaker":
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("circuit_breaker failures must be positive: %d", n)
+		}
+		window, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		cooldown, err := time.ParseDuration(args[2])
+		if err != nil {
+			return err
+		}
+		if window <= 0 || cooldown <= 0 {
+			return fmt.Errorf("circuit_breaker needs a positive WINDOW and COOLDOWN: %s %s", window, cooldown)
+		}
+		f.breakerFailures = n
+		f.breakerWindow = window
+		f.breakerCooldown = cooldown
+	case "source_address":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			ip := net.ParseIP(arg)
+			switch {
+			case ip == nil:
+				return fmt.Errorf("source_address must be an IP address: %q", arg)
+			case ip.To4() != nil:
+				if f.sourceAddr4 != nil {
+					return fmt.Errorf("source_address has more than one IPv4 address: %q", arg)
+				}
+				f.sourceAddr4 = ip
+			default:
+				if f.sourceAddr6 != nil {
+					return fmt.Errorf("source_address has more than one IPv6 address: %q", arg)
+				}
+				f.sourceAddr6 = ip
+			}
+		}
+	case "source_port":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("source_port must be a port number: %q", c.Val())
+		}
+		f.sourcePort = n
+	case "source_interface":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("source_interface is only supported on Linux")
+		}
+		f.sourceInterface = c.Val()
+	case "socks5":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 3 {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(args[0]); err != nil {
+			return fmt.Errorf("socks5 needs an address with a port: %q", args[0])
+		}
+		f.socksAddr = args[0]
+		if len(args) == 3 {
+			f.socksUser, f.socksPassword = args[1], args[2]
+		}
+	case "tcp_keepalive":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("tcp_keepalive can't be negative: %s", dur)
+		}
+		f.tcpKeepAlive = dur
+		if dur == 0 {
+			f.tcpKeepAlive = -1
+		}
+	case "proxy_protocol":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.proxyProtocol = true
+	case "tcp_fast_open":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.fastOpen = true
+	case "early_data":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.earlyData = true
 	case "policy":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -376,9 +1002,26 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			f.p = &roundRobin{}
 		case "sequential":
 			f.p = &sequential{}
+		case "latency":
+			f.p = &latency{from: f.from}
+		case "weighted":
+			f.p = &weighted{}
+		case "client_hash":
+			f.p = &clientHash{}
 		default:
 			return c.Errf("unknown policy '%s'", x)
 		}
+	case "admin":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+			return fmt.Errorf("admin: %s", err)
+		}
+		f.adminAddr = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
 	case "max_concurrent":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -392,6 +1035,80 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		}
 		f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum " + c.Val())
 		f.maxConcurrent = int64(n)
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("max_concurrent per upstream can't be negative: %d", n)
+			}
+			f.maxConcurrentUpstream = int64(n)
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		}
+	case "fanout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("fanout must be at least 1: %d", n)
+		}
+		f.opts.Fanout = n
+	case "hedge":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("hedge delay must be positive: %s", dur)
+		}
+		n := int64(defaultHedgeMax)
+		if len(args) == 2 {
+			n, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return fmt.Errorf("hedge max must be at least 1: %d", n)
+			}
+		}
+		f.hedgeDelay = dur
+		f.hedgeLimit = proxy.NewHedgeLimit(n)
+	case "max_inflight":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_inflight can't be negative: %d", n)
+		}
+		f.maxInFlight = n
+		if len(args) == 2 && args[1] == "block" {
+			f.inFlightWait = -1
+		} else if len(args) == 2 {
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return err
+			}
+			if dur < 0 {
+				return fmt.Errorf("max_inflight wait can't be negative: %s", dur)
+			}
+			f.inFlightWait = dur
+		}
 	case "next":
 		args := c.RemainingArgs()
 		if len(args) == 0 {
@@ -422,7 +1139,8 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 	case "failover":
 		args := c.RemainingArgs()
 		if len(args) == 0 {
-			return c.ArgErr()
+			f.opts.FailoverOnRcode = proxy.DefaultFailoverRcodes
+			return nil
 		}
 		toRcode := dns.StringToRcode
 
@@ -435,8 +1153,25 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 				return fmt.Errorf("NoError cannot be used in failover")
 			}
 
-			f.failoverRcodes = append(f.failoverRcodes, rc)
+			f.opts.FailoverOnRcode |= proxy.NewRcodeSet(rc)
+		}
+	case "reresolve":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("reresolve must be positive: %s", dur)
+		}
+		f.reresolve = dur
+	case "happy_eyeballs":
+		if c.NextArg() {
+			return c.ArgErr()
 		}
+		f.happyEyeballs = true
 	case "resolver":
 		args := c.RemainingArgs()
 		if len(args) == 0 {
@@ -18,8 +18,15 @@ func TestSetupPolicy(t *testing.T) {
 		{"forward . 127.0.0.1 {\npolicy random\n}\n", false, "random", ""},
 		{"forward . 127.0.0.1 {\npolicy round_robin\n}\n", false, "round_robin", ""},
 		{"forward . 127.0.0.1 {\npolicy sequential\n}\n", false, "sequential", ""},
+		{"forward . 127.0.0.1 {\npolicy latency\n}\n", false, "latency", ""},
+		{"forward . 127.0.0.1 {\npolicy weighted\n}\n", false, "weighted", ""},
+		{"forward . 127.0.0.1 {\npolicy client_hash\n}\n", false, "client_hash", ""},
+		{"forward . 127.0.0.1*3 127.0.0.2 {\npolicy weighted\n}\n", false, "weighted", ""},
 		// negative
 		{"forward . 127.0.0.1 {\npolicy random2\n}\n", true, "random", "unknown policy"},
+		{"forward . 127.0.0.1*3 127.0.0.2\n", true, "random", "only be used with policy weighted"},
+		{"forward . 127.0.0.1*0 {\npolicy weighted\n}\n", true, "weighted", "invalid weight"},
+		{"forward . 127.0.0.1*x {\npolicy weighted\n}\n", true, "weighted", "invalid weight"},
 	}
 
 	for i, test := range tests {
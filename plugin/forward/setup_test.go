@@ -2,9 +2,12 @@ package forward
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -36,6 +39,11 @@ func TestSetup(t *testing.T) {
 		{"forward . 127.0.0.1 {\nforce_tcp\n}\n", false, ".", nil, 2, proxy.Options{ForceTCP: true, HCRecursionDesired: true, HCDomain: "."}, ""},
 		{"forward . 127.0.0.1 {\nprefer_udp\n}\n", false, ".", nil, 2, proxy.Options{PreferUDP: true, HCRecursionDesired: true, HCDomain: "."}, ""},
 		{"forward . 127.0.0.1 {\nforce_tcp\nprefer_udp\n}\n", false, ".", nil, 2, proxy.Options{PreferUDP: true, ForceTCP: true, HCRecursionDesired: true, HCDomain: "."}, ""},
+		{"forward . 127.0.0.1 {\ntcp_fallback\n}\n", false, ".", nil, 2, proxy.Options{RetryTCPOnTruncated: true, HCRecursionDesired: true, HCDomain: "."}, ""},
+		{"forward . 127.0.0.1 {\ncookies\n}\n", false, ".", nil, 2, proxy.Options{EnableCookies: true, HCRecursionDesired: true, HCDomain: "."}, ""},
+		{"forward . 127.0.0.1 {\nedns_tcp_keepalive\n}\n", false, ".", nil, 2, proxy.Options{TCPKeepalive: true, HCRecursionDesired: true, HCDomain: "."}, ""},
+		{"forward . 127.0.0.1 {\nno_question_check\n}\n", false, ".", nil, 2, proxy.Options{NoQuestionCheck: true, HCRecursionDesired: true, HCDomain: "."}, ""},
+		{"forward . 127.0.0.1 {\nno_question_check yes\n}\n", true, "", nil, 0, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "Wrong argument count"},
 		{"forward . 127.0.0.1:53", false, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, ""},
 		{"forward . 127.0.0.1:8080", false, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, ""},
 		{"forward . [::1]:53", false, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, ""},
@@ -49,7 +57,7 @@ func TestSetup(t *testing.T) {
 		{"forward . a27.0.0.1", true, "", nil, 0, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "failed to resolve"},
 		{"forward . 127.0.0.1 {\nblaatl\n}\n", true, "", nil, 0, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "unknown property"},
 		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain\n}\n", true, "", nil, 0, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "Wrong argument count or unexpected line ending after 'domain'"},
-		{"forward . https://127.0.0.1 \n", true, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "'https' is not supported as a destination protocol in forward: https://127.0.0.1"},
+		{"forward . grpc://127.0.0.1 \n", true, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "'grpc' is not supported as a destination protocol in forward: grpc://127.0.0.1:443"},
 		{"forward xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx 127.0.0.1 \n", true, ".", nil, 2, proxy.Options{HCRecursionDesired: true, HCDomain: "."}, "unable to normalize 'xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx'"},
 	}
 
@@ -297,13 +305,18 @@ func TestSetupMaxConcurrent(t *testing.T) {
 		input       string
 		shouldErr   bool
 		expectedVal int64
+		expectedPer int64
 		expectedErr string
 	}{
 		// positive
-		{"forward . 127.0.0.1 {\nmax_concurrent 1000\n}\n", false, 1000, ""},
+		{"forward . 127.0.0.1 {\nmax_concurrent 1000\n}\n", false, 1000, 1000, ""},
+		{"forward . 127.0.0.1 127.0.0.2 127.0.0.3 {\nmax_concurrent 1000\n}\n", false, 1000, 334, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nmax_concurrent 1000 100\n}\n", false, 1000, 100, ""},
 		// negative
-		{"forward . 127.0.0.1 {\nmax_concurrent many\n}\n", true, 0, "invalid"},
-		{"forward . 127.0.0.1 {\nmax_concurrent -4\n}\n", true, 0, "negative"},
+		{"forward . 127.0.0.1 {\nmax_concurrent many\n}\n", true, 0, 0, "invalid"},
+		{"forward . 127.0.0.1 {\nmax_concurrent -4\n}\n", true, 0, 0, "negative"},
+		{"forward . 127.0.0.1 {\nmax_concurrent 1000 -1\n}\n", true, 0, 0, "negative"},
+		{"forward . 127.0.0.1 {\nmax_concurrent 1000 100 7\n}\n", true, 0, 0, "Wrong argument count"},
 	}
 
 	for i, test := range tests {
@@ -331,6 +344,9 @@ func TestSetupMaxConcurrent(t *testing.T) {
 		if f.maxConcurrent != test.expectedVal {
 			t.Errorf("Test %d: expected: %d, got: %d", i, test.expectedVal, f.maxConcurrent)
 		}
+		if x := f.upstreamConcurrent(); x != test.expectedPer {
+			t.Errorf("Test %d: expected %d per upstream, got: %d", i, test.expectedPer, x)
+		}
 	}
 }
 
@@ -417,6 +433,476 @@ func TestSetupMaxIdleConns(t *testing.T) {
 	}
 }
 
+func TestSetupOptions(t *testing.T) {
+	dir, err := test.WritePEMFiles(t)
+	if err != nil {
+		t.Fatalf("Could not write PEM files: %s", err)
+	}
+	cert, key, ca := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	pin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	var (
+		padding          = func(f *Forward) int { return f.opts.Padding }
+		readTimeout      = func(f *Forward) [2]time.Duration { return [2]time.Duration{f.minReadTimeout, f.maxReadTimeout} }
+		dialTimeout      = func(f *Forward) [2]time.Duration { return [2]time.Duration{f.minDialTimeout, f.maxDialTimeout} }
+		timeoutWeight    = func(f *Forward) int64 { return f.avgWeight }
+		timeoutJitter    = func(f *Forward) float64 { return f.timeoutJitter }
+		activeHcInterval = func(f *Forward) time.Duration { return f.activeHcInterval }
+		activeHcFailures = func(f *Forward) int { return f.activeHcFailures }
+		proxyProtocol    = func(f *Forward) bool { return f.proxyProtocol }
+		maxInFlight      = func(f *Forward) int { return f.maxInFlight }
+		inFlightWait     = func(f *Forward) time.Duration { return f.inFlightWait }
+		breaker          = func(f *Forward) [3]any { return [3]any{f.breakerFailures, f.breakerWindow, f.breakerCooldown} }
+		tcpKeepAlive     = func(f *Forward) time.Duration { return f.tcpKeepAlive }
+		fastOpen         = func(f *Forward) bool { return f.fastOpen }
+		earlyData        = func(f *Forward) bool { return f.earlyData }
+		addr             = func(f *Forward) string { return f.proxies[0].Addr() }
+		serverName       = func(f *Forward) string { return f.proxies[0].GetTransport().GetTLSConfig().ServerName }
+		sourceAddr4      = func(f *Forward) string { return f.sourceAddr4.String() }
+		sourceAddr6      = func(f *Forward) string { return f.sourceAddr6.String() }
+		sourcePort       = func(f *Forward) int { return f.sourcePort }
+		hcQType          = func(f *Forward) uint16 { return f.proxies[0].GetHealthchecker().GetQType() }
+		hcBackoff        = func(f *Forward) time.Duration { return f.hcBackoff }
+		expireUDP        = func(f *Forward) time.Duration { return f.expireUDP }
+		expireTCP        = func(f *Forward) time.Duration { return f.expireTCP }
+		maxMismatched    = func(f *Forward) int { return f.maxMismatched }
+		maxTransfer      = func(f *Forward) [2]int { return [2]int{f.maxTransferRecords, f.maxTransferBytes} }
+		maxQueries       = func(f *Forward) int { return f.maxQueries }
+		noCache          = func(f *Forward) bool { return f.noCache }
+		pipelining       = func(f *Forward) bool { return f.pipelining }
+		pipelineDepth    = func(f *Forward) int { return f.pipelineDepth }
+		socks5           = func(f *Forward) [3]string { return [3]string{f.socksAddr, f.socksUser, f.socksPassword} }
+		affinity         = func(f *Forward) bool { return f.affinity }
+		fanout           = func(f *Forward) int { return f.opts.Fanout }
+		hedgeDelay       = func(f *Forward) time.Duration { return f.hedgeDelay }
+		hedgeMax         = func(f *Forward) int64 {
+			if f.hedgeLimit == nil {
+				return 0
+			}
+			return f.hedgeLimit.Max()
+		}
+		preferTCPLarge    = func(f *Forward) bool { return f.opts.PreferTCPLarge }
+		truncationHistory = func(f *Forward) int { return f.truncationHistory }
+		writeTimeout      = func(f *Forward) time.Duration { return f.writeTimeout }
+		tlsPins           = func(f *Forward) int { return len(f.tlsPins) }
+		tlsPinned         = func(f *Forward) bool { return f.proxies[0].GetTransport().GetTLSConfig().VerifyConnection != nil }
+	)
+
+	tests := []struct {
+		input       string
+		expectedErr string // empty when the input is valid
+		check       func(f *Forward) error
+	}{
+		// padding
+		{"forward . tls://127.0.0.1\n", "", want("padding", padding, 0)},
+		{"forward . tls://127.0.0.1 {\npadding\n}\n", "", want("padding", padding, 128)},
+		{"forward . tls://127.0.0.1 {\npadding 468\n}\n", "", want("padding", padding, 468)},
+		{"forward . tls://127.0.0.1 {\npadding 0\n}\n", "between 1 and 512", nil},
+		{"forward . tls://127.0.0.1 {\npadding many\n}\n", "invalid", nil},
+		{"forward . tls://127.0.0.1 {\npadding 128 256\n}\n", "Wrong argument count", nil},
+
+		// adaptive_read_timeout
+		{"forward . 127.0.0.1\n", "", want("adaptive read timeout", readTimeout, [2]time.Duration{})},
+		{"forward . 127.0.0.1 {\nadaptive_read_timeout 100ms 2s\n}\n", "", want("adaptive read timeout", readTimeout, [2]time.Duration{100 * time.Millisecond, 2 * time.Second})},
+		{"forward . 127.0.0.1 {\nadaptive_read_timeout 2s 1s\n}\n", "MIN <= MAX", nil},
+		{"forward . 127.0.0.1 {\nadaptive_read_timeout 0s 1s\n}\n", "0 < MIN", nil},
+		{"forward . 127.0.0.1 {\nadaptive_read_timeout 1s\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nadaptive_read_timeout soon 1s\n}\n", "invalid duration", nil},
+
+		// dial_timeout and timeout_weight
+		{"forward . 127.0.0.1\n", "", all(want("dial timeout", dialTimeout, [2]time.Duration{}), want("timeout weight", timeoutWeight, 0))},
+		{"forward . 127.0.0.1 {\ndial_timeout 5s 2m\n}\n", "", all(want("dial timeout", dialTimeout, [2]time.Duration{5 * time.Second, 2 * time.Minute}), want("timeout weight", timeoutWeight, 0))},
+		{"forward . 127.0.0.1 {\ntimeout_weight 8\n}\n", "", all(want("dial timeout", dialTimeout, [2]time.Duration{}), want("timeout weight", timeoutWeight, 8))},
+		{"forward . 127.0.0.1 {\ndial_timeout 2s 1s\n}\n", "MIN <= MAX", nil},
+		{"forward . 127.0.0.1 {\ndial_timeout 1s\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\ntimeout_weight 0\n}\n", "at least 1", nil},
+		{"forward . 127.0.0.1 {\ntimeout_weight\n}\n", "Wrong argument count", nil},
+
+		// timeout_jitter
+		{"forward . 127.0.0.1\n", "", want("timeout jitter", timeoutJitter, 0)},
+		{"forward . 127.0.0.1 {\ntimeout_jitter 0.1\n}\n", "", want("timeout jitter", timeoutJitter, 0.1)},
+		{"forward . 127.0.0.1 {\ntimeout_jitter 1\n}\n", "less than 1", nil},
+		{"forward . 127.0.0.1 {\ntimeout_jitter -0.1\n}\n", "at least 0", nil},
+		{"forward . 127.0.0.1 {\ntimeout_jitter 10%\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\ntimeout_jitter\n}\n", "Wrong argument count", nil},
+
+		// write_timeout
+		{"forward . 127.0.0.1\n", "", want("write timeout", writeTimeout, 0)},
+		{"forward . 127.0.0.1 {\nwrite_timeout 500ms\n}\n", "", want("write timeout", writeTimeout, 500*time.Millisecond)},
+		{"forward . 127.0.0.1 {\nwrite_timeout 0s\n}\n", "must be positive", nil},
+		{"forward . 127.0.0.1 {\nwrite_timeout soon\n}\n", "invalid duration", nil},
+		{"forward . 127.0.0.1 {\nwrite_timeout\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nwrite_timeout 1s 2s\n}\n", "Wrong argument count", nil},
+
+		// upstream_timeout
+		{"forward . 127.0.0.1\n", "", upstreamTimeouts(map[string]upstreamTimeout{})},
+		{"forward . 127.0.0.1 10.0.0.1 {\nupstream_timeout 127.0.0.1 read 50ms dial 100ms\nupstream_timeout 10.0.0.1:53 read 1s\n}\n", "",
+			upstreamTimeouts(map[string]upstreamTimeout{
+				"127.0.0.1:53": {to: "127.0.0.1", read: 50 * time.Millisecond, dial: 100 * time.Millisecond},
+				"10.0.0.1:53":  {to: "10.0.0.1:53", read: time.Second},
+			})},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 read 50ms\nupstream_timeout 127.0.0.1 dial 2s\n}\n", "",
+			upstreamTimeouts(map[string]upstreamTimeout{"127.0.0.1:53": {to: "127.0.0.1", read: 50 * time.Millisecond, dial: 2 * time.Second}})},
+		{"forward . 127.0.0.1 10.0.0.1 {\nadaptive_read_timeout 10ms 1s\ndial_timeout 10ms 5s\nupstream_timeout 127.0.0.1 read 50ms dial 100ms\n}\n", "",
+			upstreamTimeouts(map[string]upstreamTimeout{"127.0.0.1:53": {to: "127.0.0.1", read: 50 * time.Millisecond, dial: 100 * time.Millisecond}})},
+		{"forward . 127.0.0.1 {\ndial_timeout 200ms 5s\nupstream_timeout 127.0.0.1 dial 100ms\n}\n", "",
+			upstreamTimeouts(map[string]upstreamTimeout{"127.0.0.1:53": {to: "127.0.0.1", dial: 100 * time.Millisecond}})},
+		{"forward . 127.0.0.1 {\nupstream_timeout 10.0.0.1 read 1s\n}\n", "'10.0.0.1' is not one of the upstreams", nil},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 write 1s\n}\n", "unknown property 'write'", nil},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 read 0s\n}\n", "read must be positive", nil},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 read soon\n}\n", "invalid duration", nil},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 read\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nupstream_timeout 127.0.0.1 read 1s dial\n}\n", "Wrong argument count", nil},
+
+		// active_health_check
+		{"forward . 127.0.0.1\n", "", all(want("active health check interval", activeHcInterval, 0), want("active health check failures", activeHcFailures, 0))},
+		{"forward . 127.0.0.1 {\nactive_health_check 5s\n}\n", "", all(want("active health check interval", activeHcInterval, 5*time.Second), want("active health check failures", activeHcFailures, 0))},
+		{"forward . 127.0.0.1 {\nactive_health_check 5s 2\n}\n", "", all(want("active health check interval", activeHcInterval, 5*time.Second), want("active health check failures", activeHcFailures, 2))},
+		{"forward . 127.0.0.1 {\nactive_health_check 0s\n}\n", "must be positive", nil},
+		{"forward . 127.0.0.1 {\nactive_health_check 5s 0\n}\n", "must be positive", nil},
+		{"forward . 127.0.0.1 {\nactive_health_check\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nactive_health_check 5s 2 3\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nactive_health_check often\n}\n", "invalid duration", nil},
+
+		// health_check type and rcodes
+		{"forward . 127.0.0.1\n", "", all(want("health check type", hcQType, dns.TypeNS), hcRcodes(nil))},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s type soa\n}\n", "", all(want("health check type", hcQType, dns.TypeSOA), hcRcodes(nil))},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s rcodes NOERROR,servfail\n}\n", "",
+			all(want("health check type", hcQType, dns.TypeNS), hcRcodes([]int{dns.RcodeSuccess, dns.RcodeServerFailure}))},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain example.org type A rcodes NXDOMAIN no_rec\n}\n", "",
+			all(want("health check type", hcQType, dns.TypeA), hcRcodes([]int{dns.RcodeNameError}))},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s type FOO\n}\n", "health_check: invalid type FOO", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s type\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s rcodes NOERROR,BAR\n}\n", "health_check: invalid rcode BAR", nil},
+
+		// health_check expect
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain example.com type A\n}\n", "", hcExpectation(nil)},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain example.com type A expect NOERROR\n}\n", "",
+			hcExpectation(&proxy.HealthExpectation{Name: "example.com.", QType: dns.TypeA, Rcode: dns.RcodeSuccess, Interval: defaultExpectInterval})},
+		{"forward . 127.0.0.1 {\nhealth_check 1s expect nxdomain answer expect_interval 1m\n}\n", "",
+			hcExpectation(&proxy.HealthExpectation{Name: ".", QType: dns.TypeNS, Rcode: dns.RcodeNameError, Answer: true, Interval: time.Minute})},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s expect FOO\n}\n", "invalid rcode FOO", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s answer\n}\n", "need expect", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 1s expect NOERROR expect_interval 0.5s\n}\n", "shorter than the interval", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s expect\n}\n", "Wrong argument count", nil},
+
+		// health_check backoff
+		{"forward . 127.0.0.1\n", "", want("health check backoff", hcBackoff, 0)},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s backoff 30s\n}\n", "", want("health check backoff", hcBackoff, 30*time.Second)},
+		{"forward . 127.0.0.1 {\nhealth_check 1s no_rec backoff 1m type A\n}\n", "", want("health check backoff", hcBackoff, time.Minute)},
+		{"forward . 127.0.0.1 {\nhealth_check 1s backoff 100ms\n}\n", "shorter than the interval", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 1s backoff\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nhealth_check 1s backoff often\n}\n", "invalid duration", nil},
+
+		// proxy_protocol
+		{"forward . 127.0.0.1\n", "", want("proxy_protocol", proxyProtocol, false)},
+		{"forward . 127.0.0.1 {\nproxy_protocol\n}\n", "", want("proxy_protocol", proxyProtocol, true)},
+		{"forward . tls://127.0.0.1 {\nproxy_protocol\nforce_tcp\n}\n", "", want("proxy_protocol", proxyProtocol, true)},
+		{"forward . 127.0.0.1 {\nproxy_protocol\nprefer_udp\n}\n", "can't be combined with prefer_udp", nil},
+		{"forward . 127.0.0.1 {\nproxy_protocol v2\n}\n", "Wrong argument count", nil},
+
+		// max_inflight
+		{"forward . 127.0.0.1\n", "", all(want("max_inflight", maxInFlight, 0), want("max_inflight wait", inFlightWait, 0))},
+		{"forward . 127.0.0.1 {\nmax_inflight 100\n}\n", "", all(want("max_inflight", maxInFlight, 100), want("max_inflight wait", inFlightWait, 0))},
+		{"forward . 127.0.0.1 {\nmax_inflight 100 50ms\n}\n", "", all(want("max_inflight", maxInFlight, 100), want("max_inflight wait", inFlightWait, 50*time.Millisecond))},
+		{"forward . 127.0.0.1 {\nmax_inflight 100 block\n}\n", "", all(want("max_inflight", maxInFlight, 100), want("max_inflight wait", inFlightWait, -1))},
+		{"forward . 127.0.0.1 {\nmax_inflight -1\n}\n", "can't be negative", nil},
+		{"forward . 127.0.0.1 {\nmax_inflight 100 -1s\n}\n", "can't be negative", nil},
+		{"forward . 127.0.0.1 {\nmax_inflight\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nmax_inflight 100 1s 2s\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nmax_inflight many\n}\n", "invalid syntax", nil},
+
+		// circuit_breaker
+		{"forward . 127.0.0.1\n", "", want("circuit breaker", breaker, [3]any{0, time.Duration(0), time.Duration(0)})},
+		{"forward . 127.0.0.1 {\ncircuit_breaker 5 10s 30s\n}\n", "", want("circuit breaker", breaker, [3]any{5, 10 * time.Second, 30 * time.Second})},
+		{"forward . 127.0.0.1 {\ncircuit_breaker 0 10s 30s\n}\n", "must be positive", nil},
+		{"forward . 127.0.0.1 {\ncircuit_breaker 5 0s 30s\n}\n", "positive WINDOW and COOLDOWN", nil},
+		{"forward . 127.0.0.1 {\ncircuit_breaker 5 10s\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\ncircuit_breaker five 10s 30s\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\ncircuit_breaker 5 10s soon\n}\n", "invalid duration", nil},
+
+		// tcp_keepalive
+		{"forward . 127.0.0.1\n", "", want("tcp_keepalive", tcpKeepAlive, 0)},
+		{"forward . 127.0.0.1 {\ntcp_keepalive 30s\n}\n", "", want("tcp_keepalive", tcpKeepAlive, 30*time.Second)},
+		{"forward . 127.0.0.1 {\ntcp_keepalive 0s\n}\n", "", want("tcp_keepalive", tcpKeepAlive, -1)},
+		{"forward . 127.0.0.1 {\ntcp_keepalive -1s\n}\n", "can't be negative", nil},
+		{"forward . 127.0.0.1 {\ntcp_keepalive\n}\n", "Wrong argument count", nil},
+
+		// tcp_fast_open
+		{"forward . 127.0.0.1\n", "", want("tcp_fast_open", fastOpen, false)},
+		{"forward . 127.0.0.1 {\ntcp_fast_open\n}\n", "", want("tcp_fast_open", fastOpen, true)},
+		{"forward . 127.0.0.1 {\ntcp_fast_open yes\n}\n", "Wrong argument count", nil},
+
+		// quic:// and early_data
+		{"forward . quic://127.0.0.1\n", "", all(want("address", addr, "127.0.0.1:853"), want("server name", serverName, ""), want("early_data", earlyData, false))},
+		{"forward . quic://127.0.0.1:8853 {\ntls_servername dns.example.org\n}\n", "", all(want("address", addr, "127.0.0.1:8853"), want("server name", serverName, "dns.example.org"))},
+		{"forward . quic://127.0.0.1%dns.example.org\n", "", all(want("address", addr, "127.0.0.1:853"), want("server name", serverName, "dns.example.org"))},
+		{"forward . quic://127.0.0.1 {\nearly_data\n}\n", "", want("early_data", earlyData, true)},
+		{"forward . quic://127.0.0.1 {\nearly_data yes\n}\n", "Wrong argument count", nil},
+		{"forward . quic://127.0.0.1 {\nsocks5 127.0.0.1:1080\n}\n", "socks5 can't be used for the DNS-over-QUIC upstream", nil},
+
+		// source_address
+		{"forward . 127.0.0.1\n", "", all(want("IPv4 source", sourceAddr4, "<nil>"), want("IPv6 source", sourceAddr6, "<nil>"))},
+		{"forward . 127.0.0.1 {\nsource_address 10.0.0.1\n}\n", "", all(want("IPv4 source", sourceAddr4, "10.0.0.1"), want("IPv6 source", sourceAddr6, "<nil>"))},
+		{"forward . 127.0.0.1 {\nsource_address 2001:db8::1 10.0.0.1\n}\n", "", all(want("IPv4 source", sourceAddr4, "10.0.0.1"), want("IPv6 source", sourceAddr6, "2001:db8::1"))},
+		{"forward . 127.0.0.1 {\nsource_address 10.0.0.1 10.0.0.2\n}\n", "more than one IPv4", nil},
+		{"forward . 127.0.0.1 {\nsource_address 2001:db8::1 2001:db8::2\n}\n", "more than one IPv6", nil},
+		{"forward . 127.0.0.1 {\nsource_address example.org\n}\n", "must be an IP address", nil},
+		{"forward . 127.0.0.1 {\nsource_address\n}\n", "Wrong argument count", nil},
+
+		// source_port
+		{"forward . 127.0.0.1\n", "", want("source port", sourcePort, 0)},
+		{"forward . 127.0.0.1 {\nsource_port 5353\n}\n", "", want("source port", sourcePort, 5353)},
+		{"forward . 127.0.0.1 {\nsource_port 0\n}\n", "must be a port number", nil},
+		{"forward . 127.0.0.1 {\nsource_port 65536\n}\n", "must be a port number", nil},
+		{"forward . 127.0.0.1 {\nsource_port\n}\n", "Wrong argument count", nil},
+
+		// expire_udp and expire_tcp
+		{"forward . 127.0.0.1\n", "", all(want("expire_udp", expireUDP, 0), want("expire_tcp", expireTCP, 0))},
+		{"forward . 127.0.0.1 {\nexpire_udp 5m\nexpire_tcp 5s\n}\n", "", all(want("expire_udp", expireUDP, 5*time.Minute), want("expire_tcp", expireTCP, 5*time.Second))},
+		{"forward . 127.0.0.1 {\nexpire_udp 1m\n}\n", "", all(want("expire_udp", expireUDP, time.Minute), want("expire_tcp", expireTCP, 0))},
+		{"forward . 127.0.0.1 {\nexpire_tcp 0s\n}\n", "positive", nil},
+		{"forward . 127.0.0.1 {\nexpire_udp\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nexpire_tcp invalid\n}\n", "invalid", nil},
+		{"forward . 127.0.0.1 {\nexpire_tcp 30s\nmax_age 20s\n}\n", "expire_tcp", nil},
+
+		// max_mismatched
+		{"forward . 127.0.0.1\n", "", want("max_mismatched", maxMismatched, proxy.DefaultMaxMismatched)},
+		{"forward . 127.0.0.1 {\nmax_mismatched 10\n}\n", "", want("max_mismatched", maxMismatched, 10)},
+		{"forward . 127.0.0.1 {\nmax_mismatched 0\n}\n", "", want("max_mismatched", maxMismatched, 0)},
+		{"forward . 127.0.0.1 {\nmax_mismatched -1\n}\n", "negative", nil},
+		{"forward . 127.0.0.1 {\nmax_mismatched many\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nmax_mismatched\n}\n", "Wrong argument count", nil},
+
+		// max_transfer_size
+		{"forward . 127.0.0.1\n", "", want("max transfer size", maxTransfer, [2]int{0, 0})},
+		{"forward . 127.0.0.1 {\nmax_transfer_size 100000\n}\n", "", want("max transfer size", maxTransfer, [2]int{100000, 0})},
+		{"forward . 127.0.0.1 {\nmax_transfer_size 0 10000000\n}\n", "", want("max transfer size", maxTransfer, [2]int{0, 10000000})},
+		{"forward . 127.0.0.1 {\nmax_transfer_size 100000 10000000\n}\n", "", want("max transfer size", maxTransfer, [2]int{100000, 10000000})},
+		{"forward . 127.0.0.1 {\nmax_transfer_size -1\n}\n", "negative", nil},
+		{"forward . 127.0.0.1 {\nmax_transfer_size 10 many\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nmax_transfer_size\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nmax_transfer_size 1 2 3\n}\n", "Wrong argument count", nil},
+
+		// max_queries
+		{"forward . 127.0.0.1\n", "", want("max_queries", maxQueries, 0)},
+		{"forward . 127.0.0.1 {\nmax_queries 100\n}\n", "", want("max_queries", maxQueries, 100)},
+		{"forward . 127.0.0.1 {\nmax_queries -1\n}\n", "negative", nil},
+		{"forward . 127.0.0.1 {\nmax_queries many\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nmax_queries\n}\n", "Wrong argument count", nil},
+
+		// no_cache
+		{"forward . 127.0.0.1\n", "", want("no_cache", noCache, false)},
+		{"forward . 127.0.0.1 {\nno_cache\n}\n", "", want("no_cache", noCache, true)},
+		{"forward . 127.0.0.1 {\nno_cache yes\n}\n", "Wrong argument count", nil},
+
+		// pipeline
+		{"forward . 127.0.0.1\n", "", all(want("pipelining", pipelining, false), want("pipeline depth", pipelineDepth, 0))},
+		{"forward . 127.0.0.1 {\npipeline\n}\n", "", all(want("pipelining", pipelining, true), want("pipeline depth", pipelineDepth, 0))},
+		{"forward . 127.0.0.1 {\npipeline 16\n}\n", "", all(want("pipelining", pipelining, true), want("pipeline depth", pipelineDepth, 16))},
+		{"forward . 127.0.0.1 {\npipeline 0\n}\n", "must be a positive integer", nil},
+		{"forward . 127.0.0.1 {\npipeline 16 32\n}\n", "Wrong argument count", nil},
+
+		// socks5
+		{"forward . 127.0.0.1 {\nforce_tcp\nsocks5 127.0.0.1:1080\n}\n", "", want("socks5", socks5, [3]string{"127.0.0.1:1080", "", ""})},
+		{"forward . tls://127.0.0.1 {\nsocks5 [::1]:1080 user pass\n}\n", "", want("socks5", socks5, [3]string{"[::1]:1080", "user", "pass"})},
+		{"forward . unix:///var/run/resolver.sock {\nsocks5 127.0.0.1:1080\n}\n", "", want("socks5", socks5, [3]string{"127.0.0.1:1080", "", ""})},
+		{"forward . 127.0.0.1 {\nsocks5 127.0.0.1:1080\n}\n", "force_tcp or tls://", nil},
+		{"forward . 127.0.0.1 {\nforce_tcp\nsocks5 127.0.0.1\n}\n", "with a port", nil},
+		{"forward . 127.0.0.1 {\nforce_tcp\nsocks5 127.0.0.1:1080 user\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nforce_tcp\nsocks5\n}\n", "Wrong argument count", nil},
+
+		// affinity
+		{"forward . 127.0.0.1\n", "", want("affinity", affinity, false)},
+		{"forward . 127.0.0.1 {\naffinity\n}\n", "", want("affinity", affinity, true)},
+		{"forward . 127.0.0.1 {\naffinity ip\n}\n", "Wrong argument count", nil},
+
+		// fanout
+		{"forward . 127.0.0.1\n", "", want("fanout", fanout, 0)},
+		{"forward . 127.0.0.1 127.0.0.2 {\nfanout 2\n}\n", "", want("fanout", fanout, 2)},
+		{"forward . 127.0.0.1 {\nfanout 0\n}\n", "at least 1", nil},
+		{"forward . 127.0.0.1 {\nfanout all\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nfanout\n}\n", "Wrong argument count", nil},
+
+		// hedge
+		{"forward . 127.0.0.1\n", "", all(want("hedge delay", hedgeDelay, 0), want("hedged queries in flight", hedgeMax, 0))},
+		{"forward . 127.0.0.1 127.0.0.2 {\nhedge 25ms\n}\n", "", all(want("hedge delay", hedgeDelay, 25*time.Millisecond), want("hedged queries in flight", hedgeMax, defaultHedgeMax))},
+		{"forward . 127.0.0.1 127.0.0.2 {\nhedge 25ms 10\n}\n", "", all(want("hedge delay", hedgeDelay, 25*time.Millisecond), want("hedged queries in flight", hedgeMax, 10))},
+		{"forward . 127.0.0.1 {\nhedge 0s\n}\n", "positive", nil},
+		{"forward . 127.0.0.1 {\nhedge soon\n}\n", "invalid duration", nil},
+		{"forward . 127.0.0.1 {\nhedge\n}\n", "Wrong argument count", nil},
+		{"forward . 127.0.0.1 {\nhedge 25ms\nfanout 2\n}\n", "fanout", nil},
+		{"forward . 127.0.0.1 {\nhedge 25ms 0\n}\n", "at least 1", nil},
+		{"forward . 127.0.0.1 {\nhedge 25ms many\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nhedge 25ms 10 20\n}\n", "Wrong argument count", nil},
+
+		// prefer_tcp_large
+		{"forward . 127.0.0.1\n", "", all(want("prefer_tcp_large", preferTCPLarge, false), want("truncation history", truncationHistory, 0))},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large\n}\n", "", all(want("prefer_tcp_large", preferTCPLarge, true), want("truncation history", truncationHistory, proxy.DefaultTruncationHistory))},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large 50\n}\n", "", all(want("prefer_tcp_large", preferTCPLarge, true), want("truncation history", truncationHistory, 50))},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large 0\n}\n", "", all(want("prefer_tcp_large", preferTCPLarge, true), want("truncation history", truncationHistory, 0))},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large -1\n}\n", "negative", nil},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large many\n}\n", "invalid syntax", nil},
+		{"forward . 127.0.0.1 {\nprefer_tcp_large 1 2\n}\n", "Wrong argument count", nil},
+
+		// tls_upstream
+		{"forward . tls://1.1.1.1 tls://9.9.9.9 {\ntls_upstream tls://1.1.1.1 servername cloudflare-dns.com\ntls_upstream 9.9.9.9:853 servername dns.quad9.net min_version 1.3\n}\n", "",
+			tlsConfigs(tlsConfig{"cloudflare-dns.com", 0, false, false}, tlsConfig{"dns.quad9.net", tls.VersionTLS13, false, false})},
+		// The other upstreams keep the TLS config of the block.
+		{"forward . tls://1.1.1.1 tls://9.9.9.9 {\ntls_servername dns\ntls_upstream tls://1.1.1.1 ca " + ca + "\n}\n", "",
+			tlsConfigs(tlsConfig{"dns", tls.VersionTLS12, false, true}, tlsConfig{"dns", 0, false, false})},
+		// Lines for the same upstream add up, files not set for it are taken from the block.
+		{"forward . tls://1.1.1.1 tls://9.9.9.9 {\ntls " + ca + "\ntls_upstream tls://1.1.1.1 cert " + cert + " " + key + "\ntls_upstream tls://1.1.1.1 servername one\n}\n", "",
+			tlsConfigs(tlsConfig{"one", tls.VersionTLS12, true, true}, tlsConfig{"", tls.VersionTLS12, false, true})},
+		{"forward . tls://1.1.1.1%one tls://9.9.9.9 {\ntls_upstream tls://1.1.1.1 min_version 1.2\n}\n", "",
+			tlsConfigs(tlsConfig{"one", tls.VersionTLS12, false, false}, tlsConfig{"", 0, false, false})},
+		{"forward . tls://1.1.1.1%one {\ntls_upstream tls://1.1.1.1 servername two\n}\n", "tls_upstream 'tls://1.1.1.1': both", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://9.9.9.9 servername two\n}\n", "tls_upstream: 'tls://9.9.9.9' is not one of the upstreams", nil},
+		{"forward . 1.1.1.1 {\ntls_upstream 1.1.1.1 servername two\n}\n", "tls_upstream: '1.1.1.1' is not a tls:// upstream", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://1.1.1.1 ca /does/not/exist.pem\n}\n", "tls_upstream 'tls://1.1.1.1'", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://1.1.1.1 min_version 1.1\n}\n", "unsupported min_version", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://1.1.1.1 sni two\n}\n", "unknown property 'sni'", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://1.1.1.1 cert " + cert + "\n}\n", "Wrong argument count", nil},
+		{"forward . tls://1.1.1.1 {\ntls_upstream tls://1.1.1.1\n}\n", "Wrong argument count", nil},
+
+		// tls_pin
+		{"forward . tls://127.0.0.1 {\ntls_servername dns\n}\n", "", all(want("pins", tlsPins, 0), want("pin check in the TLS config", tlsPinned, false))},
+		{"forward . tls://127.0.0.1 {\ntls_servername dns\ntls_pin " + pin + "\n}\n", "", all(want("pins", tlsPins, 1), want("pin check in the TLS config", tlsPinned, true))},
+		{"forward . tls://127.0.0.1 {\ntls_pin " + pin + " " + pin + "\n}\n", "", all(want("pins", tlsPins, 2), want("pin check in the TLS config", tlsPinned, true))},
+		{"forward . tls://127.0.0.1 {\ntls_pin deadbeef\n}\n", "invalid SPKI pin", nil},
+		{"forward . tls://127.0.0.1 {\ntls_pin\n}\n", "Wrong argument count", nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.expectedErr != "" {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if err := test.check(fs[0]); err != nil {
+			t.Errorf("Test %d: %s, input: %s", i, err, test.input)
+		}
+	}
+}
+
+// want returns a check that the value got takes from the Forward is expected.
+func want[T comparable](name string, got func(f *Forward) T, expected T) func(f *Forward) error {
+	return func(f *Forward) error {
+		if x := got(f); x != expected {
+			return fmt.Errorf("expected %s %v, got %v", name, expected, x)
+		}
+		return nil
+	}
+}
+
+// all returns a check that runs checks in order and stops at the first that fails.
+func all(checks ...func(f *Forward) error) func(f *Forward) error {
+	return func(f *Forward) error {
+		for _, check := range checks {
+			if err := check(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func hcRcodes(expected []int) func(f *Forward) error {
+	return func(f *Forward) error {
+		if x := f.proxies[0].GetHealthchecker().GetRcodes(); !slices.Equal(x, expected) {
+			return fmt.Errorf("expected health check rcodes %v, got %v", expected, x)
+		}
+		return nil
+	}
+}
+
+func hcExpectation(expected *proxy.HealthExpectation) func(f *Forward) error {
+	return func(f *Forward) error {
+		hc := f.proxies[0].GetHealthchecker()
+		e := hc.GetExpectation()
+		if (e == nil) != (expected == nil) || (e != nil && *e != *expected) {
+			return fmt.Errorf("expected expectation %+v, got %+v", expected, e)
+		}
+		// With an expectation the cheap probe asks for the root NS.
+		if e != nil && (hc.GetDomain() != "." || hc.GetQType() != dns.TypeNS) {
+			return fmt.Errorf("expected the health check to ask for . NS, got %s %d", hc.GetDomain(), hc.GetQType())
+		}
+		return nil
+	}
+}
+
+type tlsConfig struct {
+	serverName string
+	minVersion uint16
+	clientCert bool
+	ca         bool
+}
+
+func tlsConfigs(expected ...tlsConfig) func(f *Forward) error {
+	return func(f *Forward) error {
+		for j, p := range f.proxies {
+			cfg := p.GetTransport().GetTLSConfig()
+			got := tlsConfig{cfg.ServerName, cfg.MinVersion, len(cfg.Certificates) > 0, cfg.RootCAs != nil}
+			if got != expected[j] {
+				return fmt.Errorf("expected TLS config %+v for %s, got %+v", expected[j], p.Addr(), got)
+			}
+		}
+		return nil
+	}
+}
+
+// upstreamTimeouts checks the parsed upstream_timeout lines, and that the proxies get the overrides while the
+// others follow the block.
+func upstreamTimeouts(expected map[string]upstreamTimeout) func(f *Forward) error {
+	return func(f *Forward) error {
+		if len(f.upstreamTimeouts) != len(expected) {
+			return fmt.Errorf("expected %d upstream timeouts, got %d", len(expected), len(f.upstreamTimeouts))
+		}
+		for key, e := range expected {
+			if u, ok := f.upstreamTimeouts[key]; !ok || *u != e {
+				return fmt.Errorf("expected upstream timeout %+v for %s, got %+v", e, key, u)
+			}
+		}
+
+		for _, p := range f.proxies {
+			minRead, maxRead := p.AdaptiveReadTimeout()
+			minDial, maxDial := p.DialTimeout()
+			u, ok := expected[p.Addr()]
+			if !ok {
+				if f.maxReadTimeout > 0 && (minRead != f.minReadTimeout || maxRead != f.maxReadTimeout) {
+					return fmt.Errorf("expected adaptive read timeout %s %s for %s, got %s %s", f.minReadTimeout, f.maxReadTimeout, p.Addr(), minRead, maxRead)
+				}
+				if f.maxDialTimeout > 0 && (minDial != f.minDialTimeout || maxDial != f.maxDialTimeout) {
+					return fmt.Errorf("expected dial timeout %s %s for %s, got %s %s", f.minDialTimeout, f.maxDialTimeout, p.Addr(), minDial, maxDial)
+				}
+				continue
+			}
+			if u.read > 0 {
+				if x := p.ReadTimeout(); x != u.read {
+					return fmt.Errorf("expected read timeout %s for %s, got %s", u.read, p.Addr(), x)
+				}
+				if maxRead != 0 {
+					return fmt.Errorf("expected no adaptive read timeout for %s, got %s %s", p.Addr(), minRead, maxRead)
+				}
+			}
+			if u.dial > 0 && (maxDial != u.dial || minDial > u.dial) {
+				return fmt.Errorf("expected dial timeout up to %s for %s, got %s %s", u.dial, p.Addr(), minDial, maxDial)
+			}
+		}
+		return nil
+	}
+}
+
 func TestSetupHealthCheck(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -672,6 +1158,68 @@ func TestFailover(t *testing.T) {
 	}
 }
 
+func TestFailoverBestReply(t *testing.T) {
+	servfail := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(ret)
+	})
+	defer servfail.Close()
+
+	refused := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(ret)
+	})
+	defer refused.Close()
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		// Every upstream fails over, the refusal is better than the server failure.
+		{fmt.Sprintf("forward . %s %s {\npolicy sequential\nfailover\n}\n", servfail.Addr, refused.Addr), dns.RcodeRefused},
+		// The failover to the second upstream uses up the connect attempts.
+		{fmt.Sprintf("forward . %s %s {\npolicy sequential\nfailover\nmax_connect_attempts 1\n}\n", servfail.Addr, refused.Addr), dns.RcodeServerFailure},
+		// A name error is an answer, it isn't failed over on unless listed.
+		{fmt.Sprintf("forward . %s %s {\npolicy sequential\nfailover SERVFAIL NXDOMAIN\n}\n", servfail.Addr, refused.Addr), dns.RcodeRefused},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		fs, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		f := fs[0]
+		f.OnStartup()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+		start := time.Now()
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: expected a reply, got %s", i, err)
+		}
+		if rec.Msg.Rcode != tc.expected {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.expected], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Test %d: expected the reply once every upstream was tried, took %s", i, d)
+		}
+		f.OnShutdown()
+	}
+
+	fs, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\nfailover\n}\n"))
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if x := fs[0].opts.FailoverOnRcode; x != proxy.NewRcodeSet(dns.RcodeServerFailure, dns.RcodeRefused) || x.Has(dns.RcodeNameError) {
+		t.Errorf("Expected SERVFAIL and REFUSED by default, got %b", x)
+	}
+}
+
 func TestFailoverValidation(t *testing.T) {
 	cases := []struct {
 		name      string
@@ -782,3 +1330,80 @@ func TestSetupMaxAge(t *testing.T) {
 		})
 	}
 }
+
+func TestSetupUnix(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . unix:///var/run/resolver.sock 127.0.0.1\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	f := fs[0]
+	if len(f.proxies) != 2 {
+		t.Fatalf("Expected 2 proxies, got %d", len(f.proxies))
+	}
+	if x := f.proxies[0].Addr(); x != "/var/run/resolver.sock" {
+		t.Errorf("Expected the socket path as address, got %s", x)
+	}
+	if x := f.proxies[1].Addr(); x != "127.0.0.1:53" {
+		t.Errorf("Expected 127.0.0.1:53, got %s", x)
+	}
+}
+
+func TestSetupDoH(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . https://1.1.1.1/dns-query https://1.1.1.1/custom https://dns.example.com:8443 127.0.0.1 tls://127.0.0.2 {\ntls_servername cloudflare-dns.com\n}\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	var addrs []string
+	for _, p := range fs[0].proxies {
+		addrs = append(addrs, p.Addr())
+	}
+	expected := []string{"1.1.1.1:443/dns-query", "1.1.1.1:443/custom", "dns.example.com:8443", "127.0.0.1:53", "127.0.0.2:853"}
+	if !slices.Equal(addrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, addrs)
+	}
+	if x := fs[0].proxies[0].GetTransport().GetTLSConfig().ServerName; x != "cloudflare-dns.com" {
+		t.Errorf("Expected the server name of tls_servername, got %q", x)
+	}
+}
+
+func TestSetupAdmin(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedVal string
+		expectedErr string
+	}{
+		// positive
+		{"forward . 127.0.0.1 {\nadmin localhost:9154\n}\n", false, "localhost:9154", ""},
+		{"forward . 127.0.0.1 {\nadmin :9154\n}\n", false, ":9154", ""},
+		// negative
+		{"forward . 127.0.0.1 {\nadmin\n}\n", true, "", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nadmin localhost\n}\n", true, "", "missing port"},
+		{"forward . 127.0.0.1 {\nadmin localhost:9154 localhost:9155\n}\n", true, "", "Wrong argument count"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		fs, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+
+		if !test.shouldErr && fs[0].adminAddr != test.expectedVal {
+			t.Errorf("Test %d: expected: %s, got: %s", i, test.expectedVal, fs[0].adminAddr)
+		}
+	}
+}
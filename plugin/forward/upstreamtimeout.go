@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+)
+
+// upstreamTimeout overrides the timeouts of a single upstream, see upstream_timeout. What isn't set follows
+// dial_timeout and adaptive_read_timeout of the block. It is keyed by the TO as written, so it applies to all the
+// addresses a hostname resolves to, also after reresolve.
+type upstreamTimeout struct {
+	to   string        // the upstream as written in upstream_timeout
+	read time.Duration // static read timeout, the adaptive read timeout isn't used
+	dial time.Duration // upper bound of the adaptive dial timeout
+}
+
+// parseUpstreamTimeout parses the arguments of upstream_timeout. Several upstream_timeout lines for the same
+// upstream add up.
+func parseUpstreamTimeout(c *caddy.Controller, f *Forward) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	key, ok := scopeKey(args[0])
+	if !ok {
+		return c.Errf("upstream_timeout: '%s' is not a single upstream address", args[0])
+	}
+	if f.upstreamTimeouts == nil {
+		f.upstreamTimeouts = make(map[string]*upstreamTimeout)
+	}
+	u, ok := f.upstreamTimeouts[key]
+	if !ok {
+		u = &upstreamTimeout{to: args[0]}
+		f.upstreamTimeouts[key] = u
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return c.ArgErr()
+		}
+		d, err := time.ParseDuration(args[i+1])
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return c.Errf("upstream_timeout '%s': %s must be positive: %s", u.to, args[i], d)
+		}
+		switch args[i] {
+		case "read":
+			u.read = d
+		case "dial":
+			u.dial = d
+		default:
+			return c.Errf("upstream_timeout '%s': unknown property '%s'", u.to, args[i])
+		}
+	}
+	return nil
+}
+
+// upstreamTimeoutKey returns the key of f.upstreamTimeouts for the upstream address addr: the TO it was written
+// as, or addr itself when it came from a file.
+func (f *Forward) upstreamTimeoutKey(addr string) string {
+	if e, ok := f.origins[addr]; ok && e.file == "" && e.key != "" {
+		return e.key
+	}
+	return addr
+}
+
+// apply sets the timeouts of u on p, over those of the block.
+func (u *upstreamTimeout) apply(p *proxy.Proxy) {
+	if u.read > 0 {
+		p.SetAdaptiveReadTimeout(0, 0)
+		p.SetReadTimeout(u.read)
+	}
+	if u.dial > 0 {
+		p.SetMaxDialTimeout(u.dial)
+	}
+}
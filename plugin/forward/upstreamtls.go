@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+
+	"github.com/coredns/caddy"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+)
+
+// upstreamTLS is the TLS configuration of a single tls:// upstream, see tls_upstream. What isn't set is
+// taken from the tls and tls_servername options of the block.
+type upstreamTLS struct {
+	to         string // the upstream as written in tls_upstream
+	serverName string
+	cert, key  string
+	ca         string
+	minVersion uint16
+
+	config *tls.Config // built by buildUpstreamTLS
+}
+
+// parseUpstreamTLS parses the arguments of tls_upstream, relative file names are taken from root. Several
+// tls_upstream lines for the same upstream add up.
+func parseUpstreamTLS(c *caddy.Controller, f *Forward, root string) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	key, ok := scopeKey(args[0])
+	if !ok {
+		return c.Errf("tls_upstream: '%s' is not a single upstream address", args[0])
+	}
+	if f.upstreamTLS == nil {
+		f.upstreamTLS = make(map[string]*upstreamTLS)
+	}
+	u, ok := f.upstreamTLS[key]
+	if !ok {
+		u = &upstreamTLS{to: args[0]}
+		f.upstreamTLS[key] = u
+	}
+
+	path := func(p string) string {
+		if !filepath.IsAbs(p) && root != "" {
+			return filepath.Join(root, p)
+		}
+		return p
+	}
+	for i := 1; i < len(args); i++ {
+		next := func() (string, error) {
+			if i++; i >= len(args) {
+				return "", c.ArgErr()
+			}
+			return args[i], nil
+		}
+		var err error
+		switch args[i] {
+		case "servername":
+			u.serverName, err = next()
+		case "cert":
+			var cert, key string
+			if cert, err = next(); err == nil {
+				key, err = next()
+			}
+			u.cert, u.key = path(cert), path(key)
+		case "ca":
+			var ca string
+			ca, err = next()
+			u.ca = path(ca)
+		case "min_version":
+			var v string
+			if v, err = next(); err != nil {
+				break
+			}
+			switch v {
+			case "1.2":
+				u.minVersion = tls.VersionTLS12
+			case "1.3":
+				u.minVersion = tls.VersionTLS13
+			default:
+				return c.Errf("tls_upstream '%s': unsupported min_version '%s', expected 1.2 or 1.3", u.to, v)
+			}
+		default:
+			return c.Errf("tls_upstream '%s': unknown property '%s'", u.to, args[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildUpstreamTLS builds the TLS config of each tls_upstream, from the files of the upstream and those
+// of the tls option of the block.
+func (f *Forward) buildUpstreamTLS() error {
+	for _, u := range f.upstreamTLS {
+		var cfg *tls.Config
+		if u.cert == "" && u.ca == "" {
+			cfg = f.tlsConfig.Clone()
+		} else {
+			var cert, key, ca string
+			switch len(f.tlsArgs) {
+			case 1:
+				ca = f.tlsArgs[0]
+			case 2:
+				cert, key = f.tlsArgs[0], f.tlsArgs[1]
+			case 3:
+				cert, key, ca = f.tlsArgs[0], f.tlsArgs[1], f.tlsArgs[2]
+			}
+			if u.cert != "" {
+				cert, key = u.cert, u.key
+			}
+			if u.ca != "" {
+				ca = u.ca
+			}
+
+			var args []string
+			switch {
+			case cert != "" && ca != "":
+				args = []string{cert, key, ca}
+			case cert != "":
+				args = []string{cert, key}
+			default:
+				args = []string{ca}
+			}
+			var err error
+			if cfg, err = pkgtls.NewTLSConfigFromArgs(args...); err != nil {
+				return fmt.Errorf("tls_upstream '%s': %s", u.to, err)
+			}
+			cfg.ServerName = f.tlsServerName
+		}
+		if u.serverName != "" {
+			cfg.ServerName = u.serverName
+		}
+		if u.minVersion != 0 {
+			cfg.MinVersion = u.minVersion
+		}
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		u.config = cfg
+	}
+	return nil
+}
+
+// tlsConfigFor returns the TLS config of the tls:// upstream addr, when it has a tls_upstream. The server
+// name in the address, as in tls://9.9.9.9%dns.quad9.net, is used unless tls_upstream sets one.
+func (f *Forward) tlsConfigFor(addr, serverName string) (*tls.Config, bool, error) {
+	u, ok := f.upstreamTLS[addr]
+	if !ok {
+		return nil, false, nil
+	}
+	if serverName == "" {
+		return u.config, true, nil
+	}
+	if u.serverName != "" {
+		return nil, false, fmt.Errorf("tls_upstream '%s': both the address ('%s') and tls_upstream ('%s') set the TLS servername", u.to, serverName, u.serverName)
+	}
+	cfg := u.config.Clone()
+	cfg.ServerName = serverName
+	return cfg, true, nil
+}
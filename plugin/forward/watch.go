@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+)
+
+// defaultWatchInterval is how often the resolv.conf like files in TO are checked for changes.
+const defaultWatchInterval = 5 * time.Second
+
+// fileStamp is what tells a changed file apart when it is polled.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// statFile returns the stamp of the regular file name.
+func statFile(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return fileStamp{}, fmt.Errorf("not a regular file: %q", name)
+	}
+	return fileStamp{mod: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// Equal returns true when s and o are the stamps of an unchanged file. The times are compared with Equal, ==
+// would also compare their locations and monotonic clock readings.
+func (s fileStamp) Equal(o fileStamp) bool {
+	return s.mod.Equal(o.mod) && s.size == o.size
+}
+
+// hasFiles returns true when one of the TO entries was read from a file.
+func (f *Forward) hasFiles() bool {
+	for _, e := range f.toEntries {
+		if e.file != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadFiles reads the files of the TO entries again when they changed since they were last read, and
+// returns the files that were read. A file that can't be read, or has no nameservers, keeps the addresses
+// read before, it's tried again the next time.
+func (f *Forward) reloadFiles() ([]string, error) {
+	var reloaded []string
+	for i := range f.toEntries {
+		e := &f.toEntries[i]
+		if e.file == "" {
+			continue
+		}
+		stamp, err := statFile(e.file)
+		if err != nil {
+			return reloaded, err
+		}
+		if stamp.Equal(e.stamp) {
+			continue
+		}
+		addrs, err := parse.HostPortOrFile(e.file)
+		if err != nil {
+			return reloaded, err
+		}
+		e.addrs, e.stamp = addrs, stamp
+		fileReloadsCount.WithLabelValues(e.file).Inc()
+		reloaded = append(reloaded, e.file)
+	}
+	return reloaded, nil
+}
+
+// watch reloads the changed files of the TO entries and updates the upstreams when their addresses
+// changed.
+func (f *Forward) watch() {
+	reloaded, err := f.reloadFiles()
+	if err != nil {
+		log.Warningf("Failed to reload upstreams of %s, keeping the current ones: %s", f.from, err)
+	}
+	if len(reloaded) == 0 {
+		return
+	}
+	if err := f.refresh(); err != nil {
+		log.Warningf("Failed to update upstreams of %s from %v, keeping the current ones: %s", f.from, reloaded, err)
+		return
+	}
+	var addrs []string
+	for _, p := range f.upstreams() {
+		addrs = append(addrs, p.Addr())
+	}
+	log.Infof("Reloaded %v, upstreams of %s are: %v", reloaded, f.from, addrs)
+}
@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolv.conf")
+	write := func(content string) {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+	write("nameserver 10.0.0.1\nnameserver 10.0.0.2\n")
+
+	c := caddy.NewTestController("dns", "forward . "+name+" 10.0.0.9\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	if !f.hasFiles() {
+		t.Fatal("Expected the TO file to be watched")
+	}
+	f.watchInterval = 0 // the test calls watch itself
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	kept := f.upstreams()[1]
+	reloads := testutil.ToFloat64(fileReloadsCount.WithLabelValues(name))
+
+	// An unchanged file isn't read again.
+	f.watch()
+	if x := testutil.ToFloat64(fileReloadsCount.WithLabelValues(name)); x != reloads {
+		t.Errorf("Expected no reload to be counted, got %v", x-reloads)
+	}
+
+	write("nameserver 10.0.0.2\nnameserver 10.0.0.3\nnameserver 10.0.0.4\n")
+	f.watch()
+	expected := []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.4:53", "10.0.0.9:53"}
+	if addrs := upstreamAddrs(f); !slices.Equal(addrs, expected) {
+		t.Errorf("Expected upstreams %v, got %v", expected, addrs)
+	}
+	if f.upstreams()[0] != kept {
+		t.Error("Expected the proxy of a nameserver that is still there to be kept")
+	}
+	if x := testutil.ToFloat64(fileReloadsCount.WithLabelValues(name)); x != reloads+1 {
+		t.Errorf("Expected 1 reload to be counted, got %v", x-reloads)
+	}
+
+	// A file without nameservers keeps the current upstreams.
+	write("# no nameservers\n")
+	f.watch()
+	if addrs := upstreamAddrs(f); !slices.Equal(addrs, expected) {
+		t.Errorf("Expected upstreams %v after reading a file without nameservers, got %v", expected, addrs)
+	}
+
+	// As does a removed file.
+	os.Remove(name)
+	f.watch()
+	if addrs := upstreamAddrs(f); !slices.Equal(addrs, expected) {
+		t.Errorf("Expected upstreams %v after the file was removed, got %v", expected, addrs)
+	}
+}
+
+func TestWatchLoop(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(name, []byte("nameserver 10.0.0.1\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %s", name, err)
+	}
+
+	c := caddy.NewTestController("dns", "forward . "+name+"\n")
+	fs, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	f := fs[0]
+	f.watchInterval = 10 * time.Millisecond
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	if err := os.WriteFile(name, []byte("nameserver 10.0.0.22\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %s", name, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if addrs := upstreamAddrs(f); slices.Equal(addrs, []string{"10.0.0.22:53"}) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the upstream to move to 10.0.0.22:53, got %v", upstreamAddrs(f))
+}
+
+func TestFileStampEqual(t *testing.T) {
+	mod := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	stamp := fileStamp{mod: mod, size: 10}
+
+	// The same instant in another location is the same modification time.
+	if !stamp.Equal(fileStamp{mod: mod.In(time.FixedZone("UTC+2", 2*60*60)), size: 10}) {
+		t.Error("Expected the stamps of the same time in another location to be equal")
+	}
+	if stamp.Equal(fileStamp{mod: mod.Add(time.Nanosecond), size: 10}) {
+		t.Error("Expected stamps with another modification time to differ")
+	}
+	if stamp.Equal(fileStamp{mod: mod, size: 11}) {
+		t.Error("Expected stamps with another size to differ")
+	}
+}
@@ -28,7 +28,8 @@ func stripZone(host string) string {
 // HostPortOrFile parses the strings in s, each string can either be a
 // address, [scheme://]address:port or a filename. The address part is checked
 // and in case of filename a resolv.conf like file is (assumed) and parsed and
-// the nameservers found are returned.
+// the nameservers found are returned. An https:// address may end in the URL
+// path, as in https://1.1.1.1/dns-query, which is kept.
 func HostPortOrFile(s ...string) ([]string, error) {
 	var servers []string
 	for _, h := range s {
@@ -42,6 +43,13 @@ func HostPortOrFile(s ...string) ([]string, error) {
 			continue
 		}
 
+		var path string
+		if trans == transport.HTTPS {
+			if i := strings.Index(host, "/"); i >= 0 {
+				host, path = host[:i], host[i:]
+			}
+		}
+
 		addr, _, err := net.SplitHostPort(host)
 
 		if err != nil {
@@ -67,7 +75,7 @@ func HostPortOrFile(s ...string) ([]string, error) {
 			case transport.GRPC:
 				ss = transport.GRPC + "://" + net.JoinHostPort(host, transport.GRPCPort)
 			case transport.HTTPS:
-				ss = transport.HTTPS + "://" + net.JoinHostPort(host, transport.HTTPSPort)
+				ss = transport.HTTPS + "://" + net.JoinHostPort(host, transport.HTTPSPort) + path
 			}
 			servers = append(servers, ss)
 			continue
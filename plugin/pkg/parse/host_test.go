@@ -68,6 +68,21 @@ func TestHostPortOrFile(t *testing.T) {
 			"",
 			true,
 		},
+		{
+			"https://1.1.1.1/dns-query",
+			"https://1.1.1.1:443/dns-query",
+			false,
+		},
+		{
+			"https://[2606:4700::1111]:8443/custom",
+			"https://[2606:4700::1111]:8443/custom",
+			false,
+		},
+		{
+			"https://1.1.1.1",
+			"https://1.1.1.1:443",
+			false,
+		},
 	}
 
 	err := os.WriteFile("resolv.conf", []byte("nameserver 127.0.0.1\n"), 0600)
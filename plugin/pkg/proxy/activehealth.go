@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SetActiveHealthCheck makes the transport probe the upstream every interval with a query for name and qtype,
+// in the background and whether or not queries are sent. After threshold probes in a row got no reply the
+// upstream is marked down, until a probe gets a reply again. An empty name probes ".", a qtype of 0 asks for
+// NS and a threshold below 1 is 3. An interval of 0 disables the probes. It must be called before Start.
+func (t *Transport) SetActiveHealthCheck(interval time.Duration, name string, qtype uint16, threshold int) {
+	if name == "" {
+		name = "."
+	}
+	if qtype == 0 {
+		qtype = dns.TypeNS
+	}
+	if threshold < 1 {
+		threshold = defaultProbeThreshold
+	}
+	t.probeInterval = interval
+	t.probeName = dns.Fqdn(name)
+	t.probeType = qtype
+	t.probeThreshold = int32(threshold) // #nosec G115 -- a threshold of failed probes fits in int32
+}
+
+// Down returns true when the active health check marked the upstream down, see SetActiveHealthCheck.
+func (t *Transport) Down() bool { return atomic.LoadInt32(&t.down) == 1 }
+
+// healthCheck probes the upstream every probeInterval until the transport is stopped.
+func (t *Transport) healthCheck() {
+	ticker := time.NewTicker(t.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.checkUpstream()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// checkUpstream sends a probe and marks the upstream down or up again.
+func (t *Transport) checkUpstream() {
+	if err := t.probe(); err != nil {
+		healthcheckFailureCount.WithLabelValues(t.proxyName, t.addr).Add(1)
+		if atomic.AddInt32(&t.probeFailures, 1) >= t.probeThreshold {
+			t.setDown(true)
+		}
+	} else {
+		atomic.StoreInt32(&t.probeFailures, 0)
+		t.setDown(false)
+	}
+	if t.observer != nil {
+		t.observer.Probed(t.Down())
+	}
+}
+
+func (t *Transport) setDown(down bool) {
+	v, up := int32(0), 1.0
+	if down {
+		v, up = 1, 0
+	}
+	atomic.StoreInt32(&t.down, v)
+	upstreamUpGauge.WithLabelValues(t.proxyName, t.addr).Set(up)
+}
+
+// probeKey marks the context of a probe, which is sent also when the transport is drained.
+type probeKey struct{}
+
+// probe sends the probe query over a new connection, as queries would be sent. Any reply is fine, only
+// failing to get one counts.
+func (t *Transport) probe() error {
+	ping := new(dns.Msg)
+	ping.SetQuestion(t.probeName, t.probeType)
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeKey{}, true), probeTimeout)
+	defer cancel()
+
+	if t.dohURL != "" {
+		_, err := t.exchangeHTTPS(ctx, ping)
+		return err
+	}
+
+	pc, _, err := t.dial(ctx, "udp", true, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer pc.close()
+
+	if pc.qc != nil {
+		_, err := exchangeQUIC(ctx, pc.qc, ping, probeTimeout, probeTimeout)
+		return err
+	}
+
+	pc.c.SetDeadline(time.Now().Add(probeTimeout))
+	if err := pc.c.WriteMsg(ping); err != nil {
+		return err
+	}
+	for {
+		ret, err := pc.c.ReadMsg()
+		if err != nil {
+			// A reply with a header made it through, see dnsHc.send.
+			if ret != nil && (ret.Response || ret.Opcode == dns.OpcodeQuery) && ret.Id == ping.Id {
+				return nil
+			}
+			return err
+		}
+		if ret.Id == ping.Id {
+			return nil
+		}
+	}
+}
+
+const (
+	defaultProbeThreshold = 3
+	probeTimeout          = 1 * time.Second
+)
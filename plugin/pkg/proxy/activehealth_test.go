@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestActiveHealthCheck(t *testing.T) {
+	// Nothing listens on addr at first, so the probes fail right away.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	p := NewProxy("TestActiveHealthCheck", addr, transport.DNS)
+	p.SetActiveHealthCheck(10*time.Millisecond, "example.org", dns.TypeA, 2)
+	p.Start(time.Second)
+	defer p.Stop()
+	defer p.transport.Stop()
+
+	waitFor := func(down bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for p.transport.Down() != down && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if p.transport.Down() != down {
+			t.Fatalf("Expected the upstream to be marked down: %t", down)
+		}
+	}
+
+	waitFor(true)
+	if !p.Down(0) {
+		t.Error("Expected the proxy to be down, also without maxfails")
+	}
+	if x := testutil.ToFloat64(healthcheckFailureCount.WithLabelValues("TestActiveHealthCheck", addr)); x < 2 {
+		t.Errorf("Expected at least 2 failed health checks, got %v", x)
+	}
+	if x := testutil.ToFloat64(upstreamUpGauge.WithLabelValues("TestActiveHealthCheck", addr)); x != 0 {
+		t.Errorf("Expected the upstream to be reported down, got %v", x)
+	}
+
+	var asked atomic.Value
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("Failed to listen on %s again: %s", addr, err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		asked.Store(r.Question[0])
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeRefused) // Any reply means the upstream is up.
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	waitFor(false)
+	if p.Down(0) {
+		t.Error("Expected the proxy to be up")
+	}
+	if x := testutil.ToFloat64(upstreamUpGauge.WithLabelValues("TestActiveHealthCheck", addr)); x != 1 {
+		t.Errorf("Expected the upstream to be reported up, got %v", x)
+	}
+	if q := asked.Load().(dns.Question); q.Name != "example.org." || q.Qtype != dns.TypeA {
+		t.Errorf("Expected the probe to ask for example.org. A, got %s", q.String())
+	}
+}
+
+func TestSetActiveHealthCheckDefaults(t *testing.T) {
+	tr := newTransport("TestSetActiveHealthCheckDefaults", "127.0.0.1:53")
+	tr.SetActiveHealthCheck(time.Second, "", 0, 0)
+	if tr.probeName != "." || tr.probeType != dns.TypeNS || tr.probeThreshold != defaultProbeThreshold {
+		t.Errorf("Expected a probe for . NS with a threshold of %d, got %s %s %d", defaultProbeThreshold,
+			tr.probeName, dns.TypeToString[tr.probeType], tr.probeThreshold)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"hash/fnv"
+	"net"
+
+	"github.com/coredns/coredns/request"
+)
+
+// AffinityHash maps the address of a client to the affinity key its connections are cached under.
+type AffinityHash func(ip net.IP) uint64
+
+// FNVAffinity is an AffinityHash that hashes the client address with 64-bit FNV-1a.
+func FNVAffinity(ip net.IP) uint64 {
+	h := fnv.New64a()
+	h.Write(ip.To16())
+	return h.Sum64()
+}
+
+// SetAffinity makes the transport remember for which client a cached connection was last used, with the
+// affinity key h returns for the client's address. A query prefers a cached connection of its client, so a
+// returning client tends to get the same connection to the upstream, at the cost of sometimes skipping an
+// older connection that is closer to expiring. Pipelined connections are shared by all clients. A nil h,
+// the default, takes the oldest cached connection for every query.
+func (t *Transport) SetAffinity(h AffinityHash) { t.affinity = h }
+
+// affinityKey returns the affinity key of the client of state, 0 when affinity is disabled.
+func (t *Transport) affinityKey(state request.Request) uint64 {
+	if t.affinity == nil {
+		return 0
+	}
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return 0
+	}
+	return t.affinity(ip)
+}
+
+// pick returns the index of the cached connection of transtype to use for a query with the PROXY protocol
+// header and affinity key, or -1 when there is none. Without affinity it is the oldest connection (the
+// front of the slice) for source port diversity. t.mu must be held.
+func (t *Transport) pick(transtype transportType, header []byte, key uint64) int {
+	first := -1
+	for i, pc := range t.conns[transtype] {
+		if !bytes.Equal(pc.header, header) {
+			continue
+		}
+		if t.affinity == nil || pc.affinity == key {
+			return i
+		}
+		if first < 0 {
+			first = i
+		}
+	}
+	return first
+}
+
+// countAffinity counts whether a query got a connection last used for its client.
+func (t *Transport) countAffinity(proto string, hit bool) {
+	if t.affinity == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	affinityCount.WithLabelValues(t.proxyName, t.addr, proto, result).Add(1)
+}
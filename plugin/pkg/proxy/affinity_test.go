@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAffinity(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	keyA := FNVAffinity(net.ParseIP("192.0.2.1"))
+	keyB := FNVAffinity(net.ParseIP("192.0.2.2"))
+	keyC := FNVAffinity(net.ParseIP("2001:db8::1"))
+
+	for _, affinity := range []bool{false, true} {
+		tr := newTransport("TestAffinity", s.Addr)
+		if affinity {
+			tr.SetAffinity(FNVAffinity)
+		}
+		tr.Start()
+
+		ctx := t.Context()
+		a, _, _ := tr.dial(ctx, "tcp", false, nil, keyA)
+		b, _, _ := tr.dial(ctx, "tcp", false, nil, keyB)
+		tr.Yield(a)
+		tr.Yield(b)
+
+		// The connection of A is the oldest in the cache.
+		pc, cached, _ := tr.dial(ctx, "tcp", false, nil, keyB)
+		if !cached {
+			t.Fatalf("Affinity %t: expected a cached connection", affinity)
+		}
+		if affinity && pc != b {
+			t.Errorf("Affinity %t: expected the connection of the client", affinity)
+		}
+		if !affinity && pc != a {
+			t.Errorf("Affinity %t: expected the oldest connection", affinity)
+		}
+		tr.Yield(pc)
+
+		// A client without a connection of its own gets the oldest one, the one that wasn't used last.
+		oldest := a
+		if !affinity {
+			oldest = b
+		}
+		pc, _, _ = tr.dial(ctx, "tcp", false, nil, keyC)
+		if pc != oldest {
+			t.Errorf("Affinity %t: expected the oldest connection for a new client", affinity)
+		}
+		tr.Yield(pc)
+		tr.Stop()
+	}
+
+	if x := testutil.ToFloat64(affinityCount.WithLabelValues("TestAffinity", s.Addr, "tcp", "hit")); x != 1 {
+		t.Errorf("Expected 1 affinity hit, got %v", x)
+	}
+	if x := testutil.ToFloat64(affinityCount.WithLabelValues("TestAffinity", s.Addr, "tcp", "miss")); x != 3 {
+		t.Errorf("Expected 3 affinity misses, got %v", x)
+	}
+
+	// A failed dial gives no connection and isn't counted.
+	tr := newTransport("TestAffinity", "127.0.0.1:1")
+	tr.SetAffinity(FNVAffinity)
+	defer tr.Stop()
+	if _, _, err := tr.dial(t.Context(), "tcp", false, nil, keyA); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	if x := testutil.ToFloat64(affinityCount.WithLabelValues("TestAffinity", "127.0.0.1:1", "tcp", "miss")); x != 0 {
+		t.Errorf("Expected no affinity miss for a failed dial, got %v", x)
+	}
+}
+
+func TestAffinityKey(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{Req: m, W: &test.ResponseWriter{}}
+
+	tr := newTransport("TestAffinityKey", "127.0.0.1:53")
+	if key := tr.affinityKey(state); key != 0 {
+		t.Errorf("Expected no affinity key without affinity, got %d", key)
+	}
+
+	tr.SetAffinity(FNVAffinity)
+	if key, expected := tr.affinityKey(state), FNVAffinity(net.ParseIP(state.IP())); key != expected {
+		t.Errorf("Expected affinity key %d, got %d", expected, key)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+import "net"
+
+// connAlive always returns true, cached connections are only checked on unix systems.
+func connAlive(_ net.Conn) bool { return true }
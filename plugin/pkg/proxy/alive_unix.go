@@ -0,0 +1,37 @@
+//go:build unix
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// connAlive returns false when the upstream closed or reset the idle TCP connection c. The socket is peeked at
+// without blocking, data that is waiting is left in place.
+func connAlive(c net.Conn) bool {
+	sc, ok := netConn(c).(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	alive := true
+	err = rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		// Sockets of the net package are non-blocking, so this returns right away.
+		n, _, err := unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK) // #nosec G115 -- fd is a valid socket descriptor
+		switch {
+		case err == unix.EAGAIN || err == unix.EWOULDBLOCK:
+		case err != nil, n == 0: // reset, or EOF
+			alive = false
+		}
+		return true
+	})
+	return err == nil && alive
+}
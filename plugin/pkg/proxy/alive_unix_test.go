@@ -0,0 +1,106 @@
+//go:build unix
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !connAlive(c) {
+		t.Error("Expected an idle connection to be alive")
+	}
+	s.Write([]byte{0})
+	time.Sleep(10 * time.Millisecond)
+	if !connAlive(c) {
+		t.Error("Expected a connection with pending data to be alive")
+	}
+	buf := make([]byte, 1)
+	if n, _ := c.Read(buf); n != 1 {
+		t.Error("Expected the pending data to be left in place")
+	}
+
+	s.Close()
+	time.Sleep(10 * time.Millisecond)
+	if connAlive(c) {
+		t.Error("Expected a connection closed by the peer not to be alive")
+	}
+}
+
+func TestDialSkipsClosedConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Each connection gets one reply, then the server closes it.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := &dns.Conn{Conn: c}
+			if m, err := conn.ReadMsg(); err == nil {
+				ret := new(dns.Msg)
+				ret.SetReply(m)
+				conn.WriteMsg(ret)
+			}
+			conn.Close()
+		}
+	}()
+
+	p := NewProxy("TestDialSkipsClosedConn", l.Addr().String(), transport.DNS)
+	p.readTimeout = 5 * time.Second
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	for i := range 2 {
+		begin := time.Now()
+		if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != nil {
+			t.Fatalf("Query %d: expected no error, got %s", i, err)
+		}
+		if d := time.Since(begin); d > time.Second {
+			t.Errorf("Query %d: expected no read timeout on a closed connection, took %s", i, d)
+		}
+		time.Sleep(20 * time.Millisecond) // let the FIN arrive
+	}
+
+	if x := testutil.ToFloat64(connDeadCount.WithLabelValues("TestDialSkipsClosedConn", l.Addr().String(), "tcp")); x != 1 {
+		t.Errorf("Expected 1 closed connection to be skipped, got %v", x)
+	}
+	if x := testutil.ToFloat64(connRetriesCount.WithLabelValues("TestDialSkipsClosedConn", l.Addr().String())); x != 0 {
+		t.Errorf("Expected no retries after a failed write, got %v", x)
+	}
+}
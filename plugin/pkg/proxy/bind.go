@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// SetLocalAddr sets the source addresses used when dialing the upstream over udp, tcp and tcp-tls.
+// The address matching the family of the upstream is used, either may be nil.
+func (t *Transport) SetLocalAddr(v4, v6 net.IP) {
+	t.localAddr4 = v4
+	t.localAddr6 = v6
+}
+
+// SetLocalPort sets the source port used when dialing the upstream over udp, tcp and tcp-tls, together with
+// the source address of SetLocalAddr when one is set. This serializes the upstream to one socket per protocol:
+// only one socket can use the port at a time, and a query that needs a new connection while it is in use, such
+// as a concurrent query while the UDP socket waits for its reply, fails with ErrLocalAddr instead of waiting.
+func (t *Transport) SetLocalPort(port int) { t.localPort = port }
+
+// localAddrError wraps err, an error dialing the upstream, with ErrLocalAddr when the source address or port
+// is in use or can't be assigned.
+func (t *Transport) localAddrError(err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("%w: %w", ErrLocalAddr, err)
+	}
+	return err
+}
+
+// SetBindDevice binds the sockets dialing the upstream over udp, tcp and tcp-tls to the network
+// interface or VRF dev. This is only supported on Linux.
+func (t *Transport) SetBindDevice(dev string) { t.bindDevice = dev }
+
+// SetFastOpen makes dials over tcp and tcp-tls use TCP Fast Open (RFC 7413), so the first query or the
+// TLS ClientHello is carried in the SYN once the upstream handed out a cookie. Where the platform or
+// kernel doesn't support it a regular handshake is done.
+func (t *Transport) SetFastOpen(b bool) { t.fastOpen = b }
+
+// happyEyeballsDelay is how long a dual stack dial waits for the first address family before racing the other.
+const happyEyeballsDelay = 50 * time.Millisecond
+
+// SetDualStackDial makes dials over tcp and tcp-tls to an upstream given as a hostname race its IPv4 and IPv6
+// addresses (RFC 8305), the second family is tried happyEyeballsDelay after the first. The connection that
+// is established first is used, the other attempt is cancelled.
+func (t *Transport) SetDualStackDial(b bool) { t.dualStackDial = b }
+
+// countDialFamily records the address family of the connection that won a dual stack dial. Only tcp and tcp-tls
+// dials race the families, UDP uses the address of the last connection and isn't counted.
+func (t *Transport) countDialFamily(proto string, conn net.Conn) {
+	if proto != "tcp" && proto != "tcp-tls" {
+		return
+	}
+	network := "tcp4"
+	if addr, ok := conn.RemoteAddr().(interface{ AddrPort() netip.AddrPort }); ok && addr.AddrPort().Addr().Unmap().Is6() {
+		network = network[:3] + "6"
+	}
+	dualStackDialCount.WithLabelValues(t.proxyName, t.addr, network).Add(1)
+}
+
+// control returns the net.Dialer Control function setting the socket options for a new connection over network.
+func (t *Transport) control(network string) func(network, address string, c syscall.RawConn) error {
+	return func(nw, address string, c syscall.RawConn) error {
+		if t.bindDevice != "" {
+			if err := bindToDevice(t.bindDevice)(nw, address, c); err != nil {
+				return err
+			}
+		}
+		if t.fastOpen && network == "tcp" {
+			setFastOpen(c)
+		}
+		if t.localPort != 0 && network == "tcp" {
+			setReuseAddr(c)
+		}
+		return nil
+	}
+}
+
+// dialer returns the net.Dialer for a new connection to addr over network.
+func (t *Transport) dialer(network, addr string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if t.dualStackDial {
+		d.FallbackDelay = happyEyeballsDelay
+	}
+	if t.bindDevice != "" || (t.fastOpen && network == "tcp") || (t.localPort != 0 && network == "tcp") {
+		d.Control = t.control(network)
+	}
+
+	// The source address is only known for an upstream given as an IP address, the source port is
+	// used either way.
+	var local net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			local = t.localAddr6
+			if ip.To4() != nil {
+				local = t.localAddr4
+			}
+		}
+	}
+	if local == nil && t.localPort == 0 {
+		return d
+	}
+
+	if network == "udp" {
+		d.LocalAddr = &net.UDPAddr{IP: local, Port: t.localPort}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: local, Port: t.localPort}
+	}
+	return d
+}
+
+// defaultKeepAlive is the period of the TCP keepalive probes, the same as the default of net.Dialer.
+const defaultKeepAlive = 15 * time.Second
+
+// SetKeepAlivePeriod sets the interval of the TCP keepalive probes on connections dialed over tcp and tcp-tls,
+// so the kernel notices a dead upstream before the connection is taken from the cache. The default is 15s,
+// a negative period disables keepalive probes.
+func (t *Transport) SetKeepAlivePeriod(d time.Duration) { t.keepAlive = d }
+
+// setTCPOptions enables TCP keepalive and TCP_NODELAY on conn when it is a TCP connection, the queries and
+// replies are small and shouldn't wait for more data to be written. A TLS connection is unwrapped to get to it.
+func (t *Transport) setTCPOptions(conn net.Conn) {
+	tcp, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcp.SetNoDelay(true)
+	if t.keepAlive < 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAlive(true)
+	period := t.keepAlive
+	if period == 0 {
+		period = defaultKeepAlive
+	}
+	tcp.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice returns a net.Dialer Control function that sets SO_BINDTODEVICE on the socket.
+func bindToDevice(dev string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), dev) // #nosec G115 -- fd is a valid socket descriptor
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// sockopt returns the integer socket option level/opt of conn.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		t.Fatalf("Expected a syscall.Conn, got %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var gerr error
+	raw.Control(func(fd uintptr) { v, gerr = unix.GetsockoptInt(int(fd), level, opt) })
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	return v
+}
+
+func TestTCPOptions(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestTCPOptions", s.Addr)
+	tr.SetKeepAlivePeriod(42 * time.Second)
+	defer tr.Stop()
+
+	pc, _, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer pc.close()
+
+	if x := sockopt(t, pc.c.Conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE); x == 0 {
+		t.Error("Expected TCP keepalive to be enabled")
+	}
+	if x := sockopt(t, pc.c.Conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); x != 42 {
+		t.Errorf("Expected keepalive period of 42s, got %ds", x)
+	}
+	if x := sockopt(t, pc.c.Conn, unix.IPPROTO_TCP, unix.TCP_NODELAY); x == 0 {
+		t.Error("Expected TCP_NODELAY to be set")
+	}
+}
+
+func TestTCPOptionsTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tr := newTransport("TestTCPOptionsTLS", l.Addr().String())
+	tr.SetKeepAlivePeriod(-1)
+	defer tr.Stop()
+
+	// The TLS connection is unwrapped to set the options on the TCP connection underneath.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tr.setTCPOptions(tls.Client(c, &tls.Config{}))
+
+	if x := sockopt(t, c, unix.SOL_SOCKET, unix.SO_KEEPALIVE); x != 0 {
+		t.Error("Expected TCP keepalive to be disabled")
+	}
+	if x := sockopt(t, c, unix.IPPROTO_TCP, unix.TCP_NODELAY); x == 0 {
+		t.Error("Expected TCP_NODELAY to be set")
+	}
+}
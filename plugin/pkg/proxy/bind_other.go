@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice returns a net.Dialer Control function that fails, binding to a device needs SO_BINDTODEVICE.
+func bindToDevice(_ string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, _ syscall.RawConn) error {
+		return errors.New("proxy: binding to a device is only supported on Linux")
+	}
+}
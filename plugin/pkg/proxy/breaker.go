@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a circuit breaker, its value is reported by the circuit_breaker_state gauge.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // queries are sent to the upstream
+	breakerOpen                         // queries fail fast with ErrCircuitOpen
+	breakerHalfOpen                     // a single query probes the upstream
+)
+
+// breaker is a circuit breaker for an upstream. After threshold consecutive failures within window it opens
+// and queries fail immediately. Once cooldown has passed a single query is let through, if that succeeds the
+// breaker closes again, otherwise it stays open for another cooldown.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures
+	first    time.Time // time of the first of the consecutive failures
+	opened   time.Time // time the breaker was last opened
+	probing  bool      // a half-open probe is outstanding
+
+	proxyName string
+	addr      string
+}
+
+func newBreaker(proxyName, addr string, threshold int, window, cooldown time.Duration) *breaker {
+	b := &breaker{threshold: threshold, window: window, cooldown: cooldown, proxyName: proxyName, addr: addr}
+	b.report()
+	return b
+}
+
+// allow returns true if a query may be sent to the upstream. A nil breaker always allows it.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record records the outcome of a query to the upstream, err is the error returned for it.
+func (b *breaker) record(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		b.success()
+	case ctxErr(ctx) != nil:
+		b.abort()
+	default:
+		b.failure()
+	}
+}
+
+// success records a query that got a reply, this closes the breaker.
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.setState(breakerClosed)
+}
+
+// failure records a query that failed to dial or to read a reply.
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		b.opened = now
+		b.setState(breakerOpen)
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.first) > b.window {
+		b.failures = 0
+		b.first = now
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.opened = now
+		b.setState(breakerOpen)
+	}
+}
+
+// abort records a query that was abandoned, it says nothing about the upstream. If it was the half-open
+// probe another query may probe in its place.
+func (b *breaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// setState sets the state and reports it, b.mu must be held.
+func (b *breaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	b.report()
+}
+
+func (b *breaker) report() {
+	breakerStateGauge.WithLabelValues(b.proxyName, b.addr).Set(float64(b.state))
+}
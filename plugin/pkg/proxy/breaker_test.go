@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("TestBreaker", "127.0.0.1:53", 3, time.Minute, 50*time.Millisecond)
+	state := func() float64 {
+		return testutil.ToFloat64(breakerStateGauge.WithLabelValues("TestBreaker", "127.0.0.1:53"))
+	}
+	errFailed := errors.New("failed")
+	ctx := context.Background()
+
+	for range 2 {
+		b.record(ctx, errFailed)
+	}
+	if !b.allow() {
+		t.Fatal("Expected breaker to allow queries below the threshold")
+	}
+	b.record(ctx, errFailed)
+	if b.allow() {
+		t.Fatal("Expected breaker to be open after 3 failures")
+	}
+	if x := state(); x != float64(breakerOpen) {
+		t.Errorf("Expected state gauge %d, got %v", breakerOpen, x)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("Expected breaker to allow a probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("Expected breaker to allow a single probe only")
+	}
+	if x := state(); x != float64(breakerHalfOpen) {
+		t.Errorf("Expected state gauge %d, got %v", breakerHalfOpen, x)
+	}
+
+	// An abandoned probe lets another query probe.
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	b.record(ctx2, context.Canceled)
+	if !b.allow() {
+		t.Fatal("Expected breaker to allow a probe after the previous one was abandoned")
+	}
+
+	// A failed probe opens the breaker for another cooldown.
+	b.record(ctx, errFailed)
+	if b.allow() {
+		t.Fatal("Expected breaker to be open after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("Expected breaker to allow a probe after the cooldown")
+	}
+	b.record(ctx, nil)
+	if x := state(); x != float64(breakerClosed) {
+		t.Errorf("Expected state gauge %d, got %v", breakerClosed, x)
+	}
+
+	// The failures were reset, so it takes the full threshold to open it again.
+	for range 2 {
+		b.record(ctx, errFailed)
+	}
+	if !b.allow() {
+		t.Error("Expected breaker to be closed after a successful probe")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	b := newBreaker("TestBreakerWindow", "127.0.0.1:53", 2, 20*time.Millisecond, time.Minute)
+	errFailed := errors.New("failed")
+
+	b.record(context.Background(), errFailed)
+	time.Sleep(30 * time.Millisecond)
+	b.record(context.Background(), errFailed)
+	if !b.allow() {
+		t.Error("Expected failures outside the window not to open the breaker")
+	}
+	b.record(context.Background(), errFailed)
+	if b.allow() {
+		t.Error("Expected failures within the window to open the breaker")
+	}
+}
+
+func TestConnectCircuitOpen(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	addr := s.Addr
+	s.Close()
+
+	p := NewProxy("TestConnectCircuitOpen", addr, transport.DNS)
+	p.SetCircuitBreaker(1, time.Minute, time.Minute)
+	p.readTimeout = 10 * time.Millisecond
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("Expected the query to the closed upstream to fail, got %v", err)
+	}
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != ErrCircuitOpen {
+		t.Errorf("Expected %q, got %v", ErrCircuitOpen, err)
+	}
+}
+
+func TestConnectCircuitFailover(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectCircuitFailover", s.Addr, transport.DNS)
+	p.SetCircuitBreaker(1, time.Minute, time.Minute)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// A reply with a failover rcode is a reply, the circuit stays closed.
+	opts := Options{FailoverOnRcode: DefaultFailoverRcodes}
+	for range 3 {
+		if _, _, err := p.Connect(context.Background(), req, opts); !errors.Is(err, ErrFailover) {
+			t.Fatalf("Expected ErrFailover, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// msgBufPool stores pointers to buffers that fit any DNS message and its TCP length prefix.
+var msgBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 2+dns.MaxMsgSize)
+		return &b
+	},
+}
+
+// readMsg reads a message from c like dns.Conn.ReadMsg, but the wire data goes into a pooled buffer. Unpack
+// copies everything it keeps, so the returned message doesn't reference the buffer once it is given back. Over
+// UDP no more than c.UDPSize bytes are read, just like ReadMsg, so an oversized reply still fails to unpack.
+func readMsg(c *dns.Conn) (*dns.Msg, error) {
+	p := msgBufPool.Get().(*[]byte)
+	defer msgBufPool.Put(p)
+
+	b := *p
+	if isPacketConn(c.Conn) {
+		b = b[:max(c.UDPSize, dns.MinMsgSize)]
+	}
+	n, err := c.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	if n < headerSize {
+		return nil, dns.ErrShortRead
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(b[:n]); err != nil {
+		return m, err
+	}
+	if m.IsTsig() != nil {
+		// Like ReadMsg on a connection without TSIG secrets, the signature can't be verified.
+		return m, dns.ErrSecret
+	}
+	return m, nil
+}
+
+// writeMsg writes m to c like dns.Conn.WriteMsg, but packs it into a pooled buffer, which also holds the
+// length prefix over TCP. A message with a TSIG record is left to WriteMsg, which signs it.
+func writeMsg(c *dns.Conn, m *dns.Msg) error {
+	if m.IsTsig() != nil {
+		return c.WriteMsg(m)
+	}
+
+	p := msgBufPool.Get().(*[]byte)
+	defer msgBufPool.Put(p)
+
+	b := *p
+	out, err := m.PackBuffer(b[2:])
+	if err != nil {
+		return err
+	}
+	if isPacketConn(c.Conn) || &out[0] != &b[2] {
+		// Datagrams go out as they are, a message that didn't fit the buffer is framed by Write.
+		_, err = c.Write(out)
+		return err
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(out))) // #nosec G115 -- out fits the buffer, so it's at most dns.MaxMsgSize
+	_, err = c.Conn.Write(b[:2+len(out)])
+	return err
+}
+
+// headerSize is the size of the DNS message header.
+const headerSize = 12
+
+// isPacketConn returns true if c carries datagrams, the same check the dns package makes. Unix domain sockets
+// are only packet oriented when they are unixgram or unixpacket sockets.
+func isPacketConn(c net.Conn) bool {
+	if _, ok := c.(net.PacketConn); !ok {
+		return false
+	}
+	if ua, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		return ua.Net == "unixgram" || ua.Net == "unixpacket"
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// loopConn is a stream connection that reads the same framed message over and over, and discards writes.
+type loopConn struct {
+	net.Conn
+	wire []byte
+	r    *bytes.Reader
+}
+
+func newLoopConn(m *dns.Msg) *loopConn {
+	out, _ := m.Pack()
+	wire := make([]byte, 2+len(out))
+	binary.BigEndian.PutUint16(wire, uint16(len(out)))
+	copy(wire[2:], out)
+	return &loopConn{wire: wire, r: bytes.NewReader(wire)}
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	if c.r.Len() == 0 {
+		c.r.Reset(c.wire)
+	}
+	return c.r.Read(b)
+}
+
+func (c *loopConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// loopPacketConn is loopConn for datagrams, each read returns the whole unframed message.
+type loopPacketConn struct {
+	net.PacketConn
+	wire []byte
+}
+
+func (c *loopPacketConn) Read(b []byte) (int, error)  { return copy(b, c.wire[2:]), nil }
+func (c *loopPacketConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *loopPacketConn) LocalAddr() net.Addr         { return &net.UDPAddr{} }
+func (c *loopPacketConn) RemoteAddr() net.Addr        { return &net.UDPAddr{} }
+func (c *loopPacketConn) SetDeadline(time.Time) error { return nil }
+
+func (c *loopPacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *loopPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+func reply() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Response = true
+	m.Answer = []dns.RR{test.A("example.org. 300 IN A 127.0.0.1"), test.A("example.org. 300 IN A 127.0.0.2")}
+	m.SetEdns0(4096, true)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte("data")})
+	return m
+}
+
+func TestReadMsgPooled(t *testing.T) {
+	c := &dns.Conn{Conn: newLoopConn(reply())}
+	m, err := readMsg(c)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	before := m.String()
+
+	// Scribble over the buffer that was given back, the message must not change.
+	p := msgBufPool.Get().(*[]byte)
+	for i := range *p {
+		(*p)[i] = 0xff
+	}
+	msgBufPool.Put(p)
+
+	if after := m.String(); after != before {
+		t.Errorf("Expected the message not to reference the pooled buffer, got\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestWriteMsgPooled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	m := reply()
+	go writeMsg(&dns.Conn{Conn: client}, m)
+
+	ret, err := (&dns.Conn{Conn: server}).ReadMsg()
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	if ret.String() != m.String() {
+		t.Errorf("Expected the message to be written as is, got\n%s\nwant\n%s", ret, m)
+	}
+}
+
+func BenchmarkReadMsg(b *testing.B) {
+	tcp := &dns.Conn{Conn: newLoopConn(reply())}
+	udp := &dns.Conn{Conn: &loopPacketConn{wire: newLoopConn(reply()).wire}, UDPSize: 1232}
+	for _, c := range []struct {
+		name string
+		conn *dns.Conn
+	}{{"tcp", tcp}, {"udp", udp}} {
+		b.Run(c.name+"/dns", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := c.conn.ReadMsg(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(c.name+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := readMsg(c.conn); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteMsg(b *testing.B) {
+	c := &dns.Conn{Conn: newLoopConn(reply())}
+	m := reply()
+	b.Run("dns", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := c.WriteMsg(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := writeMsg(c, m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
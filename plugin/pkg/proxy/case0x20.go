@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"crypto/rand"
+
+	"github.com/miekg/dns"
+)
+
+// randomizeCase randomly flips the case of the letters in the name of the first question of m, see
+// draft-vixie-dnsext-dns0x20. It returns the randomized name and a function that puts the original
+// name back. If m has no question, name is empty.
+func randomizeCase(m *dns.Msg) (name string, restore func()) {
+	if len(m.Question) == 0 {
+		return "", func() {}
+	}
+	orig := m.Question[0].Name
+
+	bits := make([]byte, (len(orig)+7)/8)
+	rand.Read(bits)
+	b := []byte(orig)
+	for i, c := range b {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+
+	m.Question[0].Name = string(b)
+	return m.Question[0].Name, func() { m.Question[0].Name = orig }
+}
+
+// matchCase returns true if the first question of ret carries name with exactly the same casing.
+func matchCase(ret *dns.Msg, name string) bool {
+	return len(ret.Question) > 0 && ret.Question[0].Name == name
+}
+
+// restoreCase replaces name with orig in the first question of ret and in the owner names of its records.
+func restoreCase(ret *dns.Msg, name, orig string) {
+	if len(ret.Question) > 0 && ret.Question[0].Name == name {
+		ret.Question[0].Name = orig
+	}
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == name {
+				rr.Header().Name = orig
+			}
+		}
+	}
+}
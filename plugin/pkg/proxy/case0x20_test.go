@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("abcdefghijklmnopqrstuvwxyz.example.org.", dns.TypeA)
+
+	name, restore := randomizeCase(m)
+	if !strings.EqualFold(name, "abcdefghijklmnopqrstuvwxyz.example.org.") {
+		t.Errorf("Expected randomized name to be equal ignoring case, got %s", name)
+	}
+	if m.Question[0].Name != name {
+		t.Errorf("Expected question to be %s, got %s", name, m.Question[0].Name)
+	}
+	restore()
+	if x := m.Question[0].Name; x != "abcdefghijklmnopqrstuvwxyz.example.org." {
+		t.Errorf("Expected original name to be restored, got %s", x)
+	}
+
+	if name, _ := randomizeCase(new(dns.Msg)); name != "" {
+		t.Errorf("Expected no name for a message without question, got %s", name)
+	}
+}
+
+func TestConnectCase0x20(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		// A spoofed reply with the right ID but without the randomized casing comes first.
+		spoof := new(dns.Msg)
+		spoof.SetReply(r)
+		spoof.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		spoof.Answer = append(spoof.Answer, test.A(spoof.Question[0].Name+" IN A 10.0.0.1"))
+		w.WriteMsg(spoof)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectCase0x20", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	// Long enough that the randomized name is practically never all lower case.
+	const qname = "abcdefghijklmnopqrstuvwxyz.example.org."
+	m := new(dns.Msg)
+	m.SetQuestion(qname, dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	resp, _, err := p.Connect(context.Background(), req, Options{PreferUDP: true, Case0x20: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if x := resp.Question[0].Name; x != qname {
+		t.Errorf("Expected question %s, got %s", qname, x)
+	}
+	if x := resp.Answer[0].Header().Name; x != qname {
+		t.Errorf("Expected answer owner %s, got %s", qname, x)
+	}
+	if x := resp.Answer[0].(*dns.A).A.String(); x != "127.0.0.1" {
+		t.Errorf("Expected the spoofed reply to be dropped, got answer %s", x)
+	}
+	if x := m.Question[0].Name; x != qname {
+		t.Errorf("Expected request question to be restored to %s, got %s", qname, x)
+	}
+}
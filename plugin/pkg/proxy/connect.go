@@ -6,15 +6,21 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http/httptrace"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+	otext "github.com/opentracing/opentracing-go/ext"
 )
 
 const (
@@ -41,28 +47,67 @@ func averageTimeout(currentAvg *int64, observedDuration time.Duration, weight in
 }
 
 func (t *Transport) dialTimeout() time.Duration {
-	return limitTimeout(&t.avgDialTime, minDialTimeout, maxDialTimeout)
+	timeout := limitTimeout(&t.avgDialTime, t.dialTimeoutMin, t.dialTimeoutMax)
+	timeout = jitter(timeout, t.timeoutJitter, t.dialTimeoutMin, t.dialTimeoutMax)
+	dialTimeoutGauge.WithLabelValues(t.proxyName, t.addr).Set(timeout.Seconds())
+	return timeout
 }
 
 func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
-	averageTimeout(&t.avgDialTime, newDialTime, cumulativeAvgWeight)
+	averageTimeout(&t.avgDialTime, newDialTime, t.avgWeight)
+	averageTimeGauge.WithLabelValues(t.proxyName, t.addr, "dial").Set(time.Duration(atomic.LoadInt64(&t.avgDialTime)).Seconds())
+}
+
+// dialProto returns the protocol that is actually dialed when proto is asked for.
+func (t *Transport) dialProto(proto string) string {
+	// QUIC upstreams only speak QUIC, Unix domain sockets are streams, otherwise if tls has been configured; use it.
+	switch {
+	case t.quic:
+		return "quic"
+	case t.unix:
+		return "tcp"
+	case t.tlsConfig != nil && proto != "quic":
+		return "tcp-tls"
+	}
+	return proto
+}
+
+// encrypted returns true if queries for proto are sent over an encrypted transport.
+func (t *Transport) encrypted(proto string) bool {
+	if t.dohURL != "" {
+		return true
+	}
+	dp := t.dialProto(proto)
+	return dp == "tcp-tls" || dp == "quic"
 }
 
 // Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
 func (t *Transport) Dial(proto string) (*persistConn, bool, error) {
-	// If tls has been configured; use it.
-	if t.tlsConfig != nil {
-		proto = "tcp-tls"
-	}
+	return t.dial(context.Background(), proto, false, nil, 0)
+}
 
-	// Check if transport is stopped before attempting to dial
+// dial is Dial, but it gives up when ctx is done and when forceNew is true the connection cache is skipped
+// and a new connection is always dialed. A PROXY protocol header is sent ahead of everything else on a new
+// tcp or tcp-tls connection, such a connection is only taken from the cache for the same header. With
+// affinity a cached connection last used for the client with the affinity key is preferred.
+func (t *Transport) dial(ctx context.Context, proto string, forceNew bool, header []byte, key uint64) (*persistConn, bool, error) {
+	proto = t.dialProto(proto)
+	forceNew = forceNew || t.noCache || (header != nil && !reusableHeader(header))
+
+	if t.shuttingDown() {
+		return nil, false, ErrShuttingDown
+	}
+	// Check if transport is stopped or the query abandoned before attempting to dial
 	select {
 	case <-t.stop:
 		return nil, false, errors.New(ErrTransportStopped)
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
 	default:
 	}
 
 	transtype := stringToTransportType(proto)
+	acquire := time.Now()
 
 	t.mu.Lock()
 	// Pre-compute max-age deadline outside the loop to avoid repeated time.Now() calls.
@@ -70,110 +115,436 @@ func (t *Transport) Dial(proto string) (*persistConn, bool, error) {
 	if t.maxAge > 0 {
 		maxAgeDeadline = time.Now().Add(-t.maxAge)
 	}
-	// FIFO: take the oldest conn (front of slice) for source port diversity
-	for len(t.conns[transtype]) > 0 {
-		pc := t.conns[transtype][0]
-		t.conns[transtype] = t.conns[transtype][1:]
-		if time.Since(pc.used) > t.expire {
-			pc.c.Close()
+	for i := t.pick(transtype, header, key); !forceNew && i >= 0; i = t.pick(transtype, header, key) {
+		pc := t.conns[transtype][i]
+		t.conns[transtype] = slices.Delete(t.conns[transtype], i, i+1)
+		if time.Since(pc.used) > t.connIdleTimeout(pc, transtype) {
+			t.closeConn(pc, closeExpire)
 			continue
 		}
 		if !maxAgeDeadline.IsZero() && pc.created.Before(maxAgeDeadline) {
-			pc.c.Close()
+			t.closeConn(pc, closeMaxAge)
 			continue
 		}
+		// An upstream that closed the connection while it was idle would only be noticed after the write.
+		if pc.c != nil && (transtype == typeTCP || transtype == typeTLS) && !connAlive(pc.c.Conn) {
+			connDeadCount.WithLabelValues(t.proxyName, t.addr, proto).Add(1)
+			t.closeConn(pc, closePeer)
+			continue
+		}
+		t.updatePoolSize(transtype)
 		t.mu.Unlock()
+		t.countAffinity(proto, pc.affinity == key)
+		pc.affinity = key
 		connCacheHitsCount.WithLabelValues(t.proxyName, t.addr, proto).Add(1)
+		connAcquireDuration.WithLabelValues(t.proxyName, t.addr, proto, "true").Observe(time.Since(acquire).Seconds())
 		return pc, true, nil
 	}
+	t.updatePoolSize(transtype)
 	t.mu.Unlock()
 
+	if t.drained.Load() && ctx.Value(probeKey{}) == nil {
+		return nil, false, ErrDrained
+	}
+
 	connCacheMissesCount.WithLabelValues(t.proxyName, t.addr, proto).Add(1)
 
+	span, ctx := startSpan(ctx, t.tracer, "dial")
+	if span != nil {
+		otext.PeerAddress.Set(span, t.addr)
+		span.SetTag("proto", proto)
+	}
+
 	reqTime := time.Now()
 	timeout := t.dialTimeout()
-	if proto == "tcp-tls" {
-		conn, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, timeout)
-		t.updateDialTimeout(time.Since(reqTime))
-		return &persistConn{c: conn, created: time.Now()}, false, err
-	}
-	conn, err := dns.DialTimeout(proto, t.addr, timeout)
-	t.updateDialTimeout(time.Since(reqTime))
-	return &persistConn{c: conn, created: time.Now()}, false, err
+	// Through a SOCKS5 proxy the dial always includes the handshakes with the proxy.
+	fastOpen := t.fastOpen && proto == "tcp" && t.socksAddr == ""
+	pc := &persistConn{proto: proto, header: header, affinity: key}
+	var (
+		conn        net.Conn
+		connectTime time.Duration // Without the TLS handshake, which is observed on its own.
+		err         error
+	)
+	switch proto {
+	case "quic":
+		pc.qc, err = t.dialQUIC(ctx, timeout)
+		pc.early = t.earlyData
+	case "tcp-tls":
+		// The dial timeout covers the TLS handshake as well.
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err = t.dialAddr(dialCtx, "tcp", timeout)
+		connectTime = time.Since(reqTime)
+		if err == nil {
+			conn, err = sendHeader(conn, header)
+		}
+		if err == nil {
+			conn, err = t.handshake(dialCtx, conn)
+		}
+		cancel()
+	default:
+		conn, err = t.dialAddr(ctx, proto, timeout)
+		if err == nil && fastOpen {
+			conn = &fastOpenConn{Conn: conn, t: t, start: reqTime}
+		}
+		if err == nil && proto == "tcp" {
+			conn, err = sendHeader(conn, header)
+		}
+	}
+	if err != nil {
+		err = t.localAddrError(err)
+	}
+	if conn != nil {
+		t.setTCPOptions(conn)
+		pc.c = &dns.Conn{Conn: conn}
+		if t.dualStackDial || len(t.candidates) > 0 {
+			t.countDialFamily(proto, conn)
+		}
+	}
+	dialTime := time.Since(reqTime)
+	// A dial cut short by an abandoned query says nothing about the upstream. A plain TCP dial with Fast
+	// Open returns before the handshake, fastOpenConn records the dial time after the first write.
+	if ctx.Err() == nil && !fastOpen {
+		t.updateDialTimeout(dialTime)
+	}
+	if err == nil {
+		// Only a query that gets the new connection counts as an affinity miss.
+		t.countAffinity(proto, false)
+		if connectTime == 0 {
+			connectTime = dialTime
+		}
+		dialDuration.WithLabelValues(t.proxyName, t.addr, proto).Observe(connectTime.Seconds())
+		connAcquireDuration.WithLabelValues(t.proxyName, t.addr, proto, "false").Observe(time.Since(acquire).Seconds())
+	} else {
+		t.countConnError(ctx, stageDial, err)
+		t.countDialFailure(ctx, proto, err)
+	}
+	finishSpan(span, err)
+	pc.created = time.Now()
+	return pc, false, err
 }
 
 // Connect selects an upstream, sends the request and waits for a response.
+//
+// For AXFR and IXFR queries the records of the transfer are returned instead of a response, in the order the
+// upstream sent them, see ConnectTransfer.
+//
+// Timeouts, refused connections and replies that can't be parsed are returned wrapped in ErrTimeout,
+// ErrConnRefused and ErrMalformed, see ErrorKind. An abandoned query returns the error of ctx.
 func (p *Proxy) Connect(ctx context.Context, state request.Request, opts Options) (*dns.Msg, []dns.RR, error) {
+	if state.QType() == dns.TypeAXFR || state.QType() == dns.TypeIXFR {
+		var rrs []dns.RR
+		err := p.ConnectTransfer(ctx, state, opts, func(batch []dns.RR) error {
+			rrs = append(rrs, batch...)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, rrs, nil
+	}
+
+	start := time.Now()
+
+	if err := p.transport.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer p.transport.end()
+
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	if !p.transport.breaker.allow() {
+		return nil, nil, ErrCircuitOpen
+	}
+	udp := p.transport.dohURL == "" && p.transport.dialProto(protocol(state, opts)) == "udp"
+	// A query whose reply likely doesn't fit in UDP skips the wasted round trip.
+	if opts.PreferTCPLarge && udp {
+		if reason := p.largeReply(state); reason != "" {
+			udpSkippedCount.WithLabelValues(p.proxyName, p.addr, reason).Add(1)
+			opts.ForceTCP, udp = true, false
+		}
+	}
+	var ev Event
+	ret, err := p.connect(ctx, state, opts, start, false, &ev, nil)
+	// An abandoned query is not retried, whatever went wrong.
+	if err != nil && ctxErr(ctx) != nil {
+		p.transport.breaker.record(ctx, err)
+		return nil, nil, ctxErr(ctx)
+	}
+	// BADCOOKIE carries a fresh server cookie, which connect has learned, so retry once with it. The
+	// cookie is ours and not the client's, so a second BADCOOKIE isn't passed on.
+	if err == nil && opts.EnableCookies && ret != nil && ret.Rcode == dns.RcodeBadCookie {
+		ret, err = p.connect(ctx, state, opts, start, false, &ev, nil)
+		if err == nil && ret != nil && ret.Rcode == dns.RcodeBadCookie {
+			p.transport.breaker.record(ctx, ErrBadCookie)
+			return nil, nil, ErrBadCookie
+		}
+	}
+	if err == nil && opts.PreferTCPLarge && udp && ret != nil && ret.Truncated {
+		p.truncated.add(state)
+	}
+	// A truncated reply over UDP is discarded and the query is sent again over TCP. The UDP connection
+	// is fine and has already been given back. This is done once, a truncated reply over TCP is returned
+	// as is.
+	if err == nil && opts.RetryTCPOnTruncated && ret != nil && ret.Truncated && udp {
+		truncatedRetriesCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+		opts.ForceTCP = true
+		ret, err = p.connect(ctx, state, opts, start, false, &ev, nil)
+	}
+	// A cached connection closed by the upstream is almost always a stale keepalive, retry once on a new
+	// one. The original message ID is restored by connect, so the retry starts from a clean request.
+	if err == ErrCachedClosed {
+		connRetriesCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+		ret, err = p.connect(ctx, state, opts, start, true, &ev, nil)
+	}
+	// An AD bit that can't be backed by signatures is not passed on in strict mode.
+	if err == nil && opts.StrictAD && ret != nil && unsignedAD(ret) {
+		p.transport.breaker.record(ctx, ErrUnsignedAD)
+		return nil, nil, ErrUnsignedAD
+	}
+	// The breaker sees the outcome before a failover rcode is turned into an error, such a reply isn't held
+	// against the upstream.
+	p.transport.breaker.record(ctx, err)
+	if err == nil && ret != nil {
+		opts.Hooks.postReceive(ret)
+		ev.ProxyName, ev.Addr, ev.Client, ev.Query, ev.Reply = p.proxyName, p.addr, state.W.RemoteAddr(), state.Req, ret
+		p.sink.Load().Event(ev)
+		recordUpstream(ctx, Upstream{ProxyName: p.proxyName, Addr: p.addr, Proto: ev.Proto})
+		err = p.failover(ret, opts)
+	}
+	if err != nil && ctxErr(ctx) != nil {
+		return nil, nil, ctxErr(ctx)
+	}
+	err = classifyError(err)
+	if errors.Is(err, ErrTimeout) {
+		// A slow upstream that times out must not keep the round-trip time of its last reply.
+		p.srtt.observe(time.Since(start), time.Now())
+	}
+	return ret, nil, err
+}
+
+// ConnectTransfer sends the AXFR or IXFR in state to the upstream and calls out with the records of each
+// message of the transfer as it arrives, so the caller doesn't have to hold the whole zone in memory. An IXFR
+// can be answered with a lone SOA when the zone is up to date, with the records of a full transfer between two
+// copies of the SOA, or incrementally as in RFC 1995: the new SOA, followed for each difference sequence by the
+// old SOA, the deleted records, the SOA of the next version and the added records, and the new SOA again.
+//
+// An error returned by out aborts the transfer: the connection is closed and the error is returned as is. It
+// isn't held against the upstream. Other errors are as for Connect. A transfer isn't retried, as out may
+// already have been called.
+func (p *Proxy) ConnectTransfer(ctx context.Context, state request.Request, opts Options, out func([]dns.RR) error) error {
+	if state.QType() != dns.TypeAXFR && state.QType() != dns.TypeIXFR {
+		return fmt.Errorf("proxy: %s query is not a zone transfer", dns.TypeToString[state.QType()])
+	}
 	start := time.Now()
 
-	var proto string
+	if err := p.transport.begin(); err != nil {
+		return err
+	}
+	defer p.transport.end()
+
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !p.transport.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	var (
+		ev     Event
+		outErr error
+	)
+	ret, err := p.connect(ctx, state, opts, start, false, &ev, func(rrs []dns.RR) error {
+		outErr = out(rrs)
+		return outErr
+	})
+	// DoH and DoQ carry the transfer in a single reply.
+	if err == nil && ret != nil {
+		if ret.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%w: %s", ErrTransferRcode, dns.RcodeToString[ret.Rcode])
+		} else {
+			outErr = out(ret.Answer)
+		}
+	}
+	if outErr != nil {
+		p.transport.breaker.abort()
+		return outErr
+	}
+	p.transport.breaker.record(ctx, err)
+	if err == nil {
+		recordUpstream(ctx, Upstream{ProxyName: p.proxyName, Addr: p.addr, Proto: ev.Proto})
+	}
+	if err != nil && ctxErr(ctx) != nil {
+		return ctxErr(ctx)
+	}
+	err = classifyError(err)
+	if errors.Is(err, ErrTimeout) {
+		p.srtt.observe(time.Since(start), time.Now())
+	}
+	return err
+}
+
+// protocol returns the protocol asked for to send the query in state.
+func protocol(state request.Request, opts Options) string {
 	switch {
 	case opts.ForceTCP: // TCP flag has precedence over UDP flag
-		proto = "tcp"
+		return "tcp"
 	case opts.PreferUDP:
-		proto = "udp"
-	default:
-		proto = state.Proto()
+		return "udp"
+	}
+	return state.Proto()
+}
+
+// roundTrip does the work for Connect, when forceNew is true a new connection is dialed instead of using the cache.
+// The protocol, connection and round-trip time of a reply are recorded in ev.
+func (p *Proxy) roundTrip(ctx context.Context, state request.Request, opts Options, start time.Time, forceNew bool, ev *Event, out func([]dns.RR) error) (*dns.Msg, error) {
+	proto := protocol(state, opts)
+	// The PROXY protocol header needs a connection of its own, or one that carries the same header.
+	var header []byte
+	if p.transport.proxyProtocol && !p.transport.quic {
+		proto = "tcp"
+		header = proxyHeader(state)
+	}
+
+	if opts.SetDO {
+		defer setDO(state.Req)()
+	}
+
+	if opts.Padding > 0 && p.transport.encrypted(proto) {
+		defer padRequest(state.Req, opts.Padding)()
+	}
+
+	cookies := opts.EnableCookies && p.transport.dohURL == "" && p.transport.dialProto(proto) == "udp"
+	if cookies {
+		defer p.transport.cookies.set(state.Req)()
 	}
 
-	pc, cached, err := p.transport.Dial(proto)
+	if p.transport.dohURL != "" {
+		state.Req = opts.Hooks.preSend(state.Req)
+		return p.connectHTTPS(ctx, state, opts, start, ev)
+	}
+
+	if p.transport.pipelining && !p.transport.noCache && header == nil && state.QType() != dns.TypeAXFR && state.QType() != dns.TypeIXFR {
+		if dp := p.transport.dialProto(proto); dp == "tcp" || dp == "tcp-tls" {
+			state.Req = opts.Hooks.preSend(state.Req)
+			return p.connectPipelined(ctx, state, opts, dp, start, ev)
+		}
+	}
+
+	keepalive := false
+	if dp := p.transport.dialProto(proto); opts.TCPKeepalive && (dp == "tcp" || dp == "tcp-tls") {
+		keepalive = true
+		defer setKeepalive(state.Req)()
+	}
+
+	pc, cached, err := p.transport.dial(ctx, proto, forceNew, header, p.transport.affinityKey(state))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	if pc.qc != nil {
+		state.Req = opts.Hooks.preSend(state.Req)
+		return p.connectQUIC(ctx, pc, cached, state, opts, start, ev)
 	}
 
+	// Unblock reads and writes when the query is abandoned, the connection is closed by the error
+	// handling below, so it never goes back into the cache with a reply still pending on it.
+	stop := context.AfterFunc(ctx, func() { pc.c.SetDeadline(time.Now()) })
+	defer stop()
+	// yield gives pc back to the transport. When the query was abandoned in the meantime the deadline may
+	// hit pc after another query took it, so it is closed instead.
+	yield := func() {
+		if !stop() {
+			p.transport.closeConn(pc, closeCanceled)
+			return
+		}
+		p.transport.Yield(pc)
+	}
+
+	readTimeout := p.nextReadTimeout()
+
 	// Set buffer size correctly for this client.
 	pc.c.UDPSize = max(uint16(state.Size()), 512) // #nosec G115 -- UDP size fits in uint16
 
-	var retRRs []dns.RR
 	var ret *dns.Msg
 
 	if state.QType() == dns.TypeAXFR || state.QType() == dns.TypeIXFR {
-		pc.c.SetWriteDeadline(time.Now().Add(maxTimeout))
-		if err := pc.c.WriteMsg(state.Req); err != nil {
-			pc.c.Close() // not giving it back
+		pc.c.SetWriteDeadline(deadline(ctx, p.writeTimeout))
+		req := opts.Hooks.preSend(state.Req)
+		if err := pc.c.WriteMsg(req); err != nil {
+			p.transport.countConnError(ctx, stageWrite, err)
+			p.transport.closeConn(pc, closeReason(ctx)) // not giving it back
 			if err == io.EOF && cached {
-				return nil, nil, ErrCachedClosed
+				return nil, ErrCachedClosed
 			}
-			return nil, nil, err
+			return nil, err
 		}
-		first := true
+		x := newXfr(req)
+		records, size := 0, 0
 		for {
-			pc.c.SetReadDeadline(time.Now().Add(p.readTimeout))
-			in, err := pc.c.ReadMsg()
+			// Stop between messages of the transfer when the query is abandoned.
+			if err := ctx.Err(); err != nil {
+				p.transport.closeConn(pc, closeCanceled)
+				return nil, err
+			}
+			pc.c.SetReadDeadline(deadline(ctx, p.transferReadTimeout))
+			in, err := readMsg(pc.c)
 			if err != nil {
-				pc.c.Close() // not giving it back
-				if err == io.EOF && cached {
-					return nil, nil, ErrCachedClosed
+				p.transport.countConnError(ctx, stageRead, err)
+				p.transport.closeConn(pc, closeReason(ctx)) // not giving it back
+				// Once the transfer started the upstream took the query, it can't be retried on a new
+				// connection.
+				if err == io.EOF && cached && !x.started {
+					return nil, ErrCachedClosed
 				}
-				return ret, nil, err
+				return ret, err
 			}
-			if state.Req.Id != in.Id {
+			if req.Id != in.Id {
 				// out-of-order response. unexpected.
 				continue
 			}
-			if first {
-				if len(in.Answer) == 0 || in.Answer[0].Header().Rrtype != dns.TypeSOA {
-					pc.c.Close()
-					return nil, nil, dns.ErrSoa
+			if in.Rcode != dns.RcodeSuccess {
+				// The upstream is done with the transfer, the connection can be used again when it
+				// didn't start.
+				if x.started {
+					p.transport.closeConn(pc, closeError)
+				} else {
+					yield()
 				}
-				first = !first
-				if len(in.Answer) == 1 {
-					retRRs = append(retRRs, in.Answer[0])
-					continue
+				if x.ixfr && in.Rcode == dns.RcodeNotImplemented {
+					return nil, ErrIXFRNotImplemented
 				}
+				return nil, fmt.Errorf("%w: %s", ErrTransferRcode, dns.RcodeToString[in.Rcode])
+			}
+			records, size = records+len(in.Answer), size+in.Len()
+			if err := p.checkTransferSize(records, size); err != nil {
+				// The rest of the transfer is still on its way, the connection can't be used again.
+				p.transport.closeConn(pc, closeError)
+				return nil, err
 			}
-			for _, rr := range in.Answer {
-				retRRs = append(retRRs, rr)
+			rrs, done, err := x.add(in.Answer)
+			if err == nil && len(rrs) > 0 {
+				err = out(rrs)
+			}
+			if err != nil {
+				p.transport.closeConn(pc, closeError)
+				return nil, err
 			}
-			if len(in.Answer) >= 0 && in.Answer[len(in.Answer)-1].Header().Rrtype == dns.TypeSOA {
+			if done {
 				break
 			}
 		}
-		p.transport.Yield(pc)
-		return nil, retRRs, nil
+		*ev = Event{Proto: pc.proto, Cached: cached}
+		yield()
+		return nil, nil
 	}
 
-	pc.c.SetWriteDeadline(time.Now().Add(maxTimeout))
+	pc.c.SetWriteDeadline(deadline(ctx, p.writeTimeout))
 	// records the origin Id before upstream.
 	originId := state.Req.Id
 	state.Req.Id = dns.Id()
@@ -181,18 +552,32 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts Options
 		state.Req.Id = originId
 	}()
 
-	if err := pc.c.WriteMsg(state.Req); err != nil {
-		pc.c.Close() // not giving it back
+	var originName, randomName string
+	if opts.Case0x20 && len(state.Req.Question) > 0 {
+		originName = state.Req.Question[0].Name
+		var restore func()
+		randomName, restore = randomizeCase(state.Req)
+		defer restore()
+	}
+
+	// The caller's message is left alone, replies are matched against what was sent.
+	req := opts.Hooks.preSend(state.Req)
+	if err := writeMsg(pc.c, req); err != nil {
+		p.transport.countConnError(ctx, stageWrite, err)
+		p.transport.closeConn(pc, closeReason(ctx)) // not giving it back
 		if err == io.EOF && cached {
-			return nil, nil, ErrCachedClosed
+			return nil, ErrCachedClosed
 		}
-		return nil, nil, err
+		return nil, err
 	}
-	pc.c.SetReadDeadline(time.Now().Add(p.readTimeout))
+	// The round-trip time starts when the query is written, after the dial.
+	sent := time.Now()
+	pc.c.SetReadDeadline(deadline(ctx, readTimeout))
+	mismatched := 0
 	for {
-		ret, err = pc.c.ReadMsg()
+		ret, err = readMsg(pc.c)
 		if err != nil {
-			if ret != nil && (state.Req.Id == ret.Id) && p.transport.transportTypeFromConn(pc) == typeUDP && shouldTruncateResponse(err) {
+			if ret != nil && (req.Id == ret.Id) && p.transport.transportTypeFromConn(pc) == typeUDP && shouldTruncateResponse(err) {
 				// For UDP, if the error is an overflow, we probably have an upstream misbehaving in some way.
 				// (e.g. sending >512 byte responses without an eDNS0 OPT RR).
 				// Instead of returning an error, return an empty response with TC bit set. This will make the
@@ -204,38 +589,159 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts Options
 				break
 			}
 
-			pc.c.Close() // not giving it back
+			p.transport.countConnError(ctx, stageRead, err)
+			p.transport.closeConn(pc, closeReason(ctx)) // not giving it back
 			if err == io.EOF && cached {
-				return nil, nil, ErrCachedClosed
+				return nil, ErrCachedClosed
 			}
 			// recovery the origin Id after upstream.
 			if ret != nil {
 				ret.Id = originId
 			}
-			return ret, nil, err
+			return ret, err
 		}
-		// drop out-of-order responses
-		if state.Req.Id == ret.Id {
+		// drop out-of-order responses, those for another question, and with 0x20 those that don't echo
+		// the randomized name
+		if req.Id == ret.Id && (opts.NoQuestionCheck || matchQuestion(ret, req)) &&
+			(randomName == "" || matchCase(ret, randomName)) {
 			break
 		}
+		transtype := p.transport.transportTypeFromConn(pc)
+		unmatchedResponsesCount.WithLabelValues(p.proxyName, p.addr, transtype.String()).Add(1)
+		if req.Id == ret.Id && !opts.NoQuestionCheck && !matchQuestion(ret, req) {
+			questionMismatchesCount.WithLabelValues(p.proxyName, p.addr, transtype.String()).Add(1)
+		}
+		if transtype != typeUDP {
+			// Replies over a stream come in the order of the queries, and there is only one query on the connection.
+			log.Warningf("Dropped reply from %s over %s that doesn't match the query: ID %d, expected %d", p.addr, transtype, ret.Id, req.Id)
+			continue
+		}
+		mismatched++
+		if p.maxMismatched > 0 && mismatched > p.maxMismatched {
+			p.transport.closeConn(pc, closeError)
+			return nil, ErrTooManyMismatched
+		}
 	}
 	// recovery the origin Id after upstream.
 	ret.Id = originId
+	if randomName != "" {
+		restoreCase(ret, randomName, originName)
+	}
+	if cookies {
+		p.transport.cookies.learn(ret)
+	}
+	if keepalive {
+		p.transport.learnKeepalive(pc, ret)
+	}
+	rtt := time.Since(sent)
+	p.observeRTT(pc.proto, rtt)
+	*ev = Event{Proto: pc.proto, Cached: cached, Sent: sent, RTT: rtt}
+
+	yield()
+
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = strconv.Itoa(ret.Rcode)
+	}
+
+	requestDuration.WithLabelValues(p.proxyName, p.addr, rc, pc.proto).Observe(time.Since(start).Seconds())
+
+	return ret, nil
+}
+
+// connectPipelined sends the request over the shared connection for proto.
+func (p *Proxy) connectPipelined(ctx context.Context, state request.Request, opts Options, proto string, start time.Time, ev *Event) (*dns.Msg, error) {
+	m, err := p.transport.muxDial(ctx, proto)
+	if err != nil {
+		return nil, err
+	}
+
+	originId := state.Req.Id
+	ret, sent, err := m.exchange(ctx, state.Req, p.writeTimeout, p.nextReadTimeout(), opts.NoQuestionCheck)
+	state.Req.Id = originId
+	if err != nil {
+		p.transport.countConnError(ctx, stageAny, err)
+		return nil, err
+	}
+	rtt := time.Since(sent)
+	p.observeRTT(proto, rtt)
+	*ev = Event{Proto: proto, Sent: sent, RTT: rtt}
+	ret.Id = originId
 
-	p.transport.Yield(pc)
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = strconv.Itoa(ret.Rcode)
+	}
+
+	requestDuration.WithLabelValues(p.proxyName, p.addr, rc, proto).Observe(time.Since(start).Seconds())
+
+	return ret, nil
+}
+
+// connectHTTPS sends the request to a DNS-over-HTTPS upstream. The http.Client takes care of
+// connection reuse, so the connection cache in p.transport isn't used.
+func (p *Proxy) connectHTTPS(ctx context.Context, state request.Request, opts Options, start time.Time, ev *Event) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.writeTimeout+p.nextReadTimeout())
+	defer cancel()
+
+	// The round-trip time starts when the request is written, after any dial by the http.Client.
+	var sent atomic.Int64
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { sent.Store(time.Now().UnixNano()) },
+	})
+	ret, err := p.transport.exchangeHTTPS(ctx, state.Req)
+	if err != nil {
+		p.transport.countConnError(ctx, stageAny, err)
+		return nil, err
+	}
+	if err := p.checkQuestion(ret, state.Req, "https", opts); err != nil {
+		return nil, err
+	}
+	sentAt := start
+	if ns := sent.Load(); ns != 0 {
+		sentAt = time.Unix(0, ns)
+	}
+	rtt := time.Since(sentAt)
+	p.observeRTT("https", rtt)
+	*ev = Event{Proto: "https", Sent: sentAt, RTT: rtt}
 
 	rc, ok := dns.RcodeToString[ret.Rcode]
 	if !ok {
 		rc = strconv.Itoa(ret.Rcode)
 	}
 
-	requestDuration.WithLabelValues(p.proxyName, p.addr, rc).Observe(time.Since(start).Seconds())
+	requestDuration.WithLabelValues(p.proxyName, p.addr, rc, "https").Observe(time.Since(start).Seconds())
 
-	return ret, nil, nil
+	return ret, nil
 }
 
 const cumulativeAvgWeight = 4
 
+// deadline returns the time d from now, or the deadline of ctx if that is earlier. When ctx is
+// already done the deadline is now.
+func deadline(ctx context.Context, d time.Duration) time.Time {
+	now := time.Now()
+	if ctx.Err() != nil {
+		return now
+	}
+	if dl, ok := ctx.Deadline(); ok && dl.Before(now.Add(d)) {
+		return dl
+	}
+	return now.Add(d)
+}
+
+// ctxErr returns the error of ctx, also when its deadline has passed and ctx isn't done yet: a read that hit the
+// deadline of ctx, see deadline, may fail just before ctx is.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
 // Function to determine if a response should be truncated.
 func shouldTruncateResponse(err error) bool {
 	// This is to handle a scenario in which upstream sets the TC bit, but doesn't truncate the response
@@ -1,8 +1,18 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
 )
 
 const (
@@ -49,3 +59,65 @@ func TestDial_MultipleCallsAfterStop(t *testing.T) {
 		}
 	}
 }
+
+func TestDeadline(t *testing.T) {
+	const d = time.Second
+
+	earlier, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	later, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		min  time.Duration
+		max  time.Duration
+	}{
+		{"no deadline", context.Background(), d - 50*time.Millisecond, d},
+		{"earlier deadline wins", earlier, 0, 100 * time.Millisecond},
+		{"later deadline", later, d - 50*time.Millisecond, d},
+		{"done", done, -50 * time.Millisecond, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			x := time.Until(deadline(tc.ctx, d))
+			if x < tc.min || x > tc.max {
+				t.Errorf("Expected the deadline in %s to %s, got %s", tc.min, tc.max, x)
+			}
+		})
+	}
+}
+
+func TestConnectWriteTimeout(t *testing.T) {
+	p := NewProxy("TestConnectWriteTimeout", "127.0.0.1:53", transport.DNS)
+	p.SetReadTimeout(5 * time.Second)
+	p.SetTransferReadTimeout(5 * time.Second)
+	p.SetWriteTimeout(100 * time.Millisecond)
+	defer p.transport.Stop()
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAXFR} {
+		// The upstream never reads, so writing the query blocks.
+		c, upstream := net.Pipe()
+		defer upstream.Close()
+		p.transport.mu.Lock()
+		p.transport.conns[typeTCP] = []*persistConn{{c: &dns.Conn{Conn: c}, proto: "tcp", created: time.Now(), used: time.Now()}}
+		p.transport.mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", qtype)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		begin := time.Now()
+		_, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+		d := time.Since(begin)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("%s: expected %q, got %v", dns.TypeToString[qtype], ErrTimeout, err)
+		}
+		if d < 100*time.Millisecond || d > time.Second {
+			t.Errorf("%s: expected the write to time out after 100ms, took %s", dns.TypeToString[qtype], d)
+		}
+	}
+}
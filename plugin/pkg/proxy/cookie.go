@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// cookies holds the DNS Cookies (RFC 7873) state for an upstream.
+type cookies struct {
+	client string // hex encoded 8 byte client cookie
+
+	mu     sync.RWMutex
+	server string // hex encoded server cookie, learned from the last reply
+}
+
+func newCookies() *cookies {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &cookies{client: hex.EncodeToString(b)}
+}
+
+// set adds a cookie option to m, replacing any cookie that is already there. The returned
+// function removes it again.
+func (c *cookies) set(m *dns.Msg) (restore func()) {
+	c.mu.RLock()
+	cookie := c.client + c.server
+	c.mu.RUnlock()
+
+	opt, restore := withOPT(m)
+	opt.Option = withoutOption(opt.Option, dns.EDNS0COOKIE)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return restore
+}
+
+// learn stores the server cookie of the reply, if it echoes our client cookie, and strips the
+// cookie option from ret as it belongs to this upstream and not to the client.
+func (c *cookies) learn(ret *dns.Msg) {
+	opt := ret.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// A server cookie is 8 to 32 bytes, i.e. 16 to 64 hex characters.
+		if l := len(cookie.Cookie) - len(c.client); l >= 16 && l <= 64 && strings.EqualFold(cookie.Cookie[:len(c.client)], c.client) {
+			c.mu.Lock()
+			c.server = cookie.Cookie[len(c.client):]
+			c.mu.Unlock()
+		}
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0COOKIE)
+}
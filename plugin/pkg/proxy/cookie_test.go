@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestConnectCookies(t *testing.T) {
+	const serverCookie = "0102030405060708"
+	var badCookies atomic.Int32
+
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		var client, server string
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok && len(c.Cookie) >= 16 {
+					client, server = c.Cookie[:16], c.Cookie[16:]
+				}
+			}
+		}
+		if client == "" {
+			t.Error("Expected query to carry a client cookie")
+			return
+		}
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + serverCookie})
+		if server != serverCookie {
+			badCookies.Add(1)
+			ret.Rcode = dns.RcodeBadCookie
+			w.WriteMsg(ret)
+			return
+		}
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectCookies", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	for range 2 {
+		resp, _, err := p.Connect(context.Background(), req, Options{PreferUDP: true, EnableCookies: true})
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected %s, got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[resp.Rcode])
+		}
+		if opt := resp.IsEdns0(); opt != nil && len(opt.Option) != 0 {
+			t.Errorf("Expected the upstream cookie to be stripped from the reply, got %v", opt.Option)
+		}
+		if m.IsEdns0() != nil {
+			t.Error("Expected the cookie to be removed from the request")
+		}
+	}
+
+	if x := badCookies.Load(); x != 1 {
+		t.Errorf("Expected 1 BADCOOKIE reply, got %d", x)
+	}
+}
+
+func TestConnectBadCookie(t *testing.T) {
+	var queries atomic.Int32
+
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		ret.Rcode = dns.RcodeBadCookie
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectBadCookie", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{PreferUDP: true, EnableCookies: true}); err != ErrBadCookie {
+		t.Errorf("Expected %q, got %v", ErrBadCookie, err)
+	}
+	if x := queries.Load(); x != 2 {
+		t.Errorf("Expected the query to be retried once, got %d queries", x)
+	}
+}
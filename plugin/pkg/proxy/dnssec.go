@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// setDO sets the DO bit on m, adding an OPT record if there is none. The returned function puts
+// back the original DO bit and OPT record.
+func setDO(m *dns.Msg) (restore func()) {
+	opt, restoreOPT := withOPT(m)
+	do := opt.Do()
+	opt.SetDo()
+	return func() {
+		opt.SetDo(do)
+		restoreOPT()
+	}
+}
+
+// unsignedAD returns true if ret has the AD bit set, but carries no RRSIG in the answer or authority section.
+func unsignedAD(ret *dns.Msg) bool {
+	if !ret.AuthenticatedData {
+		return false
+	}
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetDO(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	restore := setDO(m)
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatal("Expected OPT record with DO bit")
+	}
+	restore()
+	if m.IsEdns0() != nil {
+		t.Error("Expected OPT record to be removed again")
+	}
+
+	m.SetEdns0(1232, false)
+	restore = setDO(m)
+	if !m.IsEdns0().Do() {
+		t.Error("Expected DO bit on existing OPT record")
+	}
+	restore()
+	if opt := m.IsEdns0(); opt == nil || opt.Do() || opt.UDPSize() != 1232 {
+		t.Errorf("Expected original OPT record without DO bit, got %v", opt)
+	}
+}
+
+func TestConnectDNSSEC(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+			ret.Rcode = dns.RcodeRefused
+			w.WriteMsg(ret)
+			return
+		}
+		ret.SetEdns0(dns.DefaultMsgSize, true)
+		ret.AuthenticatedData = true
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		if r.Question[0].Name == "signed.example.org." {
+			ret.Answer = append(ret.Answer, test.RRSIG(r.Question[0].Name+" IN RRSIG A 8 3 3600 20300101000000 20200101000000 12345 example.org. AAAA"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectDNSSEC", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	tests := []struct {
+		qname   string
+		opts    Options
+		wantErr error
+		wantAD  bool
+	}{
+		{"signed.example.org.", Options{SetDO: true}, nil, true},
+		{"unsigned.example.org.", Options{SetDO: true}, nil, true},
+		{"signed.example.org.", Options{SetDO: true, StrictAD: true}, nil, true},
+		{"unsigned.example.org.", Options{SetDO: true, StrictAD: true}, ErrUnsignedAD, false},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		resp, _, err := p.Connect(context.Background(), req, tc.opts)
+		if err != tc.wantErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.wantErr, err)
+			continue
+		}
+		if m.IsEdns0() != nil {
+			t.Errorf("Test %d: expected the OPT record to be removed from the request", i)
+		}
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData != tc.wantAD {
+			t.Errorf("Test %d: expected NOERROR with AD %t, got %s with AD %t", i, tc.wantAD, dns.RcodeToString[resp.Rcode], resp.AuthenticatedData)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+
+	"github.com/miekg/dns"
+)
+
+// splitDoHAddr splits a DNS-over-HTTPS upstream of the form host:port[/path] into the
+// host:port part and the URL that queries are POSTed to. When no path is given doh.Path is used.
+func splitDoHAddr(addr string) (host, url string) {
+	host, path, found := strings.Cut(addr, "/")
+	if !found || path == "" {
+		return host, "https://" + host + doh.Path
+	}
+	return host, "https://" + host + "/" + path
+}
+
+// newHTTPClient returns the client used for DNS-over-HTTPS upstreams. Connections are kept
+// alive by the underlying http.Transport and HTTP/2 is negotiated when the upstream supports it.
+func newHTTPClient(cfg *tls.Config) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig:   cfg,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   defaultExpire,
+	}
+	return &http.Client{Transport: tr}
+}
+
+// setDoH configures the transport to send queries as RFC 8484 POST requests to url. DoH
+// upstreams bypass the connection cache, pooling is done by the http.Client instead.
+func (t *Transport) setDoH(url string) {
+	t.dohURL = url
+	t.httpClient = newHTTPClient(t.tlsConfig)
+}
+
+// exchangeHTTPS sends m to the DoH upstream and returns the reply.
+func (t *Transport) exchangeHTTPS(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The Message ID is not used by DoH, RFC 8484 recommends setting it to 0 so replies are
+	// cache friendly. The original ID is restored on the reply.
+	id := m.Id
+	m.Id = 0
+	buf, err := m.Pack()
+	m.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	// Report whether the http.Client reused a pooled connection, this keeps the
+	// conn_cache_{hits,misses}_total metrics meaningful for DoH upstreams.
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				connCacheHitsCount.WithLabelValues(t.proxyName, t.addr, "https").Add(1)
+				return
+			}
+			connCacheMissesCount.WithLabelValues(t.proxyName, t.addr, "https").Add(1)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, t.dohURL, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", doh.MimeType)
+	req.Header.Set("Accept", doh.MimeType)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy: DoH upstream %s returned status %d (%s)", t.dohURL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	ret, err := doh.ResponseToMsg(resp)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = id
+	return ret, nil
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newDoHServer(t *testing.T, path string, status int) *httptest.Server {
+	t.Helper()
+	s := httptest.NewUnstartedServer(dohHandler(path, status))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+// dohHandler answers the DoH queries to path with an A record, or with status when it isn't http.StatusOK.
+func dohHandler(path string, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		m, err := doh.RequestToMsg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.Id != 0 {
+			http.Error(w, "message ID is not 0", http.StatusBadRequest)
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		if m.Question[0].Name == "rewrite.example.org." {
+			ret.Question[0].Name = "example.org."
+		}
+		buf, _ := ret.Pack()
+		w.Header().Set("Content-Type", doh.MimeType)
+		w.Write(buf)
+	}
+}
+
+func TestSplitDoHAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantHost string
+		wantURL  string
+	}{
+		{"dns.example.com:443", "dns.example.com:443", "https://dns.example.com:443/dns-query"},
+		{"dns.example.com:443/", "dns.example.com:443", "https://dns.example.com:443/dns-query"},
+		{"dns.example.com:8443/resolve", "dns.example.com:8443", "https://dns.example.com:8443/resolve"},
+	}
+	for _, tc := range tests {
+		host, url := splitDoHAddr(tc.addr)
+		if host != tc.wantHost || url != tc.wantURL {
+			t.Errorf("splitDoHAddr(%q) = %q, %q; want %q, %q", tc.addr, host, url, tc.wantHost, tc.wantURL)
+		}
+	}
+}
+
+func TestProxyDoH(t *testing.T) {
+	s := newDoHServer(t, "/custom", http.StatusOK)
+	defer s.Close()
+
+	p := NewProxy("TestProxyDoH", s.Listener.Addr().String()+"/custom", transport.HTTPS)
+	if x := p.Addr(); x != s.Listener.Addr().String()+"/custom" {
+		t.Errorf("Expected the path to be part of the address, got %s", x)
+	}
+	p.SetTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Id = 1234
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	for range 2 {
+		resp, _, err := p.Connect(context.Background(), req, Options{})
+		if err != nil {
+			t.Fatalf("Failed to connect to DoH server: %s", err)
+		}
+		if resp.Id != 1234 {
+			t.Errorf("Expected reply ID %d, got %d", 1234, resp.Id)
+		}
+		if x := resp.Answer[0].Header().Name; x != "example.org." {
+			t.Errorf("Expected %s, got %s", "example.org.", x)
+		}
+	}
+
+	if err := p.GetHealthchecker().Check(p); err != nil {
+		t.Errorf("Expected DoH health check to succeed, got %s", err)
+	}
+}
+
+func TestProxyDoHSetTLSConfig(t *testing.T) {
+	var closed atomic.Int32
+	s := httptest.NewUnstartedServer(dohHandler("/dns-query", http.StatusOK))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	p := NewProxy("TestProxyDoHSetTLSConfig", s.Listener.Addr().String(), transport.HTTPS)
+	cfg := s.Client().Transport.(*http.Transport).TLSClientConfig
+	p.SetTLSConfig(cfg)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect to DoH server: %s", err)
+	}
+
+	// The idle connection of the client with the old config is closed.
+	p.SetTLSConfig(cfg.Clone())
+	for range 100 {
+		if closed.Load() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if x := closed.Load(); x != 1 {
+		t.Errorf("Expected the idle connection to be closed, got %d closed connections", x)
+	}
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Errorf("Failed to connect with the new config: %s", err)
+	}
+}
+
+func TestProxyDoHStatus(t *testing.T) {
+	s := newDoHServer(t, doh.Path, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	p := NewProxy("TestProxyDoHStatus", s.Listener.Addr().String(), transport.HTTPS)
+	p.SetTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	_, _, err := p.Connect(context.Background(), req, Options{})
+	if err == nil {
+		t.Fatal("Expected error for non-200 status, got none")
+	}
+	if !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected error to mention the status, got %q", err)
+	}
+	if err := p.GetHealthchecker().Check(p); err == nil {
+		t.Error("Expected DoH health check to fail")
+	}
+	if p.Fails() != 1 {
+		t.Errorf("Expected 1 fail, got %d", p.Fails())
+	}
+}
+
+func TestProxyDoHQuestionMismatch(t *testing.T) {
+	s := newDoHServer(t, doh.Path, http.StatusOK)
+	defer s.Close()
+
+	addr := s.Listener.Addr().String()
+	p := NewProxy("TestProxyDoHQuestionMismatch", addr, transport.HTTPS)
+	p.SetTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+
+	m := new(dns.Msg)
+	m.SetQuestion("rewrite.example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{}); !errors.Is(err, ErrQuestionMismatch) {
+		t.Errorf("Expected %q, got %v", ErrQuestionMismatch, err)
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestProxyDoHQuestionMismatch", addr, "https")); x != 1 {
+		t.Errorf("Expected 1 unmatched response, got %v", x)
+	}
+	if x := testutil.ToFloat64(questionMismatchesCount.WithLabelValues("TestProxyDoHQuestionMismatch", addr, "https")); x != 1 {
+		t.Errorf("Expected 1 question mismatch, got %v", x)
+	}
+	ret, _, err := p.Connect(context.Background(), req, Options{NoQuestionCheck: true})
+	if err != nil {
+		t.Fatalf("Expected the reply with NoQuestionCheck, got %s", err)
+	}
+	if x := ret.Question[0].Name; x != "example.org." {
+		t.Errorf("Expected the rewritten question, got %s", x)
+	}
+}
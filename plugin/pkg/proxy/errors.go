@@ -1,7 +1,15 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/miekg/dns"
 )
 
 var (
@@ -11,8 +19,100 @@ var (
 	ErrNoForward = errors.New("no forwarder defined")
 	// ErrCachedClosed means cached connection was closed by peer.
 	ErrCachedClosed = errors.New("cached connection was closed by peer")
+	// ErrUnsignedAD means the response has the AD bit set, but no RRSIGs, see Options.StrictAD.
+	ErrUnsignedAD = errors.New("authenticated data without signatures")
+	// ErrBadCookie means the upstream kept answering BADCOOKIE, also after retrying with the server cookie it sent.
+	ErrBadCookie = errors.New("upstream rejected the DNS cookie")
+	// ErrCircuitOpen means the circuit breaker of the upstream is open and the query wasn't sent.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+	// ErrMaxInFlight means the limit of queries in flight to the upstream was reached, see Proxy.SetMaxInFlight.
+	ErrMaxInFlight = errors.New("too many queries in flight to upstream")
+	// ErrShuttingDown means the transport to the upstream is shutting down and takes no new queries, see Transport.Shutdown.
+	ErrShuttingDown = errors.New("proxy: transport shutting down")
+	// ErrTooManyMismatched means more replies with a mismatched ID arrived over UDP than allowed, see Proxy.SetMaxMismatched.
+	ErrTooManyMismatched = errors.New("too many replies with a mismatched ID from upstream")
+	// ErrPinMismatch means the public key of the upstream's certificate doesn't match any of the SPKI pins.
+	ErrPinMismatch = errors.New("no pinned public key matches the certificate")
+	// ErrTimeout means the upstream didn't accept the connection or answer the query in time.
+	ErrTimeout = errors.New("upstream timed out")
+	// ErrConnRefused means the upstream refused the connection, or over UDP answered with port unreachable.
+	ErrConnRefused = errors.New("upstream refused the connection")
+	// ErrMalformed means the reply of the upstream couldn't be parsed.
+	ErrMalformed = errors.New("malformed reply from upstream")
+	// ErrDrained means the upstream is drained and no new connection to it is dialed, see Transport.SetDrained.
+	ErrDrained = errors.New("upstream drained")
+	// ErrFailover means the upstream replied with an rcode of Options.FailoverOnRcode, Connect returns the reply
+	// with it.
+	ErrFailover = errors.New("upstream replied with a failover rcode")
+	// ErrLocalAddr means the source address or port set with Transport.SetLocalAddr and Transport.SetLocalPort is
+	// in use or can't be assigned, so no connection to the upstream could be dialed.
+	ErrLocalAddr = errors.New("source address of the upstream connection in use or not assignable")
+	// ErrQuestionMismatch means the reply of a DoH or DoQ upstream is for another question than the query, see
+	// Options.NoQuestionCheck.
+	ErrQuestionMismatch = errors.New("reply from upstream doesn't match the question")
+	// ErrIXFRNotImplemented means the upstream answered an IXFR with NOTIMP, the zone can be asked for with an AXFR
+	// instead.
+	ErrIXFRNotImplemented = errors.New("upstream doesn't implement IXFR")
+	// ErrTransferRcode means the upstream answered a zone transfer with an rcode other than NOERROR.
+	ErrTransferRcode = errors.New("upstream refused the zone transfer")
+	// ErrTransferTooLarge means a zone transfer went over the limits set with Proxy.SetMaxTransferSize.
+	ErrTransferTooLarge = errors.New("zone transfer exceeds the maximum size")
 )
 
+// classifyError wraps err, an error Connect got while talking to the upstream, with ErrTimeout, ErrConnRefused or
+// ErrMalformed when it is one of those, so callers can tell them apart with errors.Is. The original error is
+// wrapped as well. Other errors are returned as is.
+func classifyError(err error) error {
+	var (
+		nerr net.Error
+		derr *dns.Error
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errMuxTimeout), errors.As(err, &nerr) && nerr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %w", ErrConnRefused, err)
+	case errors.As(err, &derr):
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return err
+}
+
+// ErrorKind returns the kind of an error returned by Connect as a short name for metric labels and logs:
+// "timeout", "refused", "malformed", "cached_closed", "circuit_open", "max_inflight", "shutting_down", "drained",
+// "failover", "local_addr", "transfer", "canceled" when the query was abandoned, or "other".
+func ErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrConnRefused):
+		return "refused"
+	case errors.Is(err, ErrMalformed), errors.Is(err, ErrQuestionMismatch):
+		return "malformed"
+	case errors.Is(err, ErrCachedClosed):
+		return "cached_closed"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrMaxInFlight):
+		return "max_inflight"
+	case errors.Is(err, ErrShuttingDown):
+		return "shutting_down"
+	case errors.Is(err, ErrDrained):
+		return "drained"
+	case errors.Is(err, ErrFailover):
+		return "failover"
+	case errors.Is(err, ErrLocalAddr):
+		return "local_addr"
+	case errors.Is(err, ErrIXFRNotImplemented), errors.Is(err, ErrTransferRcode), errors.Is(err, ErrTransferTooLarge):
+		return "transfer"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "other"
+}
+
 // Options holds various Options that can be set.
 type Options struct {
 	// ForceTCP use TCP protocol for upstream DNS request. Has precedence over PreferUDP flag
@@ -23,4 +123,105 @@ type Options struct {
 	HCRecursionDesired bool
 	// HCDomain sets domain for Proxy healthcheck requests
 	HCDomain string
+	// HCQType sets the query type for Proxy healthcheck requests
+	HCQType uint16
+	// Padding pads queries sent over an encrypted transport (TLS, QUIC or HTTPS) to a multiple of this
+	// block size with the EDNS0 padding option (RFC 7830). 0 disables padding.
+	Padding int
+	// EnableCookies adds a DNS Cookie (RFC 7873) to queries sent over UDP and remembers the
+	// server cookie of the upstream for the next query.
+	EnableCookies bool
+	// Case0x20 randomizes the case of the query name sent over UDP and TCP, replies that don't echo
+	// the exact casing are dropped. Only the first question is randomized.
+	Case0x20 bool
+	// SetDO sets the DO bit on queries to the upstream, adding an OPT record when needed.
+	SetDO bool
+	// StrictAD rejects responses with the AD bit set that carry no RRSIGs with ErrUnsignedAD.
+	StrictAD bool
+	// RetryTCPOnTruncated makes Connect send the query again over TCP when the reply over UDP is truncated,
+	// the TCP reply is returned instead.
+	RetryTCPOnTruncated bool
+	// PreferTCPLarge sends a query that would go over UDP over TCP instead when its reply likely doesn't fit:
+	// for ANY and DNSKEY, and for questions whose last reply over UDP was truncated, see SetTruncationHistory.
+	PreferTCPLarge bool
+	// TCPKeepalive adds the edns-tcp-keepalive option (RFC 7828) to queries sent over TCP and TLS. The idle
+	// timeout the upstream sends back limits how long its connections are cached.
+	TCPKeepalive bool
+	// NoQuestionCheck accepts replies whose question doesn't match the name and type of the query. By default
+	// such replies are dropped like replies with another message ID, and counted as unmatched. Over DoH and DoQ,
+	// where no other reply follows, the query fails with ErrQuestionMismatch.
+	NoQuestionCheck bool
+	// Fanout is the number of upstreams ConnectFanout sends a query to at the same time. Connect ignores it.
+	Fanout int
+	// Hooks are called by Connect with the query that is sent and the reply it returns, nil calls none.
+	Hooks *Hooks
+	// FailoverOnRcode are the rcodes that make Connect treat a reply as a soft failure: the reply is returned
+	// together with an error wrapping ErrFailover, so the caller can try the next upstream and still fall back
+	// to it. It isn't counted against the health of the upstream. See DefaultFailoverRcodes.
+	FailoverOnRcode RcodeSet
+}
+
+// Stages of a query on a connection, for connErrorCategory.
+const (
+	stageDial  = "dial"
+	stageWrite = "write"
+	stageRead  = "read"
+	stageAny   = "" // an exchange where writing and reading can't be told apart
+)
+
+// connErrorCategory returns the category of err, which happened at stage of a query on a connection:
+// "dial_timeout", "read_timeout", "eof", "tls", "write", "local_addr" or "other".
+func connErrorCategory(stage string, err error) string {
+	var (
+		nerr      net.Error
+		recordErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr), errors.Is(err, ErrPinMismatch):
+		return "tls"
+	case errors.Is(err, ErrLocalAddr):
+		return "local_addr"
+	case errors.Is(err, ErrIXFRNotImplemented), errors.Is(err, ErrTransferRcode), errors.Is(err, ErrTransferTooLarge):
+		return "transfer"
+	case stage == stageWrite:
+		return "write"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &nerr) && nerr.Timeout(), errors.Is(err, errMuxTimeout):
+		if stage == stageDial {
+			return "dial_timeout"
+		}
+		return "read_timeout"
+	}
+	return "other"
+}
+
+// dialErrorCategory returns the category of err, an error establishing a connection: "refused", "unreachable",
+// or one of the categories of connErrorCategory.
+func dialErrorCategory(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	}
+	return connErrorCategory(stageDial, err)
+}
+
+// countDialFailure counts err, an error dialing over proto, in dial_failures_total, unless the query was abandoned.
+func (t *Transport) countDialFailure(ctx context.Context, proto string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	dialFailuresCount.WithLabelValues(t.proxyName, t.addr, proto, dialErrorCategory(err)).Add(1)
+}
+
+// countConnError counts err in conn_errors_total, unless the query was abandoned.
+func (t *Transport) countConnError(ctx context.Context, stage string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	connErrorsCount.WithLabelValues(t.proxyName, t.addr, connErrorCategory(stage, err)).Add(1)
 }
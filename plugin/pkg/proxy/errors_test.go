@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectErrorKind(t *testing.T) {
+	silent := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer silent.Close()
+
+	garbage := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.Write([]byte{0, 1, 2})
+	})
+	defer garbage.Close()
+
+	// A port nothing listens on, the upstream answers with port unreachable.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	closed := l.LocalAddr().String()
+	l.Close()
+
+	tests := []struct {
+		addr     string
+		expected error
+		kind     string
+		category string
+	}{
+		{silent.Addr, ErrTimeout, "timeout", "read_timeout"},
+		{garbage.Addr, ErrMalformed, "malformed", "other"},
+		{closed, ErrConnRefused, "refused", "other"},
+	}
+
+	for i, tc := range tests {
+		p := NewProxy("TestConnectErrorKind", tc.addr, transport.DNS)
+		p.readTimeout = 100 * time.Millisecond
+		p.Start(5 * time.Second)
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		_, _, err := p.Connect(context.Background(), req, Options{})
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, tc.expected, err)
+		}
+		if kind := ErrorKind(err); kind != tc.kind {
+			t.Errorf("Test %d: expected kind %q, got %q", i, tc.kind, kind)
+		}
+		if x := testutil.ToFloat64(connErrorsCount.WithLabelValues("TestConnectErrorKind", tc.addr, tc.category)); x != 1 {
+			t.Errorf("Test %d: expected 1 connection error of category %q, got %v", i, tc.category, x)
+		}
+		p.Stop()
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{ErrCachedClosed, "cached_closed"},
+		{ErrCircuitOpen, "circuit_open"},
+		{ErrMaxInFlight, "max_inflight"},
+		{ErrShuttingDown, "shutting_down"},
+		{ErrDrained, "drained"},
+		{fmt.Errorf("%w: SERVFAIL", ErrFailover), "failover"},
+		{fmt.Errorf("%w: %w", ErrLocalAddr, syscall.EADDRINUSE), "local_addr"},
+		{context.Canceled, "canceled"},
+		{classifyError(errMuxTimeout), "timeout"},
+		{classifyError(dns.ErrRdata), "malformed"},
+		{classifyError(ErrBadCookie), "other"},
+	}
+	for i, tc := range tests {
+		if kind := ErrorKind(tc.err); kind != tc.kind {
+			t.Errorf("Test %d: expected kind %q for %v, got %q", i, tc.kind, tc.err, kind)
+		}
+	}
+
+	// The original error stays visible.
+	if err := classifyError(errMuxTimeout); !errors.Is(err, errMuxTimeout) {
+		t.Errorf("Expected the original error to be wrapped, got %v", err)
+	}
+}
+
+func TestConnErrorCategory(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		stage    string
+		err      error
+		category string
+	}{
+		{stageDial, timeout, "dial_timeout"},
+		{stageRead, timeout, "read_timeout"},
+		{stageAny, errMuxTimeout, "read_timeout"},
+		{stageRead, io.EOF, "eof"},
+		{stageRead, fmt.Errorf("read: %w", io.ErrUnexpectedEOF), "eof"},
+		{stageDial, tls.AlertError(40), "tls"},
+		{stageDial, &tls.CertificateVerificationError{Err: errors.New("unknown authority")}, "tls"},
+		{stageDial, fmt.Errorf("handshake: %w", ErrPinMismatch), "tls"},
+		{stageWrite, io.EOF, "write"},
+		{stageDial, (&Transport{}).localAddrError(&net.OpError{Op: "dial", Net: "udp", Err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)}), "local_addr"},
+		{stageDial, errors.New("connection refused"), "other"},
+	}
+	for i, tc := range tests {
+		if x := connErrorCategory(tc.stage, tc.err); x != tc.category {
+			t.Errorf("Test %d: expected category %q for %v, got %q", i, tc.category, tc.err, x)
+		}
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	// A port nothing listens on, over TCP the dial is refused, over UDP only the query fails.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	closed := l.LocalAddr().String()
+	l.Close()
+
+	p := NewProxy("TestDialFailures", closed, transport.DNS)
+	p.readTimeout = 100 * time.Millisecond
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	p.Connect(context.Background(), req, Options{})
+	if x := testutil.ToFloat64(dialFailuresCount.WithLabelValues("TestDialFailures", closed, "udp", "refused")); x != 0 {
+		t.Errorf("Expected no dial failure over UDP, got %v", x)
+	}
+	p.Connect(context.Background(), req, Options{ForceTCP: true})
+	if x := testutil.ToFloat64(dialFailuresCount.WithLabelValues("TestDialFailures", closed, "tcp", "refused")); x != 1 {
+		t.Errorf("Expected 1 refused dial over TCP, got %v", x)
+	}
+}
+
+func TestDialErrorCategory(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		err      error
+		category string
+	}{
+		{dialErr(syscall.ECONNREFUSED), "refused"},
+		{dialErr(syscall.EHOSTUNREACH), "unreachable"},
+		{dialErr(syscall.ENETUNREACH), "unreachable"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, "dial_timeout"},
+		{tls.AlertError(40), "tls"},
+		{errors.New("no route"), "other"},
+	}
+	for i, tc := range tests {
+		if x := dialErrorCategory(tc.err); x != tc.category {
+			t.Errorf("Test %d: expected category %q for %v, got %q", i, tc.category, tc.err, x)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// Event describes a query Connect sent to the upstream and the reply it accepted.
+type Event struct {
+	ProxyName string
+	Addr      string // address of the upstream
+	Proto     string // protocol the query was sent over: udp, tcp, tcp-tls, https or quic
+	// Cached is whether the query went over a connection from the connection cache. Pipelined and
+	// DNS-over-HTTPS queries don't use it and are never cached.
+	Cached bool
+	Client net.Addr      // address of the client that sent the query
+	Sent   time.Time     // when the query was written to the upstream
+	RTT    time.Duration // round-trip time of the query
+	Query  *dns.Msg
+	Reply  *dns.Msg
+}
+
+// EventSink receives an Event for each reply Connect accepts, see Proxy.SetEventSink. Event is called on the
+// path of the query, a sink that may block should be wrapped in an AsyncSink. The messages of the event are
+// those of the caller of Connect, they must not be changed or kept after Event returns.
+type EventSink interface {
+	Event(Event)
+}
+
+// nopSink is the EventSink of a Proxy without one.
+type nopSink struct{}
+
+func (nopSink) Event(Event) {}
+
+// sinkHolder holds the EventSink of a Proxy, so it can be swapped atomically while queries are sent.
+type sinkHolder struct{ EventSink }
+
+// SetEventSink sets the sink the events of p are sent to, nil sends them nowhere. It is safe to call while
+// queries are sent.
+func (p *Proxy) SetEventSink(s EventSink) {
+	if s == nil {
+		s = nopSink{}
+	}
+	p.sink.Store(&sinkHolder{s})
+}
+
+// AsyncSink passes the events to another EventSink from its own goroutine, so a slow sink doesn't hold up
+// the queries. Events that don't fit in its buffer are dropped and counted.
+type AsyncSink struct {
+	sink   EventSink
+	events chan Event
+	done   chan struct{}
+
+	mu     sync.RWMutex // held for reading while an event is buffered, for writing by Close
+	closed bool
+}
+
+// NewAsyncSink returns an AsyncSink that buffers up to size events for s. Close must be called to stop it.
+func NewAsyncSink(s EventSink, size int) *AsyncSink {
+	a := &AsyncSink{sink: s, events: make(chan Event, size), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+// Event implements EventSink. The messages are copied, as the caller of Connect keeps using them.
+func (a *AsyncSink) Event(ev Event) {
+	if ev.Query != nil {
+		ev.Query = ev.Query.Copy()
+	}
+	if ev.Reply != nil {
+		ev.Reply = ev.Reply.Copy()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		eventsDroppedCount.WithLabelValues(ev.ProxyName, ev.Addr).Add(1)
+		return
+	}
+	select {
+	case a.events <- ev:
+	default:
+		eventsDroppedCount.WithLabelValues(ev.ProxyName, ev.Addr).Add(1)
+	}
+}
+
+// Close stops a after the events in its buffer are passed on. Events sent after Close are dropped and counted.
+func (a *AsyncSink) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.closed = true
+		close(a.done)
+	}
+}
+
+func (a *AsyncSink) run() {
+	for {
+		select {
+		case ev := <-a.events:
+			a.sink.Event(ev)
+		case <-a.done:
+			for {
+				select {
+				case ev := <-a.events:
+					a.sink.Event(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Tapper is what DnstapSink sends dnstap messages to, the dnstap plugin implements it.
+type Tapper interface {
+	TapMessage(*tap.Message)
+}
+
+// DnstapSink is an EventSink that turns each event into a FORWARDER_QUERY and a FORWARDER_RESPONSE dnstap
+// message. The dnstap plugin taps synchronously, use it in an AsyncSink.
+type DnstapSink struct {
+	Tapper Tapper
+	// IncludeRawMessage adds the packed query and reply to the messages.
+	IncludeRawMessage bool
+}
+
+// Event implements EventSink.
+func (d DnstapSink) Event(ev Event) {
+	to := tapAddr(ev.Addr)
+	proto := tapProtocol(ev.Proto)
+
+	q := new(tap.Message)
+	msg.SetType(q, tap.Message_FORWARDER_QUERY)
+	msg.SetQueryTime(q, ev.Sent)
+	if ev.Client != nil {
+		msg.SetQueryAddress(q, ev.Client)
+	}
+	if to != nil {
+		msg.SetResponseAddress(q, to)
+	}
+	q.SocketProtocol = &proto
+	if d.IncludeRawMessage && ev.Query != nil {
+		q.QueryMessage, _ = ev.Query.Pack()
+	}
+	d.Tapper.TapMessage(q)
+
+	r := new(tap.Message)
+	msg.SetType(r, tap.Message_FORWARDER_RESPONSE)
+	msg.SetQueryTime(r, ev.Sent)
+	msg.SetResponseTime(r, ev.Sent.Add(ev.RTT))
+	if ev.Client != nil {
+		msg.SetQueryAddress(r, ev.Client)
+	}
+	if to != nil {
+		msg.SetResponseAddress(r, to)
+	}
+	r.SocketProtocol = &proto
+	if d.IncludeRawMessage && ev.Reply != nil {
+		r.ResponseMessage, _ = ev.Reply.Pack()
+	}
+	d.Tapper.TapMessage(r)
+}
+
+// tapAddr returns the address of the upstream addr for a dnstap message, nil when addr is a hostname, as DoH
+// upstreams can be. The URL path of a DoH upstream is left out. The protocol of the address is set by the
+// caller.
+func tapAddr(addr string) net.Addr {
+	host, _, _ := strings.Cut(addr, "/")
+	ap, err := netip.ParseAddrPort(host)
+	if err != nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: net.IP(ap.Addr().Unmap().AsSlice()), Port: int(ap.Port())}
+}
+
+// tapProtocol returns the dnstap socket protocol of proto. dnstap has no protocol for DNS-over-QUIC yet, it is
+// UDP underneath.
+func tapProtocol(proto string) tap.SocketProtocol {
+	switch proto {
+	case "tcp":
+		return tap.SocketProtocol_TCP
+	case "tcp-tls":
+		return tap.SocketProtocol_DOT
+	case "https":
+		return tap.SocketProtocol_DOH
+	}
+	return tap.SocketProtocol_UDP
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type eventsRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventsRecorder) Event(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func TestEventSink(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	rec := &eventsRecorder{}
+	p := NewProxy("TestEventSink", s.Addr, transport.DNS)
+	p.SetEventSink(rec)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	for range 2 {
+		if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+	}
+
+	if len(rec.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(rec.events))
+	}
+	for i, ev := range rec.events {
+		if ev.ProxyName != "TestEventSink" || ev.Addr != s.Addr || ev.Proto != "udp" {
+			t.Errorf("Event %d: expected TestEventSink, %s and udp, got %s, %s and %s", i, s.Addr, ev.ProxyName, ev.Addr, ev.Proto)
+		}
+		if ev.Cached != (i == 1) {
+			t.Errorf("Event %d: expected cached to be %t", i, i == 1)
+		}
+		if ev.RTT <= 0 || ev.Sent.IsZero() {
+			t.Errorf("Event %d: expected a round-trip time, got %s sent at %s", i, ev.RTT, ev.Sent)
+		}
+		if ev.Reply == nil || ev.Reply.Rcode != dns.RcodeNameError || ev.Query != m {
+			t.Errorf("Event %d: expected the query and the NXDOMAIN reply, got %v", i, ev.Reply)
+		}
+		if ev.Client == nil {
+			t.Errorf("Event %d: expected the address of the client", i)
+		}
+	}
+
+	// Without a sink the events go nowhere.
+	p.SetEventSink(nil)
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if len(rec.events) != 2 {
+		t.Errorf("Expected no more events, got %d", len(rec.events))
+	}
+}
+
+type blockingSink struct {
+	unblock chan struct{}
+	eventsRecorder
+}
+
+func (b *blockingSink) Event(ev Event) {
+	<-b.unblock
+	b.eventsRecorder.Event(ev)
+}
+
+func TestAsyncSink(t *testing.T) {
+	b := &blockingSink{unblock: make(chan struct{})}
+	a := NewAsyncSink(b, 1)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ev := Event{ProxyName: "TestAsyncSink", Addr: "127.0.0.1:53", Query: m}
+
+	dropped := eventsDroppedCount.WithLabelValues("TestAsyncSink", "127.0.0.1:53")
+	before := testutil.ToFloat64(dropped)
+
+	// The first event is taken by the goroutine, the second fills the buffer, the third is dropped.
+	a.Event(ev)
+	for range 100 {
+		if len(a.events) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Event(ev)
+	a.Event(ev)
+	if x := testutil.ToFloat64(dropped) - before; x != 1 {
+		t.Errorf("Expected 1 dropped event, got %v", x)
+	}
+
+	// The messages are copies, the caller may change its own.
+	m.Id = 42
+	close(b.unblock)
+	a.Close()
+	for range 100 {
+		b.mu.Lock()
+		n := len(b.events)
+		b.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// An event after Close is dropped.
+	a.Event(ev)
+	if x := testutil.ToFloat64(dropped) - before; x != 2 {
+		t.Errorf("Expected the event after Close to be dropped, got %v dropped events", x)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) != 2 {
+		t.Fatalf("Expected 2 events passed on, got %d", len(b.events))
+	}
+	if b.events[0].Query == m || b.events[0].Query.Id == 42 {
+		t.Error("Expected the query of the event to be a copy")
+	}
+}
+
+type tapRecorder struct{ msgs []*tap.Message }
+
+func (t *tapRecorder) TapMessage(m *tap.Message) { t.msgs = append(t.msgs, m) }
+
+func TestDnstapSink(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.org.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	tr := &tapRecorder{}
+	sent := time.Now()
+	DnstapSink{Tapper: tr, IncludeRawMessage: true}.Event(Event{
+		Addr: "127.0.0.1:53", Proto: "tcp", Client: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242},
+		Sent: sent, RTT: 10 * time.Millisecond, Query: q, Reply: r,
+	})
+
+	if len(tr.msgs) != 2 {
+		t.Fatalf("Expected 2 dnstap messages, got %d", len(tr.msgs))
+	}
+	query, resp := tr.msgs[0], tr.msgs[1]
+	if query.GetType() != tap.Message_FORWARDER_QUERY || resp.GetType() != tap.Message_FORWARDER_RESPONSE {
+		t.Errorf("Expected a forwarder query and response, got %s and %s", query.GetType(), resp.GetType())
+	}
+	if len(query.QueryMessage) == 0 || len(resp.ResponseMessage) == 0 {
+		t.Error("Expected the raw messages")
+	}
+	if x := net.IP(resp.ResponseAddress).String(); x != "127.0.0.1" || resp.GetResponsePort() != 53 {
+		t.Errorf("Expected the upstream as response address, got %s:%d", x, resp.GetResponsePort())
+	}
+	if x := time.Duration(int64(resp.GetResponseTimeSec()-query.GetQueryTimeSec())*int64(time.Second) + int64(resp.GetResponseTimeNsec()) - int64(query.GetQueryTimeNsec())); x != 10*time.Millisecond {
+		t.Errorf("Expected the response 10ms after the query, got %s", x)
+	}
+}
+
+func TestDnstapSinkProto(t *testing.T) {
+	tests := []struct {
+		addr, proto string
+		expected    tap.SocketProtocol
+		ip          string // empty when the address is left out
+	}{
+		{"127.0.0.1:53", "udp", tap.SocketProtocol_UDP, "127.0.0.1"},
+		{"127.0.0.1:53", "tcp", tap.SocketProtocol_TCP, "127.0.0.1"},
+		{"[::1]:853", "tcp-tls", tap.SocketProtocol_DOT, "::1"},
+		{"127.0.0.1:443/dns-query", "https", tap.SocketProtocol_DOH, "127.0.0.1"},
+		{"dns.example.com:443/dns-query", "https", tap.SocketProtocol_DOH, ""},
+		{"127.0.0.1:853", "quic", tap.SocketProtocol_UDP, "127.0.0.1"},
+	}
+	for _, tc := range tests {
+		tr := &tapRecorder{}
+		DnstapSink{Tapper: tr}.Event(Event{Addr: tc.addr, Proto: tc.proto, Client: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242}})
+		for _, m := range tr.msgs {
+			if x := m.GetSocketProtocol(); x != tc.expected {
+				t.Errorf("%s over %s: expected socket protocol %s, got %s", tc.addr, tc.proto, tc.expected, x)
+			}
+			if tc.ip == "" {
+				if m.ResponseAddress != nil {
+					t.Errorf("%s over %s: expected no response address, got %s", tc.addr, tc.proto, net.IP(m.ResponseAddress))
+				}
+				continue
+			}
+			if x := net.IP(m.ResponseAddress).String(); x != tc.ip {
+				t.Errorf("%s over %s: expected response address %s, got %s", tc.addr, tc.proto, tc.ip, x)
+			}
+		}
+	}
+}
+
+func TestSetEventSinkConcurrent(t *testing.T) {
+	var queries atomic.Int32
+	s := newDelayServer(0, &queries)
+	defer s.Close()
+
+	p := NewProxy("TestSetEventSinkConcurrent", s.Addr, transport.DNS)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// Run with -race: the sink is swapped while queries are sent.
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for range 10 {
+			p.SetEventSink(&eventsRecorder{})
+			p.SetEventSink(nil)
+		}
+	})
+	for range 10 {
+		if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+			t.Errorf("Failed to connect: %s", err)
+		}
+	}
+	wg.Wait()
+}
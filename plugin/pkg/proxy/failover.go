@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// RcodeSet is a set of rcodes, see Options.FailoverOnRcode. The zero value is the empty set. Only the rcodes
+// below 64 can be in it, which covers all rcodes but the extended ones of TSIG and TKEY.
+type RcodeSet uint64
+
+// NewRcodeSet returns the set of rcodes, rcodes of 64 and above are ignored.
+func NewRcodeSet(rcodes ...int) RcodeSet {
+	var s RcodeSet
+	for _, rcode := range rcodes {
+		if rcode >= 0 && rcode < 64 {
+			s |= 1 << rcode
+		}
+	}
+	return s
+}
+
+// Has returns true if rcode is in s.
+func (s RcodeSet) Has(rcode int) bool { return rcode >= 0 && rcode < 64 && s&(1<<rcode) != 0 }
+
+// DefaultFailoverRcodes are SERVFAIL and REFUSED. NXDOMAIN is an authoritative answer and is never failed over
+// on, unless asked for.
+var DefaultFailoverRcodes = NewRcodeSet(dns.RcodeServerFailure, dns.RcodeRefused)
+
+// failover returns an error wrapping ErrFailover when the rcode of ret is in opts.FailoverOnRcode, and counts it.
+func (p *Proxy) failover(ret *dns.Msg, opts Options) error {
+	if !opts.FailoverOnRcode.Has(ret.Rcode) {
+		return nil
+	}
+	rcode := dns.RcodeToString[ret.Rcode]
+	failoverCount.WithLabelValues(p.proxyName, p.addr, rcode).Add(1)
+	return fmt.Errorf("%w: %s", ErrFailover, rcode)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRcodeSet(t *testing.T) {
+	s := NewRcodeSet(dns.RcodeServerFailure, dns.RcodeBadCookie, 4000)
+	for rcode, expected := range map[int]bool{
+		dns.RcodeServerFailure: true,
+		dns.RcodeBadCookie:     true,
+		dns.RcodeSuccess:       false,
+		dns.RcodeNameError:     false,
+		4000:                   false,
+		-1:                     false,
+	} {
+		if x := s.Has(rcode); x != expected {
+			t.Errorf("Expected Has(%d) to be %t, got %t", rcode, expected, x)
+		}
+	}
+	if DefaultFailoverRcodes.Has(dns.RcodeNameError) {
+		t.Error("Expected NXDOMAIN not to be failed over on by default")
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectFailover", s.Addr, transport.DNS)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	ret, _, err := p.Connect(context.Background(), req, Options{})
+	if err != nil || ret.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL without an error, got %v and %v", ret, err)
+	}
+
+	ret, _, err = p.Connect(context.Background(), req, Options{FailoverOnRcode: DefaultFailoverRcodes})
+	if !errors.Is(err, ErrFailover) {
+		t.Fatalf("Expected ErrFailover, got %v", err)
+	}
+	if ret == nil || ret.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected the SERVFAIL reply with the error, got %v", ret)
+	}
+	if x := testutil.ToFloat64(failoverCount.WithLabelValues("TestConnectFailover", s.Addr, "SERVFAIL")); x != 1 {
+		t.Errorf("Expected 1 failover on SERVFAIL, got %v", x)
+	}
+	if p.Fails() != 0 {
+		t.Errorf("Expected a failover not to count as a failure, got %d fails", p.Fails())
+	}
+}
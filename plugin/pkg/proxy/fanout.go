@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// ConnectFanout sends the query in state to the first opts.Fanout of proxies at the same time and returns the
+// first reply that came without an error, with the proxy that sent it. The queries to the other proxies are
+// canceled then, their connections are closed as a reply may still be on the way. When all queries fail, the
+// error of the last one to fail is returned with its proxy, and its reply for ErrFailover. Each query gets a
+// copy of state.Req, as Connect changes the message while sending it. Zone transfers are not supported, use
+// Connect for those.
+func ConnectFanout(ctx context.Context, proxies []*Proxy, state request.Request, opts Options) (*dns.Msg, *Proxy, error) {
+	n := min(max(opts.Fanout, 1), len(proxies))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ret *dns.Msg
+		p   *Proxy
+		err error
+		up  Upstream
+		ok  bool // whether up is set
+	}
+	results := make(chan result, n) // never blocks, so the losers don't leak
+	for _, p := range proxies[:n] {
+		go func() {
+			// Each query records its upstream on its own, only the one returned ends up in ctx.
+			qctx := WithUpstream(ctx)
+			req := request.Request{Req: state.Req.Copy(), W: state.W}
+			ret, _, err := p.Connect(qctx, req, opts)
+			up, ok := UpstreamFromContext(qctx)
+			results <- result{ret, p, err, up, ok}
+		}()
+	}
+
+	var last result
+	defer func() {
+		if last.ok {
+			recordUpstream(ctx, last.up)
+		}
+	}()
+	for range n {
+		last = <-results
+		if last.err == nil {
+			fanoutWinsCount.WithLabelValues(last.p.proxyName, last.p.addr).Add(1)
+			return last.ret, last.p, nil
+		}
+	}
+	return last.ret, last.p, last.err
+}
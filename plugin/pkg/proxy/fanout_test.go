@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectFanout(t *testing.T) {
+	slow := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer slow.Close()
+	fast := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer fast.Close()
+
+	ps := []*Proxy{
+		NewProxy("TestConnectFanout", slow.Addr, transport.DNS),
+		NewProxy("TestConnectFanout", fast.Addr, transport.DNS),
+	}
+	for _, p := range ps {
+		defer p.transport.Stop()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Id = 42
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	begin := time.Now()
+	ret, p, err := ConnectFanout(context.Background(), ps, req, Options{Fanout: 2})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if d := time.Since(begin); d > 250*time.Millisecond {
+		t.Errorf("Expected the reply of the fast upstream, took %s", d)
+	}
+	if p != ps[1] || len(ret.Answer) != 1 {
+		t.Errorf("Expected the reply of %s, got one of %s with %d answers", fast.Addr, p.Addr(), len(ret.Answer))
+	}
+	if ret.Id != 42 || m.Id != 42 {
+		t.Errorf("Expected the message ID to be kept, got %d and %d", ret.Id, m.Id)
+	}
+	if x := testutil.ToFloat64(fanoutWinsCount.WithLabelValues("TestConnectFanout", fast.Addr)); x != 1 {
+		t.Errorf("Expected 1 win for the fast upstream, got %v", x)
+	}
+
+	// The query to the slow upstream is canceled, its connection closed instead of cached.
+	time.Sleep(50 * time.Millisecond)
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestConnectFanout", slow.Addr, "udp", closeCanceled)); x != 1 {
+		t.Errorf("Expected the connection to the slow upstream to be closed, got %v", x)
+	}
+	// The winner's connection is cached for the next query.
+	ps[1].transport.mu.Lock()
+	if x := len(ps[1].transport.conns[typeUDP]); x != 1 {
+		t.Errorf("Expected 1 cached connection to the fast upstream, got %d", x)
+	}
+	ps[1].transport.mu.Unlock()
+
+	// With a degree of 1 only the first upstream is asked.
+	ret, p, err = ConnectFanout(context.Background(), ps, req, Options{Fanout: 1})
+	if err != nil || p != ps[0] || len(ret.Answer) != 0 {
+		t.Errorf("Expected the reply of %s, got %v from %s", slow.Addr, err, p.Addr())
+	}
+}
+
+func TestConnectFanoutAllFail(t *testing.T) {
+	ps := []*Proxy{
+		NewProxy("TestConnectFanoutAllFail", "127.0.0.1:1", transport.DNS),
+		NewProxy("TestConnectFanoutAllFail", "127.0.0.1:2", transport.DNS),
+	}
+	for _, p := range ps {
+		defer p.transport.Stop()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	ret, p, err := ConnectFanout(context.Background(), ps, req, Options{Fanout: 3, ForceTCP: true})
+	if err == nil || ret != nil {
+		t.Errorf("Expected an error, got a reply %v", ret)
+	}
+	if p == nil {
+		t.Error("Expected the proxy of the last error")
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// fastOpenConn is a TCP connection dialed with Fast Open. The dial returns before the handshake, which is done
+// with the first write, so the dial time is recorded once that write is done.
+type fastOpenConn struct {
+	net.Conn
+	t     *Transport
+	start time.Time // when the dial started
+	once  sync.Once
+}
+
+func (c *fastOpenConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.once.Do(func() {
+		if err == nil {
+			c.t.updateDialTimeout(time.Since(c.start))
+		}
+	})
+	return n, err
+}
+
+// NetConn returns the TCP connection underneath c.
+func (c *fastOpenConn) NetConn() net.Conn { return c.Conn }
+
+// netConn returns the connection underneath the TLS and Fast Open wrappers of c.
+func netConn(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = w.NetConn()
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// happyEyeballsHeadStart is how long the addresses of the preferred family are tried before the
+	// other family is raced in (RFC 8305).
+	happyEyeballsHeadStart = 250 * time.Millisecond
+	// familyFailureMemory is how long IPv4 is tried first after IPv6 lost a race.
+	familyFailureMemory = 5 * time.Minute
+)
+
+// errNoCandidates is returned by a race when one family has no addresses.
+var errNoCandidates = errors.New("proxy: no addresses to dial")
+
+// SetCandidates makes the transport dial addrs, the IP:port addresses the upstream name resolved to, instead
+// of its own address, which is kept for the metrics and as the TLS server name. Dials over tcp and tcp-tls
+// race the IPv6 addresses with a head start of happyEyeballsHeadStart against the IPv4 addresses, and use
+// the first connection established. When IPv6 loses, IPv4 gets the head start for familyFailureMemory.
+// Dials over udp, which can't tell whether the upstream is reachable, and health checks use the address
+// that won the last race. DNS-over-HTTPS and DNS-over-QUIC upstreams are not affected.
+func (t *Transport) SetCandidates(addrs []string) { t.candidates = addrs }
+
+// addrInUse returns the address that won the last race, or before any race the first candidate of the
+// preferred family. Without candidates it is the address of the transport.
+func (t *Transport) addrInUse() string {
+	if addr := t.lastAddr.Load(); addr != nil {
+		return *addr
+	}
+	first, second := t.candidateFamilies()
+	if len(first) > 0 {
+		return first[0]
+	}
+	if len(second) > 0 {
+		return second[0]
+	}
+	return t.addr
+}
+
+// candidateFamilies splits the candidates into those of the preferred family and the others.
+func (t *Transport) candidateFamilies() (first, second []string) {
+	var v4, v6 []string
+	for _, addr := range t.candidates {
+		if ap, err := netip.ParseAddrPort(addr); err == nil && ap.Addr().Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	if time.Now().UnixNano() < atomic.LoadInt64(&t.v6Failed) {
+		return v4, v6
+	}
+	return v6, v4
+}
+
+// dialAddr dials the upstream over network, through the SOCKS5 proxy when one is set, or racing the
+// candidates when there are any. A Unix domain socket upstream is always dialed as a stream.
+func (t *Transport) dialAddr(ctx context.Context, network string, timeout time.Duration) (net.Conn, error) {
+	if t.unix {
+		d := &net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, "unix", t.addr)
+	}
+	if t.socksAddr != "" {
+		return t.dialSOCKS5(ctx, network, timeout)
+	}
+	if len(t.candidates) == 0 {
+		return t.dialer(network, t.addr, timeout).DialContext(ctx, network, t.addr)
+	}
+	if network == "udp" {
+		addr := t.addrInUse()
+		return t.dialer(network, addr, timeout).DialContext(ctx, network, addr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn  net.Conn
+		addr  string
+		first bool
+		err   error
+	}
+	results := make(chan result, 2) // never blocks, so the loser doesn't leak
+	race := func(addrs []string, first bool) {
+		err := errNoCandidates
+		for _, addr := range addrs {
+			conn, e := t.dialer(network, addr, timeout).DialContext(ctx, network, addr)
+			if e == nil {
+				results <- result{conn, addr, first, nil}
+				return
+			}
+			err = e
+		}
+		results <- result{nil, "", first, err}
+	}
+
+	first, second := t.candidateFamilies()
+	go race(first, true)
+	timer := time.NewTimer(happyEyeballsHeadStart)
+	defer timer.Stop()
+
+	pending, started := 1, false
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				t.won(res.addr, res.first)
+				// A connection of the other family that is established anyway isn't used.
+				go func(n int) {
+					for range n {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if err == nil || !errors.Is(res.err, errNoCandidates) {
+				err = res.err
+			}
+		}
+		if !started {
+			started = true
+			pending++
+			go race(second, false)
+		}
+	}
+	return nil, err
+}
+
+// won records addr as the address in use, and whether the family tried first is still preferred.
+func (t *Transport) won(addr string, first bool) {
+	t.lastAddr.Store(&addr)
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return
+	}
+	v6 := !ap.Addr().Unmap().Is4()
+	switch {
+	case v6:
+		atomic.StoreInt64(&t.v6Failed, 0)
+	case !first:
+		atomic.StoreInt64(&t.v6Failed, time.Now().Add(familyFailureMemory).UnixNano())
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+)
+
+// hasIPv6Loopback reports whether ::1 can be listened on.
+func hasIPv6Loopback() bool {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func newCandidateServer(t *testing.T) (*dnstest.Server, string) {
+	t.Helper()
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	_, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, port
+}
+
+func TestHappyEyeballsIPv6First(t *testing.T) {
+	if !hasIPv6Loopback() {
+		t.Skip("No IPv6 loopback")
+	}
+	s, port := newCandidateServer(t)
+	defer s.Close()
+
+	p := NewProxy("TestHappyEyeballsIPv6First", "dns.example.org:"+port, transport.DNS)
+	p.SetCandidates([]string{"127.0.0.1:" + port, "[::1]:" + port})
+	defer p.transport.Stop()
+
+	pc, cached, err := p.transport.Dial("tcp")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer pc.c.Close()
+	if cached {
+		t.Error("Expected a new connection")
+	}
+	// Both are reachable, IPv6 has the head start.
+	if x := pc.c.RemoteAddr().String(); x != "[::1]:"+port {
+		t.Errorf("Expected the connection to go to [::1]:%s, got %s", port, x)
+	}
+	if x := p.transport.addrInUse(); x != "[::1]:"+port {
+		t.Errorf("Expected [::1]:%s in use, got %s", port, x)
+	}
+}
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	s, port := newCandidateServer(t)
+	defer s.Close()
+
+	// Nothing listens on port 1, so IPv6 fails and IPv4 doesn't wait for the head start.
+	p := NewProxy("TestHappyEyeballsFallback", "dns.example.org:"+port, transport.DNS)
+	p.SetCandidates([]string{"[::1]:1", "127.0.0.1:" + port})
+	defer p.transport.Stop()
+
+	if x := p.transport.addrInUse(); x != "[::1]:1" {
+		t.Errorf("Expected the IPv6 address in use before the first dial, got %s", x)
+	}
+
+	begin := time.Now()
+	pc, _, err := p.transport.Dial("tcp")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	pc.c.Close()
+	if d := time.Since(begin); d >= happyEyeballsHeadStart {
+		t.Errorf("Expected IPv4 to be tried as soon as IPv6 failed, took %s", d)
+	}
+	if x := p.transport.addrInUse(); x != "127.0.0.1:"+port {
+		t.Errorf("Expected 127.0.0.1:%s in use, got %s", port, x)
+	}
+	// IPv6 lost, so IPv4 is tried first for a while.
+	if x := atomic.LoadInt64(&p.transport.v6Failed); x < time.Now().Add(familyFailureMemory-time.Minute).UnixNano() {
+		t.Errorf("Expected the IPv6 failure to be remembered")
+	}
+	if first, _ := p.transport.candidateFamilies(); len(first) != 1 || first[0] != "127.0.0.1:"+port {
+		t.Errorf("Expected IPv4 to be tried first, got %v", first)
+	}
+
+	// Health checks and UDP go to the address in use.
+	if err := p.health.Check(p); err != nil {
+		t.Errorf("Expected the health check of the address in use to succeed, got %s", err)
+	}
+	pc, _, err = p.transport.Dial("udp")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer pc.c.Close()
+	if x := pc.c.RemoteAddr().String(); x != "127.0.0.1:"+port {
+		t.Errorf("Expected the udp connection to go to 127.0.0.1:%s, got %s", port, x)
+	}
+}
+
+func TestHappyEyeballsAllFail(t *testing.T) {
+	p := NewProxy("TestHappyEyeballsAllFail", "dns.example.org:1", transport.DNS)
+	p.SetCandidates([]string{"[::1]:1", "127.0.0.1:1"})
+	defer p.transport.Stop()
+
+	if _, _, err := p.transport.Dial("tcp"); err == nil {
+		t.Error("Expected an error")
+	}
+}
@@ -1,7 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -20,7 +25,14 @@ type HealthChecker interface {
 	GetRecursionDesired() bool
 	SetDomain(domain string)
 	GetDomain() string
+	SetQType(qtype uint16)
+	GetQType() uint16
+	SetRcodes(rcodes []int)
+	GetRcodes() []int
+	SetExpectation(e *HealthExpectation)
+	GetExpectation() *HealthExpectation
 	SetTCPTransport()
+	SetUDPTransport()
 	GetReadTimeout() time.Duration
 	SetReadTimeout(time.Duration)
 	GetWriteTimeout() time.Duration
@@ -32,6 +44,9 @@ type dnsHc struct {
 	c                *dns.Client
 	recursionDesired bool
 	domain           string
+	qtype            uint16
+	rcodes           []int // healthy rcodes, when empty any reply is healthy
+	expectState
 
 	proxyName string
 }
@@ -39,9 +54,9 @@ type dnsHc struct {
 // NewHealthChecker returns a new HealthChecker based on transport.
 func NewHealthChecker(proxyName, trans string, recursionDesired bool, domain string) HealthChecker {
 	switch trans {
-	case transport.DNS, transport.TLS:
+	case transport.DNS, transport.TLS, transport.UNIX:
+		// Net is left empty, so the probe uses the same protocol as the proxy's transport.
 		c := new(dns.Client)
-		c.Net = "udp"
 		c.ReadTimeout = 1 * time.Second
 		c.WriteTimeout = 1 * time.Second
 
@@ -49,8 +64,18 @@ func NewHealthChecker(proxyName, trans string, recursionDesired bool, domain str
 			c:                c,
 			recursionDesired: recursionDesired,
 			domain:           domain,
+			qtype:            dns.TypeNS,
 			proxyName:        proxyName,
 		}
+
+	case transport.HTTPS, transport.QUIC:
+		return &transportHc{
+			recursionDesired: recursionDesired,
+			domain:           domain,
+			qtype:            dns.TypeNS,
+			readTimeout:      1 * time.Second,
+			writeTimeout:     1 * time.Second,
+		}
 	}
 
 	log.Warningf("No healthchecker for transport %q", trans)
@@ -80,10 +105,28 @@ func (h *dnsHc) GetDomain() string {
 	return h.domain
 }
 
+func (h *dnsHc) SetQType(qtype uint16) {
+	h.qtype = qtype
+}
+func (h *dnsHc) GetQType() uint16 {
+	return h.qtype
+}
+
+func (h *dnsHc) SetRcodes(rcodes []int) {
+	h.rcodes = rcodes
+}
+func (h *dnsHc) GetRcodes() []int {
+	return h.rcodes
+}
+
 func (h *dnsHc) SetTCPTransport() {
 	h.c.Net = "tcp"
 }
 
+func (h *dnsHc) SetUDPTransport() {
+	h.c.Net = "udp"
+}
+
 func (h *dnsHc) GetReadTimeout() time.Duration {
 	return h.c.ReadTimeout
 }
@@ -102,10 +145,15 @@ func (h *dnsHc) SetWriteTimeout(t time.Duration) {
 
 // For HC, we send to . IN NS +[no]rec message to the upstream. Dial timeouts and empty
 // replies are considered fails, basically anything else constitutes a healthy upstream.
+// The name and type of the probe can be changed, and the healthy replies can be limited
+// to a set of rcodes.
 
 // Check is used as the up.Func in the up.Probe.
 func (h *dnsHc) Check(p *Proxy) error {
-	err := h.send(p.addr)
+	err := h.send(p)
+	if err == nil {
+		err = h.expected(func(m *dns.Msg) (*dns.Msg, error) { return h.exchange(p, m) })
+	}
 	if err != nil {
 		healthcheckFailureCount.WithLabelValues(p.proxyName, p.addr).Add(1)
 		p.incrementFails()
@@ -116,12 +164,68 @@ func (h *dnsHc) Check(p *Proxy) error {
 	return nil
 }
 
-func (h *dnsHc) send(addr string) error {
+// client returns the client used for the probe. Unless a protocol was set explicitly, the probe goes
+// over the same protocol as the queries: tcp-tls when the transport has a TLS config, udp otherwise.
+func (h *dnsHc) client(p *Proxy) *dns.Client {
+	c := h.c
+	if c.Net == "" {
+		c = &dns.Client{Net: "udp", ReadTimeout: h.c.ReadTimeout, WriteTimeout: h.c.WriteTimeout}
+		if cfg := p.transport.tlsConfig; cfg != nil {
+			c.Net = "tcp-tls"
+			c.TLSConfig = cfg
+		}
+	}
+	// With the PROXY protocol the queries go over TCP, so does the probe.
+	if p.transport.proxyProtocol && c.Net == "udp" {
+		cc := *c
+		cc.Net = "tcp"
+		c = &cc
+	}
+	// With candidates the probe dials an IP address, the certificate is still verified for the upstream's name.
+	if c.TLSConfig != nil && len(p.transport.candidates) > 0 {
+		cc := *c
+		cc.TLSConfig = p.transport.withServerName(c.TLSConfig)
+		c = &cc
+	}
+	return c
+}
+
+func (h *dnsHc) send(p *Proxy) error {
 	ping := new(dns.Msg)
-	ping.SetQuestion(h.domain, dns.TypeNS)
+	ping.SetQuestion(h.domain, h.qtype)
 	ping.RecursionDesired = h.recursionDesired
 
-	m, _, err := h.c.Exchange(ping, addr)
+	m, err := h.exchange(p, ping)
+	if err != nil {
+		return err
+	}
+	return checkRcode(m, h.rcodes)
+}
+
+// exchange sends ping to the upstream of p over a new connection and returns the reply.
+func (h *dnsHc) exchange(p *Proxy, ping *dns.Msg) (*dns.Msg, error) {
+	c := h.client(p)
+	start := time.Now()
+	var (
+		conn *dns.Conn
+		err  error
+	)
+	switch {
+	case p.transport.unix:
+		conn, err = h.dialUnix(p)
+	case p.transport.socksAddr != "":
+		conn, err = h.dialSOCKS5(p, c)
+	default:
+		conn, err = h.dialProbe(p, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Let the probe warm up the adaptive dial timeout, also when the upstream sees no queries.
+	p.transport.updateDialTimeout(time.Since(start))
+
+	m, _, err := c.ExchangeWithConn(ping, conn)
 	// If we got a header, we're alright, basically only care about I/O errors 'n stuff.
 	if err != nil && m != nil {
 		// Silly check, something sane came back.
@@ -129,6 +233,172 @@ func (h *dnsHc) send(addr string) error {
 			err = nil
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dialProbe dials the upstream for the probe with the dialer of the transport, so it leaves from the source
+// address and interface of the queries. The source port isn't used, it may be taken by a query. With candidates
+// the address in use is probed. With the PROXY protocol the probe sends a header too, see Transport.probeHeader.
+func (h *dnsHc) dialProbe(p *Proxy, c *dns.Client) (*dns.Conn, error) {
+	timeout := p.transport.dialTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := strings.TrimSuffix(c.Net, "-tls")
+	addr := p.transport.addrInUse()
+	d := p.transport.dialer(network, addr, timeout)
+	switch local := d.LocalAddr.(type) {
+	case *net.UDPAddr:
+		d.LocalAddr = &net.UDPAddr{IP: local.IP}
+	case *net.TCPAddr:
+		d.LocalAddr = &net.TCPAddr{IP: local.IP}
+	}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err == nil {
+		conn, err = sendHeader(conn, p.transport.probeHeader())
+	}
+	if err == nil && c.Net == "tcp-tls" {
+		// As tls.Dial does, the certificate is verified for the host of addr when no server name is set.
+		cfg := c.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+		}
+		conn = tc
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn, UDPSize: c.UDPSize}, nil
+}
+
+// dialSOCKS5 dials the upstream for the probe through the SOCKS5 proxy of the transport. The probe goes over
+// tcp-tls when c uses it, and over tcp otherwise.
+func (h *dnsHc) dialSOCKS5(p *Proxy, c *dns.Client) (*dns.Conn, error) {
+	timeout := p.transport.dialTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := p.transport.dialSOCKS5(ctx, "tcp", timeout)
+	if err == nil {
+		conn, err = sendHeader(conn, p.transport.probeHeader())
+	}
+	if err == nil && c.Net == "tcp-tls" {
+		conn, err = p.transport.handshake(ctx, conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// dialUnix dials the Unix domain socket of the upstream for the probe.
+func (h *dnsHc) dialUnix(p *Proxy) (*dns.Conn, error) {
+	timeout := p.transport.dialTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := p.transport.dialAddr(ctx, "unix", timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// checkRcode returns an error if rcodes is not empty and doesn't contain the rcode of m.
+func checkRcode(m *dns.Msg, rcodes []int) error {
+	if len(rcodes) == 0 || slices.Contains(rcodes, m.Rcode) {
+		return nil
+	}
+	return fmt.Errorf("proxy: health check got unexpected rcode %s", dns.RcodeToString[m.Rcode])
+}
+
+// transportHc is a health checker for DNS-over-HTTPS and DNS-over-QUIC endpoints. The probe is
+// sent over the proxy's own transport, so it checks the same path as the queries take.
+type transportHc struct {
+	tlsConfig        *tls.Config
+	recursionDesired bool
+	domain           string
+	qtype            uint16
+	rcodes           []int // healthy rcodes, when empty any reply is healthy
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	expectState
+}
+
+func (h *transportHc) SetTLSConfig(cfg *tls.Config)    { h.tlsConfig = cfg }
+func (h *transportHc) GetTLSConfig() *tls.Config       { return h.tlsConfig }
+func (h *transportHc) SetRecursionDesired(rd bool)     { h.recursionDesired = rd }
+func (h *transportHc) GetRecursionDesired() bool       { return h.recursionDesired }
+func (h *transportHc) SetDomain(domain string)         { h.domain = domain }
+func (h *transportHc) GetDomain() string               { return h.domain }
+func (h *transportHc) SetQType(qtype uint16)           { h.qtype = qtype }
+func (h *transportHc) GetQType() uint16                { return h.qtype }
+func (h *transportHc) SetRcodes(rcodes []int)          { h.rcodes = rcodes }
+func (h *transportHc) GetRcodes() []int                { return h.rcodes }
+func (h *transportHc) SetTCPTransport()                {} // Neither DoH nor DoQ can fall back to TCP.
+func (h *transportHc) SetUDPTransport()                {} // or to UDP.
+func (h *transportHc) GetReadTimeout() time.Duration   { return h.readTimeout }
+func (h *transportHc) SetReadTimeout(t time.Duration)  { h.readTimeout = t }
+func (h *transportHc) GetWriteTimeout() time.Duration  { return h.writeTimeout }
+func (h *transportHc) SetWriteTimeout(t time.Duration) { h.writeTimeout = t }
+
+// Check is used as the up.Func in the up.Probe.
+func (h *transportHc) Check(p *Proxy) error {
+	// Any reply that made it through the transport is considered healthy, unless limited to h.rcodes.
+	err := h.send(p)
+	if err == nil {
+		err = h.expected(func(m *dns.Msg) (*dns.Msg, error) { return h.exchange(p, m) })
+	}
+	if err != nil {
+		healthcheckFailureCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+		p.incrementFails()
+		return err
+	}
+
+	atomic.StoreUint32(&p.fails, 0)
+	return nil
+}
+
+func (h *transportHc) send(p *Proxy) error {
+	ping := new(dns.Msg)
+	ping.SetQuestion(h.domain, h.qtype)
+	ping.RecursionDesired = h.recursionDesired
+
+	m, err := h.exchange(p, ping)
+	if err != nil {
+		return err
+	}
+	return checkRcode(m, h.rcodes)
+}
 
-	return err
+// exchange sends ping to the upstream of p over its DoH or DoQ transport and returns the reply.
+func (h *transportHc) exchange(p *Proxy, ping *dns.Msg) (*dns.Msg, error) {
+	if p.transport.dohURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), h.readTimeout+h.writeTimeout)
+		defer cancel()
+		return p.transport.exchangeHTTPS(ctx, ping)
+	}
+
+	pc, _, err := p.transport.Dial("quic")
+	if err != nil {
+		return nil, err
+	}
+	m, err := exchangeQUIC(context.Background(), pc.qc, ping, h.writeTimeout, h.readTimeout)
+	if err != nil {
+		pc.close()
+		return nil, err
+	}
+	p.transport.Yield(pc)
+	return m, nil
 }
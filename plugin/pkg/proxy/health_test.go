@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -9,6 +11,7 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/transport"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestHealth(t *testing.T) {
@@ -151,3 +154,203 @@ func TestHealthDomain(t *testing.T) {
 		t.Errorf("Expected number of health checks with Domain==%s to be %d, got %d", hcDomain, 1, i1)
 	}
 }
+
+func TestHealthQTypeRcodes(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype != dns.TypeSOA {
+			ret.Rcode = dns.RcodeRefused
+		} else {
+			ret.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	hc := NewHealthChecker("TestHealthQTypeRcodes", transport.DNS, true, "corp.example.")
+	hc.SetReadTimeout(100 * time.Millisecond)
+	hc.SetWriteTimeout(100 * time.Millisecond)
+	hc.SetRcodes([]int{dns.RcodeSuccess, dns.RcodeServerFailure})
+
+	p := NewProxy("TestHealthQTypeRcodes", s.Addr, transport.DNS)
+
+	if err := hc.Check(p); err == nil {
+		t.Error("Expected REFUSED to fail the health check")
+	}
+
+	hc.SetQType(dns.TypeSOA)
+	if err := hc.Check(p); err != nil {
+		t.Errorf("Expected SERVFAIL to be healthy, got %s", err)
+	}
+
+	hc.SetRcodes(nil)
+	hc.SetQType(dns.TypeNS)
+	if err := hc.Check(p); err != nil {
+		t.Errorf("Expected any reply to be healthy without rcodes, got %s", err)
+	}
+}
+
+func TestHealthFollowsTransport(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestHealthFollowsTransport", s.Addr, transport.DNS)
+	hc := p.GetHealthchecker().(*dnsHc)
+
+	if x := hc.client(p).Net; x != "udp" {
+		t.Errorf("Expected probe over udp, got %s", x)
+	}
+	before := atomic.LoadInt64(&p.transport.avgDialTime)
+	if err := hc.Check(p); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if after := atomic.LoadInt64(&p.transport.avgDialTime); after >= before {
+		t.Errorf("Expected the probe to lower the average dial time, got %d, was %d", after, before)
+	}
+
+	p.transport.SetTLSConfig(&tls.Config{})
+	if x := hc.client(p).Net; x != "tcp-tls" {
+		t.Errorf("Expected probe over tcp-tls when the transport uses TLS, got %s", x)
+	}
+
+	hc.SetUDPTransport()
+	if x := hc.client(p).Net; x != "udp" {
+		t.Errorf("Expected explicit udp to override the transport, got %s", x)
+	}
+}
+
+func TestHealthcheckBackoff(t *testing.T) {
+	var healthy atomic.Bool
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		if healthy.Load() {
+			ret.Rcode = dns.RcodeSuccess
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestHealthcheckBackoff", s.Addr, transport.DNS)
+	p.health.SetRcodes([]int{dns.RcodeSuccess})
+	p.Start(10 * time.Millisecond)
+	defer p.Stop()
+	p.SetHealthcheckBackoff(40 * time.Millisecond)
+
+	interval := func() float64 {
+		return testutil.ToFloat64(healthcheckIntervalGauge.WithLabelValues("TestHealthcheckBackoff", s.Addr))
+	}
+	waitFor := func(expected float64) {
+		t.Helper()
+		for range 100 {
+			if interval() == expected {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Expected a health check interval of %vs, got %vs", expected, interval())
+	}
+
+	p.Healthcheck()
+	waitFor(0.04)
+
+	healthy.Store(true)
+	waitFor(0.01)
+}
+
+// recordingObserver is a HealthObserver that keeps what it was told last.
+type recordingObserver struct {
+	fails  atomic.Uint32
+	probes atomic.Int32
+	down   atomic.Bool
+}
+
+func (o *recordingObserver) Checked(fails uint32) { o.fails.Store(fails) }
+func (o *recordingObserver) Probed(down bool)     { o.down.Store(down); o.probes.Add(1) }
+
+func TestHealthObserver(t *testing.T) {
+	var healthy atomic.Bool
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		if healthy.Load() {
+			ret.Rcode = dns.RcodeSuccess
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	o := &recordingObserver{}
+	p := NewProxy("TestHealthObserver", s.Addr, transport.DNS)
+	p.health.SetRcodes([]int{dns.RcodeSuccess})
+	p.SetHealthObserver(o)
+	p.SetActiveHealthCheck(time.Hour, ".", 0, 1)
+	p.Start(10 * time.Millisecond)
+	defer p.Stop()
+	defer p.transport.Stop()
+
+	if p.HealthObserver() != o {
+		t.Fatal("Expected the health observer to be returned")
+	}
+
+	waitFor := func(cond func() bool) bool {
+		for range 200 {
+			if cond() {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	// The health checks are repeated while they fail, each one is observed.
+	p.Healthcheck()
+	if !waitFor(func() bool { return o.fails.Load() >= 2 }) {
+		t.Errorf("Expected failed health checks to be observed, got %d fails", o.fails.Load())
+	}
+	healthy.Store(true)
+	if !waitFor(func() bool { return o.fails.Load() == 0 }) {
+		t.Errorf("Expected a passing health check to be observed, got %d fails", o.fails.Load())
+	}
+
+	// The probe of the active health check gets a reply, so it doesn't mark the upstream down.
+	p.transport.checkUpstream()
+	if o.probes.Load() != 1 || o.down.Load() {
+		t.Errorf("Expected 1 probe that left the upstream up, got %d, down: %t", o.probes.Load(), o.down.Load())
+	}
+}
+
+func TestHealthSourceAddress(t *testing.T) {
+	sources := make(chan string, 2)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		sources <- host
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p := NewProxy("TestHealthSourceAddress", net.JoinHostPort("127.0.0.1", port), transport.DNS)
+	p.SetLocalAddr(net.ParseIP("127.0.0.2"), nil)
+
+	// The probe leaves from the source address of the queries, over UDP and TCP.
+	for _, tcp := range []bool{false, true} {
+		hc := NewHealthChecker("TestHealthSourceAddress", transport.DNS, true, ".")
+		if tcp {
+			hc.SetTCPTransport()
+		}
+		if err := hc.Check(p); err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if x := <-sources; x != "127.0.0.2" {
+			t.Errorf("Expected the probe from 127.0.0.2 (tcp %t), got one from %s", tcp, x)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"weak"
+
+	"github.com/miekg/dns"
+)
+
+// HealthExpectation is a stricter health check: a recursive query for Name and QType whose reply must have
+// Rcode, and an answer when Answer is set. It checks that the upstream can resolve, which the cheap probe of
+// the health checker doesn't. As it makes the upstream recurse it is sent every Interval from Proxy.Start on, and
+// by the health checks at most that often, in between the result of the last one stands.
+type HealthExpectation struct {
+	Name     string
+	QType    uint16
+	Rcode    int
+	Answer   bool
+	Interval time.Duration
+}
+
+// match returns an error when m isn't the reply e expects.
+func (e *HealthExpectation) match(m *dns.Msg) error {
+	if m.Rcode != e.Rcode {
+		return fmt.Errorf("proxy: health check for %s %s got rcode %s, expected %s",
+			e.Name, dns.TypeToString[e.QType], dns.RcodeToString[m.Rcode], dns.RcodeToString[e.Rcode])
+	}
+	if e.Answer && len(m.Answer) == 0 {
+		return fmt.Errorf("proxy: health check for %s %s got no answer", e.Name, dns.TypeToString[e.QType])
+	}
+	return nil
+}
+
+// expectState holds the HealthExpectation of a health checker and the result of its last query.
+type expectState struct {
+	mu     sync.Mutex
+	expect *HealthExpectation
+	last   time.Time
+	err    error
+}
+
+// SetExpectation sets the stricter health check, nil disables it.
+func (s *expectState) SetExpectation(e *HealthExpectation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expect, s.last, s.err = e, time.Time{}, nil
+}
+
+// GetExpectation returns the stricter health check, or nil when there is none.
+func (s *expectState) GetExpectation() *HealthExpectation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expect
+}
+
+// expected sends the query of the expectation with exchange when it is due and returns whether the reply
+// was as expected. When it isn't due the result of the last query is returned.
+func (s *expectState) expected(exchange func(*dns.Msg) (*dns.Msg, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expect == nil {
+		return nil
+	}
+	if !s.last.IsZero() && time.Since(s.last) < s.expect.Interval {
+		return s.err
+	}
+	return s.query(exchange)
+}
+
+// expectedNow is expected, with the query sent whether or not it is due.
+func (s *expectState) expectedNow(exchange func(*dns.Msg) (*dns.Msg, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expect == nil {
+		return nil
+	}
+	return s.query(exchange)
+}
+
+// query sends the query of the expectation with exchange and keeps the result, s.mu must be held.
+func (s *expectState) query(exchange func(*dns.Msg) (*dns.Msg, error)) error {
+	q := new(dns.Msg)
+	q.SetQuestion(s.expect.Name, s.expect.QType)
+	q.RecursionDesired = true
+	m, err := exchange(q)
+	if err == nil {
+		err = s.expect.match(m)
+	}
+	s.last, s.err = time.Now(), err
+	return err
+}
+
+// expecter is a HealthChecker that can send the query of its HealthExpectation to p.
+type expecter interface {
+	GetExpectation() *HealthExpectation
+	expectNow(p *Proxy) error
+}
+
+func (h *dnsHc) expectNow(p *Proxy) error {
+	return h.expectedNow(func(m *dns.Msg) (*dns.Msg, error) { return h.exchange(p, m) })
+}
+
+func (h *transportHc) expectNow(p *Proxy) error {
+	return h.expectedNow(func(m *dns.Msg) (*dns.Msg, error) { return h.exchange(p, m) })
+}
+
+// startExpect sends the query of the HealthExpectation of the health checker of p every Interval, until the
+// transport is stopped. Otherwise it would only be sent by the health checks, which only run after a query
+// failed: an upstream that still replies, but with SERVFAIL as it can't resolve, would never be checked. When
+// the reply isn't as expected the health checks are started, they fail until it is again.
+func (p *Proxy) startExpect() {
+	e, ok := p.health.(expecter)
+	if !ok || e.GetExpectation() == nil || e.GetExpectation().Interval <= 0 {
+		return
+	}
+	interval := e.GetExpectation().Interval
+	wp, stop := weak.Make(p), p.transport.stop // not p, the loop would keep it from being finalized
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p := wp.Value()
+				if p == nil {
+					return
+				}
+				if err := e.expectNow(p); err != nil {
+					p.Healthcheck()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
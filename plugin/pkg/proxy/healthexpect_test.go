@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealthExpectation(t *testing.T) {
+	var (
+		rcode   atomic.Int32
+		answer  atomic.Bool
+		queries atomic.Int32
+	)
+	rcode.Store(dns.RcodeServerFailure)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.com." {
+			queries.Add(1)
+			if !r.RecursionDesired {
+				t.Error("Expected the query of the expectation to be recursive")
+			}
+			ret.Rcode = int(rcode.Load())
+			if answer.Load() {
+				ret.Answer = append(ret.Answer, test.A("example.com. IN A 192.0.2.1"))
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	hc := NewHealthChecker("TestHealthExpectation", transport.DNS, false, ".")
+	hc.SetReadTimeout(100 * time.Millisecond)
+	hc.SetWriteTimeout(100 * time.Millisecond)
+	hc.SetExpectation(&HealthExpectation{Name: "example.com.", QType: dns.TypeA, Rcode: dns.RcodeSuccess, Answer: true, Interval: 200 * time.Millisecond})
+
+	p := NewProxy("TestHealthExpectation", s.Addr, transport.DNS)
+
+	// The upstream replies to the probe, but can't resolve.
+	if err := hc.Check(p); err == nil {
+		t.Error("Expected the check to fail on SERVFAIL")
+	}
+	if x := queries.Load(); x != 1 {
+		t.Errorf("Expected 1 query of the expectation, got %d", x)
+	}
+
+	// The last result stands until the interval passed.
+	rcode.Store(dns.RcodeSuccess)
+	if err := hc.Check(p); err == nil {
+		t.Error("Expected the check to fail until the next query of the expectation")
+	}
+	if x := queries.Load(); x != 1 {
+		t.Errorf("Expected no new query of the expectation within the interval, got %d", x)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if err := hc.Check(p); err == nil {
+		t.Error("Expected the check to fail without an answer")
+	}
+
+	answer.Store(true)
+	time.Sleep(200 * time.Millisecond)
+	if err := hc.Check(p); err != nil {
+		t.Errorf("Expected the check to pass, got %s", err)
+	}
+	if x := queries.Load(); x != 3 {
+		t.Errorf("Expected 3 queries of the expectation, got %d", x)
+	}
+
+	// Without an expectation only the cheap probe is sent.
+	hc.SetExpectation(nil)
+	rcode.Store(dns.RcodeServerFailure)
+	if err := hc.Check(p); err != nil {
+		t.Errorf("Expected the check to pass without an expectation, got %s", err)
+	}
+	if x := queries.Load(); x != 3 {
+		t.Errorf("Expected no query of the expectation without an expectation, got %d", x)
+	}
+}
+
+func TestHealthExpectationStarted(t *testing.T) {
+	var (
+		rcode   atomic.Int32
+		queries atomic.Int32
+	)
+	rcode.Store(dns.RcodeServerFailure)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "example.com." {
+			queries.Add(1)
+			ret.Rcode = int(rcode.Load())
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestHealthExpectationStarted", s.Addr, transport.DNS)
+	p.health.SetReadTimeout(100 * time.Millisecond)
+	p.health.SetWriteTimeout(100 * time.Millisecond)
+	p.health.SetExpectation(&HealthExpectation{Name: "example.com.", QType: dns.TypeA, Rcode: dns.RcodeSuccess, Interval: 50 * time.Millisecond})
+	p.Start(10 * time.Millisecond)
+
+	waitFor := func(cond func() bool, what string) {
+		t.Helper()
+		for range 100 {
+			if cond() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(what)
+	}
+
+	// Without any query failing, the upstream that can't resolve is found and its health checks fail.
+	waitFor(func() bool { return p.Fails() > 0 }, "Expected the health checks to fail on SERVFAIL")
+
+	rcode.Store(dns.RcodeSuccess)
+	waitFor(func() bool { return p.Fails() == 0 }, "Expected the health checks to pass again")
+
+	// The queries stop with the transport.
+	p.Stop()
+	p.transport.Stop()
+	time.Sleep(20 * time.Millisecond)
+	n := queries.Load()
+	time.Sleep(150 * time.Millisecond)
+	if x := queries.Load(); x != n {
+		t.Errorf("Expected no query of the expectation after the transport stopped, got %d", x-n)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// HedgeLimit caps the number of hedged queries in flight, so a slow upstream doesn't double the load on the
+// others. It is shared by the callers of RaceConnect that draw from the same budget.
+type HedgeLimit struct {
+	max   int64
+	count atomic.Int64
+}
+
+// NewHedgeLimit returns a HedgeLimit that allows n hedged queries in flight.
+func NewHedgeLimit(n int64) *HedgeLimit { return &HedgeLimit{max: n} }
+
+// Max returns the number of hedged queries l allows in flight.
+func (l *HedgeLimit) Max() int64 { return l.max }
+
+// acquire takes one of the hedged queries of l, it returns false when all are in flight. A nil l doesn't limit.
+func (l *HedgeLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if l.count.Add(1) > l.max {
+		l.count.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release gives back a hedged query taken with acquire.
+func (l *HedgeLimit) release() {
+	if l != nil {
+		l.count.Add(-1)
+	}
+}
+
+// RaceConnect sends the query in state to first and, when no reply came after delay or first failed before
+// that, also to second. It returns whichever reply without an error comes back first, with the proxy that
+// sent it, and cancels the other query; its connection is closed as a reply may still be on the way. When
+// both fail the error of the last one is returned with its proxy, and its reply for ErrFailover. Like
+// ConnectFanout each query gets a copy of state.Req, and zone transfers are not supported. When all hedged
+// queries of limit are in flight the query isn't hedged and only first is waited for.
+func RaceConnect(ctx context.Context, first, second *Proxy, state request.Request, opts Options, delay time.Duration, limit *HedgeLimit) (*dns.Msg, *Proxy, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ret *dns.Msg
+		p   *Proxy
+		err error
+		up  Upstream
+		ok  bool // whether up is set
+	}
+	results := make(chan result, 2) // never blocks, so the loser doesn't leak
+	send := func(p *Proxy) {
+		// Each query records its upstream on its own, only the one returned ends up in ctx.
+		qctx := WithUpstream(ctx)
+		req := request.Request{Req: state.Req.Copy(), W: state.W}
+		ret, _, err := p.Connect(qctx, req, opts)
+		up, ok := UpstreamFromContext(qctx)
+		results <- result{ret, p, err, up, ok}
+	}
+	go send(first)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var res result
+	defer func() {
+		if res.ok {
+			recordUpstream(ctx, res.up)
+		}
+	}()
+	select {
+	case res = <-results:
+		if res.err == nil {
+			return res.ret, res.p, nil
+		}
+		// first failed early, don't wait for the delay.
+		go send(second)
+		res = <-results
+		return res.ret, res.p, res.err
+	case <-timer.C:
+	}
+
+	if !limit.acquire() {
+		hedgesLimitedCount.WithLabelValues(second.proxyName, second.addr).Add(1)
+		res = <-results
+		return res.ret, res.p, res.err
+	}
+	defer limit.release()
+	hedgesCount.WithLabelValues(second.proxyName, second.addr).Add(1)
+	go send(second)
+	for range 2 {
+		res = <-results
+		if res.err == nil {
+			if res.p == second {
+				hedgeWinsCount.WithLabelValues(second.proxyName, second.addr).Add(1)
+			}
+			return res.ret, res.p, nil
+		}
+	}
+	return res.ret, res.p, res.err
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newDelayServer starts a DNS server that replies after delay and counts the queries it got.
+func newDelayServer(delay time.Duration, queries *atomic.Int32) *dnstest.Server {
+	return dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(delay)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+}
+
+func TestRaceConnect(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := newDelayServer(300*time.Millisecond, &slowQueries)
+	defer slow.Close()
+	fast := newDelayServer(0, &fastQueries)
+	defer fast.Close()
+
+	first := NewProxy("TestRaceConnect", slow.Addr, transport.DNS)
+	defer first.transport.Stop()
+	second := NewProxy("TestRaceConnect", fast.Addr, transport.DNS)
+	defer second.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// The first upstream is too slow, the hedged query wins.
+	begin := time.Now()
+	_, p, err := RaceConnect(context.Background(), first, second, req, Options{}, 20*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if d := time.Since(begin); d > 200*time.Millisecond {
+		t.Errorf("Expected the reply of the hedged query, took %s", d)
+	}
+	if p != second {
+		t.Errorf("Expected the reply of %s, got one of %s", fast.Addr, p.Addr())
+	}
+	if x := testutil.ToFloat64(hedgesCount.WithLabelValues("TestRaceConnect", fast.Addr)); x != 1 {
+		t.Errorf("Expected 1 hedge, got %v", x)
+	}
+	if x := testutil.ToFloat64(hedgeWinsCount.WithLabelValues("TestRaceConnect", fast.Addr)); x != 1 {
+		t.Errorf("Expected 1 hedge win, got %v", x)
+	}
+
+	// The first upstream replies within the delay, the second never sees the query.
+	_, p, err = RaceConnect(context.Background(), second, first, req, Options{}, 200*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if p != second || slowQueries.Load() != 1 {
+		t.Errorf("Expected only the first upstream to be asked, the slow one got %d queries", slowQueries.Load())
+	}
+	if x := testutil.ToFloat64(hedgesCount.WithLabelValues("TestRaceConnect", slow.Addr)); x != 0 {
+		t.Errorf("Expected no hedge, got %v", x)
+	}
+}
+
+func TestRaceConnectFirstFails(t *testing.T) {
+	var queries atomic.Int32
+	s := newDelayServer(0, &queries)
+	defer s.Close()
+
+	first := NewProxy("TestRaceConnectFirstFails", "127.0.0.1:1", transport.DNS)
+	defer first.transport.Stop()
+	second := NewProxy("TestRaceConnectFirstFails", s.Addr, transport.DNS)
+	defer second.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// A failure of the first upstream sends the query to the second right away.
+	begin := time.Now()
+	_, p, err := RaceConnect(context.Background(), first, second, req, Options{ForceTCP: true}, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("Expected not to wait for the delay, took %s", d)
+	}
+	if p != second {
+		t.Errorf("Expected the reply of %s, got one of %s", s.Addr, p.Addr())
+	}
+	if x := testutil.ToFloat64(hedgesCount.WithLabelValues("TestRaceConnectFirstFails", s.Addr)); x != 0 {
+		t.Errorf("Expected no hedge, got %v", x)
+	}
+}
+
+func TestRaceConnectLimit(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := newDelayServer(100*time.Millisecond, &slowQueries)
+	defer slow.Close()
+	fast := newDelayServer(0, &fastQueries)
+	defer fast.Close()
+
+	first := NewProxy("TestRaceConnectLimit", slow.Addr, transport.DNS)
+	defer first.transport.Stop()
+	second := NewProxy("TestRaceConnectLimit", fast.Addr, transport.DNS)
+	defer second.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// With the only hedged query in flight, the other queries wait for the slow upstream.
+	limit := NewHedgeLimit(1)
+	limit.count.Store(1)
+	_, p, err := RaceConnect(context.Background(), first, second, req, Options{}, 10*time.Millisecond, limit)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if p != first || fastQueries.Load() != 0 {
+		t.Errorf("Expected only the first upstream to be asked, the fast one got %d queries", fastQueries.Load())
+	}
+	if x := testutil.ToFloat64(hedgesLimitedCount.WithLabelValues("TestRaceConnectLimit", fast.Addr)); x != 1 {
+		t.Errorf("Expected 1 limited hedge, got %v", x)
+	}
+
+	// Once it is done the query is hedged again, and the hedged query is given back after.
+	limit.release()
+	_, p, err = RaceConnect(context.Background(), first, second, req, Options{}, 10*time.Millisecond, limit)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if p != second {
+		t.Errorf("Expected the reply of %s, got one of %s", fast.Addr, p.Addr())
+	}
+	if x := limit.count.Load(); x != 0 {
+		t.Errorf("Expected no hedged query in flight, got %d", x)
+	}
+}
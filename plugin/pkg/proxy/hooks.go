@@ -0,0 +1,34 @@
+package proxy
+
+import "github.com/miekg/dns"
+
+// Hooks let the caller of Connect inspect or change the query that is sent to the upstream and the reply
+// that comes back, for instance to add EDNS0 options.
+type Hooks struct {
+	// PreSend is called with the query just before it is written to the upstream, after its ID and case are
+	// randomized. It gets a copy, so its changes never reach the message of the caller. Over a pipelined
+	// connection, DNS-over-HTTPS and DNS-over-QUIC the transport sets the ID after PreSend.
+	PreSend func(*dns.Msg)
+	// PostReceive is called with the reply Connect returns, after the ID and case of the query are restored.
+	// Replies that are dropped because they don't match the query are not passed, nor are the messages of a
+	// zone transfer, for which PreSend is called as for any other query.
+	PostReceive func(*dns.Msg)
+}
+
+// preSend returns the message to send for req, a copy changed by PreSend when there is one.
+func (h *Hooks) preSend(req *dns.Msg) *dns.Msg {
+	if h == nil || h.PreSend == nil {
+		return req
+	}
+	m := req.Copy()
+	h.PreSend(m)
+	return m
+}
+
+// postReceive calls PostReceive with ret when there is one.
+func (h *Hooks) postReceive(ret *dns.Msg) {
+	if h == nil || h.PostReceive == nil {
+		return
+	}
+	h.PostReceive(ret)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestConnectHooks(t *testing.T) {
+	var seen atomic.Bool
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil && len(opt.Option) == 1 {
+			seen.Store(true)
+		}
+		// An out-of-order reply first, which must not reach PostReceive.
+		bogus := new(dns.Msg)
+		bogus.SetReply(r)
+		bogus.Id = r.Id + 1
+		w.WriteMsg(bogus)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectHooks", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Id = 42
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	var sentID uint16
+	var received []uint16
+	hooks := &Hooks{
+		PreSend: func(m *dns.Msg) {
+			sentID = m.Id
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte{1}})
+		},
+		PostReceive: func(m *dns.Msg) { received = append(received, m.Id) },
+	}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{Hooks: hooks}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !seen.Load() {
+		t.Error("Expected the option added by PreSend to be sent")
+	}
+	if sentID == 42 {
+		t.Error("Expected PreSend to see the randomized ID")
+	}
+	if m.IsEdns0() != nil || m.Id != 42 {
+		t.Errorf("Expected the caller's message to be left alone, got ID %d and OPT %v", m.Id, m.IsEdns0())
+	}
+	if len(received) != 1 || received[0] != 42 {
+		t.Errorf("Expected PostReceive to be called once with the original ID, got %v", received)
+	}
+}
+
+func TestConnectTransferHooks(t *testing.T) {
+	var seen atomic.Bool
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil && len(opt.Option) == 1 {
+			seen.Store(true)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = []dns.RR{soa("1"), soa("1")}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectTransferHooks", s.Addr, transport.DNS)
+	p.SetTransferReadTimeout(time.Second)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	hooks := &Hooks{
+		PreSend: func(m *dns.Msg) {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte{1}})
+		},
+	}
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true, Hooks: hooks}); err != nil {
+		t.Fatalf("Expected the transfer to succeed, got %s", err)
+	}
+	if !seen.Load() {
+		t.Error("Expected the option added by PreSend to be sent with the transfer")
+	}
+	if m.IsEdns0() != nil {
+		t.Errorf("Expected the caller's message to be left alone, got OPT %v", m.IsEdns0())
+	}
+}
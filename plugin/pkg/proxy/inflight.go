@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// SetMaxInFlight limits the number of queries in flight to the upstream to n. When the limit is reached a query
+// waits up to wait for another one to finish and fails with ErrMaxInFlight after that, with a wait of 0 it fails
+// right away, so the caller can try another upstream. A negative wait blocks until a query finishes or the
+// context of the query is done. An n of 0 disables the limit.
+func (p *Proxy) SetMaxInFlight(n int, wait time.Duration) {
+	if n <= 0 {
+		p.inFlight = nil
+		return
+	}
+	p.inFlight = make(chan struct{}, n)
+	p.inFlightWait = wait
+}
+
+// acquire takes one of the in-flight slots of the upstream for a query, release gives it back.
+func (p *Proxy) acquire(ctx context.Context) (release func(), err error) {
+	if p.inFlight == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case p.inFlight <- struct{}{}:
+	default:
+		if p.inFlightWait == 0 {
+			inFlightRejectsCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+			return nil, ErrMaxInFlight
+		}
+		var expired <-chan time.Time // nil blocks forever
+		if p.inFlightWait > 0 {
+			timer := time.NewTimer(p.inFlightWait)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case p.inFlight <- struct{}{}:
+		case <-expired:
+			inFlightRejectsCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+			return nil, ErrMaxInFlight
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	inFlightGauge.WithLabelValues(p.proxyName, p.addr).Inc()
+	return func() {
+		<-p.inFlight
+		inFlightGauge.WithLabelValues(p.proxyName, p.addr).Dec()
+	}, nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	arrived := make(chan struct{})
+	unblock := make(chan struct{})
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow.example.org." {
+			arrived <- struct{}{}
+			<-unblock
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestMaxInFlight", s.Addr, transport.DNS)
+	p.readTimeout = 2 * time.Second
+	p.SetMaxInFlight(1, 0)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	query := func(name string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := p.Connect(context.Background(), query("slow.example.org."), Options{})
+		done <- err
+	}()
+	<-arrived
+
+	if x := testutil.ToFloat64(inFlightGauge.WithLabelValues("TestMaxInFlight", s.Addr)); x != 1 {
+		t.Errorf("Expected 1 query in flight, got %v", x)
+	}
+
+	// Fail fast.
+	if _, _, err := p.Connect(context.Background(), query("example.org."), Options{}); !errors.Is(err, ErrMaxInFlight) {
+		t.Errorf("Expected %q, got %v", ErrMaxInFlight, err)
+	}
+	if x := testutil.ToFloat64(inFlightRejectsCount.WithLabelValues("TestMaxInFlight", s.Addr)); x != 1 {
+		t.Errorf("Expected 1 rejected query, got %v", x)
+	}
+
+	// Bounded wait that runs out.
+	p.inFlightWait = 50 * time.Millisecond
+	start := time.Now()
+	if _, _, err := p.Connect(context.Background(), query("example.org."), Options{}); !errors.Is(err, ErrMaxInFlight) {
+		t.Errorf("Expected %q, got %v", ErrMaxInFlight, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Expected to wait at least 50ms for a slot, waited %s", d)
+	}
+
+	// The wait stops when the client goes away, also when blocking until a slot frees.
+	p.inFlightWait = -1
+	blocked, cancelBlocked := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelBlocked()
+	if _, _, err := p.Connect(blocked, query("example.org."), Options{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+
+	p.inFlightWait = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.Connect(ctx, query("example.org."), Options{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Blocking wait that gets a slot.
+	p.inFlightWait = -1
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(unblock)
+	}()
+	if _, _, err := p.Connect(context.Background(), query("example.org."), Options{}); err != nil {
+		t.Errorf("Expected the query to get a slot, got %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the slow query to succeed, got %s", err)
+	}
+	if x := testutil.ToFloat64(inFlightGauge.WithLabelValues("TestMaxInFlight", s.Addr)); x != 0 {
+		t.Errorf("Expected no query in flight, got %v", x)
+	}
+	if x := testutil.ToFloat64(inFlightRejectsCount.WithLabelValues("TestMaxInFlight", s.Addr)); x != 2 {
+		t.Errorf("Expected 2 rejected queries, got %v", x)
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// SetTimeoutJitter moves each dial and read timeout by a random amount of up to fraction of it, up or down,
+// so connections that died at the same time, e.g. when the upstream restarted, aren't dialed and retried in
+// lockstep. An adaptive timeout stays within its bounds. A fraction of 0 (default) disables the jitter,
+// fractions outside [0, 1) are ignored.
+func (t *Transport) SetTimeoutJitter(fraction float64) {
+	if fraction < 0 || fraction >= 1 {
+		return
+	}
+	t.timeoutJitter = fraction
+}
+
+// jitter returns d moved by a random amount of up to fraction of it in either direction, clamped to
+// [minValue, maxValue].
+func jitter(d time.Duration, fraction float64, minValue, maxValue time.Duration) time.Duration {
+	if fraction == 0 {
+		return d
+	}
+	d += time.Duration((rand.Float64()*2 - 1) * fraction * float64(d)) // #nosec G404 -- spreading timeouts needs no cryptographic randomness.
+	return min(max(d, minValue), maxValue)
+}
+
+// nextReadTimeout returns the read timeout for a query: currentReadTimeout with the jitter of the transport.
+func (p *Proxy) nextReadTimeout() time.Duration {
+	d := p.currentReadTimeout()
+	if p.maxReadTimeout == 0 || atomic.LoadInt64(&p.avgReadTime) == 0 {
+		d = jitter(d, p.transport.timeoutJitter, 0, math.MaxInt64)
+	} else {
+		d = jitter(d, p.transport.timeoutJitter, p.minReadTimeout, p.maxReadTimeout)
+	}
+	readTimeoutGauge.WithLabelValues(p.proxyName, p.addr).Set(d.Seconds())
+	return d
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+func TestTimeoutJitter(t *testing.T) {
+	p := NewProxy("TestTimeoutJitter", "127.0.0.1:53", transport.DNS)
+	defer p.transport.Stop()
+
+	if x := p.transport.dialTimeout(); x != maxDialTimeout {
+		t.Errorf("Expected no jitter by default, got %s", x)
+	}
+
+	p.SetTimeoutJitter(0.1)
+	p.SetDialTimeout(100*time.Millisecond, 1*time.Second)
+	p.SetAdaptiveReadTimeout(10*time.Millisecond, 100*time.Millisecond)
+
+	tests := []struct {
+		avg      time.Duration // average dial and read time
+		min, max time.Duration // bounds of the dial timeout
+	}{
+		{300 * time.Millisecond, 540 * time.Millisecond, 660 * time.Millisecond},
+		// At the bounds the jitter only goes one way.
+		{10 * time.Millisecond, 100 * time.Millisecond, 110 * time.Millisecond},
+		{time.Second, 900 * time.Millisecond, time.Second},
+	}
+	for i, tc := range tests {
+		atomic.StoreInt64(&p.transport.avgDialTime, int64(tc.avg))
+		atomic.StoreInt64(&p.avgReadTime, int64(tc.avg/10))
+		seen := map[time.Duration]bool{}
+		for range 1000 {
+			x := p.transport.dialTimeout()
+			if x < tc.min || x > tc.max {
+				t.Fatalf("Test %d: expected the dial timeout within [%s, %s], got %s", i, tc.min, tc.max, x)
+			}
+			seen[x] = true
+			// The read timeout bounds are the dial timeout bounds divided by 10.
+			if x := p.nextReadTimeout(); x < tc.min/10 || x > tc.max/10 {
+				t.Fatalf("Test %d: expected the read timeout within [%s, %s], got %s", i, tc.min/10, tc.max/10, x)
+			}
+		}
+		if len(seen) < 2 {
+			t.Errorf("Test %d: expected the dial timeout to vary, got %d distinct values", i, len(seen))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setKeepalive adds an empty edns-tcp-keepalive option (RFC 7828) to m, asking the upstream for its idle
+// timeout. The returned function removes it again.
+func setKeepalive(m *dns.Msg) (restore func()) {
+	opt, restore := withOPT(m)
+	opt.Option = withoutOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	return restore
+}
+
+// learnKeepalive stores the idle timeout the upstream sent in the edns-tcp-keepalive option of ret, which
+// was read from pc, and strips the option, it belongs to the connection to this upstream and not to the
+// client. The timeout applies to pc, and to the connections that haven't had a reply with the option yet.
+// A reply without the option forgets the timeout again, the upstream no longer asks for one and expire applies.
+func (t *Transport) learnKeepalive(pc *persistConn, ret *dns.Msg) {
+	if opt := ret.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				timeout := time.Duration(ka.Timeout) * 100 * time.Millisecond
+				pc.keepalive, pc.hasKeepalive = timeout, true
+				atomic.StoreInt64(&t.keepaliveTimeout, int64(timeout))
+				keepaliveTimeoutGauge.WithLabelValues(t.proxyName, t.addr).Set(timeout.Seconds())
+				opt.Option = withoutOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+				return
+			}
+		}
+	}
+	pc.keepalive, pc.hasKeepalive = 0, false
+	if atomic.SwapInt64(&t.keepaliveTimeout, -1) >= 0 {
+		keepaliveTimeoutGauge.DeleteLabelValues(t.proxyName, t.addr)
+	}
+}
+
+// idleTimeout returns how long an idle connection of transtype is kept in the cache: the expire duration,
+// or less when the upstream asked for a shorter idle timeout for TCP connections.
+func (t *Transport) idleTimeout(transtype transportType) time.Duration {
+	expire := t.expireFor(transtype)
+	if transtype != typeTCP && transtype != typeTLS {
+		return expire
+	}
+	ka := time.Duration(atomic.LoadInt64(&t.keepaliveTimeout))
+	if ka < 0 || ka > expire {
+		return expire
+	}
+	return ka
+}
+
+// connIdleTimeout is idleTimeout for pc, using the idle timeout the upstream sent on pc when it did.
+func (t *Transport) connIdleTimeout(pc *persistConn, transtype transportType) time.Duration {
+	if !pc.hasKeepalive || (transtype != typeTCP && transtype != typeTLS) {
+		return t.idleTimeout(transtype)
+	}
+	return min(pc.keepalive, t.expireFor(transtype))
+}
+
+// keepaliveKnown returns true when the upstream sent an idle timeout with edns-tcp-keepalive, after which the
+// idle timeouts of cached connections may differ.
+func (t *Transport) keepaliveKnown() bool { return atomic.LoadInt64(&t.keepaliveTimeout) >= 0 }
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectTCPKeepalive(t *testing.T) {
+	var timeout atomic.Int32 // in units of 100ms
+	var asked atomic.Bool
+
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		asked.Store(false)
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if _, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+					asked.Store(true)
+					ret.SetEdns0(dns.DefaultMsgSize, false)
+					ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout.Load())})
+				}
+			}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectTCPKeepalive", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	cached := func() int {
+		p.transport.mu.Lock()
+		defer p.transport.mu.Unlock()
+		return len(p.transport.conns[typeTCP])
+	}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if asked.Load() {
+		t.Error("Expected no edns-tcp-keepalive option without TCPKeepalive")
+	}
+
+	timeout.Store(5)
+	resp, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true, TCPKeepalive: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !asked.Load() {
+		t.Error("Expected the query to carry the edns-tcp-keepalive option")
+	}
+	if opt := resp.IsEdns0(); opt != nil && len(opt.Option) != 0 {
+		t.Errorf("Expected the edns-tcp-keepalive option to be stripped from the reply, got %v", opt.Option)
+	}
+	if m.IsEdns0() != nil {
+		t.Error("Expected the edns-tcp-keepalive option to be removed from the request")
+	}
+	if x := p.transport.idleTimeout(typeTCP); x != 500*time.Millisecond {
+		t.Errorf("Expected an idle timeout of 500ms, got %s", x)
+	}
+	if x := p.transport.idleTimeout(typeUDP); x != defaultExpire {
+		t.Errorf("Expected the UDP idle timeout to stay at %s, got %s", defaultExpire, x)
+	}
+	if x := cached(); x != 1 {
+		t.Errorf("Expected 1 cached TCP connection, got %d", x)
+	}
+
+	// The upstream asks for idle connections to be closed.
+	timeout.Store(0)
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true, TCPKeepalive: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if x := cached(); x != 0 {
+		t.Errorf("Expected no cached TCP connection, got %d", x)
+	}
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestConnectTCPKeepalive", s.Addr, "tcp", closeKeepalive)); x != 1 {
+		t.Errorf("Expected 1 connection closed because of edns-tcp-keepalive, got %v", x)
+	}
+}
+
+func TestKeepalivePerConn(t *testing.T) {
+	tr := newTransport("TestKeepalivePerConn", "127.0.0.1:53")
+
+	reply := func(timeout uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: timeout})
+		return m
+	}
+
+	newConn := func() *persistConn {
+		c, _ := net.Pipe()
+		return &persistConn{c: &dns.Conn{Conn: c}, proto: "tcp"}
+	}
+	a, b := newConn(), newConn()
+	fresh := &persistConn{proto: "tcp"}
+	tr.learnKeepalive(a, reply(50))
+	tr.learnKeepalive(b, reply(2))
+
+	if x := tr.connIdleTimeout(a, typeTCP); x != 5*time.Second {
+		t.Errorf("Expected an idle timeout of 5s for the first connection, got %s", x)
+	}
+	if x := tr.connIdleTimeout(b, typeTCP); x != 200*time.Millisecond {
+		t.Errorf("Expected an idle timeout of 200ms for the second connection, got %s", x)
+	}
+	if x := tr.connIdleTimeout(fresh, typeTCP); x != 200*time.Millisecond {
+		t.Errorf("Expected the last idle timeout for a connection without one, got %s", x)
+	}
+	if x := testutil.ToFloat64(keepaliveTimeoutGauge.WithLabelValues("TestKeepalivePerConn", "127.0.0.1:53")); x != 0.2 {
+		t.Errorf("Expected the keepalive gauge at 0.2, got %v", x)
+	}
+
+	// The sweep closes the idle connection whose own timeout passed.
+	used := time.Now().Add(-time.Second)
+	a.used, b.used = used, used
+	a.created, b.created = used, used
+	tr.conns[typeTCP] = []*persistConn{a, b}
+	tr.cleanup(false)
+	if len(tr.conns[typeTCP]) != 1 || tr.conns[typeTCP][0] != a {
+		t.Errorf("Expected only the connection with the longer idle timeout to be kept, got %d connections", len(tr.conns[typeTCP]))
+	}
+
+	// A reply without the option forgets the timeout, expire applies again.
+	none := new(dns.Msg)
+	none.SetEdns0(dns.DefaultMsgSize, false)
+	tr.learnKeepalive(a, none)
+	if x := tr.connIdleTimeout(a, typeTCP); x != defaultExpire {
+		t.Errorf("Expected an idle timeout of %s after a reply without keepalive, got %s", defaultExpire, x)
+	}
+	if x := tr.connIdleTimeout(fresh, typeTCP); x != defaultExpire {
+		t.Errorf("Expected an idle timeout of %s for a connection without one, got %s", defaultExpire, x)
+	}
+	if tr.keepaliveKnown() {
+		t.Error("Expected the keepalive timeout to be forgotten")
+	}
+	if keepaliveTimeoutGauge.DeleteLabelValues("TestKeepalivePerConn", "127.0.0.1:53") {
+		t.Error("Expected the keepalive gauge to be deleted")
+	}
+}
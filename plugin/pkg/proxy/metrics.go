@@ -15,8 +15,8 @@ var (
 		Name:                        "request_duration_seconds",
 		Buckets:                     plugin.TimeBuckets,
 		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
-		Help:                        "Histogram of the time each request took.",
-	}, []string{"proxy_name", "to", "rcode"})
+		Help:                        "Histogram of the time each request took, per rcode and the protocol it was sent with.",
+	}, []string{"proxy_name", "to", "rcode", "proto"})
 
 	healthcheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
@@ -38,4 +38,259 @@ var (
 		Name:      "conn_cache_misses_total",
 		Help:      "Counter of connection cache misses per upstream and protocol.",
 	}, []string{"proxy_name", "to", "proto"})
+
+	dialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "proxy",
+		Name:                        "dial_duration_seconds",
+		Buckets:                     plugin.TimeBuckets,
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time it took to establish a new connection per upstream and protocol, without the TLS handshake.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	tlsHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "proxy",
+		Name:                        "tls_handshake_duration_seconds",
+		Buckets:                     plugin.TimeBuckets,
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time the TLS handshake of a new tcp-tls connection took per upstream, and whether the session was resumed.",
+	}, []string{"proxy_name", "to", "resumed"})
+
+	connAcquireDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "proxy",
+		Name:                        "conn_acquire_duration_seconds",
+		Buckets:                     plugin.TimeBuckets,
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time it took to get a connection per upstream and protocol, and whether it came from the cache.",
+	}, []string{"proxy_name", "to", "proto", "cached"})
+
+	rttDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "proxy",
+		Name:                        "rtt_seconds",
+		Buckets:                     plugin.TimeBuckets,
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the time between writing a query and reading its reply per upstream and protocol, without the dial.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	connPoolSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_pool_size",
+		Help:      "Gauge of the number of idle cached connections per upstream and protocol.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	connPoolOverflowCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_pool_overflows_total",
+		Help:      "Counter of connections closed instead of cached because the idle pool was full.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	connRetriesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_retries_total",
+		Help:      "Counter of queries retried on a new connection after a cached connection was found closed.",
+	}, []string{"proxy_name", "to"})
+
+	truncatedRetriesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "truncated_retries_total",
+		Help:      "Counter of queries sent again over TCP because the reply over UDP was truncated.",
+	}, []string{"proxy_name", "to"})
+
+	unmatchedResponsesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "unmatched_responses_total",
+		Help:      "Counter of responses whose message ID or question did not match any outstanding query.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	questionMismatchesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "question_mismatches_total",
+		Help:      "Counter of unmatched responses that had the message ID of a query, but were for another question.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	connClosedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_closed_total",
+		Help:      "Counter of connections closed because they expired, exceeded max-age or failed, per upstream and protocol.",
+	}, []string{"proxy_name", "to", "proto", "reason"})
+
+	connAge = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   plugin.Namespace,
+		Subsystem:                   "proxy",
+		Name:                        "conn_age_seconds",
+		Buckets:                     prometheus.ExponentialBuckets(0.1, 4, 8), // from 100ms to ~27 minutes
+		NativeHistogramBucketFactor: plugin.NativeHistogramBucketFactor,
+		Help:                        "Histogram of the age of connections when they are closed, per upstream and protocol.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	readTimeoutGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "read_timeout_seconds",
+		Help:      "Gauge of the read timeout per upstream, as used for the last query or derived from the last reply.",
+	}, []string{"proxy_name", "to"})
+
+	dialTimeoutGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "dial_timeout_seconds",
+		Help:      "Gauge of the dial timeout used for the last dial per upstream, the minimum dial timeout before the first dial.",
+	}, []string{"proxy_name", "to"})
+
+	dualStackDialCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "dual_stack_dials_total",
+		Help:      "Counter of dual stack dials per upstream and the network that connected first.",
+	}, []string{"proxy_name", "to", "network"})
+
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_state",
+		Help:      "Gauge of the circuit breaker state per upstream: 0 closed, 1 open, 2 half-open.",
+	}, []string{"proxy_name", "to"})
+
+	averageTimeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "average_time_seconds",
+		Help:      "Gauge of the average dial and read times the adaptive timeouts are derived from, per upstream.",
+	}, []string{"proxy_name", "to", "kind"})
+
+	tlsPinFailuresCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "tls_pin_failures_total",
+		Help:      "Counter of TLS connections rejected because the public key of the upstream matched no SPKI pin.",
+	}, []string{"proxy_name", "to"})
+
+	inFlightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "inflight_queries",
+		Help:      "Gauge of the queries in flight per upstream, only when the number is limited.",
+	}, []string{"proxy_name", "to"})
+
+	inFlightRejectsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "inflight_rejects_total",
+		Help:      "Counter of queries rejected because the limit of queries in flight to the upstream was reached.",
+	}, []string{"proxy_name", "to"})
+
+	upstreamUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_up",
+		Help:      "Gauge of whether the active health check considers the upstream up (1) or down (0).",
+	}, []string{"proxy_name", "to"})
+
+	connDeadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_cache_dead_total",
+		Help:      "Counter of cached connections found closed by the upstream when taken from the cache.",
+	}, []string{"proxy_name", "to", "proto"})
+
+	fanoutWinsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "fanout_wins_total",
+		Help:      "Counter of queries sent to several upstreams at the same time that were answered first by this upstream.",
+	}, []string{"proxy_name", "to"})
+
+	hedgesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "hedges_total",
+		Help:      "Counter of queries also sent to this upstream because the first upstream didn't reply within the hedge delay.",
+	}, []string{"proxy_name", "to"})
+
+	hedgeWinsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "hedge_wins_total",
+		Help:      "Counter of hedged queries to this upstream that were answered before the first upstream replied.",
+	}, []string{"proxy_name", "to"})
+
+	hedgesLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "hedges_limited_total",
+		Help:      "Counter of queries not sent to this upstream after the hedge delay because the limit of hedged queries in flight was reached.",
+	}, []string{"proxy_name", "to"})
+
+	affinityCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_affinity_total",
+		Help:      "Counter of queries that got a connection last used for their client (hit) or not (miss), when affinity is enabled.",
+	}, []string{"proxy_name", "to", "proto", "result"})
+
+	keepaliveTimeoutGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "keepalive_timeout_seconds",
+		Help:      "Gauge of the last idle timeout the upstream sent with edns-tcp-keepalive.",
+	}, []string{"proxy_name", "to"})
+
+	connErrorsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "conn_errors_total",
+		Help:      "Counter of errors dialing, writing to or reading from upstream connections, per category.",
+	}, []string{"proxy_name", "to", "category"})
+
+	healthcheckIntervalGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "healthcheck_interval_seconds",
+		Help:      "Gauge of the interval between health checks of the upstream, which grows while they fail with a backoff.",
+	}, []string{"proxy_name", "to"})
+
+	failoverCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "failover_total",
+		Help:      "Counter of replies with an rcode of FailoverOnRcode, which make the caller try the next upstream.",
+	}, []string{"proxy_name", "to", "rcode"})
+
+	eventsDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "events_dropped_total",
+		Help:      "Counter of events an AsyncSink dropped because its buffer was full.",
+	}, []string{"proxy_name", "to"})
+
+	dialFailuresCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "dial_failures_total",
+		Help:      "Counter of failures to establish a connection to the upstream, per protocol and category.",
+	}, []string{"proxy_name", "to", "proto", "category"})
+
+	transfersAbortedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "transfers_aborted_total",
+		Help:      "Counter of zone transfers aborted because they exceeded the maximum size.",
+	}, []string{"proxy_name", "to"})
+
+	udpSkippedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "proxy",
+		Name:      "udp_skipped_total",
+		Help:      "Counter of queries sent over TCP instead of UDP with PreferTCPLarge, per reason: qtype or history.",
+	}, []string{"proxy_name", "to", "reason"})
 )
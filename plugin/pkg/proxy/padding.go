@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// withOPT returns the OPT record of m, adding one if there is none. The returned function undoes the
+// changes made to m afterwards, including any changes to the option list of an existing OPT record.
+func withOPT(m *dns.Msg) (*dns.OPT, func()) {
+	extra := m.Extra
+
+	if opt := m.IsEdns0(); opt != nil {
+		options := opt.Option
+		return opt, func() { opt.Option = options }
+	}
+
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	m.Extra = append(extra[:len(extra):len(extra)], opt)
+	return opt, func() { m.Extra = extra }
+}
+
+// withoutOption returns options with all options of type code removed. The returned slice is
+// always newly allocated, so it can be appended to without changing options.
+func withoutOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	ret := make([]dns.EDNS0, 0, len(options)+1)
+	for _, o := range options {
+		if o.Option() != code {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// padRequest adds an EDNS0 padding option (RFC 7830) to m so its wire length is a multiple of
+// block. An existing OPT record is reused, otherwise one is added. A message that would grow beyond
+// the maximum message size is not padded. The returned function undoes the changes, so the caller's
+// message is only modified while it is being sent.
+func padRequest(m *dns.Msg, block int) (restore func()) {
+	opt, restore := withOPT(m)
+
+	// Drop any padding that is already there, the new option is calculated from scratch.
+	opt.Option = withoutOption(opt.Option, dns.EDNS0PADDING)
+
+	// The option header is 4 bytes, the remainder is filled with zero padding.
+	l := m.Len() + 4
+	pad := (block - l%block) % block
+	if l+pad > dns.MaxMsgSize {
+		return restore
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, pad)})
+
+	return restore
+}
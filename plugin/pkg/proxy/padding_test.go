@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *dns.Msg)
+	}{
+		{"no OPT", func(m *dns.Msg) {}},
+		{"with OPT", func(m *dns.Msg) { m.SetEdns0(4096, true) }},
+		{"with padding", func(m *dns.Msg) {
+			m.SetEdns0(4096, false)
+			o := m.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 7)})
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			tc.setup(m)
+			before := m.Copy()
+
+			restore := padRequest(m, 128)
+			if l := m.Len(); l%128 != 0 {
+				t.Errorf("Expected padded length to be a multiple of 128, got %d", l)
+			}
+			buf, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf)%128 != 0 {
+				t.Errorf("Expected packed length to be a multiple of 128, got %d", len(buf))
+			}
+			paddings := 0
+			for _, o := range m.IsEdns0().Option {
+				if o.Option() == dns.EDNS0PADDING {
+					paddings++
+				}
+			}
+			if paddings != 1 {
+				t.Errorf("Expected exactly 1 padding option, got %d", paddings)
+			}
+
+			restore()
+			if m.String() != before.String() {
+				t.Errorf("Expected message to be restored, got\n%s\nwant\n%s", m, before)
+			}
+		})
+	}
+}
+
+func TestPadRequestMaxSize(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	// Fill the message up so padding to the next block would exceed the maximum message size.
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}}
+	for m.Len() < dns.MaxMsgSize-300 {
+		txt.Txt = append(txt.Txt, strings.Repeat("x", 255))
+		m.Extra = []dns.RR{txt}
+	}
+
+	restore := padRequest(m, 512)
+	defer restore()
+	for _, o := range m.IsEdns0().Option {
+		if o.Option() == dns.EDNS0PADDING {
+			t.Fatalf("Expected no padding beyond the maximum message size, message is %d bytes", m.Len())
+		}
+	}
+}
@@ -1,34 +1,130 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"net"
+	"net/http"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/quic-go/quic-go"
+	xproxy "golang.org/x/net/proxy"
 )
 
 // a persistConn holds the dns.Conn, its creation time, and the last used time.
+// For DNS-over-QUIC upstreams qc holds the QUIC connection and c is nil.
 type persistConn struct {
 	c       *dns.Conn
+	qc      *quic.Conn
+	proto   string // the protocol the connection was dialed with
+	header  []byte // the PROXY protocol header sent on the connection, it's only reused for the same header
 	created time.Time
 	used    time.Time
+	uses    int // the number of times the connection was given back after a query
+
+	affinity uint64 // the affinity key of the client the connection was last used for
+
+	early bool // the QUIC connection was dialed for 0-RTT and its first query isn't done yet
+
+	keepalive    time.Duration // the idle timeout the upstream sent with edns-tcp-keepalive on this connection
+	hasKeepalive bool          // whether the upstream sent keepalive on this connection
+}
+
+// close closes the underlying connection.
+func (pc *persistConn) close() {
+	if pc.qc != nil {
+		pc.qc.CloseWithError(doqNoError, "")
+		return
+	}
+	pc.c.Close()
 }
 
 // Transport hold the persistent cache.
 type Transport struct {
-	avgDialTime  int64                          // kind of average time of dial time
-	conns        [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls.
-	expire       time.Duration                  // After this duration an idle connection is expired.
-	maxAge       time.Duration                  // After this duration a connection is closed regardless of activity; 0 means unlimited.
-	maxIdleConns int                            // Max idle connections per transport type; 0 means unlimited.
-	addr         string
-	tlsConfig    *tls.Config
-	proxyName    string
+	avgDialTime   int64                          // kind of average time of dial time
+	conns         [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls.
+	expire        time.Duration                  // After this duration an idle connection is expired.
+	maxAge        time.Duration                  // After this duration a connection is closed regardless of activity; 0 means unlimited.
+	maxIdleConns  int                            // Max idle connections per transport type; 0 means unlimited.
+	addr          string
+	tlsConfig     *tls.Config // TLS config used to dial, baseTLSConfig with the SPKI pin check added.
+	baseTLSConfig *tls.Config // TLS config as it was set.
+	proxyName     string
+	quic          bool   // Dial the upstream with DNS-over-QUIC.
+	unix          bool   // Dial the upstream over the Unix domain socket at addr.
+	pipelining    bool   // Share one TCP/TLS connection between concurrent queries.
+	pipelineDepth int    // Queries in flight on one pipelined connection, 0 is unlimited.
+	localAddr4    net.IP // Source address for IPv4 upstreams, nil lets the kernel choose.
+	localAddr6    net.IP // Source address for IPv6 upstreams, nil lets the kernel choose.
+	localPort     int    // Source port, 0 lets the kernel choose.
+	bindDevice    string // Network interface or VRF the sockets are bound to.
+	dualStackDial bool   // Race IPv4 and IPv6 when dialing an upstream given as a hostname.
+	fastOpen      bool   // Use TCP Fast Open when dialing over tcp and tcp-tls.
+
+	tracer   ot.Tracer      // Tracer for the spans, see Proxy.SetTracer.
+	observer HealthObserver // Told the outcome of the health checks, see Proxy.SetHealthObserver.
+
+	avgWeight      int64         // Weight of the previous average when averaging dial and read times.
+	dialTimeoutMin time.Duration // Lower bound of the adaptive dial timeout.
+	dialTimeoutMax time.Duration // Upper bound of the adaptive dial timeout.
+	keepAlive      time.Duration // Period of the TCP keepalive probes, 0 uses defaultKeepAlive and negative disables them.
+
+	timeoutJitter float64 // Fraction of the dial and read timeouts they are randomly moved by, 0 disables it.
+
+	keepaliveTimeout int64 // Idle timeout for TCP connections the upstream sent with edns-tcp-keepalive, -1 until known.
+
+	protoExpire [typeTotalCount]time.Duration // Expire duration per transport type, overriding expire when set.
+
+	dohURL     string       // Set for DNS-over-HTTPS upstreams, these bypass the conn cache.
+	httpClient *http.Client // Pools the connections to a DNS-over-HTTPS upstream.
+
+	cookies *cookies // DNS Cookies for this upstream, only used when Options.EnableCookies is set.
+	breaker *breaker // Circuit breaker for this upstream, nil when disabled.
+
+	pins [][sha256.Size]byte // SHA-256 digests of the accepted SubjectPublicKeyInfos, empty disables pinning.
+
+	sessionCache tls.ClientSessionCache // TLS session cache for a TLS config that has none, so reconnects resume.
+
+	proxyProtocol bool // Send a PROXY protocol v2 header with the client's address on tcp and tcp-tls connections.
+
+	maxUses int // After this many queries a connection is closed instead of cached; 0 means unlimited.
+
+	noCache bool // Dial a new connection for every query and close it afterwards.
+
+	candidates []string               // Addresses the upstream name resolved to, dialed instead of addr when set.
+	lastAddr   atomic.Pointer[string] // The candidate that won the last race.
+	v6Failed   int64                  // Until when, in Unix nanoseconds, IPv4 is tried first.
+
+	socksAddr string       // SOCKS5 proxy the upstream is dialed through, empty dials it directly.
+	socksAuth *xproxy.Auth // Username and password for the SOCKS5 proxy, nil when it needs none.
+
+	affinity AffinityHash // Keys cached connections by client, nil disables affinity.
+
+	earlyData bool // Send the first query on a resumed DNS-over-QUIC connection as 0-RTT early data.
 
-	mu   sync.Mutex
-	stop chan struct{}
+	probeInterval  time.Duration // Interval of the active health probes, 0 disables them.
+	probeName      string        // Name asked for by the probes.
+	probeType      uint16        // Type asked for by the probes.
+	probeThreshold int32         // Failed probes in a row after which the upstream is marked down.
+	probeFailures  int32         // Failed probes in a row so far.
+	down           int32         // 1 when the upstream is marked down by the probes.
+
+	drained atomic.Bool // No new connections are dialed, see SetDrained.
+
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	drain    drain // Outstanding Connect calls, for Shutdown.
+
+	muxMu    sync.Mutex
+	muxes    [typeTotalCount][]*muxConn  // Pipelined connections, only used when pipelining is enabled.
+	muxDials [typeTotalCount]*muxDialing // Pipelined connection being dialed, see muxDial.
 }
 
 func newTransport(proxyName, addr string) *Transport {
@@ -39,13 +135,22 @@ func newTransport(proxyName, addr string) *Transport {
 		addr:        addr,
 		stop:        make(chan struct{}),
 		proxyName:   proxyName,
+		cookies:     newCookies(),
+
+		avgWeight:      cumulativeAvgWeight,
+		dialTimeoutMin: minDialTimeout,
+		dialTimeoutMax: maxDialTimeout,
+
+		keepaliveTimeout: -1,
 	}
+	// Until the first dial there is no dial timeout in use yet.
+	dialTimeoutGauge.WithLabelValues(proxyName, addr).Set(minDialTimeout.Seconds())
 	return t
 }
 
 // connManager manages the persistent connection cache for UDP and TCP.
 func (t *Transport) connManager() {
-	ticker := time.NewTicker(defaultExpire)
+	ticker := time.NewTicker(t.cleanupInterval())
 	defer ticker.Stop()
 	for {
 		select {
@@ -58,20 +163,31 @@ func (t *Transport) connManager() {
 	}
 }
 
+// cleanupInterval returns how often connManager closes expired connections, at least as often as the
+// shortest expire duration.
+func (t *Transport) cleanupInterval() time.Duration {
+	interval := defaultExpire
+	for _, expire := range append(t.protoExpire[:], t.expire) {
+		if expire > 0 && expire < interval {
+			interval = expire
+		}
+	}
+	return interval
+}
+
 // closeConns closes connections.
 func closeConns(conns []*persistConn) {
 	for _, pc := range conns {
-		pc.c.Close()
+		pc.close()
 	}
 }
 
 // cleanup removes connections from cache.
 func (t *Transport) cleanup(all bool) {
-	var toClose []*persistConn
+	var toClose, expired, aged []*persistConn
 
 	t.mu.Lock()
 	now := time.Now()
-	staleTime := now.Add(-t.expire)
 	// Pre-compute max-age deadline outside the loop to avoid repeated time.Now() calls.
 	var maxAgeDeadline time.Time
 	if t.maxAge > 0 {
@@ -84,21 +200,28 @@ func (t *Transport) cleanup(all bool) {
 		if all {
 			t.conns[transtype] = nil
 			toClose = append(toClose, stack...)
+			t.updatePoolSize(transportType(transtype))
 			continue
 		}
+		staleTime := now.Add(-t.idleTimeout(transportType(transtype)))
 
 		// When max-age is set, use a linear scan to evaluate both the idle-timeout
 		// (expire, based on last-used time) and the max-age (based on creation time).
-		if t.maxAge > 0 {
+		// The same goes for idle timeouts sent with edns-tcp-keepalive, which are per connection.
+		if t.maxAge > 0 || t.keepaliveKnown() {
 			var alive []*persistConn
 			for _, pc := range stack {
-				if !pc.used.After(staleTime) || pc.created.Before(maxAgeDeadline) {
-					toClose = append(toClose, pc)
-				} else {
+				switch {
+				case !maxAgeDeadline.IsZero() && pc.created.Before(maxAgeDeadline):
+					aged = append(aged, pc)
+				case !pc.used.After(now.Add(-t.connIdleTimeout(pc, transportType(transtype)))):
+					expired = append(expired, pc)
+				default:
 					alive = append(alive, pc)
 				}
 			}
 			t.conns[transtype] = alive
+			t.updatePoolSize(transportType(transtype))
 			continue
 		}
 
@@ -111,12 +234,29 @@ func (t *Transport) cleanup(all bool) {
 			return stack[i].used.After(staleTime)
 		})
 		t.conns[transtype] = stack[good:]
-		toClose = append(toClose, stack[:good]...)
+		expired = append(expired, stack[:good]...)
+		t.updatePoolSize(transportType(transtype))
 	}
 	t.mu.Unlock()
 
 	// Close connections after releasing lock
 	closeConns(toClose)
+	for _, pc := range expired {
+		t.closeConn(pc, closeExpire)
+	}
+	for _, pc := range aged {
+		t.closeConn(pc, closeMaxAge)
+	}
+
+	if !all {
+		t.expireMuxes(now)
+	}
+	if all {
+		t.closeMuxes()
+		if t.httpClient != nil {
+			t.httpClient.CloseIdleConnections()
+		}
+	}
 }
 
 // Yield returns the connection to transport for reuse.
@@ -125,45 +265,203 @@ func (t *Transport) Yield(pc *persistConn) {
 	select {
 	case <-t.stop:
 		// If stopped, don't return to pool, just close
-		pc.c.Close()
+		pc.close()
 		return
 	default:
 	}
 
+	// The connection was opened for a query of a UDP client, no other query has the same PROXY protocol header.
+	if pc.header != nil && !reusableHeader(pc.header) {
+		t.closeConn(pc, closeProxyHeader)
+		return
+	}
+
+	if t.noCache {
+		t.closeConn(pc, closeNoCache)
+		return
+	}
+
 	pc.used = time.Now() // update used time
+	pc.uses++
+
+	// A connection past its max-age would only be closed on the next Dial or cleanup, do it now.
+	if t.maxAge > 0 && pc.used.Sub(pc.created) > t.maxAge {
+		t.closeConn(pc, closeMaxAge)
+		return
+	}
+	if t.maxUses > 0 && pc.uses >= t.maxUses {
+		t.closeConn(pc, closeMaxUses)
+		return
+	}
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	transtype := t.transportTypeFromConn(pc)
 
+	// The upstream asked for TCP connections to be closed when idle.
+	if t.connIdleTimeout(pc, transtype) == 0 {
+		t.closeConn(pc, closeKeepalive)
+		return
+	}
+
 	if t.maxIdleConns > 0 && len(t.conns[transtype]) >= t.maxIdleConns {
-		pc.c.Close()
+		connPoolOverflowCount.WithLabelValues(t.proxyName, t.addr, transtype.String()).Add(1)
+		pc.close()
 		return
 	}
 
 	t.conns[transtype] = append(t.conns[transtype], pc)
+	t.updatePoolSize(transtype)
 }
 
-// Start starts the transport's connection manager.
-func (t *Transport) Start() { go t.connManager() }
+// Reasons for closing a connection, used as the reason label of conn_closed_total.
+const (
+	closeExpire      = "expire"       // idle for longer than the expire duration
+	closeMaxAge      = "max_age"      // older than the max-age duration
+	closeMaxUses     = "max_uses"     // used for the maximum number of queries
+	closeNoCache     = "no_cache"     // connection caching is disabled
+	closeError       = "error"        // a read or write on the connection failed
+	closeCanceled    = "canceled"     // the query was abandoned while a reply was outstanding
+	closeKeepalive   = "keepalive"    // the upstream asked for idle connections to be closed with edns-tcp-keepalive
+	closePeer        = "peer"         // the upstream closed the connection while it was cached
+	closeProxyHeader = "proxy_header" // the PROXY protocol header is of a UDP client, no other query has it
+)
 
-// Stop stops the transport's connection manager.
-func (t *Transport) Stop() { close(t.stop) }
+// closeReason returns the reason for closing a connection after a failed read or write.
+func closeReason(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return closeCanceled
+	}
+	return closeError
+}
+
+// closeConn closes pc and records why it was closed and how old it was.
+func (t *Transport) closeConn(pc *persistConn, reason string) {
+	proto := t.transportTypeFromConn(pc).String()
+	connClosedCount.WithLabelValues(t.proxyName, t.addr, proto, reason).Add(1)
+	connAge.WithLabelValues(t.proxyName, t.addr, proto).Observe(time.Since(pc.created).Seconds())
+	pc.close()
+}
+
+// updatePoolSize reports the number of cached connections for transtype, t.mu must be held.
+func (t *Transport) updatePoolSize(transtype transportType) {
+	connPoolSize.WithLabelValues(t.proxyName, t.addr, transtype.String()).Set(float64(len(t.conns[transtype])))
+}
+
+// Start starts the transport's connection manager, and the active health check when it is enabled.
+func (t *Transport) Start() {
+	go t.connManager()
+	if t.probeInterval > 0 {
+		go t.healthCheck()
+	}
+}
+
+// Stop stops the transport's connection manager, it is safe to call more than once.
+func (t *Transport) Stop() { t.stopOnce.Do(func() { close(t.stop) }) }
 
 // SetExpire sets the connection expire time in transport.
 func (t *Transport) SetExpire(expire time.Duration) { t.expire = expire }
 
+// SetProtoExpire sets the expire time of the connections dialed with proto, "udp", "tcp", "tcp-tls" or "quic",
+// overriding the one set with SetExpire, e.g. to close idle TCP connections before the upstream does while
+// keeping UDP sockets around for longer. An expire of 0 goes back to the one set with SetExpire.
+func (t *Transport) SetProtoExpire(proto string, expire time.Duration) {
+	t.protoExpire[stringToTransportType(proto)] = expire
+}
+
+// expireFor returns after how long an idle connection of transtype expires.
+func (t *Transport) expireFor(transtype transportType) time.Duration {
+	if expire := t.protoExpire[transtype]; expire > 0 {
+		return expire
+	}
+	return t.expire
+}
+
 // SetMaxAge sets the maximum lifetime of a connection regardless of activity.
 // A value of 0 (default) disables max-age and connections are only closed by expire (idle-timeout).
 func (t *Transport) SetMaxAge(maxAge time.Duration) { t.maxAge = maxAge }
 
+// SetMaxUses sets the number of queries after which a connection is closed instead of going back into the
+// cache, so a load balancer in front of the upstream gets to pick a backend again. Like max-age it doesn't
+// apply to pipelined connections. A value of 0 (default) means unlimited.
+func (t *Transport) SetMaxUses(n int) { t.maxUses = n }
+
+// SetNoCache disables connection caching: Dial always returns a new connection and Yield always closes it.
+// Useful to rule out stale cached connections while debugging, or where connection reuse isn't allowed.
+// Pipelining is not used when caching is disabled.
+func (t *Transport) SetNoCache(b bool) { t.noCache = b }
+
 // SetMaxIdleConns sets the maximum idle connections per transport type.
 // A value of 0 means unlimited (default).
 func (t *Transport) SetMaxIdleConns(n int) { t.maxIdleConns = n }
 
+// SetCircuitBreaker makes queries fail fast with ErrCircuitOpen for cooldown after threshold consecutive
+// dial or read failures within window. After cooldown a single query probes the upstream, a reply closes
+// the breaker. A threshold of 0 disables it.
+func (t *Transport) SetCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	if threshold <= 0 {
+		t.breaker = nil
+		return
+	}
+	t.breaker = newBreaker(t.proxyName, t.addr, threshold, window, cooldown)
+}
+
+// SetDialTimeout sets the bounds of the adaptive dial timeout, the defaults are 1s and 30s. The average
+// dial time starts over from half of maxValue.
+func (t *Transport) SetDialTimeout(minValue, maxValue time.Duration) {
+	t.dialTimeoutMin = minValue
+	t.dialTimeoutMax = maxValue
+	atomic.StoreInt64(&t.avgDialTime, int64(maxValue/2))
+	dialTimeoutGauge.WithLabelValues(t.proxyName, t.addr).Set(minValue.Seconds())
+}
+
+// SetMaxDialTimeout sets the upper bound of the adaptive dial timeout, the lower bound is kept unless it is above
+// maxValue. The average dial time starts over from half of maxValue.
+func (t *Transport) SetMaxDialTimeout(maxValue time.Duration) {
+	t.SetDialTimeout(min(t.dialTimeoutMin, maxValue), maxValue)
+}
+
+// SetAverageWeight sets how much the observed dial and read times are smoothed, each new one moves the
+// average by 1/weight of the difference. The default is 4, a weight below 1 is ignored.
+func (t *Transport) SetAverageWeight(weight int64) {
+	if weight < 1 {
+		return
+	}
+	t.avgWeight = weight
+}
+
+// SetDrained stops the transport from dialing new connections to the upstream, a dial fails with ErrDrained.
+// Cached connections are still used, so queries already on their way finish. Health checks are not affected.
+func (t *Transport) SetDrained(b bool) { t.drained.Store(b) }
+
+// SetQUIC makes the transport dial the upstream with DNS-over-QUIC regardless of the
+// protocol asked for in Dial.
+func (t *Transport) SetQUIC() { t.quic = true }
+
+// SetUnix makes the transport dial its address as the path of a Unix domain socket. Queries are sent over it
+// with DNS-over-TCP framing, whichever protocol is asked for in Dial.
+func (t *Transport) SetUnix() { t.unix = true }
+
+// SetEarlyData makes the transport send the first query on a new DNS-over-QUIC connection as 0-RTT early
+// data when it resumes a session the upstream allows 0-RTT for, saving a round trip. Early data can be
+// replayed by an attacker, see RFC 9250, Section 4.5. When the upstream rejects it the query is sent again
+// once the handshake is complete. Go's TLS client can't send early data, so DNS-over-TLS connections only
+// resume sessions.
+func (t *Transport) SetEarlyData(b bool) { t.earlyData = b }
+
 // SetTLSConfig sets the TLS config in transport.
-func (t *Transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
+func (t *Transport) SetTLSConfig(cfg *tls.Config) {
+	t.baseTLSConfig = cfg
+	t.tlsConfig = t.pinned(t.withSessionCache(cfg))
+	if t.dohURL != "" {
+		// The idle connections of the old client would linger with the old config until they time out.
+		if t.httpClient != nil {
+			t.httpClient.CloseIdleConnections()
+		}
+		t.httpClient = newHTTPClient(t.tlsConfig)
+	}
+}
 
 // GetTLSConfig returns the TLS config in transport.
 func (t *Transport) GetTLSConfig() *tls.Config { return t.tlsConfig }
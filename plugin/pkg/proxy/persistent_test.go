@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"runtime"
 	"testing"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCached(t *testing.T) {
@@ -195,6 +197,93 @@ func TestMaxIdleConnsUnlimited(t *testing.T) {
 	}
 }
 
+func TestConnPoolSizeMetric(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestConnPoolSizeMetric", s.Addr)
+	tr.SetMaxIdleConns(2)
+	tr.Start()
+	defer tr.Stop()
+
+	poolSize := func() float64 {
+		return testutil.ToFloat64(connPoolSize.WithLabelValues("TestConnPoolSizeMetric", s.Addr, "udp"))
+	}
+
+	c1, _, _ := tr.Dial("udp")
+	c2, _, _ := tr.Dial("udp")
+	c3, _, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	tr.Yield(c2)
+	tr.Yield(c3) // discarded, pool is full
+
+	if x := poolSize(); x != 2 {
+		t.Errorf("Expected pool size metric 2, got %v", x)
+	}
+	if x := testutil.ToFloat64(connPoolOverflowCount.WithLabelValues("TestConnPoolSizeMetric", s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 connection closed because the pool was full, got %v", x)
+	}
+
+	tr.Dial("udp")
+	if x := poolSize(); x != 1 {
+		t.Errorf("Expected pool size metric 1 after dial, got %v", x)
+	}
+
+	tr.cleanup(true)
+	if x := poolSize(); x != 0 {
+		t.Errorf("Expected pool size metric 0 after cleanup, got %v", x)
+	}
+}
+
+func TestConnClosedMetric(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	// The connection manager isn't started, cleanup is called by the test only.
+	tr := newTransport("TestConnClosedMetric", s.Addr)
+	tr.SetExpire(10 * time.Millisecond)
+	defer tr.Stop()
+
+	closed := func(reason string) float64 {
+		return testutil.ToFloat64(connClosedCount.WithLabelValues("TestConnClosedMetric", s.Addr, "udp", reason))
+	}
+
+	c1, _, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	time.Sleep(20 * time.Millisecond)
+	tr.cleanup(false)
+	if x := closed(closeExpire); x != 1 {
+		t.Errorf("Expected 1 connection closed by expire, got %v", x)
+	}
+
+	tr.SetExpire(time.Minute)
+	tr.SetMaxAge(10 * time.Millisecond)
+	c2, _, _ := tr.Dial("udp")
+	tr.Yield(c2)
+	time.Sleep(20 * time.Millisecond)
+	tr.cleanup(false)
+	if x := closed(closeMaxAge); x != 1 {
+		t.Errorf("Expected 1 connection closed by max-age, got %v", x)
+	}
+
+	c3, _, _ := tr.Dial("udp")
+	tr.closeConn(c3, closeError)
+	if x := closed(closeError); x != 1 {
+		t.Errorf("Expected 1 connection closed by an error, got %v", x)
+	}
+	if x := testutil.CollectAndCount(connAge, "coredns_proxy_conn_age_seconds"); x == 0 {
+		t.Error("Expected connection ages to be recorded")
+	}
+}
+
 func TestYieldAfterStop(t *testing.T) {
 	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
 		ret := new(dns.Msg)
@@ -314,6 +403,40 @@ func TestMaxAgeFIFORotation(t *testing.T) {
 	}
 }
 
+// TestMaxAgeYield verifies that a connection past max_age is closed when it is
+// yielded instead of being put back in the pool.
+func TestMaxAgeYield(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestMaxAgeYield", s.Addr)
+	tr.SetExpire(10 * time.Second)
+	tr.SetMaxAge(100 * time.Millisecond)
+	tr.Start()
+	defer tr.Stop()
+
+	pc, _, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	pc.created = time.Now().Add(-200 * time.Millisecond)
+	tr.Yield(pc)
+
+	tr.mu.Lock()
+	pooled := len(tr.conns[typeUDP])
+	tr.mu.Unlock()
+	if pooled != 0 {
+		t.Errorf("Expected connection past max_age not to be pooled, got %d cached", pooled)
+	}
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestMaxAgeYield", s.Addr, "udp", closeMaxAge)); x != 1 {
+		t.Errorf("Expected 1 connection closed by max-age, got %v", x)
+	}
+}
+
 func BenchmarkYield(b *testing.B) {
 	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
 		ret := new(dns.Msg)
@@ -341,3 +464,168 @@ func BenchmarkYield(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func TestProtoExpire(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	// Without the connection manager, so only Dial checks the expire durations.
+	tr := newTransport("TestProtoExpire", s.Addr)
+	tr.SetExpire(time.Minute)
+	tr.SetProtoExpire("tcp", 50*time.Millisecond)
+	defer tr.Stop()
+
+	if x := tr.cleanupInterval(); x != 50*time.Millisecond {
+		t.Errorf("Expected the cleanup to run every 50ms, got %s", x)
+	}
+
+	udp, _, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, _, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Yield(udp)
+	tr.Yield(tcp)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if c, cached, _ := tr.Dial("tcp"); cached {
+		t.Error("Expected the tcp connection to be expired")
+	} else {
+		c.close()
+	}
+	if c, cached, _ := tr.Dial("udp"); !cached || c != udp {
+		t.Error("Expected the cached udp connection")
+	} else {
+		c.close()
+	}
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestProtoExpire", s.Addr, "tcp", closeExpire)); x != 1 {
+		t.Errorf("Expected 1 expired tcp connection, got %v", x)
+	}
+
+	tr.SetProtoExpire("tcp", 0)
+	if x := tr.expireFor(typeTCP); x != time.Minute {
+		t.Errorf("Expected tcp to go back to the expire duration, got %s", x)
+	}
+}
+
+func TestMaxUses(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestMaxUses", s.Addr)
+	tr.SetMaxUses(2)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, cached, _ := tr.Dial("tcp")
+	if cached {
+		t.Error("Expected a new connection")
+	}
+	tr.Yield(c1)
+
+	c2, cached, _ := tr.Dial("tcp")
+	if !cached || c2 != c1 {
+		t.Error("Expected the cached connection after its first query")
+	}
+	tr.Yield(c2)
+
+	c3, cached, _ := tr.Dial("tcp")
+	if cached {
+		t.Error("Expected a new connection after the maximum number of queries")
+	}
+	tr.Yield(c3)
+
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestMaxUses", s.Addr, "tcp", closeMaxUses)); x != 1 {
+		t.Errorf("Expected 1 connection closed after its maximum number of queries, got %v", x)
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestNoCache", s.Addr)
+	tr.SetNoCache(true)
+	tr.Start()
+	defer tr.Stop()
+
+	seen := make(map[*persistConn]bool)
+	for _, proto := range []string{"udp", "tcp", "udp", "tcp"} {
+		pc, cached, err := tr.Dial(proto)
+		if err != nil {
+			t.Fatalf("Failed to dial %s: %v", proto, err)
+		}
+		if cached {
+			t.Errorf("Expected a new %s connection", proto)
+		}
+		if seen[pc] {
+			t.Errorf("Expected a %s connection that wasn't used before", proto)
+		}
+		seen[pc] = true
+		tr.Yield(pc)
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		if x := testutil.ToFloat64(connCacheHitsCount.WithLabelValues("TestNoCache", s.Addr, proto)); x != 0 {
+			t.Errorf("Expected no %s cache hits, got %v", proto, x)
+		}
+		if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestNoCache", s.Addr, proto, closeNoCache)); x != 2 {
+			t.Errorf("Expected 2 %s connections closed, got %v", proto, x)
+		}
+	}
+}
+
+func TestDrained(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport("TestDrained", s.Addr)
+	tr.Start()
+	defer tr.Stop()
+
+	c, _, _ := tr.Dial("udp")
+	tr.Yield(c)
+
+	tr.SetDrained(true)
+	// A connection that is already there is still used.
+	c, cached, err := tr.Dial("udp")
+	if err != nil || !cached {
+		t.Fatalf("Expected the cached connection, got cached %t and %v", cached, err)
+	}
+	tr.Yield(c)
+
+	tr.cleanup(true)
+	if _, _, err := tr.Dial("udp"); !errors.Is(err, ErrDrained) {
+		t.Errorf("Expected %q, got %v", ErrDrained, err)
+	}
+	// The probes go on.
+	tr.probeName, tr.probeType = ".", dns.TypeNS
+	if err := tr.probe(); err != nil {
+		t.Errorf("Expected the probe to be sent while drained, got %v", err)
+	}
+
+	tr.SetDrained(false)
+	if _, _, err := tr.Dial("udp"); err != nil {
+		t.Errorf("Expected a new connection once undrained, got %v", err)
+	}
+}
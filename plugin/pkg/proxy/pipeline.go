@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// errMuxClosed is returned to queries that were in flight when a pipelined connection went away.
+	errMuxClosed = errors.New("proxy: pipelined connection closed")
+	// errMuxTimeout is returned when no reply arrived on a pipelined connection within the read timeout.
+	errMuxTimeout = errors.New("proxy: timeout waiting for pipelined reply")
+)
+
+// muxConn shares one TCP or TLS connection between concurrent queries. Replies are
+// demultiplexed by message ID, so the upstream may answer out of order (RFC 7766).
+type muxConn struct {
+	pc    *persistConn
+	proto string
+	t     *Transport
+
+	wmu sync.Mutex // serializes writes on pc
+
+	mu        sync.Mutex
+	waiters   map[uint16]muxWaiter
+	reserved  int       // queries that took a slot with reserve, see Transport.SetPipelineDepth
+	idleSince time.Time // when the last query gave its slot back
+	err       error     // set once the reader has stopped, no new queries are accepted after that
+}
+
+// muxDialing is the dial of a pipelined connection that is in progress. Queries that find no connection with a
+// free slot wait for it instead of dialing one of their own.
+type muxDialing struct {
+	done chan struct{}
+	err  error // the error of the dial, set before done is closed
+}
+
+// muxWaiter is a query on a muxConn waiting for its reply.
+type muxWaiter struct {
+	ch  chan *dns.Msg
+	req *dns.Msg // the query, to drop replies for another question; nil to take any reply with the ID
+}
+
+// SetPipelining enables pipelining of queries over TCP and TLS connections. Instead of
+// taking a connection out of the cache for each query, all queries share one connection
+// per protocol. Zone transfers always use a connection of their own. A connection without
+// queries in flight is closed after the expire duration, and those over the maximum of idle
+// connections are closed as well, see SetExpire and SetMaxIdleConns.
+func (t *Transport) SetPipelining(b bool) { t.pipelining = b }
+
+// SetPipelineDepth limits the queries in flight on one pipelined connection to n. A query that finds the
+// connections at the limit gets a pipelined connection of its own, which further queries share as well.
+// 0, the default, puts no limit on the queries in flight.
+func (t *Transport) SetPipelineDepth(n int) { t.pipelineDepth = n }
+
+// muxDial returns a shared connection for proto with a slot reserved for a query, dialing a new one
+// if there is none or all are at the pipeline depth. The slot is given back by exchange. One connection
+// per proto is dialed at a time, without holding t.muxMu: the other queries wait for it until their ctx
+// is done, and fail with its error, unless the dial was only given up because the query that started it
+// was abandoned.
+func (t *Transport) muxDial(ctx context.Context, proto string) (*muxConn, error) {
+	proto = t.dialProto(proto)
+	transtype := stringToTransportType(proto)
+
+	for {
+		t.muxMu.Lock()
+		for _, m := range t.muxes[transtype] {
+			if m.reserve(t.pipelineDepth) {
+				t.muxMu.Unlock()
+				connCacheHitsCount.WithLabelValues(t.proxyName, t.addr, proto).Add(1)
+				return m, nil
+			}
+		}
+		if d := t.muxDials[transtype]; d != nil {
+			t.muxMu.Unlock()
+			select {
+			case <-d.done:
+				if d.err != nil {
+					return nil, d.err
+				}
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		d := &muxDialing{done: make(chan struct{})}
+		t.muxDials[transtype] = d
+		t.muxMu.Unlock()
+
+		pc, _, err := t.dial(ctx, proto, false, nil, 0)
+
+		t.muxMu.Lock()
+		t.muxDials[transtype] = nil
+		var m *muxConn
+		if err == nil {
+			select {
+			case <-t.stop:
+				// closeMuxes may already have run, the connection is not published.
+				pc.close()
+				err = errors.New(ErrTransportStopped)
+			default:
+				m = &muxConn{pc: pc, proto: proto, t: t, waiters: make(map[uint16]muxWaiter), reserved: 1}
+				t.muxes[transtype] = append(t.muxes[transtype], m)
+			}
+		}
+		if ctx.Err() == nil {
+			d.err = err
+		}
+		close(d.done)
+		t.muxMu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		go m.readLoop()
+		return m, nil
+	}
+}
+
+// reserve takes a slot for a query when m is alive and has fewer than depth queries, when depth isn't 0.
+func (m *muxConn) reserve(depth int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil || (depth > 0 && m.reserved >= depth) {
+		return false
+	}
+	m.reserved++
+	return true
+}
+
+// exchange sends req and waits at most readTimeout for the reply, or until ctx is done. Writing req may take
+// at most writeTimeout. The message ID of req is overwritten with one that isn't in use on this connection.
+// sent is when req was written. Unless noQuestionCheck is set replies for another question are dropped. It
+// gives back the slot muxDial reserved.
+func (m *muxConn) exchange(ctx context.Context, req *dns.Msg, writeTimeout, readTimeout time.Duration, noQuestionCheck bool) (ret *dns.Msg, sent time.Time, err error) {
+	defer func() {
+		m.mu.Lock()
+		m.reserved--
+		if m.reserved == 0 {
+			m.idleSince = time.Now()
+		}
+		m.mu.Unlock()
+	}()
+	ch := make(chan *dns.Msg, 1)
+
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, sent, m.err
+	}
+	id := dns.Id()
+	for {
+		if _, ok := m.waiters[id]; !ok {
+			break
+		}
+		id = dns.Id()
+	}
+	w := muxWaiter{ch: ch, req: req}
+	if noQuestionCheck {
+		w.req = nil
+	}
+	m.waiters[id] = w
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.waiters, id)
+		m.mu.Unlock()
+	}()
+
+	req.Id = id
+	m.wmu.Lock()
+	m.pc.c.SetWriteDeadline(deadline(ctx, writeTimeout))
+	err = m.pc.c.WriteMsg(req)
+	m.wmu.Unlock()
+	if err != nil {
+		m.close()
+		return nil, sent, err
+	}
+	sent = time.Now()
+
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+	select {
+	case ret, ok := <-ch:
+		if !ok {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return nil, sent, m.err
+		}
+		return ret, sent, nil
+	case <-timer.C:
+		return nil, sent, errMuxTimeout
+	case <-ctx.Done():
+		// A late reply is dropped by readLoop, the connection stays usable for the other queries.
+		return nil, sent, ctx.Err()
+	}
+}
+
+// readLoop reads replies and hands them to the waiting queries, until the connection is closed. An idle
+// connection is closed by expireMuxes.
+func (m *muxConn) readLoop() {
+	for {
+		ret, err := m.pc.c.ReadMsg()
+		if err != nil {
+			m.close()
+			return
+		}
+
+		// A reply for another question is dropped, the query keeps waiting for its own.
+		m.mu.Lock()
+		w, ok := m.waiters[ret.Id]
+		question := ok && w.req != nil && !matchQuestion(ret, w.req)
+		if question {
+			ok = false
+		}
+		if ok {
+			delete(m.waiters, ret.Id)
+		}
+		m.mu.Unlock()
+
+		if !ok {
+			unmatchedResponsesCount.WithLabelValues(m.t.proxyName, m.t.addr, m.proto).Add(1)
+			if question {
+				questionMismatchesCount.WithLabelValues(m.t.proxyName, m.t.addr, m.proto).Add(1)
+			}
+			continue
+		}
+		w.ch <- ret
+	}
+}
+
+// close shuts the connection down and fails all queries still in flight.
+func (m *muxConn) close() {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = errMuxClosed
+	for id, w := range m.waiters {
+		close(w.ch)
+		delete(m.waiters, id)
+	}
+	m.mu.Unlock()
+
+	m.remove()
+	m.pc.close()
+}
+
+// idle returns since when m has no queries in flight, false when it has some or is closed.
+func (m *muxConn) idle() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reserved > 0 || m.err != nil {
+		return time.Time{}, false
+	}
+	return m.idleSince, true
+}
+
+// closeIdle closes m unless a query took a slot on it in the meantime. It returns false when it didn't.
+func (m *muxConn) closeIdle() bool {
+	m.mu.Lock()
+	if m.reserved > 0 || m.err != nil {
+		m.mu.Unlock()
+		return false
+	}
+	m.err = errMuxClosed
+	m.mu.Unlock()
+
+	m.remove()
+	return true
+}
+
+// remove takes m out of the pipelined connections of the transport.
+func (m *muxConn) remove() {
+	m.t.muxMu.Lock()
+	transtype := stringToTransportType(m.proto)
+	m.t.muxes[transtype] = slices.DeleteFunc(m.t.muxes[transtype], func(x *muxConn) bool { return x == m })
+	m.t.muxMu.Unlock()
+}
+
+// expireMuxes closes the pipelined connections without queries in flight for longer than the idle timeout,
+// and the idle ones over maxIdleConns per transport type. Queries take the first connection with a free slot,
+// so the later connections are the ones closed.
+func (t *Transport) expireMuxes(now time.Time) {
+	var expired, overflow []*muxConn
+
+	t.muxMu.Lock()
+	for transtype, ms := range t.muxes {
+		stale := now.Add(-t.idleTimeout(transportType(transtype)))
+		idle := 0
+		for _, m := range ms {
+			since, ok := m.idle()
+			if !ok {
+				continue
+			}
+			if !since.After(stale) {
+				expired = append(expired, m)
+				continue
+			}
+			idle++
+			if t.maxIdleConns > 0 && idle > t.maxIdleConns {
+				overflow = append(overflow, m)
+			}
+		}
+	}
+	t.muxMu.Unlock()
+
+	for _, m := range expired {
+		if m.closeIdle() {
+			t.closeConn(m.pc, closeExpire)
+		}
+	}
+	for _, m := range overflow {
+		if m.closeIdle() {
+			connPoolOverflowCount.WithLabelValues(t.proxyName, t.addr, m.proto).Add(1)
+			m.pc.close()
+		}
+	}
+}
+
+// closeMuxes closes all pipelined connections of the transport.
+func (t *Transport) closeMuxes() {
+	t.muxMu.Lock()
+	var muxes []*muxConn
+	for _, ms := range t.muxes {
+		muxes = append(muxes, ms...)
+	}
+	t.muxMu.Unlock()
+
+	for _, m := range muxes {
+		m.close()
+	}
+}
@@ -0,0 +1,434 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPipelinedOutOfOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				// Read two queries, then answer them in reverse order preceded by a reply nobody asked for.
+				var queries []*dns.Msg
+				for range 2 {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					queries = append(queries, m)
+				}
+				stray := new(dns.Msg)
+				stray.SetReply(queries[0])
+				stray.Id = queries[0].Id ^ queries[1].Id ^ 0xffff
+				conn.WriteMsg(stray)
+				for i := len(queries) - 1; i >= 0; i-- {
+					ret := new(dns.Msg)
+					ret.SetReply(queries[i])
+					ret.Answer = append(ret.Answer, test.A(queries[i].Question[0].Name+" IN A 127.0.0.1"))
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+
+	addr := l.Addr().String()
+	p := NewProxy("TestPipelinedOutOfOrder", addr, transport.DNS)
+	p.SetPipelining(true)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	before := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestPipelinedOutOfOrder", addr, "tcp"))
+
+	names := []string{"a.example.org.", "b.example.org."}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			m.Id = uint16(100 + i) // #nosec G115 -- i is 0 or 1
+			req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+			resp, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+			if err != nil {
+				t.Errorf("Query %s failed: %s", name, err)
+				return
+			}
+			if resp.Id != m.Id {
+				t.Errorf("Expected reply ID %d, got %d", m.Id, resp.Id)
+			}
+			if x := resp.Answer[0].Header().Name; x != name {
+				t.Errorf("Expected answer for %s, got %s", name, x)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(accepted); n != 1 {
+		t.Errorf("Expected both queries to share 1 connection, got %d", n)
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestPipelinedOutOfOrder", addr, "tcp")) - before; x != 1 {
+		t.Errorf("Expected 1 unmatched response, got %v", x)
+	}
+}
+
+func TestPipelinedQuestionMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					// A reply with the ID of the query but for another name, then the right one.
+					ret := new(dns.Msg)
+					ret.SetReply(m)
+					ret.Question[0].Name = "other.example.org."
+					conn.WriteMsg(ret)
+					ret.Question[0].Name = m.Question[0].Name
+					ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" IN A 127.0.0.1"))
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+
+	addr := l.Addr().String()
+	p := NewProxy("TestPipelinedQuestionMismatch", addr, transport.DNS)
+	p.SetPipelining(true)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	ret, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if len(ret.Answer) != 1 {
+		t.Errorf("Expected the reply for the question, got %d answers", len(ret.Answer))
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestPipelinedQuestionMismatch", addr, "tcp")); x != 1 {
+		t.Errorf("Expected 1 unmatched response, got %v", x)
+	}
+	if x := testutil.ToFloat64(questionMismatchesCount.WithLabelValues("TestPipelinedQuestionMismatch", addr, "tcp")); x != 1 {
+		t.Errorf("Expected 1 question mismatch, got %v", x)
+	}
+
+	// With NoQuestionCheck the first reply is taken.
+	ret, _, err = p.Connect(context.Background(), req, Options{ForceTCP: true, NoQuestionCheck: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if x := ret.Question[0].Name; x != "other.example.org." {
+		t.Errorf("Expected the reply for the other name, got %s", x)
+	}
+}
+
+func TestPipelinedConnClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := &dns.Conn{Conn: c}
+		conn.ReadMsg()
+		conn.Close() // hang up without answering
+	}()
+
+	p := NewProxy("TestPipelinedConnClosed", l.Addr().String(), transport.DNS)
+	p.SetPipelining(true)
+	p.readTimeout = 1 * time.Second
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != errMuxClosed {
+		t.Errorf("Expected %q, got %v", errMuxClosed, err)
+	}
+}
+
+func TestPipelineDepth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				var wmu sync.Mutex
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					// Answer late, so the queries are in flight together. A query for
+					// cancel.example.org. isn't answered.
+					go func() {
+						if m.Question[0].Name == "cancel.example.org." {
+							return
+						}
+						time.Sleep(100 * time.Millisecond)
+						ret := new(dns.Msg)
+						ret.SetReply(m)
+						wmu.Lock()
+						conn.WriteMsg(ret)
+						wmu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+
+	p := NewProxy("TestPipelineDepth", l.Addr().String(), transport.DNS)
+	p.SetPipelining(true)
+	p.SetPipelineDepth(2)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	query := func(ctx context.Context, name string) error {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		_, _, err := p.Connect(ctx, req, Options{ForceTCP: true})
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			if err := query(context.Background(), "example.org."); err != nil {
+				t.Errorf("Query failed: %s", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if x := accepted.Load(); x != 2 {
+		t.Errorf("Expected 4 queries at a depth of 2 to use 2 connections, got %d", x)
+	}
+
+	// An abandoned query gives back its slot and ID.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := query(ctx, "cancel.example.org."); err == nil {
+		t.Error("Expected the abandoned query to fail")
+	}
+	p.transport.muxMu.Lock()
+	defer p.transport.muxMu.Unlock()
+	for _, m := range p.transport.muxes[typeTCP] {
+		m.mu.Lock()
+		if m.reserved != 0 || len(m.waiters) != 0 {
+			t.Errorf("Expected no reserved slots and waiting queries, got %d and %d", m.reserved, len(m.waiters))
+		}
+		m.mu.Unlock()
+	}
+}
+
+func TestPipelinedDialUnlocked(t *testing.T) {
+	// The upstream accepts connections but never finishes the TLS handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := NewProxy("TestPipelinedDialUnlocked", l.Addr().String(), transport.TLS)
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.SetPipelining(true)
+	p.SetDialTimeout(300*time.Millisecond, 300*time.Millisecond)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	query := func(ctx context.Context) error {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		_, _, err := p.Connect(ctx, req, Options{})
+		return err
+	}
+
+	// The queries share the one dial and fail with it, instead of each waiting for a dial of its own.
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			if err := query(context.Background()); err == nil {
+				t.Error("Expected the query to fail")
+			}
+		})
+	}
+
+	// An abandoned query doesn't wait for the dial.
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	abandoned := time.Now()
+	if err := query(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(abandoned); d > 150*time.Millisecond {
+		t.Errorf("Expected the abandoned query to return right away, took %s", d)
+	}
+
+	wg.Wait()
+	if d := time.Since(begin); d > 800*time.Millisecond {
+		t.Errorf("Expected the queries to wait for a single dial, took %s", d)
+	}
+}
+
+func TestPipelinedIdle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				var wmu sync.Mutex
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					// Answer late, so the queries are in flight together.
+					go func() {
+						time.Sleep(100 * time.Millisecond)
+						ret := new(dns.Msg)
+						ret.SetReply(m)
+						wmu.Lock()
+						conn.WriteMsg(ret)
+						wmu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+
+	p := NewProxy("TestPipelinedIdle", l.Addr().String(), transport.DNS)
+	p.SetPipelining(true)
+	p.SetPipelineDepth(1)
+	p.SetMaxIdleConns(1)
+	p.readTimeout = 1 * time.Second
+	defer p.transport.Stop()
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+			if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != nil {
+				t.Errorf("Query failed: %s", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	muxes := func() int {
+		p.transport.muxMu.Lock()
+		defer p.transport.muxMu.Unlock()
+		return len(p.transport.muxes[typeTCP])
+	}
+	if x := muxes(); x != 3 {
+		t.Fatalf("Expected 3 queries at a depth of 1 to use 3 connections, got %d", x)
+	}
+
+	// The idle connections over max_idle_conns are closed.
+	p.transport.cleanup(false)
+	if x := muxes(); x != 1 {
+		t.Errorf("Expected 1 idle connection to be kept, got %d", x)
+	}
+
+	// The last one once it was idle for longer than expire.
+	expired := testutil.ToFloat64(connClosedCount.WithLabelValues("TestPipelinedIdle", l.Addr().String(), "tcp", closeExpire))
+	p.transport.SetExpire(10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	p.transport.cleanup(false)
+	if x := muxes(); x != 0 {
+		t.Errorf("Expected the idle connection to expire, got %d connections", x)
+	}
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestPipelinedIdle", l.Addr().String(), "tcp", closeExpire)) - expired; x != 1 {
+		t.Errorf("Expected 1 connection closed for expire, got %v", x)
+	}
+}
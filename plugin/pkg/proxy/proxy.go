@@ -1,16 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"runtime"
 	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/plugin/pkg/up"
 )
 
-// Proxy defines an upstream host.
+// Proxy defines an upstream host. It is a single upstream, choosing between upstreams and falling through to the
+// next one on failure is left to the plugin using it, as forward does with its policies.
 type Proxy struct {
 	fails     uint32
 	addr      string
@@ -18,15 +22,43 @@ type Proxy struct {
 
 	transport *Transport
 
-	readTimeout time.Duration
+	readTimeout    time.Duration // Static read timeout, used until the first reply when adaptive.
+	avgReadTime    int64         // kind of average round-trip time, 0 until the first reply
+	minReadTimeout time.Duration // Lower bound of the adaptive read timeout.
+	maxReadTimeout time.Duration // Upper bound of the adaptive read timeout, 0 disables it.
+
+	transferReadTimeout time.Duration // Read timeout between the messages of a zone transfer.
+	writeTimeout        time.Duration // Write timeout of a query, or of the request of a zone transfer.
+	maxTransferRecords  int           // Records of a zone transfer before it is aborted, 0 is unlimited.
+	maxTransferBytes    int           // Bytes of the messages of a zone transfer before it is aborted, 0 is unlimited.
+
+	srtt srtt // Smoothed round-trip time, see SRTT.
+
+	weight int // Share of the queries relative to the other upstreams, for a weighted selection.
+
+	maxMismatched int // Replies with a mismatched ID tolerated per query over UDP, 0 is unlimited.
+
+	truncated *truncationHistory // Questions whose reply over UDP was truncated, see Options.PreferTCPLarge.
+
+	inFlight     chan struct{} // Counted semaphore of the queries in flight, nil when unlimited.
+	inFlightWait time.Duration // How long a query waits for a slot when the limit is reached.
+
+	sink atomic.Pointer[sinkHolder] // Gets an Event for each reply, see SetEventSink.
 
 	// health checking
 	probe  *up.Probe
 	health HealthChecker
 }
 
-// NewProxy returns a new proxy.
+// NewProxy returns a new proxy. For DNS-over-HTTPS (trans is transport.HTTPS) addr may carry the
+// URL path as in "dns.example.com:443/dns-query"; when it's omitted "/dns-query" is used. The path
+// stays part of the address, so upstreams on different paths of a host are told apart in the metrics.
 func NewProxy(proxyName, addr, trans string) *Proxy {
+	var dohURL string
+	if trans == transport.HTTPS {
+		_, dohURL = splitDoHAddr(addr)
+	}
+
 	p := &Proxy{
 		addr:        addr,
 		fails:       0,
@@ -35,8 +67,28 @@ func NewProxy(proxyName, addr, trans string) *Proxy {
 		transport:   newTransport(proxyName, addr),
 		health:      NewHealthChecker(proxyName, trans, true, "."),
 		proxyName:   proxyName,
+
+		transferReadTimeout: 2 * time.Second,
+		writeTimeout:        maxTimeout,
+
+		maxMismatched: DefaultMaxMismatched,
+
+		truncated: newTruncationHistory(DefaultTruncationHistory),
+
+		weight: 1,
+	}
+	p.SetEventSink(nil)
+	switch {
+	case dohURL != "":
+		p.transport.setDoH(dohURL)
+	case trans == transport.QUIC:
+		p.transport.SetQUIC()
+	case trans == transport.UNIX:
+		p.transport.SetUnix()
 	}
 
+	readTimeoutGauge.WithLabelValues(proxyName, addr).Set(p.readTimeout.Seconds())
+
 	runtime.SetFinalizer(p, (*Proxy).finalizer)
 	return p
 }
@@ -46,16 +98,170 @@ func (p *Proxy) Addr() string { return p.addr }
 // SetTLSConfig sets the TLS config in the lower p.transport and in the healthchecking client.
 func (p *Proxy) SetTLSConfig(cfg *tls.Config) {
 	p.transport.SetTLSConfig(cfg)
-	p.health.SetTLSConfig(cfg)
+	p.health.SetTLSConfig(p.transport.tlsConfig)
+}
+
+// SetPins sets the SPKI pins in the lower p.transport and the healthchecking client, see Transport.SetPins.
+func (p *Proxy) SetPins(pins []string) error {
+	if err := p.transport.SetPins(pins); err != nil {
+		return err
+	}
+	if p.transport.tlsConfig != nil {
+		p.health.SetTLSConfig(p.transport.tlsConfig)
+	}
+	return nil
+}
+
+// SetClientCert loads a client certificate into the lower p.transport and the healthchecking client,
+// see Transport.SetClientCert.
+func (p *Proxy) SetClientCert(certFile, keyFile, caFile string) error {
+	if err := p.transport.SetClientCert(certFile, keyFile, caFile); err != nil {
+		return err
+	}
+	p.health.SetTLSConfig(p.transport.tlsConfig)
+	return nil
+}
+
+// SetServerName sets the TLS server name in the lower p.transport and the healthchecking client.
+func (p *Proxy) SetServerName(name string) error {
+	if err := p.transport.SetServerName(name); err != nil {
+		return err
+	}
+	p.health.SetTLSConfig(p.transport.tlsConfig)
+	return nil
 }
 
 // SetExpire sets the expire duration in the lower p.transport.
 func (p *Proxy) SetExpire(expire time.Duration) { p.transport.SetExpire(expire) }
 
+// SetProtoExpire sets the expire time of the connections dialed with proto, see Transport.SetProtoExpire.
+func (p *Proxy) SetProtoExpire(proto string, expire time.Duration) {
+	p.transport.SetProtoExpire(proto, expire)
+}
+
 // SetMaxAge sets the maximum connection lifetime in the lower p.transport.
 // A value of 0 (default) disables max-age.
 func (p *Proxy) SetMaxAge(maxAge time.Duration) { p.transport.SetMaxAge(maxAge) }
 
+// SetMaxUses sets the maximum number of queries per connection in the lower p.transport, see Transport.SetMaxUses.
+func (p *Proxy) SetMaxUses(n int) { p.transport.SetMaxUses(n) }
+
+// SetNoCache disables connection caching in the lower p.transport, see Transport.SetNoCache.
+func (p *Proxy) SetNoCache(b bool) { p.transport.SetNoCache(b) }
+
+// SetEarlyData enables 0-RTT early data on DNS-over-QUIC connections in the lower p.transport, see
+// Transport.SetEarlyData.
+func (p *Proxy) SetEarlyData(b bool) { p.transport.SetEarlyData(b) }
+
+// SetPipelining enables pipelining of queries over TCP and TLS connections in the lower p.transport.
+func (p *Proxy) SetPipelining(b bool) { p.transport.SetPipelining(b) }
+
+// SetPipelineDepth limits the queries in flight on one pipelined connection of the lower p.transport, see
+// Transport.SetPipelineDepth.
+func (p *Proxy) SetPipelineDepth(n int) { p.transport.SetPipelineDepth(n) }
+
+// SetLocalAddr sets the source addresses for IPv4 and IPv6 upstreams in the lower p.transport.
+func (p *Proxy) SetLocalAddr(v4, v6 net.IP) { p.transport.SetLocalAddr(v4, v6) }
+
+// SetLocalPort sets the source port in the lower p.transport, see Transport.SetLocalPort.
+func (p *Proxy) SetLocalPort(port int) { p.transport.SetLocalPort(port) }
+
+// SetBindDevice binds the sockets of the lower p.transport to the network interface dev.
+func (p *Proxy) SetBindDevice(dev string) { p.transport.SetBindDevice(dev) }
+
+// SetCandidates sets the addresses the upstream name resolved to in the lower p.transport, see Transport.SetCandidates.
+func (p *Proxy) SetCandidates(addrs []string) { p.transport.SetCandidates(addrs) }
+
+// SetSOCKS5 makes the lower p.transport dial the upstream through a SOCKS5 proxy, see Transport.SetSOCKS5.
+func (p *Proxy) SetSOCKS5(addr, user, password string) { p.transport.SetSOCKS5(addr, user, password) }
+
+// SetAffinity sets the affinity hash of the lower p.transport, see Transport.SetAffinity.
+func (p *Proxy) SetAffinity(h AffinityHash) { p.transport.SetAffinity(h) }
+
+// SetWeight sets the share of the queries this upstream gets relative to the others, when the caller
+// selects upstreams by weight. w must be positive, the default is 1.
+func (p *Proxy) SetWeight(w int) { p.weight = w }
+
+// Weight returns the weight set with SetWeight.
+func (p *Proxy) Weight() int { return p.weight }
+
+// Candidates returns the addresses set with SetCandidates.
+func (p *Proxy) Candidates() []string { return p.transport.candidates }
+
+// SetDualStackDial enables racing IPv4 and IPv6 when dialing in the lower p.transport.
+func (p *Proxy) SetDualStackDial(b bool) { p.transport.SetDualStackDial(b) }
+
+// SetFastOpen enables TCP Fast Open when dialing over tcp and tcp-tls in the lower p.transport.
+func (p *Proxy) SetFastOpen(b bool) { p.transport.SetFastOpen(b) }
+
+// SetCircuitBreaker sets the circuit breaker in the lower p.transport, see Transport.SetCircuitBreaker.
+func (p *Proxy) SetCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	p.transport.SetCircuitBreaker(threshold, window, cooldown)
+}
+
+// SetDialTimeout sets the bounds of the adaptive dial timeout in the lower p.transport.
+func (p *Proxy) SetDialTimeout(minValue, maxValue time.Duration) {
+	p.transport.SetDialTimeout(minValue, maxValue)
+}
+
+// SetMaxDialTimeout sets the upper bound of the adaptive dial timeout in the lower p.transport.
+func (p *Proxy) SetMaxDialTimeout(maxValue time.Duration) {
+	p.transport.SetMaxDialTimeout(maxValue)
+}
+
+// DialTimeout returns the bounds of the adaptive dial timeout in the lower p.transport.
+func (p *Proxy) DialTimeout() (minValue, maxValue time.Duration) {
+	return p.transport.dialTimeoutMin, p.transport.dialTimeoutMax
+}
+
+// SetAverageWeight sets the weight used to average the dial and read times of this proxy, see
+// Transport.SetAverageWeight.
+func (p *Proxy) SetAverageWeight(weight int64) { p.transport.SetAverageWeight(weight) }
+
+// SetKeepAlivePeriod sets the period of the TCP keepalive probes in the lower p.transport.
+func (p *Proxy) SetKeepAlivePeriod(d time.Duration) { p.transport.SetKeepAlivePeriod(d) }
+
+// SetProxyProtocol sends the client's address in a PROXY protocol v2 header, see Transport.SetProxyProtocol.
+func (p *Proxy) SetProxyProtocol(b bool) { p.transport.SetProxyProtocol(b) }
+
+// SetDrained drains the upstream, see Transport.SetDrained. The caller should stop sending queries to a drained
+// proxy, see Drained.
+func (p *Proxy) SetDrained(b bool) { p.transport.SetDrained(b) }
+
+// Drained returns true if the upstream is drained.
+func (p *Proxy) Drained() bool { return p.transport.drained.Load() }
+
+// SetHealthcheckBackoff doubles the interval between the health checks of an upstream that keeps failing them
+// after each check, up to max. The interval of Start is used again once a check succeeds. A max that isn't above
+// that interval disables the backoff.
+func (p *Proxy) SetHealthcheckBackoff(max time.Duration) {
+	name, addr := p.proxyName, p.addr // not p, the probe would keep it from being finalized
+	p.probe.SetBackoff(max, func(d time.Duration) {
+		healthcheckIntervalGauge.WithLabelValues(name, addr).Set(d.Seconds())
+	})
+}
+
+// HealthObserver is told the outcome of the health checks of an upstream, from the goroutine that ran them.
+// It must not keep a reference to the Proxy, that would keep the Proxy from being finalized.
+type HealthObserver interface {
+	// Checked is called after a health check with the number of health checks in a row that failed.
+	Checked(fails uint32)
+	// Probed is called after a probe of the active health check with whether the upstream is marked down.
+	Probed(down bool)
+}
+
+// SetHealthObserver sets the observer of the health checks of the upstream, nil removes it. It must be
+// called before Start.
+func (p *Proxy) SetHealthObserver(o HealthObserver) { p.transport.observer = o }
+
+// HealthObserver returns the observer of the health checks of the upstream, or nil when there is none.
+func (p *Proxy) HealthObserver() HealthObserver { return p.transport.observer }
+
+// SetActiveHealthCheck probes the upstream in the background, see Transport.SetActiveHealthCheck.
+func (p *Proxy) SetActiveHealthCheck(interval time.Duration, name string, qtype uint16, threshold int) {
+	p.transport.SetActiveHealthCheck(interval, name, qtype, threshold)
+}
+
 // SetMaxIdleConns sets the maximum idle connections per transport type.
 // A value of 0 means unlimited (default).
 func (p *Proxy) SetMaxIdleConns(n int) { p.transport.SetMaxIdleConns(n) }
@@ -80,12 +286,20 @@ func (p *Proxy) Healthcheck() {
 	}
 
 	p.probe.Do(func() error {
-		return p.health.Check(p)
+		err := p.health.Check(p)
+		if o := p.transport.observer; o != nil {
+			o.Checked(p.Fails())
+		}
+		return err
 	})
 }
 
-// Down returns true if this proxy is down, i.e. has *more* fails than maxfails.
+// Down returns true if this proxy is down, i.e. has *more* fails than maxfails, or the active health
+// check marked it down.
 func (p *Proxy) Down(maxfails uint32) bool {
+	if p.transport.Down() {
+		return true
+	}
 	if maxfails == 0 {
 		return false
 	}
@@ -98,14 +312,102 @@ func (p *Proxy) Down(maxfails uint32) bool {
 func (p *Proxy) Stop()      { p.probe.Stop() }
 func (p *Proxy) finalizer() { p.transport.Stop() }
 
+// Shutdown stops the health checking goroutine and gracefully stops the transport, see Transport.Shutdown.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.probe.Stop()
+	return p.transport.Shutdown(ctx)
+}
+
 // Start starts the proxy's healthchecking.
 func (p *Proxy) Start(duration time.Duration) {
 	p.probe.Start(duration)
+	healthcheckIntervalGauge.WithLabelValues(p.proxyName, p.addr).Set(duration.Seconds())
 	p.transport.Start()
+	p.startExpect()
 }
 
 func (p *Proxy) SetReadTimeout(duration time.Duration) {
 	p.readTimeout = duration
+	readTimeoutGauge.WithLabelValues(p.proxyName, p.addr).Set(duration.Seconds())
+}
+
+// ReadTimeout returns the static read timeout, see SetReadTimeout.
+func (p *Proxy) ReadTimeout() time.Duration { return p.readTimeout }
+
+// SetTransferReadTimeout sets how long Connect waits for each message of an AXFR or IXFR, independent of
+// the read timeout of other queries. The default is 2s.
+func (p *Proxy) SetTransferReadTimeout(duration time.Duration) {
+	p.transferReadTimeout = duration
+}
+
+// SetWriteTimeout sets how long Connect waits for a query to be written to the upstream, independent of the read
+// timeout. A write that is stuck, as on a flaky network or with a full TCP window, fails after this time. The
+// default is 2s.
+func (p *Proxy) SetWriteTimeout(duration time.Duration) {
+	p.writeTimeout = duration
+}
+
+// SetMaxTransferSize limits the size of an AXFR or IXFR, in records and in bytes of the messages read from
+// the upstream. Without a limit an upstream can keep a transfer going for as long as it likes, and make Connect,
+// which holds the records until the transfer is complete, use as much memory as it likes; ConnectTransfer hands
+// them to its callback instead. The limits are checked as each message arrives, once one is exceeded the
+// transfer fails with ErrTransferTooLarge. A value of 0 removes the limit, which is the default.
+func (p *Proxy) SetMaxTransferSize(records, bytes int) {
+	p.maxTransferRecords, p.maxTransferBytes = records, bytes
+}
+
+// SetTruncationHistory sets how many questions are remembered for Options.PreferTCPLarge after their reply over
+// UDP was truncated, the least recently used is forgotten first. A value of 0 remembers none, the default is
+// DefaultTruncationHistory. It must be called before the proxy is used.
+func (p *Proxy) SetTruncationHistory(n int) {
+	p.truncated = newTruncationHistory(n)
+}
+
+// SetMaxMismatched sets how many replies with a mismatched ID Connect drops over UDP while waiting for the
+// reply to a query, before giving up with ErrTooManyMismatched. This keeps a flood of spoofed or late packets
+// from holding the query until the read timeout. A value of 0 removes the limit, the default is
+// DefaultMaxMismatched.
+func (p *Proxy) SetMaxMismatched(n int) {
+	p.maxMismatched = n
+}
+
+// SetTimeoutJitter sets the jitter of the dial and read timeouts in the lower p.transport, see Transport.SetTimeoutJitter.
+func (p *Proxy) SetTimeoutJitter(fraction float64) { p.transport.SetTimeoutJitter(fraction) }
+
+// SetAdaptiveReadTimeout makes the read timeout follow the observed round-trip times to the upstream,
+// the same way the dial timeout does, bounded by minValue and maxValue. Until the first reply the
+// static read timeout is used. A maxValue of 0 disables it.
+func (p *Proxy) SetAdaptiveReadTimeout(minValue, maxValue time.Duration) {
+	p.minReadTimeout = minValue
+	p.maxReadTimeout = maxValue
+}
+
+// AdaptiveReadTimeout returns the bounds of the adaptive read timeout, a maxValue of 0 means it is disabled.
+func (p *Proxy) AdaptiveReadTimeout() (minValue, maxValue time.Duration) {
+	return p.minReadTimeout, p.maxReadTimeout
+}
+
+// currentReadTimeout returns the read timeout to use for the next query.
+func (p *Proxy) currentReadTimeout() time.Duration {
+	if p.maxReadTimeout == 0 || atomic.LoadInt64(&p.avgReadTime) == 0 {
+		return p.readTimeout
+	}
+	return limitTimeout(&p.avgReadTime, p.minReadTimeout, p.maxReadTimeout)
+}
+
+// observeRTT records the round-trip time of a query sent over proto and feeds it into the adaptive read timeout.
+func (p *Proxy) observeRTT(proto string, rtt time.Duration) {
+	rttDuration.WithLabelValues(p.proxyName, p.addr, proto).Observe(rtt.Seconds())
+	p.srtt.observe(rtt, time.Now())
+	if p.maxReadTimeout == 0 {
+		return
+	}
+	// The first sample becomes the average, otherwise it would be dragged down from 0.
+	if !atomic.CompareAndSwapInt64(&p.avgReadTime, 0, int64(rtt)) {
+		averageTimeout(&p.avgReadTime, rtt, p.transport.avgWeight)
+	}
+	averageTimeGauge.WithLabelValues(p.proxyName, p.addr, "read").Set(time.Duration(atomic.LoadInt64(&p.avgReadTime)).Seconds())
+	readTimeoutGauge.WithLabelValues(p.proxyName, p.addr).Set(p.currentReadTimeout().Seconds())
 }
 
 // incrementFails increments the number of fails safely.
@@ -120,4 +422,8 @@ func (p *Proxy) incrementFails() {
 
 const (
 	maxTimeout = 2 * time.Second
+
+	// DefaultMaxMismatched is the number of replies with a mismatched ID a proxy drops per query over UDP, see
+	// Proxy.SetMaxMismatched.
+	DefaultMaxMismatched = 3
 )
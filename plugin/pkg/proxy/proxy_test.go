@@ -6,6 +6,9 @@ import (
 	"errors"
 	"math"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +18,9 @@ import (
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestProxy(t *testing.T) {
@@ -214,7 +220,7 @@ func TestCoreDNSOverflow(t *testing.T) {
 		recorder := dnstest.NewRecorder(&test.ResponseWriter{})
 		request := request.Request{Req: queryMsg, W: recorder}
 
-		_, response, err := p.Connect(context.Background(), request, options)
+		response, _, err := p.Connect(context.Background(), request, options)
 		if err != nil {
 			t.Errorf("Failed to connect to testdnsserver: %s", err)
 		}
@@ -260,3 +266,737 @@ func TestShouldTruncateResponse(t *testing.T) {
 		})
 	}
 }
+
+// newOneShotTCPServer returns a TCP server that answers one query per connection and hangs up when the
+// next query arrives, so the connection looks alive while it is cached.
+func newOneShotTCPServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := &dns.Conn{Conn: c}
+			if m, err := conn.ReadMsg(); err == nil {
+				ret := new(dns.Msg)
+				ret.SetReply(m)
+				conn.WriteMsg(ret)
+				conn.ReadMsg()
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestConnectRetryOnCachedClose(t *testing.T) {
+	l := newOneShotTCPServer(t)
+	defer l.Close()
+
+	addr := l.Addr().String()
+	p := NewProxy("TestConnectRetryOnCachedClose", addr, transport.DNS)
+	p.readTimeout = 500 * time.Millisecond
+	opts := Options{ForceTCP: true}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Id = 4242
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, opts); err != nil {
+		t.Fatalf("Expected first query to succeed, got %s", err)
+	}
+
+	before := testutil.ToFloat64(connRetriesCount.WithLabelValues("TestConnectRetryOnCachedClose", addr))
+	resp, _, err := p.Connect(context.Background(), req, opts)
+	if err != nil {
+		t.Fatalf("Expected retry on a new connection to succeed, got %s", err)
+	}
+	if resp.Id != 4242 || m.Id != 4242 {
+		t.Errorf("Expected message ID 4242 on reply and request, got %d and %d", resp.Id, m.Id)
+	}
+	if x := testutil.ToFloat64(connRetriesCount.WithLabelValues("TestConnectRetryOnCachedClose", addr)) - before; x != 1 {
+		t.Errorf("Expected 1 retry, got %v", x)
+	}
+}
+
+func TestConnectRetryTCPOnTruncated(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if w.RemoteAddr().Network() == "udp" {
+			ret.Truncated = true
+		} else {
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectRetryTCPOnTruncated", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	resp, _, err := p.Connect(context.Background(), req, Options{})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !resp.Truncated {
+		t.Error("Expected the truncated reply without RetryTCPOnTruncated")
+	}
+
+	resp, _, err = p.Connect(context.Background(), req, Options{RetryTCPOnTruncated: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Errorf("Expected the reply over TCP, got truncated %t with %d answers", resp.Truncated, len(resp.Answer))
+	}
+	if x := testutil.ToFloat64(truncatedRetriesCount.WithLabelValues("TestConnectRetryTCPOnTruncated", s.Addr)); x != 1 {
+		t.Errorf("Expected 1 truncated retry, got %v", x)
+	}
+
+	p.transport.mu.Lock()
+	udp, tcp := len(p.transport.conns[typeUDP]), len(p.transport.conns[typeTCP])
+	p.transport.mu.Unlock()
+	if udp != 1 || tcp != 1 {
+		t.Errorf("Expected the UDP and TCP connections to be cached, got %d and %d", udp, tcp)
+	}
+}
+
+func TestConnectRetryTCPOnTruncatedOnce(t *testing.T) {
+	var tcpQueries atomic.Int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.RemoteAddr().Network() == "tcp" {
+			tcpQueries.Add(1)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Truncated = true
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectRetryTCPOnTruncatedOnce", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	resp, _, err := p.Connect(context.Background(), req, Options{RetryTCPOnTruncated: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if !resp.Truncated {
+		t.Error("Expected the truncated reply over TCP to be returned")
+	}
+	if x := tcpQueries.Load(); x != 1 {
+		t.Errorf("Expected 1 query over TCP, got %d", x)
+	}
+	if x := testutil.ToFloat64(truncatedRetriesCount.WithLabelValues("TestConnectRetryTCPOnTruncatedOnce", s.Addr)); x != 1 {
+		t.Errorf("Expected 1 truncated retry, got %v", x)
+	}
+}
+
+func TestConnectContextCanceled(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		// never answer
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectContextCanceled", s.Addr, transport.DNS)
+	p.readTimeout = 5 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// The deadline of ctx is earlier than the read timeout, it bounds the query.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	_, _, err := p.Connect(ctx, req, Options{PreferUDP: true})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("Expected Connect to return when the context is done, took %s", d)
+	}
+
+	p.transport.mu.Lock()
+	n := len(p.transport.conns[typeUDP])
+	p.transport.mu.Unlock()
+	if n != 0 {
+		t.Errorf("Expected abandoned connection not to be cached, got %d cached", n)
+	}
+
+	// A context that is already done doesn't dial at all.
+	if _, _, err := p.transport.dial(ctx, "udp", false, nil, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q from dial, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	_, port, _ := net.SplitHostPort(s.Addr)
+	tr := newTransport("TestDialLocalAddr", net.JoinHostPort("127.0.0.1", port))
+	tr.SetLocalAddr(net.ParseIP("127.0.0.2"), net.ParseIP("::1"))
+	defer tr.Stop()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		pc, _, err := tr.Dial(proto)
+		if err != nil {
+			t.Fatalf("Failed to dial over %s: %s", proto, err)
+		}
+		host, _, _ := net.SplitHostPort(pc.c.LocalAddr().String())
+		if host != "127.0.0.2" {
+			t.Errorf("Expected %s connection from 127.0.0.2, got %s", proto, host)
+		}
+		pc.close()
+	}
+}
+
+func TestDialLocalPort(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(l.LocalAddr().String())
+	l.Close()
+	local, _ := strconv.Atoi(port)
+
+	_, sport, _ := net.SplitHostPort(s.Addr)
+	tr := newTransport("TestDialLocalPort", net.JoinHostPort("127.0.0.1", sport))
+	tr.SetLocalPort(local)
+	defer tr.Stop()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		pc, _, err := tr.Dial(proto)
+		if err != nil {
+			t.Fatalf("Failed to dial over %s: %s", proto, err)
+		}
+		if _, p, _ := net.SplitHostPort(pc.c.LocalAddr().String()); p != port {
+			t.Errorf("Expected %s connection from port %s, got %s", proto, port, p)
+		}
+
+		// The port is taken by the first connection.
+		_, _, err = tr.dial(context.Background(), proto, true, nil, 0)
+		if !errors.Is(err, ErrLocalAddr) {
+			t.Errorf("Expected %q dialing over %s while the port is in use, got %v", ErrLocalAddr, proto, err)
+		}
+		if kind := ErrorKind(err); kind != "local_addr" {
+			t.Errorf("Expected kind local_addr, got %q", kind)
+		}
+		pc.close()
+	}
+
+	// An address that isn't on the host.
+	tr.SetLocalAddr(net.ParseIP("192.0.2.1"), nil)
+	tr.SetLocalPort(0)
+	if _, _, err := tr.Dial("udp"); !errors.Is(err, ErrLocalAddr) {
+		t.Errorf("Expected %q dialing from an address that can't be assigned, got %v", ErrLocalAddr, err)
+	}
+}
+
+func TestDialLocalPortConcurrent(t *testing.T) {
+	var queries atomic.Int32
+	s := newDelayServer(100*time.Millisecond, &queries)
+	defer s.Close()
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(l.LocalAddr().String())
+	l.Close()
+	local, _ := strconv.Atoi(port)
+
+	p := NewProxy("TestDialLocalPortConcurrent", s.Addr, transport.DNS)
+	p.SetLocalPort(local)
+	p.SetMaxIdleConns(1)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// Queries share the one socket of a protocol: while it waits for a reply the others fail with
+	// ErrLocalAddr instead of waiting, and the upstream isn't counted as failed.
+	const n = 8
+	var ok, inUse atomic.Int32
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := p.Connect(context.Background(), req, Options{})
+			switch {
+			case err == nil:
+				ok.Add(1)
+			case errors.Is(err, ErrLocalAddr):
+				inUse.Add(1)
+			default:
+				t.Errorf("Expected no error or %q, got %v", ErrLocalAddr, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok.Load() == 0 {
+		t.Error("Expected at least one query to succeed")
+	}
+	if ok.Load()+inUse.Load() != n {
+		t.Errorf("Expected %d queries to succeed or fail with %q, got %d and %d", n, ErrLocalAddr, ok.Load(), inUse.Load())
+	}
+	if fails := atomic.LoadUint32(&p.fails); fails != 0 {
+		t.Errorf("Expected no fails, got %d", fails)
+	}
+
+	// Once the socket is free again it's reused.
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Errorf("Expected the query to succeed after the others, got %v", err)
+	}
+}
+
+func TestFastOpen(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestFastOpen", s.Addr, transport.DNS)
+	p.SetFastOpen(true)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	avg := atomic.LoadInt64(&p.transport.avgDialTime)
+	resp, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+	if err != nil {
+		t.Fatalf("Failed to connect with TCP Fast Open: %s", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(resp.Answer))
+	}
+	// The dial returned before the handshake, the dial time is recorded after the first write.
+	if x := atomic.LoadInt64(&p.transport.avgDialTime); x == avg {
+		t.Errorf("Expected average dial time %d to be updated", avg)
+	}
+}
+
+func TestAdaptiveReadTimeout(t *testing.T) {
+	p := NewProxy("TestAdaptiveReadTimeout", "127.0.0.1:53", transport.DNS)
+	p.SetReadTimeout(2 * time.Second)
+
+	p.observeRTT("udp", 10*time.Millisecond)
+	if x := p.currentReadTimeout(); x != 2*time.Second {
+		t.Errorf("Expected static read timeout when not adaptive, got %s", x)
+	}
+
+	p.SetAdaptiveReadTimeout(100*time.Millisecond, time.Second)
+	if x := p.currentReadTimeout(); x != 2*time.Second {
+		t.Errorf("Expected static read timeout before the first reply, got %s", x)
+	}
+
+	p.observeRTT("udp", 10*time.Millisecond)
+	if x := p.currentReadTimeout(); x != 100*time.Millisecond {
+		t.Errorf("Expected read timeout to be bounded by the minimum, got %s", x)
+	}
+	if x := testutil.ToFloat64(readTimeoutGauge.WithLabelValues("TestAdaptiveReadTimeout", "127.0.0.1:53")); x != 0.1 {
+		t.Errorf("Expected read timeout gauge 0.1, got %v", x)
+	}
+
+	for range 20 {
+		p.observeRTT("udp", 300*time.Millisecond)
+	}
+	if x := p.currentReadTimeout(); x < 500*time.Millisecond || x > 600*time.Millisecond {
+		t.Errorf("Expected read timeout of about twice the round-trip time, got %s", x)
+	}
+
+	for range 20 {
+		p.observeRTT("udp", 5*time.Second)
+	}
+	if x := p.currentReadTimeout(); x != time.Second {
+		t.Errorf("Expected read timeout to be bounded by the maximum, got %s", x)
+	}
+}
+
+func TestDialTimeoutParameters(t *testing.T) {
+	p := NewProxy("TestDialTimeoutParameters", "127.0.0.1:53", transport.DNS)
+	if x := p.transport.dialTimeout(); x != maxDialTimeout {
+		t.Errorf("Expected default dial timeout %s, got %s", maxDialTimeout, x)
+	}
+
+	p.SetDialTimeout(100*time.Millisecond, 2*time.Second)
+	p.SetAverageWeight(1)
+	if x := p.transport.dialTimeout(); x != 2*time.Second {
+		t.Errorf("Expected dial timeout 2s, got %s", x)
+	}
+
+	// With a weight of 1 the average is the last observed dial time.
+	p.transport.updateDialTimeout(10 * time.Millisecond)
+	if x := p.transport.dialTimeout(); x != 100*time.Millisecond {
+		t.Errorf("Expected dial timeout to be bounded by the minimum, got %s", x)
+	}
+	p.transport.updateDialTimeout(300 * time.Millisecond)
+	if x := p.transport.dialTimeout(); x != 600*time.Millisecond {
+		t.Errorf("Expected dial timeout of twice the dial time, got %s", x)
+	}
+	if x := testutil.ToFloat64(averageTimeGauge.WithLabelValues("TestDialTimeoutParameters", "127.0.0.1:53", "dial")); x != 0.3 {
+		t.Errorf("Expected average dial time gauge 0.3, got %v", x)
+	}
+
+	p.SetAdaptiveReadTimeout(100*time.Millisecond, time.Second)
+	p.observeRTT("udp", 10*time.Millisecond)
+	p.observeRTT("udp", 200*time.Millisecond)
+	if x := p.currentReadTimeout(); x != 400*time.Millisecond {
+		t.Errorf("Expected read timeout of twice the last round-trip time, got %s", x)
+	}
+	if x := testutil.ToFloat64(averageTimeGauge.WithLabelValues("TestDialTimeoutParameters", "127.0.0.1:53", "read")); x != 0.2 {
+		t.Errorf("Expected average read time gauge 0.2, got %v", x)
+	}
+
+	p.SetAverageWeight(0)
+	if x := p.transport.avgWeight; x != 1 {
+		t.Errorf("Expected a weight below 1 to be ignored, got %d", x)
+	}
+}
+
+func TestMaxDialTimeout(t *testing.T) {
+	p := NewProxy("TestMaxDialTimeout", "127.0.0.1:53", transport.DNS)
+	p.SetMaxDialTimeout(5 * time.Second)
+	if p.transport.dialTimeoutMin != minDialTimeout || p.transport.dialTimeoutMax != 5*time.Second {
+		t.Errorf("Expected dial timeout bounds %s and 5s, got %s and %s", minDialTimeout, p.transport.dialTimeoutMin, p.transport.dialTimeoutMax)
+	}
+
+	// A maximum below the minimum lowers the minimum too.
+	p.SetMaxDialTimeout(5 * time.Millisecond)
+	if x := p.transport.dialTimeout(); x != 5*time.Millisecond {
+		t.Errorf("Expected dial timeout 5ms, got %s", x)
+	}
+	p.transport.updateDialTimeout(time.Second)
+	if x := p.transport.dialTimeout(); x != 5*time.Millisecond {
+		t.Errorf("Expected dial timeout to be bounded by the maximum, got %s", x)
+	}
+}
+
+func TestAverageWeightConvergence(t *testing.T) {
+	// The number of dials it takes the average to get within 10ms of a dial time that dropped to 100ms.
+	converge := func(weight int64) int {
+		p := NewProxy("TestAverageWeightConvergence", "127.0.0.1:53", transport.DNS)
+		p.SetDialTimeout(10*time.Millisecond, 2*time.Second)
+		p.SetAverageWeight(weight)
+		for i := 1; i <= 100; i++ {
+			p.transport.updateDialTimeout(100 * time.Millisecond)
+			if time.Duration(atomic.LoadInt64(&p.transport.avgDialTime)) < 110*time.Millisecond {
+				return i
+			}
+		}
+		return 100
+	}
+
+	fast, slow := converge(2), converge(8)
+	if fast >= slow {
+		t.Errorf("Expected a weight of 2 to converge faster than a weight of 8, took %d and %d dials", fast, slow)
+	}
+	if x := converge(1); x != 1 {
+		t.Errorf("Expected a weight of 1 to take the dial time right away, took %d dials", x)
+	}
+}
+
+func TestDualStackDial(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	_, port, _ := net.SplitHostPort(s.Addr)
+	addr := net.JoinHostPort("localhost", port)
+	tr := newTransport("TestDualStackDial", addr)
+	tr.SetDualStackDial(true)
+	defer tr.Stop()
+
+	pc, _, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatalf("Failed to dial %s: %s", addr, err)
+	}
+	pc.close()
+
+	won := testutil.ToFloat64(dualStackDialCount.WithLabelValues("TestDualStackDial", addr, "tcp4")) +
+		testutil.ToFloat64(dualStackDialCount.WithLabelValues("TestDualStackDial", addr, "tcp6"))
+	if won != 1 {
+		t.Errorf("Expected 1 dual stack dial to be counted, got %v", won)
+	}
+
+	// UDP doesn't race the families and isn't counted.
+	pc, _, err = tr.Dial("udp")
+	if err != nil {
+		t.Fatalf("Failed to dial %s over udp: %s", addr, err)
+	}
+	pc.close()
+	for _, network := range []string{"udp4", "udp6"} {
+		if x := testutil.ToFloat64(dualStackDialCount.WithLabelValues("TestDualStackDial", addr, network)); x != 0 {
+			t.Errorf("Expected no %s dial to be counted, got %v", network, x)
+		}
+	}
+}
+
+func TestConnectTransferCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := &dns.Conn{Conn: c}
+		defer conn.Close()
+		m, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		// Send the start of the transfer and then stall.
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer = append(ret.Answer, test.SOA("example.org. IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 3600"), test.A("a.example.org. IN A 127.0.0.1"))
+		conn.WriteMsg(ret)
+		conn.ReadMsg() // blocks until the proxy hangs up
+	}()
+
+	addr := l.Addr().String()
+	p := NewProxy("TestConnectTransferCanceled", addr, transport.DNS)
+	p.readTimeout = 5 * time.Second
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	begin := time.Now()
+	if _, _, err := p.Connect(ctx, req, Options{ForceTCP: true}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %q, got %v", context.Canceled, err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("Expected the transfer to stop when the context is canceled, took %s", d)
+	}
+	if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestConnectTransferCanceled", addr, "tcp", closeCanceled)); x != 1 {
+		t.Errorf("Expected 1 connection closed because the query was canceled, got %v", x)
+	}
+}
+
+func TestRTTOutOfOrder(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		// A stale reply to another query comes first, then the reply after a delay.
+		stale := new(dns.Msg)
+		stale.SetReply(r)
+		stale.Id = r.Id + 1
+		w.WriteMsg(stale)
+		time.Sleep(20 * time.Millisecond)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestRTTOutOfOrder", s.Addr, transport.DNS)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestRTTOutOfOrder", s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 unmatched response, got %v", x)
+	}
+	if x := testutil.ToFloat64(questionMismatchesCount.WithLabelValues("TestRTTOutOfOrder", s.Addr, "udp")); x != 0 {
+		t.Errorf("Expected the reply with another ID not to count as a question mismatch, got %v", x)
+	}
+	if x := sampleCount(t, rttDuration, "TestRTTOutOfOrder", s.Addr, "udp"); x != 1 {
+		t.Errorf("Expected only the accepted reply to be observed, got %d observations", x)
+	}
+	pb := &dto.Metric{}
+	rttDuration.WithLabelValues("TestRTTOutOfOrder", s.Addr, "udp").(prometheus.Metric).Write(pb)
+	if x := pb.GetHistogram().GetSampleSum(); x < 0.02 {
+		t.Errorf("Expected the round-trip time of the accepted reply, at least 20ms, got %v", x)
+	}
+}
+
+func TestConnectMaxMismatched(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		// Spoofed replies keep coming until the read timeout, the real one never does.
+		for i := range 10 {
+			bad := new(dns.Msg)
+			bad.SetReply(r)
+			bad.Id = r.Id + uint16(i) + 1
+			w.WriteMsg(bad)
+		}
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectMaxMismatched", s.Addr, transport.DNS)
+	p.readTimeout = 5 * time.Second
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	begin := time.Now()
+	if _, _, err := p.Connect(context.Background(), req, Options{}); !errors.Is(err, ErrTooManyMismatched) {
+		t.Errorf("Expected %q, got %v", ErrTooManyMismatched, err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("Expected to give up before the read timeout, took %s", d)
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestConnectMaxMismatched", s.Addr, "udp")); x != 4 {
+		t.Errorf("Expected 4 dropped replies, got %v", x)
+	}
+}
+
+func TestConnectMismatchedTCP(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		for i := range 5 {
+			bad := new(dns.Msg)
+			bad.SetReply(r)
+			bad.Id = r.Id + uint16(i) + 1
+			w.WriteMsg(bad)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectMismatchedTCP", s.Addr, transport.DNS)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// The limit only applies to UDP.
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestConnectMismatchedTCP", s.Addr, "tcp")); x != 5 {
+		t.Errorf("Expected 5 dropped replies, got %v", x)
+	}
+}
+
+func TestRequestDurationProto(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestRequestDurationProto", s.Addr, transport.DNS)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	for _, opts := range []Options{{}, {}, {ForceTCP: true}} {
+		if _, _, err := p.Connect(context.Background(), req, opts); err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+	}
+
+	if x := sampleCount(t, requestDuration, "TestRequestDurationProto", s.Addr, "NOERROR", "udp"); x != 2 {
+		t.Errorf("Expected 2 udp requests, got %d", x)
+	}
+	if x := sampleCount(t, requestDuration, "TestRequestDurationProto", s.Addr, "NOERROR", "tcp"); x != 1 {
+		t.Errorf("Expected 1 tcp request, got %d", x)
+	}
+	if x := sampleCount(t, connAcquireDuration, "TestRequestDurationProto", s.Addr, "udp", "false"); x != 1 {
+		t.Errorf("Expected 1 dialed udp connection, got %d", x)
+	}
+	if x := sampleCount(t, connAcquireDuration, "TestRequestDurationProto", s.Addr, "udp", "true"); x != 1 {
+		t.Errorf("Expected 1 cached udp connection, got %d", x)
+	}
+	if x := sampleCount(t, connAcquireDuration, "TestRequestDurationProto", s.Addr, "tcp", "false"); x != 1 {
+		t.Errorf("Expected 1 dialed tcp connection, got %d", x)
+	}
+}
+
+func TestTimeoutGauges(t *testing.T) {
+	p := NewProxy("TestTimeoutGauges", "127.0.0.1:53", transport.DNS)
+	defer p.transport.Stop()
+
+	if x := testutil.ToFloat64(dialTimeoutGauge.WithLabelValues("TestTimeoutGauges", "127.0.0.1:53")); x != minDialTimeout.Seconds() {
+		t.Errorf("Expected dial timeout gauge %v before the first dial, got %v", minDialTimeout.Seconds(), x)
+	}
+	if x := testutil.ToFloat64(readTimeoutGauge.WithLabelValues("TestTimeoutGauges", "127.0.0.1:53")); x != 2 {
+		t.Errorf("Expected read timeout gauge 2, got %v", x)
+	}
+
+	p.SetDialTimeout(100*time.Millisecond, 2*time.Second)
+	p.SetAverageWeight(1)
+	p.transport.updateDialTimeout(300 * time.Millisecond)
+	if x := p.transport.dialTimeout(); x != 600*time.Millisecond {
+		t.Fatalf("Expected dial timeout of twice the dial time, got %s", x)
+	}
+	if x := testutil.ToFloat64(dialTimeoutGauge.WithLabelValues("TestTimeoutGauges", "127.0.0.1:53")); x != 0.6 {
+		t.Errorf("Expected dial timeout gauge 0.6, got %v", x)
+	}
+
+	// With jitter the gauges show the timeouts that were actually used.
+	p.SetTimeoutJitter(0.5)
+	d := p.transport.dialTimeout()
+	if x := testutil.ToFloat64(dialTimeoutGauge.WithLabelValues("TestTimeoutGauges", "127.0.0.1:53")); x != d.Seconds() {
+		t.Errorf("Expected dial timeout gauge %v, got %v", d.Seconds(), x)
+	}
+	r := p.nextReadTimeout()
+	if x := testutil.ToFloat64(readTimeoutGauge.WithLabelValues("TestTimeoutGauges", "127.0.0.1:53")); x != r.Seconds() {
+		t.Errorf("Expected read timeout gauge %v, got %v", r.Seconds(), x)
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/coredns/coredns/request"
+)
+
+// SetProxyProtocol makes the transport send a PROXY protocol v2 header with the address of the client, and
+// the local address it sent the query to, on new tcp and tcp-tls connections, ahead of the TLS handshake.
+// Queries are then sent over TCP. As a header is only sent once per connection, a cached connection is only
+// reused for queries with the same header: those from the same TCP client connection. Queries of UDP clients,
+// which have a header of their own, get a new connection that isn't cached. Health probes go over TCP as well,
+// with a header that has the LOCAL command. DNS-over-HTTPS and DNS-over-QUIC upstreams are not affected.
+func (t *Transport) SetProxyProtocol(b bool) { t.proxyProtocol = b }
+
+// probeHeader returns the PROXY protocol header sent ahead of a health probe, or nil without SetProxyProtocol. The
+// probe has no client, so the header has the LOCAL command.
+func (t *Transport) probeHeader() []byte {
+	if !t.proxyProtocol {
+		return nil
+	}
+	return proxyHeader(request.Request{})
+}
+
+// proxySignature starts a PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyVersionLocal = 0x20 // version 2, LOCAL command: no client address is known.
+	proxyVersionProxy = 0x21 // version 2, PROXY command.
+
+	proxyFamilyInet  = 0x10
+	proxyFamilyInet6 = 0x20
+	proxyStream      = 0x01
+	proxyDgram       = 0x02
+)
+
+// proxyHeader returns the PROXY protocol v2 header with the address and port of the client of state as the
+// source and the address the query came in on as the destination, and whether the client used TCP or UDP.
+// Without a client address the header has the LOCAL command.
+func proxyHeader(state request.Request) []byte {
+	header := append([]byte(nil), proxySignature...)
+	if state.W == nil {
+		return append(header, proxyVersionLocal, 0, 0, 0)
+	}
+	src, dst := net.ParseIP(state.IP()), net.ParseIP(state.LocalIP())
+	sport, err1 := strconv.ParseUint(state.Port(), 10, 16)
+	dport, err2 := strconv.ParseUint(state.LocalPort(), 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return append(header, proxyVersionLocal, 0, 0, 0)
+	}
+
+	proto := byte(proxyStream)
+	if state.Proto() == "udp" {
+		proto = proxyDgram
+	}
+	header = append(header, proxyVersionProxy)
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header = append(header, proxyFamilyInet|proto, 0, 12)
+		header = append(header, src4...)
+		header = append(header, dst4...)
+	} else {
+		header = append(header, proxyFamilyInet6|proto, 0, 36)
+		header = append(header, src.To16()...)
+		header = append(header, dst.To16()...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(sport))
+	return binary.BigEndian.AppendUint16(header, uint16(dport))
+}
+
+// reusableHeader reports whether header can be sent for more than one query: it has the LOCAL command, or
+// the client is a TCP connection that may send more queries.
+func reusableHeader(header []byte) bool {
+	if len(header) < len(proxySignature)+2 {
+		return false
+	}
+	return header[len(proxySignature)] == proxyVersionLocal || header[len(proxySignature)+1]&0x0f == proxyStream
+}
+
+// sendHeader writes header to the new connection conn, when it fails conn is closed. A nil header is not sent.
+func sendHeader(conn net.Conn, header []byte) (net.Conn, error) {
+	if header == nil {
+		return conn, nil
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
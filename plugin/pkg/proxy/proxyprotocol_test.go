@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxyHeader(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	sig := string(proxySignature)
+
+	tests := []struct {
+		w        dns.ResponseWriter
+		expected string
+	}{
+		// 10.240.0.1:40212 over UDP to 127.0.0.1:53.
+		{&test.ResponseWriter{}, sig + "\x21\x12\x00\x0c" + "\x0a\xf0\x00\x01" + "\x7f\x00\x00\x01" + "\x9d\x14" + "\x00\x35"},
+		// [2001:db8::1]:40212 over TCP to 127.0.0.1:53, as an IPv4-mapped address.
+		{&test.ResponseWriter{RemoteIP: "2001:db8::1", TCP: true}, sig + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x7f\x00\x00\x01" + "\x9d\x14" + "\x00\x35"},
+		// No client.
+		{nil, sig + "\x20\x00\x00\x00"},
+	}
+	for i, tc := range tests {
+		if x := proxyHeader(request.Request{Req: m, W: tc.w}); string(x) != tc.expected {
+			t.Errorf("Test %d: expected header %x, got %x", i, tc.expected, x)
+		}
+	}
+}
+
+// newProxyProtocolServer starts a DNS server over TCP, or over TLS when cfg is set, that expects a PROXY
+// protocol v2 header ahead of the TLS handshake, and sends the header of each connection on headers.
+func newProxyProtocolServer(t *testing.T, cfg *tls.Config, headers chan<- []byte) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				header := make([]byte, 16)
+				if _, err := io.ReadFull(c, header); err != nil || !bytes.HasPrefix(header, proxySignature) {
+					headers <- nil
+					return
+				}
+				header = append(header, make([]byte, binary.BigEndian.Uint16(header[14:]))...)
+				if _, err := io.ReadFull(c, header[16:]); err != nil {
+					headers <- nil
+					return
+				}
+				headers <- header
+
+				if cfg != nil {
+					c = tls.Server(c, cfg)
+				}
+				conn := &dns.Conn{Conn: c}
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(m)
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestConnectProxyProtocol(t *testing.T) {
+	pki := newTestPKI(t)
+
+	for _, useTLS := range []bool{false, true} {
+		headers := make(chan []byte, 2)
+		var l net.Listener
+		trans := transport.DNS
+		if useTLS {
+			l = newProxyProtocolServer(t, &tls.Config{Certificates: []tls.Certificate{pki.server}}, headers)
+			trans = transport.TLS
+		} else {
+			l = newProxyProtocolServer(t, nil, headers)
+		}
+		defer l.Close()
+
+		p := NewProxy("TestConnectProxyProtocol", l.Addr().String(), trans)
+		if useTLS {
+			p.SetTLSConfig(&tls.Config{RootCAs: pki.caPool, ServerName: "dns.example.org"})
+		}
+		p.SetProxyProtocol(true)
+		defer p.transport.Stop()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		expected := proxyHeader(req)
+
+		// Each query of the UDP client goes over a connection of its own.
+		for range 2 {
+			if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+				t.Fatalf("TLS %t: failed to connect: %s", useTLS, err)
+			}
+			if header := <-headers; !bytes.Equal(header, expected) {
+				t.Errorf("TLS %t: expected header %x, got %x", useTLS, expected, header)
+			}
+		}
+
+		p.transport.mu.Lock()
+		for transtype, stack := range p.transport.conns {
+			if len(stack) != 0 {
+				t.Errorf("TLS %t: expected no cached %s connections, got %d", useTLS, transportType(transtype), len(stack))
+			}
+		}
+		p.transport.mu.Unlock()
+		proto := typeTCP
+		if useTLS {
+			proto = typeTLS
+		}
+		if x := testutil.ToFloat64(connClosedCount.WithLabelValues("TestConnectProxyProtocol", l.Addr().String(), proto.String(), closeProxyHeader)); x != 2 {
+			t.Errorf("TLS %t: expected 2 connections closed for their header, got %v", useTLS, x)
+		}
+	}
+}
+
+func TestConnectProxyProtocolTCPClient(t *testing.T) {
+	headers := make(chan []byte, 3)
+	l := newProxyProtocolServer(t, nil, headers)
+	defer l.Close()
+
+	p := NewProxy("TestConnectProxyProtocolTCPClient", l.Addr().String(), transport.DNS)
+	p.SetProxyProtocol(true)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	clients := []string{"10.240.0.1", "10.240.0.1", "10.240.0.2"}
+	for i, ip := range clients {
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: ip, TCP: true})}
+		if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+			t.Fatalf("Query %d: failed to connect: %s", i, err)
+		}
+	}
+
+	// The second query of the first client reuses its connection.
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(headers))
+	}
+	for _, ip := range []string{"10.240.0.1", "10.240.0.2"} {
+		expected := proxyHeader(request.Request{Req: m, W: &test.ResponseWriter{RemoteIP: ip, TCP: true}})
+		if header := <-headers; !bytes.Equal(header, expected) {
+			t.Errorf("Expected header %x, got %x", expected, header)
+		}
+	}
+}
+
+func TestReusableHeader(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+
+	tests := []struct {
+		w        dns.ResponseWriter
+		expected bool
+	}{
+		{&test.ResponseWriter{}, false},
+		{&test.ResponseWriter{TCP: true}, true},
+		{nil, true},
+	}
+	for i, tc := range tests {
+		if x := reusableHeader(proxyHeader(request.Request{Req: m, W: tc.w})); x != tc.expected {
+			t.Errorf("Test %d: expected %t, got %t", i, tc.expected, x)
+		}
+	}
+}
+
+func TestHealthProxyProtocol(t *testing.T) {
+	pki := newTestPKI(t)
+
+	for _, useTLS := range []bool{false, true} {
+		headers := make(chan []byte, 1)
+		var l net.Listener
+		trans := transport.DNS
+		if useTLS {
+			l = newProxyProtocolServer(t, &tls.Config{Certificates: []tls.Certificate{pki.server}}, headers)
+			trans = transport.TLS
+		} else {
+			l = newProxyProtocolServer(t, nil, headers)
+		}
+		defer l.Close()
+
+		p := NewProxy("TestHealthProxyProtocol", l.Addr().String(), trans)
+		if useTLS {
+			p.SetTLSConfig(&tls.Config{RootCAs: pki.caPool, ServerName: "dns.example.org"})
+		}
+		p.SetProxyProtocol(true)
+		defer p.transport.Stop()
+
+		// The probe carries a header with the LOCAL command, the upstream would hang up on it otherwise.
+		hc := NewHealthChecker("TestHealthProxyProtocol", trans, true, ".")
+		if useTLS {
+			hc.SetTLSConfig(p.transport.tlsConfig)
+		}
+		if err := hc.Check(p); err != nil {
+			t.Fatalf("TLS %t: check failed: %s", useTLS, err)
+		}
+		if header, expected := <-headers, proxyHeader(request.Request{}); !bytes.Equal(header, expected) {
+			t.Errorf("TLS %t: expected header %x, got %x", useTLS, expected, header)
+		}
+	}
+}
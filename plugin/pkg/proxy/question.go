@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// matchQuestion returns true if the first question of ret has the name, ignoring case, and the type of
+// the first question of req. A reply to a query without a question always matches.
+func matchQuestion(ret, req *dns.Msg) bool {
+	if len(req.Question) == 0 {
+		return true
+	}
+	if len(ret.Question) == 0 {
+		return false
+	}
+	q := req.Question[0]
+	return ret.Question[0].Qtype == q.Qtype && strings.EqualFold(ret.Question[0].Name, q.Name)
+}
+
+// checkQuestion returns ErrQuestionMismatch when ret, the reply to req over proto, is for another question,
+// unless opts.NoQuestionCheck is set. It is for transports that have one reply per query, as DoH and DoQ,
+// where there is no other reply to wait for.
+func (p *Proxy) checkQuestion(ret, req *dns.Msg, proto string, opts Options) error {
+	if opts.NoQuestionCheck || matchQuestion(ret, req) {
+		return nil
+	}
+	unmatchedResponsesCount.WithLabelValues(p.proxyName, p.addr, proto).Add(1)
+	questionMismatchesCount.WithLabelValues(p.proxyName, p.addr, proto).Add(1)
+	return ErrQuestionMismatch
+}
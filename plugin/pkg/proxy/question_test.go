@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMatchQuestion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+
+	reply := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return m
+	}
+
+	tests := []struct {
+		ret      *dns.Msg
+		expected bool
+	}{
+		{reply("example.org.", dns.TypeA), true},
+		{reply("ExAmPlE.oRg.", dns.TypeA), true},
+		{reply("example.net.", dns.TypeA), false},
+		{reply("example.org.", dns.TypeAAAA), false},
+		{new(dns.Msg), false},
+	}
+	for i, tc := range tests {
+		if x := matchQuestion(tc.ret, req); x != tc.expected {
+			t.Errorf("Test %d: expected %t, got %t", i, tc.expected, x)
+		}
+	}
+
+	if !matchQuestion(new(dns.Msg), new(dns.Msg)) {
+		t.Error("Expected a reply to a query without a question to match")
+	}
+}
+
+func TestConnectQuestionMismatch(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		// A spoofed reply with the right ID but for another type comes first.
+		spoof := new(dns.Msg)
+		spoof.SetReply(r)
+		spoof.Question[0].Qtype = dns.TypeAAAA
+		spoof.Answer = append(spoof.Answer, test.AAAA("example.org. IN AAAA ::1"))
+		w.WriteMsg(spoof)
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectQuestionMismatch", s.Addr, transport.DNS)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	resp, _, err := p.Connect(context.Background(), req, Options{})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected the A reply, got %v", resp.Answer)
+	}
+	if x := testutil.ToFloat64(unmatchedResponsesCount.WithLabelValues("TestConnectQuestionMismatch", s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 unmatched response, got %v", x)
+	}
+	if x := testutil.ToFloat64(questionMismatchesCount.WithLabelValues("TestConnectQuestionMismatch", s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 question mismatch, got %v", x)
+	}
+
+	// Without the check the first reply is taken.
+	resp, _, err = p.Connect(context.Background(), req, Options{NoQuestionCheck: true})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("Expected the AAAA reply without the question check, got %v", resp.Answer)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqNoError is the DOQ_NO_ERROR code from RFC 9250, used when closing a connection normally.
+const doqNoError quic.ApplicationErrorCode = 0
+
+// errDoQLength is returned when the length prefix of a DoQ reply doesn't match the data on the stream.
+var errDoQLength = errors.New("proxy: DoQ reply length does not match length prefix")
+
+// dialQUIC opens a new DNS-over-QUIC connection to the upstream.
+func (t *Transport) dialQUIC(ctx context.Context, timeout time.Duration) (*quic.Conn, error) {
+	cfg := new(tls.Config)
+	if t.tlsConfig != nil {
+		cfg = t.tlsConfig.Clone()
+	}
+	cfg.NextProtos = []string{"doq"}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if t.earlyData {
+		// Returns before the handshake is complete when a session is resumed with 0-RTT.
+		return quic.DialAddrEarly(ctx, t.addr, cfg, nil)
+	}
+	return quic.DialAddr(ctx, t.addr, cfg, nil)
+}
+
+// exchangeQUIC sends m on a new stream of qc, waiting at most writeTimeout, and reads the reply, waiting
+// at most readTimeout. Each query uses its own stream and is prefixed with a 2-byte length field, see
+// RFC 9250, Section 4.2. When ctx is done the stream is cancelled, the connection itself stays usable.
+func exchangeQUIC(ctx context.Context, qc *quic.Conn, m *dns.Msg, writeTimeout, readTimeout time.Duration) (*dns.Msg, error) {
+	// DoQ requires the Message ID to be 0, the original ID is restored on the reply.
+	id := m.Id
+	m.Id = 0
+	buf, err := m.Pack()
+	m.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := qc.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	defer context.AfterFunc(ctx, func() { stream.SetDeadline(time.Now()) })()
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf))) // #nosec G115 -- a packed dns.Msg fits in uint16
+	copy(msg[2:], buf)
+
+	stream.SetWriteDeadline(deadline(ctx, writeTimeout))
+	if _, err := stream.Write(msg); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqNoError))
+		return nil, err
+	}
+	// Closing the stream only closes the send direction, signalling the end of the query with STREAM FIN.
+	stream.Close()
+
+	// The upstream closes its side of the stream after sending the reply, so EOF is the
+	// normal end of a response and not an error.
+	stream.SetReadDeadline(deadline(ctx, readTimeout))
+	reply, err := io.ReadAll(io.LimitReader(stream, 2+dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 || int(binary.BigEndian.Uint16(reply)) != len(reply)-2 {
+		return nil, errDoQLength
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply[2:]); err != nil {
+		return nil, err
+	}
+	ret.Id = id
+	return ret, nil
+}
+
+// quicConnClosed returns true if err means the QUIC connection is no longer usable.
+func quicConnClosed(err error) bool {
+	var (
+		appErr       *quic.ApplicationError
+		idleErr      *quic.IdleTimeoutError
+		resetErr     *quic.StatelessResetError
+		streamErr    *quic.StreamError
+		transportErr *quic.TransportError
+	)
+	return errors.Is(err, quic.Err0RTTRejected) ||
+		errors.As(err, &appErr) ||
+		errors.As(err, &idleErr) ||
+		errors.As(err, &resetErr) ||
+		errors.As(err, &streamErr) ||
+		errors.As(err, &transportErr)
+}
+
+// connectQUIC sends the request over the DNS-over-QUIC connection in pc.
+func (p *Proxy) connectQUIC(ctx context.Context, pc *persistConn, cached bool, state request.Request, opts Options, start time.Time, ev *Event) (*dns.Msg, error) {
+	sent := time.Now()
+	ret, err := exchangeQUIC(ctx, pc.qc, state.Req, p.writeTimeout, p.nextReadTimeout())
+	if pc.early {
+		pc.early = false
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// The upstream rejected the early data, send the query again with 1-RTT once the handshake is done.
+			var qc *quic.Conn
+			if qc, err = pc.qc.NextConnection(ctx); err == nil {
+				pc.qc = qc
+				ret, err = exchangeQUIC(ctx, pc.qc, state.Req, p.writeTimeout, p.nextReadTimeout())
+			}
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// Only the stream was abandoned, the connection can be used by the next query.
+		p.transport.Yield(pc)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		p.transport.countConnError(ctx, stageAny, err)
+		p.transport.closeConn(pc, closeReason(ctx)) // not giving it back
+		if cached && quicConnClosed(err) {
+			return nil, ErrCachedClosed
+		}
+		return nil, err
+	}
+
+	rtt := time.Since(sent)
+	p.observeRTT("quic", rtt)
+	*ev = Event{Proto: "quic", Cached: cached, Sent: sent, RTT: rtt}
+	p.transport.Yield(pc)
+	if err := p.checkQuestion(ret, state.Req, "quic", opts); err != nil {
+		return nil, err
+	}
+
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = strconv.Itoa(ret.Rcode)
+	}
+
+	requestDuration.WithLabelValues(p.proxyName, p.addr, rc, "quic").Observe(time.Since(start).Seconds())
+
+	return ret, nil
+}
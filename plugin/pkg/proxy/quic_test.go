@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// newDoQServer starts a minimal DNS-over-QUIC server that answers every query with an A record.
+// It records the message IDs it receives in ids.
+func newDoQServer(t *testing.T, ids chan<- uint16) *quic.Listener {
+	t.Helper()
+
+	l, err := quic.ListenAddr("127.0.0.1:0", doqTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveDoQ(l.Accept, ids)
+	return l
+}
+
+// doqTLSConfig returns a TLS config with a self-signed certificate for 127.0.0.1.
+func doqTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		NextProtos:   []string{"doq"},
+	}
+}
+
+// serveDoQ answers the queries on the connections returned by accept until it fails.
+func serveDoQ(accept func(context.Context) (*quic.Conn, error), ids chan<- uint16) {
+	for {
+		conn, err := accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				var length [2]byte
+				if _, err := io.ReadFull(stream, length[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(stream, buf); err != nil {
+					return
+				}
+				m := new(dns.Msg)
+				if err := m.Unpack(buf); err != nil {
+					return
+				}
+				ids <- m.Id
+
+				ret := new(dns.Msg)
+				ret.SetReply(m)
+				ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+				out, _ := ret.Pack()
+				reply := make([]byte, 2+len(out))
+				binary.BigEndian.PutUint16(reply, uint16(len(out)))
+				copy(reply[2:], out)
+				stream.Write(reply)
+				stream.Close()
+			}
+		}()
+	}
+}
+
+func TestProxyDoQ(t *testing.T) {
+	ids := make(chan uint16, 10)
+	l := newDoQServer(t, ids)
+	defer l.Close()
+
+	p := NewProxy("TestProxyDoQ", l.Addr().String(), transport.QUIC)
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Id = 1234
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	for range 2 {
+		resp, _, err := p.Connect(context.Background(), req, Options{})
+		if err != nil {
+			t.Fatalf("Failed to connect to DoQ server: %s", err)
+		}
+		if resp.Id != 1234 {
+			t.Errorf("Expected reply ID %d, got %d", 1234, resp.Id)
+		}
+		if x := resp.Answer[0].Header().Name; x != "example.org." {
+			t.Errorf("Expected %s, got %s", "example.org.", x)
+		}
+		if id := <-ids; id != 0 {
+			t.Errorf("Expected upstream to see message ID 0, got %d", id)
+		}
+	}
+
+	if err := p.GetHealthchecker().Check(p); err != nil {
+		t.Errorf("Expected DoQ health check to succeed, got %s", err)
+	}
+}
+
+func TestProxyDoQCachedClosed(t *testing.T) {
+	ids := make(chan uint16, 10)
+	l := newDoQServer(t, ids)
+	defer l.Close()
+
+	p := NewProxy("TestProxyDoQCachedClosed", l.Addr().String(), transport.QUIC)
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.readTimeout = 1 * time.Second
+
+	pc, _, err := p.transport.Dial("quic")
+	if err != nil {
+		t.Fatalf("Failed to dial DoQ server: %s", err)
+	}
+	// The upstream went away while the connection was sitting in the cache.
+	pc.qc.CloseWithError(doqNoError, "")
+	p.transport.Yield(pc)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, err := p.connect(context.Background(), req, Options{}, time.Now(), false, new(Event), nil); err != ErrCachedClosed {
+		t.Errorf("Expected %q, got %v", ErrCachedClosed, err)
+	}
+
+	// Connect itself redials and succeeds.
+	pc, _, err = p.transport.Dial("quic")
+	if err != nil {
+		t.Fatalf("Failed to dial DoQ server: %s", err)
+	}
+	pc.qc.CloseWithError(doqNoError, "")
+	p.transport.Yield(pc)
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Errorf("Expected Connect to retry on a new connection, got %s", err)
+	}
+}
+
+func TestProxyDoQEarlyData(t *testing.T) {
+	ids := make(chan uint16, 10)
+	cfg := doqTLSConfig(t)
+	var keys atomic.Pointer[tls.Config]
+	keys.Store(cfg)
+	// Lets the test replace the session ticket keys, as if the upstream restarted.
+	srv := &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return keys.Load(), nil }}
+
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", srv, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveDoQ(l.Accept, ids)
+
+	p := NewProxy("TestProxyDoQEarlyData", l.Addr().String(), transport.QUIC)
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.SetEarlyData(true)
+	p.readTimeout = 1 * time.Second
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// query sends the query with Connect on a new connection.
+	query := func() *persistConn {
+		t.Helper()
+		p.transport.cleanup(true)
+		pc, _, err := p.transport.Dial("quic")
+		if err != nil {
+			t.Fatalf("Failed to dial DoQ server: %s", err)
+		}
+		p.transport.Yield(pc)
+		if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+			t.Fatalf("Failed to connect to DoQ server: %s", err)
+		}
+		<-ids
+		if pc.early {
+			t.Error("Expected the connection to be done with early data after its first query")
+		}
+		return pc
+	}
+
+	// The first connection gets the session ticket, the second resumes the session with 0-RTT.
+	if pc := query(); pc.qc.ConnectionState().Used0RTT {
+		t.Error("Expected no 0-RTT without a session ticket")
+	}
+	if pc := query(); !pc.qc.ConnectionState().Used0RTT {
+		t.Error("Expected the query to be sent with 0-RTT")
+	}
+
+	// With new ticket keys the upstream rejects the early data, and the query is sent again.
+	next := cfg.Clone()
+	next.SetSessionTicketKeys([][32]byte{{1}})
+	keys.Store(next)
+	if pc := query(); pc.qc.ConnectionState().Used0RTT {
+		t.Error("Expected the query to be sent with 1-RTT after the early data was rejected")
+	}
+}
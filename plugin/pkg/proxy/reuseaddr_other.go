@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+import "syscall"
+
+// setReuseAddr does nothing, SO_REUSEADDR is only set on unix systems.
+func setReuseAddr(_ syscall.RawConn) {}
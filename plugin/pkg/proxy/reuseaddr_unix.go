@@ -0,0 +1,17 @@
+//go:build unix
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReuseAddr sets SO_REUSEADDR on the socket, so a fixed source port can be bound again while the
+// previous connection from it is in TIME_WAIT.
+func setReuseAddr(c syscall.RawConn) {
+	c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1) // #nosec G115 -- fd is a valid socket descriptor
+	})
+}
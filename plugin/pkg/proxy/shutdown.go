@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// drain tracks the Connect calls outstanding on a transport, so Shutdown can wait for them.
+type drain struct {
+	mu       sync.Mutex
+	active   int
+	shutdown bool
+	drained  chan struct{} // Closed when shutting down and no Connect call is outstanding.
+}
+
+// begin registers an outstanding Connect call, it fails with ErrShuttingDown once Shutdown was called.
+func (t *Transport) begin() error {
+	t.drain.mu.Lock()
+	defer t.drain.mu.Unlock()
+	if t.drain.shutdown {
+		return ErrShuttingDown
+	}
+	t.drain.active++
+	return nil
+}
+
+// end marks a Connect call registered with begin as finished.
+func (t *Transport) end() {
+	t.drain.mu.Lock()
+	defer t.drain.mu.Unlock()
+	t.drain.active--
+	if t.drain.shutdown && t.drain.active == 0 {
+		close(t.drain.drained)
+	}
+}
+
+// shuttingDown returns true when Shutdown was called.
+func (t *Transport) shuttingDown() bool {
+	t.drain.mu.Lock()
+	defer t.drain.mu.Unlock()
+	return t.drain.shutdown
+}
+
+// Shutdown gracefully stops the transport. New queries and Dial calls fail with ErrShuttingDown right away,
+// outstanding Connect calls are waited for until ctx is done, then the connection manager is stopped and
+// all cached connections are closed. The error of ctx is returned when it was done first.
+func (t *Transport) Shutdown(ctx context.Context) error {
+	t.drain.mu.Lock()
+	if !t.drain.shutdown {
+		t.drain.shutdown = true
+		t.drain.drained = make(chan struct{})
+		if t.drain.active == 0 {
+			close(t.drain.drained)
+		}
+	}
+	drained := t.drain.drained
+	t.drain.mu.Unlock()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	t.Stop()
+	t.cleanup(true)
+	return err
+}
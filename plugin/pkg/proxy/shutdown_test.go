@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func shutdownQuery(name string) request.Request {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	return request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+}
+
+func TestShutdown(t *testing.T) {
+	arrived := make(chan struct{})
+	unblock := make(chan struct{})
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow.example.org." {
+			arrived <- struct{}{}
+			<-unblock
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestShutdown", s.Addr, transport.DNS)
+	p.readTimeout = 2 * time.Second
+	p.Start(5 * time.Second)
+
+	if _, _, err := p.Connect(context.Background(), shutdownQuery("example.org."), Options{ForceTCP: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	inflight := make(chan error)
+	go func() {
+		_, _, err := p.Connect(context.Background(), shutdownQuery("slow.example.org."), Options{})
+		inflight <- err
+	}()
+	<-arrived
+
+	shutdown := make(chan error)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+
+	// Wait for the drain to start.
+	for !p.transport.shuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := p.Connect(context.Background(), shutdownQuery("example.org."), Options{}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected %q for a new query, got %v", ErrShuttingDown, err)
+	}
+	if _, _, err := p.transport.Dial("udp"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected %q for a new dial, got %v", ErrShuttingDown, err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the query in flight, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	if err := <-inflight; err != nil {
+		t.Errorf("Expected the query in flight to finish, got %s", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected no error from Shutdown, got %s", err)
+	}
+
+	p.transport.mu.Lock()
+	defer p.transport.mu.Unlock()
+	for transtype, stack := range p.transport.conns {
+		if len(stack) != 0 {
+			t.Errorf("Expected no cached %s connections after Shutdown, got %d", transportType(transtype), len(stack))
+		}
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	arrived := make(chan struct{})
+	unblock := make(chan struct{})
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		arrived <- struct{}{}
+		<-unblock
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	defer close(unblock)
+
+	p := NewProxy("TestShutdownTimeout", s.Addr, transport.DNS)
+	p.readTimeout = 2 * time.Second
+
+	go p.Connect(context.Background(), shutdownQuery("example.org."), Options{})
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+	// A second Shutdown doesn't panic and waits for the same queries.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %q, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestShutdownGoroutines(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	before := runtime.NumGoroutine()
+
+	p := NewProxy("TestShutdownGoroutines", s.Addr, transport.DNS)
+	p.Start(5 * time.Second)
+	pipelined := NewProxy("TestShutdownGoroutines", s.Addr, transport.DNS)
+	pipelined.SetPipelining(true)
+	pipelined.Start(5 * time.Second)
+
+	for _, opts := range []Options{{}, {ForceTCP: true}} {
+		for range 3 {
+			if _, _, err := p.Connect(context.Background(), shutdownQuery("example.org."), opts); err != nil {
+				t.Fatalf("Failed to connect: %s", err)
+			}
+		}
+	}
+	if _, _, err := pipelined.Connect(context.Background(), shutdownQuery("example.org."), Options{ForceTCP: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	for _, p := range []*Proxy{p, pipelined} {
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Expected no error from Shutdown, got %s", err)
+		}
+	}
+
+	// The connection managers, the pipelined readers and the server's goroutines for the closed TCP
+	// connections exit asynchronously.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("Expected no goroutines to leak, %d before and %d after Shutdown:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// ErrSOCKS5UDP is returned when a query would be sent over udp to an upstream that is dialed through a SOCKS5 proxy.
+var ErrSOCKS5UDP = errors.New("proxy: udp can't be sent through a SOCKS5 proxy")
+
+// SetSOCKS5 makes the transport dial the upstream over tcp and tcp-tls through the SOCKS5 proxy at addr. The
+// username and password are sent when user isn't empty. The upstream's address is passed to the proxy as is,
+// so a hostname is resolved by the proxy. The candidates of SetCandidates are not used, and udp dials fail
+// with ErrSOCKS5UDP: the UDP ASSOCIATE command is not supported. The dial timeout covers the connection to
+// the proxy, the SOCKS5 handshake and the connection it makes to the upstream.
+func (t *Transport) SetSOCKS5(addr, user, password string) {
+	t.socksAddr = addr
+	t.socksAuth = nil
+	if user != "" {
+		t.socksAuth = &xproxy.Auth{User: user, Password: password}
+	}
+}
+
+// dialSOCKS5 dials the upstream over network through the SOCKS5 proxy.
+func (t *Transport) dialSOCKS5(ctx context.Context, network string, timeout time.Duration) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, ErrSOCKS5UDP
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d, err := xproxy.SOCKS5("tcp", t.socksAddr, t.socksAuth, t.dialer("tcp", t.socksAddr, timeout))
+	if err != nil {
+		return nil, err
+	}
+	return d.(xproxy.ContextDialer).DialContext(ctx, network, t.addr)
+}
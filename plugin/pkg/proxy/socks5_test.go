@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// socks5Server is a minimal SOCKS5 proxy (RFC 1928) that only supports the CONNECT command, with no
+// authentication or, when user is set, with username and password (RFC 1929).
+type socks5Server struct {
+	l        net.Listener
+	user     string
+	password string
+	conns    atomic.Int32 // CONNECT requests handled
+}
+
+func newSOCKS5Server(t *testing.T, user, password string) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := &socks5Server{l: l, user: user, password: password}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) Addr() string { return s.l.Addr().String() }
+
+func (s *socks5Server) Close() { s.l.Close() }
+
+func (s *socks5Server) serve(c net.Conn) {
+	defer c.Close()
+	if err := s.negotiate(c); err != nil {
+		return
+	}
+
+	// VER CMD RSV ATYP, then the address and port.
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(c, hdr); err != nil || hdr[1] != 1 {
+		return
+	}
+	var host string
+	switch hdr[3] {
+	case 1:
+		b := make([]byte, 4)
+		io.ReadFull(c, b)
+		host = net.IP(b).String()
+	case 3:
+		n := make([]byte, 1)
+		io.ReadFull(c, n)
+		b := make([]byte, n[0])
+		io.ReadFull(c, b)
+		host = string(b)
+	case 4:
+		b := make([]byte, 16)
+		io.ReadFull(c, b)
+		host = net.IP(b).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return
+	}
+
+	up, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	s.conns.Add(1)
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(up, c)
+	io.Copy(c, up)
+}
+
+// negotiate reads the greeting and does the authentication.
+func (s *socks5Server) negotiate(c net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	if s.user == "" {
+		_, err := c.Write([]byte{5, 0})
+		return err
+	}
+	c.Write([]byte{5, 2})
+
+	// VER ULEN UNAME PLEN PASSWD
+	ver := make([]byte, 2)
+	if _, err := io.ReadFull(c, ver); err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	io.ReadFull(c, user)
+	plen := make([]byte, 1)
+	io.ReadFull(c, plen)
+	password := make([]byte, plen[0])
+	io.ReadFull(c, password)
+	if string(user) != s.user || string(password) != s.password {
+		c.Write([]byte{1, 1})
+		return errors.New("authentication failed")
+	}
+	_, err := c.Write([]byte{1, 0})
+	return err
+}
+
+func TestSOCKS5(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		user      string
+		password  string
+		shouldErr bool
+	}{
+		{"no auth", "", "", false},
+		{"auth", "coredns", "secret", false},
+		{"wrong password", "coredns", "wrong", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			socks := newSOCKS5Server(t, "coredns", "secret")
+			if tc.user == "" {
+				socks.user = ""
+			}
+			defer socks.Close()
+
+			p := NewProxy("TestSOCKS5", s.Addr, transport.DNS)
+			p.SetSOCKS5(socks.Addr(), tc.user, tc.password)
+			p.readTimeout = 1 * time.Second
+			p.Start(5 * time.Second)
+			defer p.Stop()
+
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{TCP: true})}
+
+			resp, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+			if tc.shouldErr {
+				if err == nil {
+					t.Error("Expected an error with the wrong password")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to connect: %s", err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Errorf("Expected 1 answer, got %d", len(resp.Answer))
+			}
+			if x := socks.conns.Load(); x != 1 {
+				t.Errorf("Expected 1 connection through the SOCKS5 proxy, got %d", x)
+			}
+
+			if err := p.health.Check(p); err != nil {
+				t.Errorf("Expected the health check through the SOCKS5 proxy to succeed, got %s", err)
+			}
+			if x := socks.conns.Load(); x != 2 {
+				t.Errorf("Expected the health check to go through the SOCKS5 proxy, got %d connections", x)
+			}
+		})
+	}
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	socks := newSOCKS5Server(t, "", "")
+	defer socks.Close()
+
+	tr := newTransport("TestSOCKS5UDP", "127.0.0.1:53")
+	tr.SetSOCKS5(socks.Addr(), "", "")
+	tr.Start()
+	defer tr.Stop()
+
+	if _, _, err := tr.Dial("udp"); !errors.Is(err, ErrSOCKS5UDP) {
+		t.Errorf("Expected ErrSOCKS5UDP, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// srttDecay is the time constant of the smoothed round-trip time. A sample is weighed in with
+// 1 - e^(-elapsed/srttDecay), where elapsed is the time since the previous sample, so the average follows a
+// change in latency within a few seconds however many queries are sent.
+const srttDecay = 2 * time.Second
+
+// srtt is an exponentially weighted moving average of the round-trip times of an upstream.
+type srtt struct {
+	mu   sync.Mutex
+	avg  time.Duration
+	last time.Time // when the last sample was taken, zero until the first one
+}
+
+// observe adds the sample rtt taken at now.
+func (s *srtt) observe(rtt time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last.IsZero() {
+		s.avg, s.last = rtt, now
+		return
+	}
+	elapsed := now.Sub(s.last)
+	if elapsed <= 0 {
+		// Concurrent samples still count a little, or a burst after a pause wouldn't move the average.
+		elapsed = time.Millisecond
+	}
+	weight := 1 - math.Exp(-float64(elapsed)/float64(srttDecay))
+	s.avg += time.Duration(weight * float64(rtt-s.avg))
+	s.last = now
+}
+
+// get returns the average, 0 until the first sample.
+func (s *srtt) get() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.avg
+}
+
+// SRTT returns the smoothed round-trip time of the queries to the upstream, 0 when no query got a reply
+// yet. A query that timed out counts with the time it waited.
+func (p *Proxy) SRTT() time.Duration { return p.srtt.get() }
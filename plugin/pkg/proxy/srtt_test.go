@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestSRTT(t *testing.T) {
+	var s srtt
+	if x := s.get(); x != 0 {
+		t.Errorf("Expected 0 without samples, got %s", x)
+	}
+
+	now := time.Now()
+	s.observe(10*time.Millisecond, now)
+	if x := s.get(); x != 10*time.Millisecond {
+		t.Errorf("Expected the first sample to become the average, got %s", x)
+	}
+
+	// A sample at the same time barely moves the average.
+	s.observe(110*time.Millisecond, now)
+	if x := s.get(); x < 10*time.Millisecond || x > 11*time.Millisecond {
+		t.Errorf("Expected the average to stay about 10ms, got %s", x)
+	}
+
+	// After srttDecay the average has moved about 63% of the way to the new latency.
+	s.observe(110*time.Millisecond, now.Add(srttDecay))
+	if x := s.get(); x < 70*time.Millisecond || x > 75*time.Millisecond {
+		t.Errorf("Expected the average to be about 73ms, got %s", x)
+	}
+
+	// Long after the last sample the new one takes over.
+	s.observe(5*time.Millisecond, now.Add(time.Minute))
+	if x := s.get(); x.Round(time.Microsecond) != 5*time.Millisecond {
+		t.Errorf("Expected the average to be 5ms, got %s", x)
+	}
+}
+
+func TestConnectSRTT(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow.example.org." {
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectSRTT", s.Addr, transport.DNS)
+	p.readTimeout = 200 * time.Millisecond
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	fast := p.SRTT()
+	if fast <= 0 || fast >= p.readTimeout {
+		t.Fatalf("Expected a smoothed round-trip time below %s, got %s", p.readTimeout, fast)
+	}
+
+	// Give the timeout some weight, a sample right after the previous one hardly counts.
+	time.Sleep(50 * time.Millisecond)
+	m.SetQuestion("slow.example.org.", dns.TypeA)
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if x := p.SRTT(); x <= fast {
+		t.Errorf("Expected the timeout to raise the smoothed round-trip time above %s, got %s", fast, x)
+	}
+}
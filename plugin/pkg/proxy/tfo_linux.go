@@ -0,0 +1,17 @@
+//go:build linux
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setFastOpen sets TCP_FASTOPEN_CONNECT on the socket, the SYN is then sent together with the first
+// write. Kernels without support for it reject the option, those fall back to a regular handshake.
+func setFastOpen(c syscall.RawConn) {
+	c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1) // #nosec G115 -- fd is a valid socket descriptor
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// setFastOpen does nothing, TCP Fast Open is only used on Linux.
+func setFastOpen(_ syscall.RawConn) {}
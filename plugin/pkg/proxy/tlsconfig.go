@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
+)
+
+// SetClientCert loads the client certificate and key presented to the upstream over tcp-tls, and the CA
+// bundle used to verify the upstream, into the TLS config of transport. When caFile is empty the system
+// CAs are used. The server name of a previously set TLS config is kept.
+func (t *Transport) SetClientCert(certFile, keyFile, caFile string) error {
+	cfg, err := ctls.NewTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	if t.baseTLSConfig != nil {
+		cfg.ServerName = t.baseTLSConfig.ServerName
+	}
+	t.SetTLSConfig(cfg)
+	return nil
+}
+
+// SetServerName sets the name sent in SNI and checked against the certificate of the upstream, needed
+// when the upstream is given as an IP address. Without a TLS config one verifying against the system CAs
+// is created.
+func (t *Transport) SetServerName(name string) error {
+	var cfg *tls.Config
+	if t.baseTLSConfig != nil {
+		cfg = t.baseTLSConfig.Clone()
+	} else {
+		var err error
+		if cfg, err = ctls.NewTLSClientConfig(""); err != nil {
+			return err
+		}
+	}
+	cfg.ServerName = name
+	t.SetTLSConfig(cfg)
+	return nil
+}
+
+// withSessionCache returns cfg with the session cache of transport when cfg has none, so a reconnect to the
+// upstream resumes the TLS session instead of doing a full handshake. A cfg with its own cache is returned as is.
+func (t *Transport) withSessionCache(cfg *tls.Config) *tls.Config {
+	if cfg == nil || cfg.ClientSessionCache != nil {
+		return cfg
+	}
+	if t.sessionCache == nil {
+		t.sessionCache = tls.NewLRUClientSessionCache(sessionCacheSize)
+	}
+	cfg = cfg.Clone()
+	cfg.ClientSessionCache = t.sessionCache
+	return cfg
+}
+
+// sessionCacheSize is the number of TLS sessions cached per upstream, more than one lets concurrent
+// reconnects each resume a session.
+const sessionCacheSize = 8
+
+// withServerName returns cfg, or when it has no server name a copy with the host of the address of the
+// transport as server name, as tls.Dial does. The address dialed may be one of the candidates instead.
+func (t *Transport) withServerName(cfg *tls.Config) *tls.Config {
+	if cfg.ServerName != "" {
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		host = t.addr
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+// handshake runs the TLS handshake over conn and observes how long it took, apart from the TCP connect.
+// conn is closed when the handshake fails.
+func (t *Transport) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	cfg := t.tlsConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = t.withServerName(cfg)
+
+	start := time.Now()
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resumed := strconv.FormatBool(tc.ConnectionState().DidResume)
+	tlsHandshakeDuration.WithLabelValues(t.proxyName, t.addr, resumed).Observe(time.Since(start).Seconds())
+	return tc, nil
+}
+
+// SetPins pins the public key of the upstream: TLS connections are only accepted when the SHA-256 digest of the
+// SubjectPublicKeyInfo of its certificate is one of pins, each given in base64 as in "pin-sha256" of RFC 7469.
+// The check is done in addition to the verification of the certificate chain. No pins disables pinning.
+func (t *Transport) SetPins(pins []string) error {
+	digests := make([][sha256.Size]byte, len(pins))
+	for i, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin %q: not a base64 encoded SHA-256 digest", pin)
+		}
+		digests[i] = [sha256.Size]byte(b)
+	}
+	t.pins = digests
+	t.SetTLSConfig(t.baseTLSConfig)
+	return nil
+}
+
+// pinned returns cfg with the SPKI pins of transport checked in VerifyConnection, after any check cfg
+// already does there. Without pins cfg is returned as is.
+func (t *Transport) pinned(cfg *tls.Config) *tls.Config {
+	if cfg == nil || len(t.pins) == 0 {
+		return cfg
+	}
+	verify := cfg.VerifyConnection
+	cfg = cfg.Clone()
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return t.verifyPins(cs)
+	}
+	return cfg
+}
+
+// verifyPins returns ErrPinMismatch when the public key of the leaf certificate isn't pinned.
+func (t *Transport) verifyPins(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) > 0 {
+		digest := spki(cs.PeerCertificates[0])
+		if slices.Contains(t.pins, digest) {
+			return nil
+		}
+		tlsPinFailuresCount.WithLabelValues(t.proxyName, t.addr).Add(1)
+		return fmt.Errorf("%w: certificate of %s has pin-sha256 %q", ErrPinMismatch, t.addr, base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	tlsPinFailuresCount.WithLabelValues(t.proxyName, t.addr).Add(1)
+	return fmt.Errorf("%w: %s sent no certificate", ErrPinMismatch, t.addr)
+}
+
+// spki returns the SHA-256 digest of the SubjectPublicKeyInfo of cert.
+func spki(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testPKI is a CA with a server certificate for dns.example.org and a client certificate.
+type testPKI struct {
+	dir    string
+	caPool *x509.CertPool
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	pki := &testPKI{dir: t.TempDir(), caPool: x509.NewCertPool()}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pki.caPool.AddCert(ca)
+	pki.write(t, "ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+
+	serverDER, serverKey := issue(2, "dns.example.org", x509.ExtKeyUsageServerAuth)
+	pki.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientDER, clientKey := issue(3, "client.example.org", x509.ExtKeyUsageClientAuth)
+	pki.write(t, "client.pem", "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.write(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+	return pki
+}
+
+func (pki *testPKI) write(t *testing.T, name, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(pki.dir, name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (pki *testPKI) path(name string) string { return filepath.Join(pki.dir, name) }
+
+// newMTLSServer starts a DNS-over-TLS server that requires a client certificate issued by the CA of pki.
+func newMTLSServer(t *testing.T, pki *testPKI) net.Listener {
+	t.Helper()
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.caPool,
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(m)
+					ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestClientCert(t *testing.T) {
+	pki := newTestPKI(t)
+	l := newMTLSServer(t, pki)
+	defer l.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	p := NewProxy("TestClientCert", l.Addr().String(), transport.TLS)
+	if err := p.SetServerName("dns.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetClientCert(pki.path("client.pem"), pki.path("client-key.pem"), pki.path("ca.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if x := p.transport.tlsConfig.ServerName; x != "dns.example.org" {
+		t.Errorf("Expected server name to be kept, got %q", x)
+	}
+	defer p.transport.Stop()
+
+	resp, _, err := p.Connect(context.Background(), req, Options{})
+	if err != nil {
+		t.Fatalf("Expected query with a client certificate to succeed, got %s", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(resp.Answer))
+	}
+	if err := p.GetHealthchecker().Check(p); err != nil {
+		t.Errorf("Expected health check with a client certificate to succeed, got %s", err)
+	}
+}
+
+func TestClientCertRejected(t *testing.T) {
+	pki := newTestPKI(t)
+	l := newMTLSServer(t, pki)
+	defer l.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// Without a client certificate.
+	p := NewProxy("TestClientCertRejected", l.Addr().String(), transport.TLS)
+	p.SetTLSConfig(&tls.Config{RootCAs: pki.caPool})
+	if err := p.SetServerName("dns.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.transport.Stop()
+
+	_, _, err := p.Connect(context.Background(), req, Options{})
+	if err == nil {
+		t.Fatal("Expected query without a client certificate to fail")
+	}
+	if errors.Is(err, ErrCachedClosed) {
+		t.Errorf("Expected a TLS handshake error, got %q", err)
+	}
+	if !strings.Contains(err.Error(), "tls") {
+		t.Errorf("Expected a TLS handshake error, got %q", err)
+	}
+}
+
+func TestSetServerName(t *testing.T) {
+	tr := newTransport("TestSetServerName", "192.0.2.1:853")
+	if err := tr.SetServerName("dns.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.tlsConfig == nil || tr.tlsConfig.ServerName != "dns.example.org" {
+		t.Fatal("Expected a TLS config with the server name")
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS13}
+	tr.SetTLSConfig(cfg)
+	if err := tr.SetServerName("other.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.tlsConfig.ServerName != "other.example.org" || tr.tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Error("Expected the server name to be set on the existing TLS config")
+	}
+	if cfg.ServerName != "" {
+		t.Error("Expected the caller's TLS config not to be modified")
+	}
+}
+
+func TestPins(t *testing.T) {
+	pki := newTestPKI(t)
+	l := newMTLSServer(t, pki)
+	defer l.Close()
+
+	leaf, _ := x509.ParseCertificate(pki.server.Certificate[0])
+	digest := spki(leaf)
+	good := base64.StdEncoding.EncodeToString(digest[:])
+	other := sha256.Sum256([]byte("another key"))
+	bad := base64.StdEncoding.EncodeToString(other[:])
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	tests := []struct {
+		pins     []string
+		mismatch bool
+	}{
+		{nil, false},
+		{[]string{good}, false},
+		{[]string{bad, good}, false},
+		{[]string{bad}, true},
+	}
+	for i, tc := range tests {
+		p := NewProxy("TestPins", l.Addr().String(), transport.TLS)
+		// Pins set before the TLS config apply as well.
+		if err := p.SetPins(tc.pins); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetServerName("dns.example.org"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetClientCert(pki.path("client.pem"), pki.path("client-key.pem"), pki.path("ca.pem")); err != nil {
+			t.Fatal(err)
+		}
+
+		before := testutil.ToFloat64(tlsPinFailuresCount.WithLabelValues("TestPins", l.Addr().String()))
+		_, _, err := p.Connect(context.Background(), req, Options{})
+		failures := testutil.ToFloat64(tlsPinFailuresCount.WithLabelValues("TestPins", l.Addr().String())) - before
+		p.transport.Stop()
+
+		if !tc.mismatch {
+			if err != nil {
+				t.Errorf("Test %d: expected no error, got %s", i, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPinMismatch) {
+			t.Errorf("Test %d: expected %q, got %v", i, ErrPinMismatch, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), good) {
+			t.Errorf("Test %d: expected error to contain the pin of the upstream, got %q", i, err)
+		}
+		if failures != 1 {
+			t.Errorf("Test %d: expected 1 pin failure, got %v", i, failures)
+		}
+		if err := p.GetHealthchecker().Check(p); err == nil {
+			t.Errorf("Test %d: expected health check to fail on a pin mismatch", i)
+		}
+	}
+}
+
+func TestSetPinsInvalid(t *testing.T) {
+	tr := newTransport("TestSetPinsInvalid", "192.0.2.1:853")
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if err := tr.SetPins([]string{pin}); err == nil {
+			t.Errorf("Expected error for pin %q", pin)
+		}
+	}
+}
+
+// sampleCount returns the number of observations in the histogram of vec with labels.
+func sampleCount(t *testing.T, vec *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	pb := &dto.Metric{}
+	if err := vec.WithLabelValues(labels...).(prometheus.Metric).Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+func TestSessionResumption(t *testing.T) {
+	pki := newTestPKI(t)
+	l := newMTLSServer(t, pki)
+	defer l.Close()
+
+	p := NewProxy("TestSessionResumption", l.Addr().String(), transport.TLS)
+	if err := p.SetServerName("dns.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetClientCert(pki.path("client.pem"), pki.path("client-key.pem"), pki.path("ca.pem")); err != nil {
+		t.Fatal(err)
+	}
+	defer p.transport.Stop()
+	if p.transport.tlsConfig.ClientSessionCache == nil {
+		t.Fatal("Expected a session cache to be installed")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// The TLS 1.3 session ticket arrives after the handshake, with the reply.
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	pc, cached, err := p.transport.dial(context.Background(), "tcp-tls", true, nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer pc.close()
+	if cached {
+		t.Fatal("Expected a new connection")
+	}
+	if !pc.c.Conn.(*tls.Conn).ConnectionState().DidResume {
+		t.Error("Expected the reconnect to resume the TLS session")
+	}
+	if x := sampleCount(t, tlsHandshakeDuration, "TestSessionResumption", l.Addr().String(), "false"); x != 1 {
+		t.Errorf("Expected 1 full handshake to be observed, got %d", x)
+	}
+	if x := sampleCount(t, tlsHandshakeDuration, "TestSessionResumption", l.Addr().String(), "true"); x != 1 {
+		t.Errorf("Expected 1 resumed handshake to be observed, got %d", x)
+	}
+}
+
+func TestSessionCacheUserConfig(t *testing.T) {
+	tr := newTransport("TestSessionCacheUserConfig", "192.0.2.1:853")
+
+	cfg := &tls.Config{ServerName: "dns.example.org"}
+	tr.SetTLSConfig(cfg)
+	if tr.tlsConfig.ClientSessionCache == nil {
+		t.Error("Expected a session cache to be installed")
+	}
+	if cfg.ClientSessionCache != nil {
+		t.Error("Expected the caller's TLS config not to be modified")
+	}
+	installed := tr.tlsConfig.ClientSessionCache
+	if err := tr.SetServerName("other.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.tlsConfig.ClientSessionCache != installed {
+		t.Error("Expected the session cache to be kept when the TLS config changes")
+	}
+
+	own := tls.NewLRUClientSessionCache(1)
+	tr.SetTLSConfig(&tls.Config{ServerName: "dns.example.org", ClientSessionCache: own})
+	if tr.tlsConfig.ClientSessionCache != own {
+		t.Error("Expected the session cache of the TLS config to be left untouched")
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// SetTracer sets the tracer for the spans of p. Without one the tracer of the span in the context of a query is
+// used, and queries without a span in their context are not traced.
+func (p *Proxy) SetTracer(tracer ot.Tracer) { p.transport.tracer = tracer }
+
+// startSpan starts the span name as a child of the span in ctx, if any. It uses tracer, or else the tracer of
+// the span in ctx. Without either nil and ctx are returned.
+func startSpan(ctx context.Context, tracer ot.Tracer, name string) (ot.Span, context.Context) {
+	var opts []ot.StartSpanOption
+	if parent := ot.SpanFromContext(ctx); parent != nil {
+		if tracer == nil {
+			tracer = parent.Tracer()
+		}
+		opts = append(opts, ot.ChildOf(parent.Context()))
+	}
+	if tracer == nil {
+		return nil, ctx
+	}
+	span := tracer.StartSpan(name, opts...)
+	return span, ot.ContextWithSpan(ctx, span)
+}
+
+// finishSpan tags span with err, when not nil, and finishes it. span may be nil.
+func finishSpan(span ot.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		otext.Error.Set(span, true)
+		span.SetTag("error.message", err.Error())
+	}
+	span.Finish()
+}
+
+// connect is roundTrip in an "exchange" span, tagged with the upstream, the protocol, whether a cached connection
+// was used and the rcode of the reply, or the number of records of a zone transfer. A new connection is dialed
+// in a nested "dial" span. The records of a zone transfer are passed to out.
+func (p *Proxy) connect(ctx context.Context, state request.Request, opts Options, start time.Time, forceNew bool, ev *Event, out func([]dns.RR) error) (*dns.Msg, error) {
+	span, ctx := startSpan(ctx, p.transport.tracer, "exchange")
+	records := 0
+	if span != nil && out != nil {
+		next := out
+		out = func(rrs []dns.RR) error {
+			records += len(rrs)
+			return next(rrs)
+		}
+	}
+	ret, err := p.roundTrip(ctx, state, opts, start, forceNew, ev, out)
+	if span != nil {
+		otext.PeerAddress.Set(span, p.addr)
+		if ev.Proto != "" {
+			span.SetTag("proto", ev.Proto)
+			span.SetTag("cached", ev.Cached)
+		}
+		if ret != nil {
+			span.SetTag("rcode", dns.RcodeToString[ret.Rcode])
+		}
+		if state.QType() == dns.TypeAXFR || state.QType() == dns.TypeIXFR {
+			span.SetTag("records", records)
+		}
+	}
+	finishSpan(span, err)
+	return ret, err
+}
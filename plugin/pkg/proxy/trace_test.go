@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestConnectSpans(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeAXFR {
+			ret.Answer = []dns.RR{soa("3"), test.A("a.example.org. IN A 127.0.0.1"), soa("3")}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectSpans", s.Addr, transport.DNS)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	tracer := mocktracer.New()
+	connect := func(m *dns.Msg, opts Options) {
+		t.Helper()
+		root := tracer.StartSpan("root")
+		ctx := ot.ContextWithSpan(context.Background(), root)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		if _, _, err := p.Connect(ctx, req, opts); err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		root.Finish()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	connect(m, Options{})
+	connect(m, Options{})
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("Expected 5 spans, got %d", len(spans))
+	}
+	// A new connection is dialed for the first query, in a span of the exchange.
+	dial, exchange, root := spans[0], spans[1], spans[2]
+	if dial.OperationName != "dial" || exchange.OperationName != "exchange" {
+		t.Fatalf("Expected a dial and an exchange span, got %s and %s", dial.OperationName, exchange.OperationName)
+	}
+	if dial.ParentID != exchange.SpanContext.SpanID || exchange.ParentID != root.SpanContext.SpanID {
+		t.Error("Expected the dial span in the exchange span, in the span of the context")
+	}
+	for k, v := range map[string]any{"peer.address": s.Addr, "proto": "udp", "cached": false, "rcode": "NOERROR"} {
+		if x := exchange.Tag(k); x != v {
+			t.Errorf("Expected tag %s of the exchange to be %v, got %v", k, v, x)
+		}
+	}
+	// The second query uses the cached connection.
+	if x := spans[3].OperationName; x != "exchange" {
+		t.Fatalf("Expected only an exchange span for the second query, got %s", x)
+	}
+	if x := spans[3].Tag("cached"); x != true {
+		t.Errorf("Expected the second exchange to use a cached connection, got %v", x)
+	}
+
+	// A transfer is tagged with the number of records.
+	tracer.Reset()
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.org.")
+	connect(axfr, Options{ForceTCP: true})
+	spans = tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	if x := spans[1].Tag("records"); x != 3 {
+		t.Errorf("Expected 3 records, got %v", x)
+	}
+}
+
+func TestSetTracer(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestSetTracer", s.Addr, transport.DNS)
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// Without a tracer and without a span in the context nothing is traced, with one the spans have no parent.
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	tracer := mocktracer.New()
+	p.SetTracer(tracer)
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].OperationName != "exchange" || spans[0].ParentID != 0 {
+		t.Errorf("Expected one exchange span without a parent, got %v", spans)
+	}
+}
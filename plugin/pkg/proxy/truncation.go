@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/edns"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultTruncationHistory is the number of questions a proxy remembers a truncated reply for, see
+	// Proxy.SetTruncationHistory.
+	DefaultTruncationHistory = 1000
+	// truncationTTL is how long a truncated reply sends the question over TCP. After that UDP is tried again, the
+	// answer may have become smaller.
+	truncationTTL = 30 * time.Minute
+)
+
+// truncationKey is the question of a truncated reply.
+type truncationKey struct {
+	name  string
+	qtype uint16
+}
+
+type truncationEntry struct {
+	key  truncationKey
+	at   time.Time
+	size uint16 // the largest UDP size of the client a reply was truncated at
+}
+
+// truncationHistory remembers the questions whose reply over UDP was truncated, so the next query for them can
+// go straight to TCP, see Options.PreferTCPLarge. A truncation only holds for queries with the same or a smaller
+// UDP size, a client that advertises a larger buffer still tries UDP. It holds at most max questions, the least
+// recently used one is dropped first. A nil truncationHistory remembers nothing.
+type truncationHistory struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List // of *truncationEntry, the most recently used first
+	entries map[truncationKey]*list.Element
+}
+
+// newTruncationHistory returns a truncationHistory of n questions, or nil when n isn't positive.
+func newTruncationHistory(n int) *truncationHistory {
+	if n <= 0 {
+		return nil
+	}
+	return &truncationHistory{max: n, ll: list.New(), entries: make(map[truncationKey]*list.Element)}
+}
+
+// add remembers that the reply to the question of state was truncated at the UDP size of state.
+func (h *truncationHistory) add(state request.Request) {
+	if h == nil {
+		return
+	}
+	k := truncationKey{state.Name(), state.QType()}
+	size := udpSize(state)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e, ok := h.entries[k]; ok {
+		te := e.Value.(*truncationEntry)
+		// An old truncation at a larger size no longer holds.
+		if time.Since(te.at) > truncationTTL || size > te.size {
+			te.size = size
+		}
+		te.at = time.Now()
+		h.ll.MoveToFront(e)
+		return
+	}
+	h.entries[k] = h.ll.PushFront(&truncationEntry{key: k, at: time.Now(), size: size})
+	if h.ll.Len() > h.max {
+		last := h.ll.Back()
+		h.ll.Remove(last)
+		delete(h.entries, last.Value.(*truncationEntry).key)
+	}
+}
+
+// truncated returns true when the reply to the question of state was truncated in the last truncationTTL, at
+// the UDP size of state or a larger one.
+func (h *truncationHistory) truncated(state request.Request) bool {
+	if h == nil {
+		return false
+	}
+	k := truncationKey{state.Name(), state.QType()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.entries[k]
+	if !ok {
+		return false
+	}
+	if time.Since(e.Value.(*truncationEntry).at) > truncationTTL {
+		h.ll.Remove(e)
+		delete(h.entries, k)
+		return false
+	}
+	h.ll.MoveToFront(e)
+	return e.Value.(*truncationEntry).size >= udpSize(state)
+}
+
+// udpSize returns the UDP size of the query in state as it is sent to the upstream, at least 512.
+func udpSize(state request.Request) uint16 {
+	var size uint16
+	if o := state.Req.IsEdns0(); o != nil {
+		size = o.UDPSize()
+	}
+	return edns.Size("udp", size)
+}
+
+// len returns the number of questions in h.
+func (h *truncationHistory) len() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ll.Len()
+}
+
+// largeReply returns why the reply to the query in state likely doesn't fit in UDP: "qtype" for a type whose
+// answers are usually large (ANY and DNSKEY), "history" when the last reply over UDP was truncated, or "" when
+// UDP is worth a try.
+func (p *Proxy) largeReply(state request.Request) string {
+	switch {
+	case state.QType() == dns.TypeANY, state.QType() == dns.TypeDNSKEY:
+		return "qtype"
+	case p.truncated.truncated(state):
+		return "history"
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTruncationHistory(t *testing.T) {
+	question := func(name string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		return request.Request{Req: m}
+	}
+
+	h := newTruncationHistory(2)
+	h.add(question("a.example.org."))
+	h.add(question("b.example.org."))
+	if !h.truncated(question("a.example.org.")) {
+		t.Error("Expected a.example.org. to be remembered")
+	}
+	// b is now the least recently used.
+	h.add(question("c.example.org."))
+	if h.truncated(question("b.example.org.")) {
+		t.Error("Expected b.example.org. to be dropped")
+	}
+	if !h.truncated(question("a.example.org.")) || !h.truncated(question("c.example.org.")) {
+		t.Error("Expected a.example.org. and c.example.org. to be remembered")
+	}
+	if x := h.len(); x != 2 {
+		t.Errorf("Expected 2 questions, got %d", x)
+	}
+
+	// Another type is another question.
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.org.", dns.TypeA)
+	if h.truncated(request.Request{Req: m}) {
+		t.Error("Expected a.example.org. A not to be remembered")
+	}
+
+	// A truncation holds for the same or a smaller UDP size, a larger buffer tries UDP again.
+	sized := func(size uint16) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion("d.example.org.", dns.TypeTXT)
+		m.SetEdns0(size, false)
+		return request.Request{Req: m}
+	}
+	h.add(sized(1232))
+	if !h.truncated(sized(1232)) || !h.truncated(question("d.example.org.")) {
+		t.Error("Expected d.example.org. to be remembered at 1232 and 512 bytes")
+	}
+	if h.truncated(sized(4096)) {
+		t.Error("Expected d.example.org. not to be remembered at 4096 bytes")
+	}
+	h.add(sized(4096))
+	h.add(question("d.example.org."))
+	if !h.truncated(sized(4096)) {
+		t.Error("Expected d.example.org. to be remembered at 4096 bytes")
+	}
+	h.add(question("a.example.org."))
+	h.add(question("c.example.org."))
+
+	// An old truncation is forgotten.
+	h.mu.Lock()
+	h.entries[truncationKey{"a.example.org.", dns.TypeTXT}].Value.(*truncationEntry).at = time.Now().Add(-truncationTTL - time.Second)
+	h.mu.Unlock()
+	if h.truncated(question("a.example.org.")) {
+		t.Error("Expected a.example.org. to be forgotten after the TTL")
+	}
+	if x := h.len(); x != 1 {
+		t.Errorf("Expected 1 question, got %d", x)
+	}
+
+	var none *truncationHistory
+	none.add(question("a.example.org."))
+	if none.truncated(question("a.example.org.")) || newTruncationHistory(0) != nil {
+		t.Error("Expected a nil history to remember nothing")
+	}
+}
+
+func TestConnectPreferTCPLarge(t *testing.T) {
+	var udp, tcp atomic.Int32
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if w.RemoteAddr().Network() == "udp" {
+			udp.Add(1)
+			if r.Question[0].Name == "big.example.org." && r.Question[0].Qtype == dns.TypeTXT {
+				ret.Truncated = true
+				w.WriteMsg(ret)
+				return
+			}
+		} else {
+			tcp.Add(1)
+		}
+		ret.Answer = append(ret.Answer, test.TXT(r.Question[0].Name+" IN TXT \"answer\""))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectPreferTCPLarge", s.Addr, transport.DNS)
+	p.readTimeout = time.Second
+	defer p.transport.Stop()
+
+	tests := []struct {
+		name            string
+		qtype           uint16
+		opts            Options
+		expectUDP       int32 // queries over UDP and TCP the upstream got
+		expectTCP       int32
+		expectTruncated bool
+		expectQtype     float64 // udp_skipped_total so far
+		expectHistory   float64
+	}{
+		{"big.example.org.", dns.TypeTXT, Options{PreferTCPLarge: true}, 1, 0, true, 0, 0},
+		{"big.example.org.", dns.TypeTXT, Options{PreferTCPLarge: true}, 1, 1, false, 0, 1},
+		{"big.example.org.", dns.TypeTXT, Options{}, 2, 1, true, 0, 1},
+		{"big.example.org.", dns.TypeA, Options{PreferTCPLarge: true}, 3, 1, false, 0, 1},
+		{"small.example.org.", dns.TypeTXT, Options{PreferTCPLarge: true}, 4, 1, false, 0, 1},
+		{"example.org.", dns.TypeDNSKEY, Options{PreferTCPLarge: true}, 4, 2, false, 1, 1},
+		{"example.org.", dns.TypeANY, Options{PreferTCPLarge: true}, 4, 3, false, 2, 1},
+		{"example.org.", dns.TypeDNSKEY, Options{}, 5, 3, false, 2, 1},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		ret, _, err := p.Connect(context.Background(), req, tc.opts)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if ret.Truncated != tc.expectTruncated {
+			t.Errorf("Test %d: expected truncated %t, got %t", i, tc.expectTruncated, ret.Truncated)
+		}
+		if u, c := udp.Load(), tcp.Load(); u != tc.expectUDP || c != tc.expectTCP {
+			t.Errorf("Test %d: expected %d queries over UDP and %d over TCP, got %d and %d", i, tc.expectUDP, tc.expectTCP, u, c)
+		}
+		if x := testutil.ToFloat64(udpSkippedCount.WithLabelValues("TestConnectPreferTCPLarge", s.Addr, "qtype")); x != tc.expectQtype {
+			t.Errorf("Test %d: expected %v queries skipping UDP for their type, got %v", i, tc.expectQtype, x)
+		}
+		if x := testutil.ToFloat64(udpSkippedCount.WithLabelValues("TestConnectPreferTCPLarge", s.Addr, "history")); x != tc.expectHistory {
+			t.Errorf("Test %d: expected %v queries skipping UDP for their history, got %v", i, tc.expectHistory, x)
+		}
+	}
+
+	// Without a history only the type counts.
+	p.SetTruncationHistory(0)
+	m := new(dns.Msg)
+	m.SetQuestion("big.example.org.", dns.TypeTXT)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	for range 2 {
+		if ret, _, err := p.Connect(context.Background(), req, Options{PreferTCPLarge: true}); err != nil || !ret.Truncated {
+			t.Errorf("Expected a truncated reply over UDP without a history, got %v", err)
+		}
+	}
+}
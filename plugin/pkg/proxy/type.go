@@ -10,6 +10,7 @@ const (
 	typeUDP transportType = iota
 	typeTCP
 	typeTLS
+	typeQUIC
 	typeTotalCount // keep this last
 )
 
@@ -21,12 +22,31 @@ func stringToTransportType(s string) transportType {
 		return typeTCP
 	case "tcp-tls":
 		return typeTLS
+	case "quic":
+		return typeQUIC
 	}
 
 	return typeUDP
 }
 
+// String returns the protocol name used in Dial and in the metric labels.
+func (t transportType) String() string {
+	switch t {
+	case typeTCP:
+		return "tcp"
+	case typeTLS:
+		return "tcp-tls"
+	case typeQUIC:
+		return "quic"
+	}
+	return "udp"
+}
+
 func (t *Transport) transportTypeFromConn(pc *persistConn) transportType {
+	if pc.qc != nil {
+		return typeQUIC
+	}
+
 	if _, ok := pc.c.Conn.(*net.UDPConn); ok {
 		return typeUDP
 	}
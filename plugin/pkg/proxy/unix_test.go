@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxyUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolver.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	p := NewProxy("TestProxyUnix", path, transport.UNIX)
+	p.readTimeout = 1 * time.Second
+	p.Start(5 * time.Second)
+	defer p.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	for i := range 2 {
+		resp, _, err := p.Connect(context.Background(), req, Options{})
+		if err != nil {
+			t.Fatalf("Query %d: failed to connect: %s", i, err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Query %d: expected 1 answer, got %d", i, len(resp.Answer))
+		}
+	}
+
+	p.transport.mu.Lock()
+	cached := len(p.transport.conns[typeTCP])
+	p.transport.mu.Unlock()
+	if cached != 1 {
+		t.Errorf("Expected the stream connection to be cached and reused, got %d cached", cached)
+	}
+
+	if err := p.health.Check(p); err != nil {
+		t.Errorf("Expected the health check to pass, got %s", err)
+	}
+
+	// The socket is gone, a new connection can't be dialed.
+	s.Shutdown()
+	os.Remove(path)
+	p.transport.cleanup(true)
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err == nil {
+		t.Error("Expected an error when the socket is gone")
+	}
+	if x := testutil.ToFloat64(connErrorsCount.WithLabelValues("TestProxyUnix", path, "other")); x != 1 {
+		t.Errorf("Expected the vanished socket to count as 1 dial error, got %v", x)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// Upstream is the upstream whose reply a query returned.
+type Upstream struct {
+	ProxyName string
+	Addr      string // address of the upstream
+	Proto     string // protocol the reply came over: udp, tcp, tcp-tls, https or quic
+}
+
+type upstreamKey struct{}
+
+// upstreamSlot holds the Upstream recorded in a context made with WithUpstream.
+type upstreamSlot struct {
+	mu sync.Mutex
+	u  Upstream
+	ok bool
+}
+
+// WithUpstream returns a copy of ctx in which Connect, ConnectTransfer, ConnectFanout and RaceConnect record the
+// upstream whose reply they return, read it with UpstreamFromContext after the call. A reply that comes with
+// ErrFailover is recorded too, a query that failed without a reply leaves the context alone. This tells the
+// caller which upstream answered when that isn't known up front, as with fanout or hedging, e.g. to log it.
+func WithUpstream(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, new(upstreamSlot))
+}
+
+// UpstreamFromContext returns the upstream recorded in ctx, false when ctx isn't made with WithUpstream or no
+// reply was returned yet. With several queries on ctx it is the upstream of the last reply.
+func UpstreamFromContext(ctx context.Context) (Upstream, bool) {
+	s, ok := ctx.Value(upstreamKey{}).(*upstreamSlot)
+	if !ok {
+		return Upstream{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.u, s.ok
+}
+
+// recordUpstream records u in ctx, when it is made with WithUpstream.
+func recordUpstream(ctx context.Context, u Upstream) {
+	s, ok := ctx.Value(upstreamKey{}).(*upstreamSlot)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.u, s.ok = u, true
+}
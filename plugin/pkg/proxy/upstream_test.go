@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamFromContext(t *testing.T) {
+	var queries atomic.Int32
+	s := newDelayServer(0, &queries)
+	defer s.Close()
+
+	p := NewProxy("TestUpstreamFromContext", s.Addr, transport.DNS)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	if _, _, err := p.Connect(context.Background(), req, Options{}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	tests := []struct {
+		opts  Options
+		proto string
+	}{
+		{Options{}, "udp"},
+		{Options{ForceTCP: true}, "tcp"},
+	}
+	for _, tc := range tests {
+		ctx := WithUpstream(context.Background())
+		if _, ok := UpstreamFromContext(ctx); ok {
+			t.Fatal("Expected no upstream before the query")
+		}
+		if _, _, err := p.Connect(ctx, req, tc.opts); err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		u, ok := UpstreamFromContext(ctx)
+		if !ok {
+			t.Fatal("Expected the upstream to be recorded")
+		}
+		expected := Upstream{ProxyName: "TestUpstreamFromContext", Addr: s.Addr, Proto: tc.proto}
+		if u != expected {
+			t.Errorf("Expected %+v, got %+v", expected, u)
+		}
+	}
+
+	// A query without a reply records nothing.
+	down := NewProxy("TestUpstreamFromContext", "127.0.0.1:1", transport.DNS)
+	defer down.transport.Stop()
+	ctx := WithUpstream(context.Background())
+	if _, _, err := down.Connect(ctx, req, Options{ForceTCP: true}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if u, ok := UpstreamFromContext(ctx); ok {
+		t.Errorf("Expected no upstream, got %+v", u)
+	}
+}
+
+func TestUpstreamFirstReply(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := newDelayServer(300*time.Millisecond, &slowQueries)
+	defer slow.Close()
+	fast := newDelayServer(0, &fastQueries)
+	defer fast.Close()
+
+	first := NewProxy("TestUpstreamFirstReply", slow.Addr, transport.DNS)
+	defer first.transport.Stop()
+	second := NewProxy("TestUpstreamFirstReply", fast.Addr, transport.DNS)
+	defer second.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// The hedged query wins, the slow reply that comes in later doesn't overwrite it.
+	ctx := WithUpstream(context.Background())
+	if _, _, err := RaceConnect(ctx, first, second, req, Options{}, 20*time.Millisecond, nil); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if u, ok := UpstreamFromContext(ctx); !ok || u.Addr != fast.Addr {
+		t.Errorf("Expected the upstream %s, got %+v", fast.Addr, u)
+	}
+
+	ctx = WithUpstream(context.Background())
+	if _, _, err := ConnectFanout(ctx, []*Proxy{first, second}, req, Options{Fanout: 2}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if u, ok := UpstreamFromContext(ctx); !ok || u.Addr != fast.Addr {
+		t.Errorf("Expected the upstream %s, got %+v", fast.Addr, u)
+	}
+}
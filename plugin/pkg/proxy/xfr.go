@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// xfr follows the SOA records of a zone transfer to find where it ends.
+//
+// An AXFR ends with the second copy of the first SOA. An IXFR can be answered in three ways (RFC 1995,
+// section 4): with a lone SOA when the zone is no newer than the serial in the query, with a full transfer as
+// for an AXFR, or incrementally. The record after the first SOA tells the last two apart: in an incremental
+// transfer it is the SOA with the older serial that starts the first difference sequence, and the transfer
+// ends with the third copy of the first SOA.
+type xfr struct {
+	ixfr        bool   // the query was an IXFR
+	current     uint32 // serial of the client's version of the zone, from the IXFR query
+	hasCurrent  bool   // the IXFR query has a serial
+	started     bool   // the first SOA has been seen
+	serial      uint32 // serial of the first SOA
+	shaped      bool   // the record after the first SOA has been seen
+	incremental bool   // the transfer is an incremental IXFR
+	copies      int    // copies of the first SOA seen
+}
+
+// newXfr returns the xfr for the transfer asked for with req.
+func newXfr(req *dns.Msg) *xfr {
+	x := &xfr{ixfr: req.Question[0].Qtype == dns.TypeIXFR}
+	if x.ixfr && len(req.Ns) > 0 {
+		if soa, ok := req.Ns[0].(*dns.SOA); ok {
+			x.current, x.hasCurrent = soa.Serial, true
+		}
+	}
+	return x
+}
+
+// add adds the answer section of the next message of the transfer. It returns the records that belong to the
+// transfer and whether it is complete. An error is returned when the transfer doesn't start with an SOA.
+func (x *xfr) add(answer []dns.RR) ([]dns.RR, bool, error) {
+	if !x.started && len(answer) == 0 {
+		return nil, false, dns.ErrSoa
+	}
+	for i, rr := range answer {
+		soa, isSOA := rr.(*dns.SOA)
+		switch {
+		case !x.started:
+			if !isSOA {
+				return nil, false, dns.ErrSoa
+			}
+			x.started, x.serial, x.copies = true, soa.Serial, 1
+			if x.upToDate(len(answer)) {
+				return answer[:1], true, nil
+			}
+			continue
+		case !x.shaped:
+			x.shaped = true
+			x.incremental = x.ixfr && isSOA && soa.Serial != x.serial
+		}
+		if !isSOA || soa.Serial != x.serial {
+			continue
+		}
+		x.copies++
+		if (!x.incremental && x.copies == 2) || x.copies == 3 {
+			return answer[:i+1], true, nil
+		}
+	}
+	return answer, false, nil
+}
+
+// upToDate returns true when the first SOA of the reply to an IXFR, in a message of n records, says the zone
+// hasn't changed since the serial in the query, in serial number arithmetic (RFC 1982). Without a serial in
+// the query a lone SOA is taken to mean so.
+func (x *xfr) upToDate(n int) bool {
+	if !x.ixfr {
+		return false
+	}
+	if x.hasCurrent {
+		return int32(x.serial-x.current) <= 0 // #nosec G115 -- the difference of two serials
+	}
+	return n == 1
+}
+
+// checkTransferSize returns ErrTransferTooLarge, and counts the aborted transfer, when records or size, the
+// records and bytes of a transfer so far, are over the limits set with SetMaxTransferSize.
+func (p *Proxy) checkTransferSize(records, size int) error {
+	var err error
+	switch {
+	case p.maxTransferRecords > 0 && records > p.maxTransferRecords:
+		err = fmt.Errorf("%w: more than %d records", ErrTransferTooLarge, p.maxTransferRecords)
+	case p.maxTransferBytes > 0 && size > p.maxTransferBytes:
+		err = fmt.Errorf("%w: more than %d bytes", ErrTransferTooLarge, p.maxTransferBytes)
+	default:
+		return nil
+	}
+	transfersAbortedCount.WithLabelValues(p.proxyName, p.addr).Add(1)
+	return err
+}
@@ -0,0 +1,607 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func soa(serial string) dns.RR {
+	return test.SOA("example.org. IN SOA ns.example.org. admin.example.org. " + serial + " 7200 3600 1209600 3600")
+}
+
+func TestXfr(t *testing.T) {
+	a1 := test.A("a.example.org. IN A 127.0.0.1")
+	a2 := test.A("b.example.org. IN A 127.0.0.2")
+
+	tests := []struct {
+		name     string
+		ixfr     bool
+		current  uint32 // serial in the IXFR query, 0 for none
+		messages [][]dns.RR
+		expected int // number of records returned, -1 when the transfer must not complete
+	}{
+		{"axfr", false, 0, [][]dns.RR{{soa("3"), a1, a2, soa("3")}}, 4},
+		{"axfr lone soa first", false, 0, [][]dns.RR{{soa("3")}, {a1}, {a2, soa("3")}}, 4},
+		{"axfr incomplete", false, 0, [][]dns.RR{{soa("3"), a1}, {a2}}, -1},
+		{"ixfr up to date", true, 0, [][]dns.RR{{soa("3")}}, 1},
+		{"ixfr full transfer", true, 0, [][]dns.RR{{soa("3"), a1}, {a2, soa("3")}}, 4},
+		{"ixfr incremental", true, 0, [][]dns.RR{{soa("3"), soa("1"), a1, soa("3")}, {a2, soa("3")}}, 6},
+		{"ixfr incremental sequences", true, 0, [][]dns.RR{
+			{soa("3"), soa("1"), a1, soa("2")},
+			{a2, soa("2"), a2},
+			{soa("3"), a1, soa("3")},
+		}, 10},
+		{"ixfr incremental incomplete", true, 0, [][]dns.RR{{soa("3"), soa("1"), a1, soa("3")}}, -1},
+		{"records after the end", false, 0, [][]dns.RR{{soa("3"), a1, soa("3"), a2}}, 3},
+		{"ixfr up to date with serial", true, 3, [][]dns.RR{{soa("3")}}, 1},
+		{"ixfr newer serial", true, 4, [][]dns.RR{{soa("3")}}, 1},
+		{"ixfr full transfer lone soa first", true, 1, [][]dns.RR{{soa("3")}, {a1}, {a2, soa("3")}}, 4},
+		{"ixfr full transfer of an empty zone", true, 1, [][]dns.RR{{soa("3"), soa("3")}}, 2},
+		{"ixfr incremental with serial", true, 1, [][]dns.RR{{soa("3")}, {soa("1"), a1, soa("3"), a2}, {soa("3")}}, 6},
+		{"ixfr incremental incomplete with serial", true, 1, [][]dns.RR{{soa("3"), soa("1"), a1, soa("3")}}, -1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			x := &xfr{ixfr: tc.ixfr, current: tc.current, hasCurrent: tc.current != 0}
+			var rrs []dns.RR
+			done := false
+			for _, m := range tc.messages {
+				if done {
+					t.Fatal("Expected transfer to complete with the last message")
+				}
+				got, d, err := x.add(m)
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				rrs = append(rrs, got...)
+				done = d
+			}
+			if tc.expected == -1 {
+				if done {
+					t.Error("Expected transfer not to be complete")
+				}
+				return
+			}
+			if !done {
+				t.Fatal("Expected transfer to be complete")
+			}
+			if len(rrs) != tc.expected {
+				t.Errorf("Expected %d records, got %d", tc.expected, len(rrs))
+			}
+		})
+	}
+}
+
+func TestXfrNoSOA(t *testing.T) {
+	for _, answer := range [][]dns.RR{nil, {test.A("a.example.org. IN A 127.0.0.1")}} {
+		x := &xfr{ixfr: true}
+		if _, _, err := x.add(answer); err != dns.ErrSoa {
+			t.Errorf("Expected %q, got %v", dns.ErrSoa, err)
+		}
+	}
+}
+
+func TestConnectIXFR(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := &dns.Conn{Conn: c}
+			m, err := conn.ReadMsg()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			messages := [][]dns.RR{
+				{soa("3"), soa("1"), test.A("a.example.org. IN A 127.0.0.1"), soa("3")},
+				{test.A("a.example.org. IN A 127.0.0.2"), soa("3")},
+			}
+			switch m.Ns[0].(*dns.SOA).Serial {
+			case 2: // a full transfer, its SOA in a message of its own
+				messages = [][]dns.RR{
+					{soa("3")},
+					{test.A("a.example.org. IN A 127.0.0.1"), test.A("a.example.org. IN A 127.0.0.2")},
+					{soa("3")},
+				}
+			case 3:
+				messages = [][]dns.RR{{soa("3")}}
+			}
+			for _, answer := range messages {
+				ret := new(dns.Msg)
+				ret.SetReply(m)
+				ret.Answer = answer
+				conn.WriteMsg(ret)
+			}
+			// Keep the connection open, the proxy must not wait for more.
+			conn.ReadMsg()
+			conn.Close()
+		}
+	}()
+
+	p := NewProxy("TestConnectIXFR", l.Addr().String(), transport.DNS)
+	p.SetTransferReadTimeout(5 * time.Second)
+
+	for _, tc := range []struct {
+		serial   uint32
+		expected int
+	}{
+		{1, 6},
+		{2, 4},
+		{3, 1},
+	} {
+		m := new(dns.Msg)
+		m.SetIxfr("example.org.", tc.serial, "ns.example.org.", "admin.example.org.")
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		begin := time.Now()
+		_, rrs, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+		if err != nil {
+			t.Fatalf("Serial %d: expected no error, got %s", tc.serial, err)
+		}
+		if len(rrs) != tc.expected {
+			t.Errorf("Serial %d: expected %d records, got %d", tc.serial, tc.expected, len(rrs))
+		}
+		if d := time.Since(begin); d > time.Second {
+			t.Errorf("Serial %d: expected the transfer to end with its last record, took %s", tc.serial, d)
+		}
+		p.transport.cleanup(true)
+	}
+}
+
+func TestConnectTransferRcode(t *testing.T) {
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch {
+		case r.Question[0].Name == "refused.example.org.":
+			ret.Rcode = dns.RcodeRefused
+		case r.Question[0].Qtype == dns.TypeIXFR:
+			ret.Rcode = dns.RcodeNotImplemented
+		default:
+			ret.Answer = []dns.RR{soa("3"), test.A("a.example.org. IN A 127.0.0.1"), soa("3")}
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectTransferRcode", s.Addr, transport.DNS)
+	p.SetTransferReadTimeout(time.Second)
+	defer p.transport.Stop()
+
+	transfer := func(m *dns.Msg) ([]dns.RR, error) {
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		_, rrs, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+		return rrs, err
+	}
+
+	m := new(dns.Msg)
+	m.SetIxfr("example.org.", 1, "ns.example.org.", "admin.example.org.")
+	if _, err := transfer(m); !errors.Is(err, ErrIXFRNotImplemented) {
+		t.Errorf("Expected %q for an IXFR, got %v", ErrIXFRNotImplemented, err)
+	}
+	if x := ErrorKind(ErrIXFRNotImplemented); x != "transfer" {
+		t.Errorf("Expected error kind transfer, got %s", x)
+	}
+	p.transport.mu.Lock()
+	cached := len(p.transport.conns[typeTCP])
+	p.transport.mu.Unlock()
+	if cached != 1 {
+		t.Errorf("Expected the connection to be cached after the NOTIMP reply, got %d connections", cached)
+	}
+
+	// The caller can ask for an AXFR instead.
+	m.SetAxfr("example.org.")
+	m.Ns = nil
+	rrs, err := transfer(m)
+	if err != nil {
+		t.Fatalf("Expected the AXFR to succeed, got %s", err)
+	}
+	if len(rrs) != 3 {
+		t.Errorf("Expected 3 records, got %d", len(rrs))
+	}
+
+	m.SetAxfr("refused.example.org.")
+	if _, err := transfer(m); !errors.Is(err, ErrTransferRcode) || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("Expected %q with the rcode, got %v", ErrTransferRcode, err)
+	}
+}
+
+func TestConnectTransferReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The transfer is sent in two messages, 200ms apart.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				m, err := conn.ReadMsg()
+				if err != nil {
+					return
+				}
+				for i, answer := range [][]dns.RR{{soa("1"), test.A("a.example.org. IN A 127.0.0.1")}, {soa("1")}} {
+					if i > 0 {
+						time.Sleep(200 * time.Millisecond)
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(m)
+					ret.Answer = answer
+					if err := conn.WriteMsg(ret); err != nil {
+						return
+					}
+				}
+				conn.ReadMsg()
+			}()
+		}
+	}()
+
+	p := NewProxy("TestConnectTransferReadTimeout", l.Addr().String(), transport.DNS)
+	defer p.transport.Stop()
+
+	for _, tc := range []struct {
+		query, transfer time.Duration
+		shouldErr       bool
+	}{
+		{50 * time.Millisecond, time.Second, false},
+		{time.Second, 50 * time.Millisecond, true},
+	} {
+		p.SetReadTimeout(tc.query)
+		p.SetTransferReadTimeout(tc.transfer)
+
+		m := new(dns.Msg)
+		m.SetAxfr("example.org.")
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+		_, rrs, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Transfer read timeout %s: expected a timeout", tc.transfer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Transfer read timeout %s: expected no error, got %s", tc.transfer, err)
+		}
+		if len(rrs) != 3 {
+			t.Errorf("Transfer read timeout %s: expected 3 records, got %d", tc.transfer, len(rrs))
+		}
+	}
+}
+
+func TestConnectTransferClosedMidway(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A query is answered, a transfer over the same connection is cut short after its first message.
+	var transfers atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					ret := new(dns.Msg)
+					ret.SetReply(m)
+					if m.Question[0].Qtype != dns.TypeAXFR {
+						ret.Answer = []dns.RR{test.A("example.org. IN A 127.0.0.1")}
+						conn.WriteMsg(ret)
+						continue
+					}
+					transfers.Add(1)
+					ret.Answer = []dns.RR{soa("1"), test.A("a.example.org. IN A 127.0.0.1")}
+					conn.WriteMsg(ret)
+					return
+				}
+			}()
+		}
+	}()
+
+	p := NewProxy("TestConnectTransferClosedMidway", l.Addr().String(), transport.DNS)
+	p.SetTransferReadTimeout(time.Second)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	if _, _, err := p.Connect(context.Background(), req, Options{ForceTCP: true}); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	// The transfer starts on the cached connection, the upstream took it, so it isn't retried on a new one.
+	m = new(dns.Msg)
+	m.SetAxfr("example.org.")
+	req = request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	_, _, err = p.Connect(context.Background(), req, Options{ForceTCP: true})
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Expected %q, got %v", io.EOF, err)
+	}
+	if x := transfers.Load(); x != 1 {
+		t.Errorf("Expected the transfer to be sent once, got %d", x)
+	}
+}
+
+func TestConnectAXFROverTLS(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", doqTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer conn.Close()
+				// A transfer over the connection, then the next one.
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					for _, answer := range [][]dns.RR{
+						{soa("1"), test.A("a.example.org. IN A 127.0.0.1")},
+						{test.A("b.example.org. IN A 127.0.0.2")},
+						{soa("1")},
+					} {
+						ret := new(dns.Msg)
+						ret.SetReply(m)
+						ret.Answer = answer
+						if err := conn.WriteMsg(ret); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	p := NewProxy("TestConnectAXFROverTLS", l.Addr().String(), transport.TLS)
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.SetTransferReadTimeout(time.Second)
+	defer p.transport.Stop()
+
+	cached := func() int {
+		p.transport.mu.Lock()
+		defer p.transport.mu.Unlock()
+		return len(p.transport.conns[typeTLS])
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	// The client asked over UDP, the transfer still goes over TLS.
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	for i := range 2 {
+		begin := time.Now()
+		_, rrs, err := p.Connect(context.Background(), req, Options{})
+		if err != nil {
+			t.Fatalf("Transfer %d: expected no error, got %s", i, err)
+		}
+		if len(rrs) != 4 {
+			t.Errorf("Transfer %d: expected 4 records from SOA to SOA, got %d", i, len(rrs))
+		}
+		if d := time.Since(begin); d > 500*time.Millisecond {
+			t.Errorf("Transfer %d: expected the transfer to end with its last SOA, took %s", i, d)
+		}
+		if x := cached(); x != 1 {
+			t.Errorf("Transfer %d: expected the TLS connection to be cached after the transfer, got %d", i, x)
+		}
+	}
+	if x := accepted.Load(); x != 1 {
+		t.Errorf("Expected both transfers over one TLS connection, got %d connections", x)
+	}
+}
+
+func TestConnectMaxTransferSize(t *testing.T) {
+	// The zone is sent in 5 messages of 10 records, 51 records with the closing SOA.
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		for i := range 5 {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			if i == 0 {
+				ret.Answer = append(ret.Answer, soa("3"))
+			}
+			for len(ret.Answer) < 10 {
+				ret.Answer = append(ret.Answer, test.A(fmt.Sprintf("a%d-%d.example.org. IN A 127.0.0.1", i, len(ret.Answer))))
+			}
+			if i == 4 {
+				ret.Answer = append(ret.Answer, soa("3"))
+			}
+			if err := w.WriteMsg(ret); err != nil {
+				return
+			}
+		}
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectMaxTransferSize", s.Addr, transport.DNS)
+	p.SetTransferReadTimeout(time.Second)
+	defer p.transport.Stop()
+
+	tests := []struct {
+		records, bytes int
+		shouldErr      bool
+	}{
+		{0, 0, false},
+		{51, 0, false},
+		{0, 100000, false},
+		{50, 0, true},
+		{25, 0, true},
+		{0, 1000, true},
+	}
+	aborted := 0.0
+	for _, tc := range tests {
+		p.SetMaxTransferSize(tc.records, tc.bytes)
+
+		m := new(dns.Msg)
+		m.SetAxfr("example.org.")
+		req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+		_, rrs, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+		if !tc.shouldErr {
+			if err != nil {
+				t.Errorf("Limits %d/%d: expected no error, got %s", tc.records, tc.bytes, err)
+			}
+			if len(rrs) != 51 {
+				t.Errorf("Limits %d/%d: expected 51 records, got %d", tc.records, tc.bytes, len(rrs))
+			}
+			continue
+		}
+		aborted++
+		if !errors.Is(err, ErrTransferTooLarge) {
+			t.Errorf("Limits %d/%d: expected %q, got %v", tc.records, tc.bytes, ErrTransferTooLarge, err)
+		}
+		if rrs != nil {
+			t.Errorf("Limits %d/%d: expected no records, got %d", tc.records, tc.bytes, len(rrs))
+		}
+		if x := testutil.ToFloat64(transfersAbortedCount.WithLabelValues("TestConnectMaxTransferSize", s.Addr)); x != aborted {
+			t.Errorf("Limits %d/%d: expected %v aborted transfers, got %v", tc.records, tc.bytes, aborted, x)
+		}
+		p.transport.mu.Lock()
+		cached := len(p.transport.conns[typeTCP])
+		p.transport.mu.Unlock()
+		if cached != 0 {
+			t.Errorf("Limits %d/%d: expected the connection of the aborted transfer to be closed, got %d cached", tc.records, tc.bytes, cached)
+		}
+	}
+	if x := ErrorKind(ErrTransferTooLarge); x != "transfer" {
+		t.Errorf("Expected error kind transfer, got %s", x)
+	}
+}
+
+func TestConnectTransfer(t *testing.T) {
+	// The zone is sent in 3 messages, 100ms apart.
+	s := dnstest.NewMultipleServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		for i, answer := range [][]dns.RR{
+			{soa("3"), test.A("a.example.org. IN A 127.0.0.1")},
+			{test.A("b.example.org. IN A 127.0.0.2")},
+			{test.A("c.example.org. IN A 127.0.0.3"), soa("3")},
+		} {
+			if i > 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = answer
+			if err := w.WriteMsg(ret); err != nil {
+				return
+			}
+		}
+	})
+	defer s.Close()
+
+	p := NewProxy("TestConnectTransfer", s.Addr, transport.DNS)
+	p.SetTransferReadTimeout(time.Second)
+	p.SetCircuitBreaker(1, time.Minute, time.Minute)
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.org.")
+	req := request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+
+	// Each message is passed on as it arrives.
+	var batches []int
+	begin := time.Now()
+	var first time.Duration
+	err := p.ConnectTransfer(context.Background(), req, Options{ForceTCP: true}, func(rrs []dns.RR) error {
+		if batches == nil {
+			first = time.Since(begin)
+		}
+		batches = append(batches, len(rrs))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the transfer to succeed, got %s", err)
+	}
+	if !slices.Equal(batches, []int{2, 1, 2}) {
+		t.Errorf("Expected batches of 2, 1 and 2 records, got %v", batches)
+	}
+	if first >= 100*time.Millisecond {
+		t.Errorf("Expected the first batch before the rest of the transfer, got it after %s", first)
+	}
+
+	// An error of the callback aborts the transfer, and isn't held against the upstream.
+	errFull := errors.New("disk full")
+	calls := 0
+	err = p.ConnectTransfer(context.Background(), req, Options{ForceTCP: true}, func(rrs []dns.RR) error {
+		calls++
+		return errFull
+	})
+	if err != errFull {
+		t.Errorf("Expected the error of the callback, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the callback to be called once, got %d", calls)
+	}
+	p.transport.mu.Lock()
+	cached := len(p.transport.conns[typeTCP])
+	p.transport.mu.Unlock()
+	if cached != 0 {
+		t.Errorf("Expected the connection of the aborted transfer to be closed, got %d cached", cached)
+	}
+
+	// Connect collects the batches.
+	_, rrs, err := p.Connect(context.Background(), req, Options{ForceTCP: true})
+	if err != nil {
+		t.Fatalf("Expected the transfer to succeed after the aborted one, got %s", err)
+	}
+	if len(rrs) != 5 {
+		t.Errorf("Expected 5 records, got %d", len(rrs))
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	req = request.Request{Req: m, W: dnstest.NewRecorder(&test.ResponseWriter{})}
+	if err := p.ConnectTransfer(context.Background(), req, Options{}, func([]dns.RR) error { return nil }); err == nil {
+		t.Error("Expected an error for a query that isn't a zone transfer")
+	}
+}
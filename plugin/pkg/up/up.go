@@ -15,11 +15,14 @@ import (
 // to backoff too much. You then also need random queries to be performed every so often to quickly detect a working
 // upstream. In the end we just send a query every 0.5 second to check the upstream. This hopefully strikes a balance
 // between getting information about the upstream state quickly and not doing too much work. Note that 0.5s is still an
-// eternity in DNS, so we may actually want to shorten it.
+// eternity in DNS, so we may actually want to shorten it. For targets that stay down for long, SetBackoff trades some
+// of that for less work.
 type Probe struct {
 	sync.Mutex
 	inprogress int
 	interval   time.Duration
+	max        time.Duration       // the interval doubles up to this while f fails, 0 keeps it fixed
+	observe    func(time.Duration) // called with each interval waited, may be nil
 }
 
 // Func is used to determine if a target is alive. If so this function must return nil.
@@ -41,27 +44,50 @@ func (p *Probe) Do(f Func) {
 	// Passed the lock. Now run f for as long it returns false. If a true is returned
 	// we return from the goroutine and we can accept another Func to run.
 	go func() {
-		i := 1
+		wait := interval
 		for {
 			if err := f(); err == nil {
 				break
 			}
-			time.Sleep(interval)
+			p.Lock()
+			observe := p.observe
+			p.Unlock()
+			if observe != nil {
+				observe(wait)
+			}
+			time.Sleep(wait)
 			p.Lock()
 			if p.inprogress == stop {
 				p.Unlock()
 				return
 			}
+			if wait < p.max {
+				wait = min(2*wait, p.max)
+			}
 			p.Unlock()
-			i++
 		}
 
 		p.Lock()
 		p.inprogress = idle
+		observe := p.observe
 		p.Unlock()
+		if observe != nil && wait != interval {
+			observe(interval)
+		}
 	}()
 }
 
+// SetBackoff makes the interval between runs of a failing Func double after each run, up to max. The interval
+// set with Start is used again for the next Func once one succeeds. When observe isn't nil it is called with each
+// interval that is waited, and with the interval of Start after a backoff ends. A max that isn't above the interval
+// of Start keeps the interval fixed.
+func (p *Probe) SetBackoff(max time.Duration, observe func(time.Duration)) {
+	p.Lock()
+	p.max = max
+	p.observe = observe
+	p.Unlock()
+}
+
 // Stop stops the probing.
 func (p *Probe) Stop() {
 	p.Lock()
@@ -1,6 +1,8 @@
 package up
 
 import (
+	"errors"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -38,3 +40,39 @@ func TestUp(t *testing.T) {
 		t.Errorf("Expected hits to be %d, got %d", 1, h)
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	pr := New()
+	pr.Start(5 * time.Millisecond)
+	defer pr.Stop()
+
+	var (
+		mu    sync.Mutex
+		waits []time.Duration
+	)
+	pr.SetBackoff(20*time.Millisecond, func(d time.Duration) {
+		mu.Lock()
+		waits = append(waits, d)
+		mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	runs := 0
+	pr.Do(func() error {
+		runs++
+		if runs < 5 {
+			return errors.New("down")
+		}
+		close(done)
+		return nil
+	})
+	<-done
+	time.Sleep(5 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, 5 * time.Millisecond}
+	if !slices.Equal(waits, expected) {
+		t.Errorf("Expected intervals %v, got %v", expected, waits)
+	}
+}
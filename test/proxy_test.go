@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"testing"
 
 	"github.com/coredns/coredns/plugin/forward"
@@ -50,6 +51,57 @@ func TestLookupProxy(t *testing.T) {
 	}
 }
 
+func TestLookupForwardNextCache(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Rcode = dns.RcodeRefused
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 300 IN A 10.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	// The REFUSED reply of the upstream hands the query to erratic, cache in front of forward must only see,
+	// and cache, the reply of erratic.
+	corefile := `example.org:0 {
+		cache
+		forward . ` + s.Addr + ` {
+			next REFUSED
+		}
+		erratic {
+			drop 0
+		}
+	}`
+
+	i, udp, _, err := CoreDNSServerAndPorts(corefile)
+	if err != nil {
+		t.Fatalf("Could not get CoreDNS serving instance: %s", err)
+	}
+	defer i.Stop()
+
+	for n := range 2 {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		resp, err := dns.Exchange(m, udp)
+		if err != nil {
+			t.Fatalf("Query %d: expected to receive reply, but didn't: %s", n, err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("Query %d: expected a NOERROR reply with one answer, got %s", n, resp)
+		}
+		if x := resp.Answer[0].(*dns.A).A.String(); x != "192.0.2.53" {
+			t.Errorf("Query %d: expected the answer of erratic 192.0.2.53, got %s", n, x)
+		}
+	}
+	// The second query was answered from the cache.
+	if x := queries.Load(); x != 1 {
+		t.Errorf("Expected 1 query to the upstream, got %d", x)
+	}
+}
+
 func BenchmarkProxyLookup(b *testing.B) {
 	t := new(testing.T)
 	name, rm, err := test.TempFile(".", exampleOrg)